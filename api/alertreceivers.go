@@ -0,0 +1,353 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	AlertReceiversConfigMapName     = "app-receivers"
+	EnvAlertmanagerConfigLabels     = "NAISD_ALERTMANAGERCONFIG_LABELS"
+	defaultAlertmanagerConfigLabels = "alertmanagerConfig=nais"
+)
+
+// AlertmanagerConfigResource is the custom resource the Prometheus Operator merges into the Alertmanager configuration
+var AlertmanagerConfigResource = schema.GroupVersionResource{
+	Group:    "monitoring.coreos.com",
+	Version:  "v1alpha1",
+	Resource: "alertmanagerconfigs",
+}
+
+func init() {
+	viper.BindEnv(EnvAlertmanagerConfigLabels, EnvAlertmanagerConfigLabels)
+	viper.SetDefault(EnvAlertmanagerConfigLabels, defaultAlertmanagerConfigLabels)
+}
+
+// AlertReceivers are where the application's alerts are sent. Slack messages are posted with the Slack URL set in
+// the Alertmanager's global configuration.
+type AlertReceivers struct {
+	Slack    []SlackReceiver
+	Webhooks []WebhookReceiver
+}
+
+type SlackReceiver struct {
+	Channel      string
+	SendResolved bool `yaml:"sendResolved"`
+}
+
+type WebhookReceiver struct {
+	URL          string `yaml:"url"`
+	SendResolved bool   `yaml:"sendResolved"`
+}
+
+// alertmanagerConfigFragment is the route and receiver of an application in the Alertmanager configuration format,
+// which is assembled from the fragments in the app-receivers configmap
+type alertmanagerConfigFragment struct {
+	Route     alertmanagerRoute      `yaml:"route"`
+	Receivers []alertmanagerReceiver `yaml:"receivers"`
+}
+
+type alertmanagerRoute struct {
+	Receiver string            `yaml:"receiver"`
+	Match    map[string]string `yaml:"match"`
+	MatchRE  map[string]string `yaml:"match_re"`
+	Continue bool              `yaml:"continue"`
+}
+
+type alertmanagerReceiver struct {
+	Name           string                      `yaml:"name"`
+	SlackConfigs   []alertmanagerSlackConfig   `yaml:"slack_configs,omitempty"`
+	WebhookConfigs []alertmanagerWebhookConfig `yaml:"webhook_configs,omitempty"`
+}
+
+type alertmanagerSlackConfig struct {
+	Channel      string `yaml:"channel"`
+	SendResolved bool   `yaml:"send_resolved"`
+}
+
+type alertmanagerWebhookConfig struct {
+	URL          string `yaml:"url"`
+	SendResolved bool   `yaml:"send_resolved"`
+}
+
+func hasAlertReceivers(manifest NaisManifest) bool {
+	receivers := manifest.Alerts.Receivers
+	return len(receivers.Slack) > 0 || len(receivers.Webhooks) > 0
+}
+
+// The application's alerts are matched by the team label and the prefix of their names, so teams with several
+// applications get the alerts of each application once
+func createAlertRouteMatchers(spec app.Spec, manifest NaisManifest) (match, matchRE map[string]string) {
+	return map[string]string{"team": manifest.Team}, map[string]string{"alertname": createDeploymentPrefix(spec) + "_.*"}
+}
+
+func createAlertmanagerConfigFragment(spec app.Spec, manifest NaisManifest) alertmanagerConfigFragment {
+	receiverName := createDeploymentPrefix(spec)
+	receiver := alertmanagerReceiver{Name: receiverName}
+
+	for _, slack := range manifest.Alerts.Receivers.Slack {
+		receiver.SlackConfigs = append(receiver.SlackConfigs, alertmanagerSlackConfig{Channel: slack.Channel, SendResolved: slack.SendResolved})
+	}
+	for _, webhook := range manifest.Alerts.Receivers.Webhooks {
+		receiver.WebhookConfigs = append(receiver.WebhookConfigs, alertmanagerWebhookConfig{URL: webhook.URL, SendResolved: webhook.SendResolved})
+	}
+
+	match, matchRE := createAlertRouteMatchers(spec, manifest)
+	return alertmanagerConfigFragment{
+		Route:     alertmanagerRoute{Receiver: receiverName, Match: match, MatchRE: matchRE, Continue: true},
+		Receivers: []alertmanagerReceiver{receiver},
+	}
+}
+
+func addReceiversToConfigMap(spec app.Spec, configMap *k8score.ConfigMap, manifest NaisManifest) (*k8score.ConfigMap, error) {
+	fragment, err := yaml.Marshal(createAlertmanagerConfigFragment(spec, manifest))
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal alert receivers: %s", err)
+	}
+
+	if configMap.Data == nil {
+		configMap.Data = make(map[string]string)
+	}
+
+	configMap.Data[createDeploymentPrefix(spec)+".yml"] = string(fragment)
+
+	return configMap, nil
+}
+
+func removeReceiversFromConfigMap(configMap *k8score.ConfigMap, spec app.Spec) *k8score.ConfigMap {
+	if configMap.Data == nil {
+		return configMap
+	}
+
+	delete(configMap.Data, createDeploymentPrefix(spec)+".yml")
+
+	return configMap
+}
+
+func createOrUpdateAlertReceivers(spec app.Spec, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
+	if !hasAlertReceivers(manifest) {
+		return nil, nil
+	}
+
+	configMap, err := getExistingConfigMap(AlertReceiversConfigMapName, AlertsConfigMapNamespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+
+	if configMap == nil {
+		configMap = &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertReceiversConfigMapName, AlertsConfigMapNamespace)}
+	}
+
+	configMap, err = addReceiversToConfigMap(spec, configMap, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return createOrUpdateConfigMapResource(configMap, AlertsConfigMapNamespace, k8sClient)
+}
+
+// getConfigMapReceivers returns the shared receivers configmap, or a not found error if it has no receivers for the
+// application
+func getConfigMapReceivers(spec app.Spec, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
+	fragmentName := createDeploymentPrefix(spec) + ".yml"
+
+	configMap, err := getExistingConfigMap(AlertReceiversConfigMapName, AlertsConfigMapNamespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	} else if configMap == nil {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, AlertReceiversConfigMapName)
+	} else if _, exists := configMap.Data[fragmentName]; !exists {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "alert receivers"}, fragmentName)
+	}
+
+	return configMap, nil
+}
+
+// deleteConfigMapReceivers removes the application's receivers from the shared receivers configmap
+func deleteConfigMapReceivers(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return retryOnConflict(func() error {
+		configMap, err := getConfigMapReceivers(spec, k8sClient)
+		if err != nil {
+			return err
+		}
+
+		_, err = createOrUpdateConfigMapResource(removeReceiversFromConfigMap(configMap, spec), AlertsConfigMapNamespace, k8sClient)
+		return err
+	})
+}
+
+// alertmanagerConfigLabels are the labels the Prometheus Operator selects configs by, as configured in the
+// alertmanagerConfigSelector of the Alertmanager
+func alertmanagerConfigLabels() map[string]string {
+	configLabels, err := labels.ConvertSelectorToLabelsMap(viper.GetString(EnvAlertmanagerConfigLabels))
+	if err != nil {
+		glog.Warningf("%s is not a list of labels: %s", EnvAlertmanagerConfigLabels, err)
+	}
+
+	return configLabels
+}
+
+func createAlertmanagerConfigSpec(spec app.Spec, manifest NaisManifest) map[string]interface{} {
+	fragment := createAlertmanagerConfigFragment(spec, manifest)
+	receiver := fragment.Receivers[0]
+
+	matchers := []interface{}{
+		map[string]interface{}{"name": "team", "value": fragment.Route.Match["team"]},
+		map[string]interface{}{"name": "alertname", "value": fragment.Route.MatchRE["alertname"], "regex": true},
+	}
+
+	slackConfigs := []interface{}{}
+	for _, slack := range receiver.SlackConfigs {
+		slackConfigs = append(slackConfigs, map[string]interface{}{"channel": slack.Channel, "sendResolved": slack.SendResolved})
+	}
+	webhookConfigs := []interface{}{}
+	for _, webhook := range receiver.WebhookConfigs {
+		webhookConfigs = append(webhookConfigs, map[string]interface{}{"url": webhook.URL, "sendResolved": webhook.SendResolved})
+	}
+
+	return map[string]interface{}{
+		"route": map[string]interface{}{
+			"receiver": receiver.Name,
+			"matchers": matchers,
+		},
+		"receivers": []interface{}{
+			map[string]interface{}{
+				"name":           receiver.Name,
+				"slackConfigs":   slackConfigs,
+				"webhookConfigs": webhookConfigs,
+			},
+		},
+	}
+}
+
+// Creates an AlertmanagerConfig custom resource. The Prometheus Operator only routes alerts with the namespace
+// label of the application to it.
+// If existingConfig is provided, its spec is replaced and metadata such as resourceVersion is kept
+func createAlertmanagerConfigDef(spec app.Spec, manifest NaisManifest, existingConfig *unstructured.Unstructured) *unstructured.Unstructured {
+	alertmanagerConfig := existingConfig
+	if alertmanagerConfig == nil {
+		alertmanagerConfig = &unstructured.Unstructured{}
+		alertmanagerConfig.SetAPIVersion(AlertmanagerConfigResource.GroupVersion().String())
+		alertmanagerConfig.SetKind("AlertmanagerConfig")
+		alertmanagerConfig.SetName(spec.ResourceName())
+		alertmanagerConfig.SetNamespace(spec.Namespace)
+	}
+
+	objectMeta := addLabelsToObjectMeta(k8smeta.ObjectMeta{
+		Labels:          alertmanagerConfig.GetLabels(),
+		Annotations:     alertmanagerConfig.GetAnnotations(),
+		OwnerReferences: alertmanagerConfig.GetOwnerReferences(),
+	}, spec)
+	for k, v := range alertmanagerConfigLabels() {
+		objectMeta.Labels[k] = v
+	}
+
+	alertmanagerConfig.SetLabels(objectMeta.Labels)
+	alertmanagerConfig.SetAnnotations(objectMeta.Annotations)
+	alertmanagerConfig.SetOwnerReferences(objectMeta.OwnerReferences)
+	alertmanagerConfig.Object["spec"] = createAlertmanagerConfigSpec(spec, manifest)
+
+	return alertmanagerConfig
+}
+
+func getExistingAlertmanagerConfig(spec app.Spec, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	alertmanagerConfig, err := dynamicClient.Resource(AlertmanagerConfigResource).Namespace(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return alertmanagerConfig, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+func createOrUpdateAlertmanagerConfig(spec app.Spec, manifest NaisManifest, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	if !hasAlertReceivers(manifest) {
+		return nil, nil
+	}
+
+	existingConfig, err := getExistingAlertmanagerConfig(spec, dynamicClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing alertmanagerconfig: %s", err)
+	}
+
+	alertmanagerConfig := createAlertmanagerConfigDef(spec, manifest, existingConfig)
+	alertmanagerConfigInterface := dynamicClient.Resource(AlertmanagerConfigResource).Namespace(spec.Namespace)
+
+	if alertmanagerConfig.GetResourceVersion() != "" {
+		return alertmanagerConfigInterface.Update(context.TODO(), alertmanagerConfig, k8smeta.UpdateOptions{})
+	}
+	return alertmanagerConfigInterface.Create(context.TODO(), alertmanagerConfig, k8smeta.CreateOptions{})
+}
+
+func deleteAlertmanagerConfig(spec app.Spec, dynamicClient dynamic.Interface) error {
+	return dynamicClient.Resource(AlertmanagerConfigResource).Namespace(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
+}
+
+// pruneAlertReceivers removes the application's receivers from the shared receivers configmap when the manifest no
+// longer has receivers, or they have moved to an AlertmanagerConfig
+func pruneAlertReceivers(spec app.Spec, deploymentResult DeploymentResult, k8sClient kubernetes.Interface) ([]string, error) {
+	if deploymentResult.AlertReceiversConfigMap != nil {
+		return nil, nil
+	}
+
+	err := deleteConfigMapReceivers(spec, k8sClient)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to remove alert receivers from configmap: %s", err)
+	}
+
+	fragmentName := createDeploymentPrefix(spec) + ".yml"
+	glog.Infof("Pruned alert receivers %s from %s", fragmentName, AlertReceiversConfigMapName)
+	return []string{fmt.Sprintf("alert receivers %s", fragmentName)}, nil
+}
+
+func validateAlertReceivers(manifest NaisManifest) *ValidationError {
+	if !hasAlertReceivers(manifest) {
+		return nil
+	}
+
+	if len(manifest.Team) == 0 {
+		return &ValidationError{
+			ErrorMessage: "Alerts.Receivers are matched by the team label, so Team must be specified",
+			Fields:       map[string]string{"Team": manifest.Team},
+		}
+	}
+
+	for _, slack := range manifest.Alerts.Receivers.Slack {
+		if len(slack.Channel) == 0 {
+			return &ValidationError{
+				ErrorMessage: "Alerts.Receivers.Slack must have a channel",
+				Fields:       map[string]string{"Channel": slack.Channel},
+			}
+		}
+	}
+
+	for _, webhook := range manifest.Alerts.Receivers.Webhooks {
+		if u, err := url.Parse(webhook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return &ValidationError{
+				ErrorMessage: "Alerts.Receivers.Webhooks must have an http or https URL",
+				Fields:       map[string]string{"URL": webhook.URL},
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newReceiversManifest() NaisManifest {
+	manifest := newAlertsManifest()
+	manifest.Alerts.Receivers = AlertReceivers{
+		Slack:    []SlackReceiver{{Channel: "#aura-alerts", SendResolved: true}},
+		Webhooks: []WebhookReceiver{{URL: "https://oncall.example.com/alerts"}},
+	}
+	return manifest
+}
+
+func TestAddReceiversToConfigMap(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	configMap := &k8score.ConfigMap{Data: map[string]string{"other-app-default.yml": "not touched"}}
+
+	configMap, err := addReceiversToConfigMap(spec, configMap, newReceiversManifest())
+	assert.NoError(t, err)
+	assert.Equal(t, "not touched", configMap.Data["other-app-default.yml"])
+
+	var fragment alertmanagerConfigFragment
+	assert.NoError(t, yaml.Unmarshal([]byte(configMap.Data["aura-appname-default.yml"]), &fragment))
+	assert.Equal(t, "aura-appname-default", fragment.Route.Receiver)
+	assert.Equal(t, map[string]string{"team": teamName}, fragment.Route.Match)
+	assert.Equal(t, map[string]string{"alertname": "aura-appname-default_.*"}, fragment.Route.MatchRE)
+	assert.True(t, fragment.Route.Continue)
+	assert.Equal(t, []alertmanagerSlackConfig{{Channel: "#aura-alerts", SendResolved: true}}, fragment.Receivers[0].SlackConfigs)
+	assert.Equal(t, []alertmanagerWebhookConfig{{URL: "https://oncall.example.com/alerts"}}, fragment.Receivers[0].WebhookConfigs)
+
+	configMap = removeReceiversFromConfigMap(configMap, spec)
+	assert.Len(t, configMap.Data, 1)
+}
+
+func TestCreateAlertmanagerConfigDef(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+
+	alertmanagerConfig := createAlertmanagerConfigDef(spec, newReceiversManifest(), nil)
+	assert.Equal(t, "AlertmanagerConfig", alertmanagerConfig.GetKind())
+	assert.Equal(t, namespace, alertmanagerConfig.GetNamespace())
+	assert.Equal(t, "nais", alertmanagerConfig.GetLabels()["alertmanagerConfig"])
+
+	matchers, _, _ := unstructured.NestedSlice(alertmanagerConfig.Object, "spec", "route", "matchers")
+	assert.Equal(t, map[string]interface{}{"name": "team", "value": teamName}, matchers[0])
+	assert.Equal(t, map[string]interface{}{"name": "alertname", "value": "aura-appname-default_.*", "regex": true}, matchers[1])
+
+	receivers, _, _ := unstructured.NestedSlice(alertmanagerConfig.Object, "spec", "receivers")
+	receiver := receivers[0].(map[string]interface{})
+	assert.Equal(t, "aura-appname-default", receiver["name"])
+	assert.Equal(t, "#aura-alerts", receiver["slackConfigs"].([]interface{})[0].(map[string]interface{})["channel"])
+	assert.Equal(t, "https://oncall.example.com/alerts", receiver["webhookConfigs"].([]interface{})[0].(map[string]interface{})["url"])
+}
+
+func TestDeployAlertReceivers(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	t.Run("receivers are written to the shared configmap", func(t *testing.T) {
+		result, err := createOrUpdateK8sResources(spec, request, newReceiversManifest(), []NaisResource{}, "nais.example.yo", false, fake.NewSimpleClientset(), newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Contains(t, result.AlertReceiversConfigMap.Data, "aura-appname-default.yml")
+		assert.Nil(t, result.AlertmanagerConfig)
+	})
+
+	t.Run("receivers are pruned from the shared configmap when they are removed", func(t *testing.T) {
+		configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertReceiversConfigMapName, AlertsConfigMapNamespace)}
+		configMap, _ = addReceiversToConfigMap(spec, configMap, newReceiversManifest())
+		configMap.ResourceVersion = resourceVersion
+		clientset := fake.NewSimpleClientset(configMap)
+
+		result, err := createOrUpdateK8sResources(spec, request, newAlertsManifest(), []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Nil(t, result.AlertReceiversConfigMap)
+
+		pruned, err := pruneK8sResources(spec, result, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Contains(t, pruned, "alert receivers aura-appname-default.yml")
+
+		configMap, _ = getExistingConfigMap(AlertReceiversConfigMapName, AlertsConfigMapNamespace, clientset)
+		assert.Empty(t, configMap.Data)
+	})
+
+	t.Run("receivers are written to an alertmanagerconfig with the prometheusrules, and deleted with the app", func(t *testing.T) {
+		viper.Set(EnvAlertsOutput, AlertsOutputPrometheusRule)
+		defer viper.Set(EnvAlertsOutput, AlertsOutputConfigMap)
+
+		clientset := fake.NewSimpleClientset()
+		dynamicClient := newFakeDynamicClient()
+		result, err := createOrUpdateK8sResources(spec, request, newReceiversManifest(), []NaisResource{}, "nais.example.yo", false, clientset, dynamicClient)
+		assert.NoError(t, err)
+		assert.Nil(t, result.AlertReceiversConfigMap)
+		assert.NotNil(t, result.AlertmanagerConfig)
+
+		results, err := deleteK8sResouces(spec, clientset, dynamicClient)
+		assert.NoError(t, err)
+		assert.Contains(t, results, DeleteResult{Resource: "alertmanagerconfig", Name: appName, Status: DeleteStatusDeleted})
+
+		alertmanagerConfig, _ := getExistingAlertmanagerConfig(spec, dynamicClient)
+		assert.Nil(t, alertmanagerConfig)
+	})
+}
+
+func TestValidateAlertReceivers(t *testing.T) {
+	assert.Nil(t, validateAlertReceivers(newDefaultManifest()))
+	assert.Nil(t, validateAlertReceivers(newReceiversManifest()))
+
+	manifest := newReceiversManifest()
+	manifest.Team = ""
+	assert.Equal(t, "Alerts.Receivers are matched by the team label, so Team must be specified", validateAlertReceivers(manifest).ErrorMessage)
+
+	manifest = newReceiversManifest()
+	manifest.Alerts.Receivers.Slack[0].Channel = ""
+	assert.Equal(t, "Alerts.Receivers.Slack must have a channel", validateAlertReceivers(manifest).ErrorMessage)
+
+	manifest = newReceiversManifest()
+	manifest.Alerts.Receivers.Webhooks[0].URL = "oncall.example.com/alerts"
+	assert.Equal(t, "Alerts.Receivers.Webhooks must have an http or https URL", validateAlertReceivers(manifest).ErrorMessage)
+}
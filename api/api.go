@@ -8,22 +8,28 @@ import (
 	"github.com/nais/naisd/api/naisrequest"
 	ver "github.com/nais/naisd/api/version"
 	"github.com/nais/naisd/pkg/event"
+	"github.com/nais/naisd/pkg/notify"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"goji.io"
 	"goji.io/pat"
+	"goji.io/pattern"
 	"io"
 	"io/ioutil"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"net/http"
 	"net/url"
 	"os"
+	"time"
 )
 
 type deploymentEventHandler func(deployment.Event)
 
 type Api struct {
 	Clientset              kubernetes.Interface
+	DynamicClient          dynamic.Interface
 	FasitURL               string
 	ClusterSubdomain       string
 	ClusterName            string
@@ -31,6 +37,15 @@ type Api struct {
 	AuthenticationEnabled  bool
 	DeploymentStatusViewer DeploymentStatusViewer
 	DeploymentEventHandler deploymentEventHandler
+	LeaderStatus           LeaderStatus
+	DeploymentNotifier     deploymentNotifier
+}
+
+// LeaderStatus reports which naisd replica runs the singleton background tasks
+type LeaderStatus interface {
+	IsLeader() bool
+	Identity() string
+	Leader() string
 }
 
 var (
@@ -88,18 +103,25 @@ func (api Api) Handler() http.Handler {
 	mux := goji.NewMux()
 
 	mux.Handle(pat.Get("/isalive"), appHandler(api.isAlive))
+	mux.Handle(pat.Get("/isready"), appHandler(api.isReady))
 	mux.Handle(pat.Post("/deploy"), appHandler(api.deploy))
 	mux.Handle(pat.Get("/metrics"), promhttp.Handler())
 	mux.Handle(pat.Get("/version"), appHandler(api.version))
 	mux.Handle(pat.Get("/deploystatus/:namespace/:deployName"), appHandler(api.deploymentStatusHandler))
 	mux.Handle(pat.Delete("/app/:namespace/:deployName"), appHandler(api.deleteApplication))
+	mux.Handle(pat.Get("/apps"), appHandler(api.listApplications))
+	mux.Handle(pat.Get("/apps/:namespace"), appHandler(api.listApplications))
+	mux.Handle(pat.Post("/app/:namespace/:deployName/pause"), appHandler(api.pauseApplication))
+	mux.Handle(pat.Post("/app/:namespace/:deployName/resume"), appHandler(api.resumeApplication))
+	mux.Handle(pat.Post("/app/:namespace/:deployName/rollback"), appHandler(api.rollbackApplication))
 	return mux
 }
 
 // NewAPI returns a new nais daemon.
-func NewAPI(clientset kubernetes.Interface, fasitURL, clusterDomain, clusterName string, istioEnabled bool, authenticationEnabled bool, d DeploymentStatusViewer, deploymentEventHandler deploymentEventHandler) Api {
+func NewAPI(clientset kubernetes.Interface, dynamicClient dynamic.Interface, fasitURL, clusterDomain, clusterName string, istioEnabled bool, authenticationEnabled bool, d DeploymentStatusViewer, deploymentEventHandler deploymentEventHandler, leaderStatus LeaderStatus, deploymentNotifier deploymentNotifier) Api {
 	return Api{
 		Clientset:              clientset,
+		DynamicClient:          dynamicClient,
 		FasitURL:               fasitURL,
 		ClusterSubdomain:       clusterDomain,
 		ClusterName:            clusterName,
@@ -107,6 +129,8 @@ func NewAPI(clientset kubernetes.Interface, fasitURL, clusterDomain, clusterName
 		AuthenticationEnabled:  authenticationEnabled,
 		DeploymentStatusViewer: d,
 		DeploymentEventHandler: deploymentEventHandler,
+		LeaderStatus:           leaderStatus,
+		DeploymentNotifier:     deploymentNotifier,
 	}
 }
 func authenticate(username, password string) *appError {
@@ -129,7 +153,7 @@ func authenticate(username, password string) *appError {
 	return nil
 }
 
-func (api Api) deploy(w http.ResponseWriter, r *http.Request) *appError {
+func (api Api) deploy(w http.ResponseWriter, r *http.Request) (deployErr *appError) {
 	requests.With(prometheus.Labels{"path": "deploy"}).Inc()
 	deploymentRequest, err := unmarshalDeploymentRequest(r.Body)
 
@@ -151,12 +175,17 @@ func (api Api) deploy(w http.ResponseWriter, r *http.Request) *appError {
 	}
 
 	deploymentRequest.ClusterName = api.ClusterName
+	deploymentRequest.CorrelationID = string(uuid.NewUUID())
 
 	if err != nil {
 		return &appError{err, "unable to unmarshal deployment request", http.StatusBadRequest}
 	}
 	glog.Infof("Received deployment request: %s", deploymentRequest)
 
+	if errs := deploymentRequest.ValidatePreview(); len(errs) > 0 {
+		return &appError{fmt.Errorf("%v", errs), "invalid preview", http.StatusBadRequest}
+	}
+
 	fasit := FasitClient{api.FasitURL, deploymentRequest.FasitUsername, deploymentRequest.FasitPassword}
 
 	glog.Infof("Starting deployment. Deploying %s:%s to %s\n", deploymentRequest.Application, deploymentRequest.Version, deploymentRequest.FasitEnvironment)
@@ -166,6 +195,10 @@ func (api Api) deploy(w http.ResponseWriter, r *http.Request) *appError {
 		return &appError{err, "unable to generate manifest/nais.yaml", http.StatusInternalServerError}
 	}
 
+	if err := validateIngressDomains(manifest, api.ClusterSubdomain); err != nil {
+		return &appError{err, "invalid ingress", http.StatusBadRequest}
+	}
+
 	var fasitEnvironmentClass string
 	var naisResources []NaisResource
 
@@ -192,25 +225,69 @@ func (api Api) deploy(w http.ResponseWriter, r *http.Request) *appError {
 		}
 	}
 
+	// A preview is deployed next to the application, under its own name
 	spec := app.Spec{
-		Application: deploymentRequest.Application,
+		Application: deploymentRequest.DeployName(),
 		Namespace:   deploymentRequest.Namespace,
 		Team:        manifest.Team,
 	}
-	deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled, api.Clientset)
-	if err != nil {
+
+	if err := acquireDeployLock(spec, deploymentRequest, api.Clientset); err != nil {
+		if _, locked := err.(DeployLockedError); locked {
+			return &appError{err, fmt.Sprintf("%s is already being deployed to %s", spec.Application, spec.Namespace), http.StatusConflict}
+		}
+		return &appError{err, "unable to acquire deploy lock", http.StatusInternalServerError}
+	}
+	stopRenewing := keepDeployLock(spec, deploymentRequest, api.Clientset)
+	defer func() {
+		stopRenewing()
+		if err := releaseDeployLock(spec, deploymentRequest, api.Clientset); err != nil {
+			glog.Errorf("Failed while releasing deploy lock for %s in %s: %s", spec.Application, spec.Namespace, err)
+		}
+	}()
+
+	api.notify(notify.DeployStarted, spec, deploymentRequest, nil)
+	defer func() {
+		if deployErr != nil {
+			api.notify(notify.DeployFailed, spec, deploymentRequest, deployErr)
+		}
+	}()
+
+	deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResources, api.ClusterSubdomain, api.IstioEnabled, api.Clientset, api.DynamicClient)
+	if conflict, ok := err.(IngressConflictError); ok {
+		return &appError{conflict, "ingress host is already taken", http.StatusConflict}
+	} else if err != nil {
 		return &appError{err, "failed while creating or updating k8s-resources", http.StatusInternalServerError}
 	}
 
+	if (deploymentResult.Deployment != nil && isPaused(deploymentResult.Deployment.ObjectMeta)) ||
+		(deploymentResult.StatefulSet != nil && isPaused(deploymentResult.StatefulSet.ObjectMeta)) ||
+		(deploymentResult.CronJob != nil && isPaused(deploymentResult.CronJob.ObjectMeta)) {
+		warnings = append(warnings, fmt.Sprintf("%s is paused and was not scaled up, resume it with POST /app/%s/%s/resume", spec.Application, spec.Namespace, spec.Application))
+	}
+
+	deploymentResult.Pruned, err = pruneK8sResources(spec, deploymentResult, api.Clientset, api.DynamicClient)
+	if err != nil {
+		glog.Errorf("Failed while pruning resources for %s in %s: %s", spec.Application, spec.Namespace, err)
+		warnings = append(warnings, fmt.Sprintf("unable to prune resources no longer in use: %s", err))
+	}
+
 	deploys.With(prometheus.Labels{"nais_app": deploymentRequest.Application}).Inc()
 
+	// Previews are never registered in Fasit, and are not announced as deploys of the application
+	if len(deploymentRequest.Preview) > 0 {
+		w.WriteHeader(200)
+		w.Write(createResponse(deploymentResult, warnings))
+		return nil
+	}
+
 	if !deploymentRequest.SkipFasit && hasResources(manifest) {
 		if err := updateFasit(fasit, deploymentRequest, naisResources, manifest, createIngressHostname(deploymentRequest.Application, deploymentRequest.Namespace, api.ClusterSubdomain), fasitEnvironmentClass, deploymentRequest.FasitEnvironment, api.ClusterSubdomain); err != nil {
 			return &appError{err, "failed while updating Fasit", http.StatusInternalServerError}
 		}
 	}
 
-	NotifySensuAboutDeploy(spec, &deploymentRequest, &api.ClusterName)
+	api.notify(notify.DeploySucceeded, spec, deploymentRequest, nil)
 
 	// Send deployment event on Kafka topic
 	deploymentEvent := NewDeploymentEvent(deploymentRequest, manifest, api.ClusterName)
@@ -255,6 +332,25 @@ func (api Api) isAlive(w http.ResponseWriter, _ *http.Request) *appError {
 	return nil
 }
 
+// isReady reports whether this replica is the leader. Every replica is ready to serve the API, so it always succeeds.
+// Without leader election the replica runs the background tasks itself, and is reported as leader.
+func (api Api) isReady(w http.ResponseWriter, _ *http.Request) *appError {
+	requests.With(prometheus.Labels{"path": "isReady"}).Inc()
+
+	response := map[string]interface{}{"leader": true}
+	if api.LeaderStatus != nil {
+		response["leader"] = api.LeaderStatus.IsLeader()
+		response["identity"] = api.LeaderStatus.Identity()
+		response["currentLeader"] = api.LeaderStatus.Leader()
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		return &appError{err, "unable to encode JSON", 500}
+	}
+
+	return nil
+}
+
 func (api Api) version(w http.ResponseWriter, _ *http.Request) *appError {
 	response := map[string]string{"version": ver.Version, "revision": ver.Revision}
 
@@ -265,29 +361,243 @@ func (api Api) version(w http.ResponseWriter, _ *http.Request) *appError {
 	return nil
 }
 
+// DeleteResponse lists the outcome of deleting each of the application's resources. A dry run lists what would be
+// deleted, along with the token confirming the delete when the cluster requires one.
+type DeleteResponse struct {
+	Application       string         `json:"application"`
+	Namespace         string         `json:"namespace"`
+	DryRun            bool           `json:"dryRun,omitempty"`
+	ConfirmationToken string         `json:"confirmationToken,omitempty"`
+	Resources         []DeleteResult `json:"resources"`
+}
+
 func (api Api) deleteApplication(w http.ResponseWriter, r *http.Request) *appError {
 	namespace := pat.Param(r, "namespace")
 	application := pat.Param(r, "deployName")
+	dryRun := r.URL.Query().Get("dryRun") == "true"
 
-	spec := app.Spec{Application: application, Namespace: namespace}
-	result, err := deleteK8sResouces(spec, api.Clientset)
+	deleteRequest, err := unmarshalDeleteRequest(r.Body)
+	if err != nil {
+		return &appError{err, "unable to unmarshal delete request", http.StatusBadRequest}
+	}
+
+	spec := resolveTeam(app.Spec{Application: application, Namespace: namespace}, api.Clientset)
+	response := DeleteResponse{Application: application, Namespace: namespace, DryRun: dryRun}
+
+	if dryRun {
+		response.Resources = append(planK8sResourceDeletion(spec, api.Clientset, api.DynamicClient), api.planFasitApplicationInstanceDeletion(spec, deleteRequest))
+		if deleteConfirmationRequired() {
+			response.ConfirmationToken = createDeleteConfirmationToken(spec, time.Now())
+		}
+		return writeDeleteResponse(w, response, nil)
+	}
 
-	response := ""
-	if len(result) > 0 {
-		response = "result: \n"
-		for _, res := range result {
-			response += res + "\n"
+	if deleteConfirmationRequired() {
+		if err := validateDeleteConfirmationToken(spec, r.URL.Query().Get("confirmationToken"), time.Now()); err != nil {
+			return &appError{err, "deleting applications in this cluster must be confirmed", http.StatusPreconditionRequired}
 		}
 	}
 
+	response.Resources, err = deleteK8sResouces(spec, api.Clientset, api.DynamicClient)
+
+	fasitResult := api.deleteFasitApplicationInstance(spec, deleteRequest)
+	response.Resources = append(response.Resources, fasitResult)
+	if fasitResult.Status == DeleteStatusFailed && err == nil {
+		err = fmt.Errorf("unable to delete %s %s: %s", fasitResult.Resource, fasitResult.Name, fasitResult.Message)
+	}
+
+	if err != nil {
+		glog.Errorf("There were errors when trying to delete %s in %s: %s", application, namespace, err)
+	} else {
+		glog.Infof("Deleted application %s in %s\n", application, namespace)
+		api.notify(notify.Deleted, spec, naisrequest.Deploy{}, nil)
+	}
+
+	return writeDeleteResponse(w, response, err)
+}
+
+func writeDeleteResponse(w http.ResponseWriter, response DeleteResponse, deleteErr error) *appError {
+	body, err := json.Marshal(response)
 	if err != nil {
-		return &appError{err, fmt.Sprintf("there were errors when trying to delete app: %+v", response), http.StatusInternalServerError}
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
 	}
 
-	glog.Infof("Deleted application %s in %s\n", application, namespace)
+	w.Header().Set("Content-Type", "application/json")
+	if deleteErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
 
-	w.Write([]byte(response))
+	w.Write(body)
+	return nil
+}
+
+func createFasitApplicationInstanceResult(spec app.Spec, deleteRequest naisrequest.Delete) (DeleteResult, bool) {
+	result := DeleteResult{Resource: "fasit application instance", Name: spec.Application}
+
+	if len(deleteRequest.FasitEnvironment) == 0 {
+		result.Status = DeleteStatusSkipped
+		result.Message = "no fasit environment given"
+		return result, false
+	}
+
+	result.Name = fmt.Sprintf("%s in %s", spec.Application, deleteRequest.FasitEnvironment)
+	return result, true
+}
+
+func isFasitNotFound(err error) bool {
+	appErr, ok := err.(appError)
+	return ok && appErr.StatusCode == http.StatusNotFound
+}
+
+// deleteFasitApplicationInstance unregisters the application from the Fasit environment given in the delete request
+func (api Api) deleteFasitApplicationInstance(spec app.Spec, deleteRequest naisrequest.Delete) DeleteResult {
+	result, ok := createFasitApplicationInstanceResult(spec, deleteRequest)
+	if !ok {
+		return result
+	}
+
+	fasit := FasitClient{api.FasitURL, deleteRequest.FasitUsername, deleteRequest.FasitPassword}
+	err := fasit.deleteApplicationInstance(spec.Application, deleteRequest.FasitEnvironment)
+
+	if isFasitNotFound(err) {
+		result.Status = DeleteStatusNotFound
+	} else if err != nil {
+		result.Status = DeleteStatusFailed
+		result.Message = err.Error()
+	} else {
+		result.Status = DeleteStatusDeleted
+	}
+
+	return result
+}
+
+func (api Api) planFasitApplicationInstanceDeletion(spec app.Spec, deleteRequest naisrequest.Delete) DeleteResult {
+	result, ok := createFasitApplicationInstanceResult(spec, deleteRequest)
+	if !ok {
+		return result
+	}
+
+	fasit := FasitClient{api.FasitURL, deleteRequest.FasitUsername, deleteRequest.FasitPassword}
+	_, err := fasit.getApplicationInstanceId(spec.Application, deleteRequest.FasitEnvironment)
+
+	if isFasitNotFound(err) {
+		result.Status = DeleteStatusNotFound
+	} else if err != nil {
+		result.Status = DeleteStatusFailed
+		result.Message = err.Error()
+	} else {
+		result.Status = DeleteStatusWouldDelete
+	}
+
+	return result
+}
+
+// listApplications lists the applications naisd has deployed, in the namespace given in the path or the namespace
+// query parameter, and for the team query parameter
+func (api Api) listApplications(w http.ResponseWriter, r *http.Request) *appError {
+	namespace := r.URL.Query().Get("namespace")
+	if pathNamespace, ok := r.Context().Value(pattern.Variable("namespace")).(string); ok {
+		namespace = pathNamespace
+	}
+	team := r.URL.Query().Get("team")
+
+	applications, err := listApplications(namespace, team, api.Clientset)
+	if err != nil {
+		return &appError{err, "unable to list applications", http.StatusInternalServerError}
+	}
+
+	body, err := json.Marshal(applications)
+	if err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return nil
+}
+
+// rollbackApplication switches an application using the BlueGreen strategy back to the previous version
+func (api Api) rollbackApplication(w http.ResponseWriter, r *http.Request) *appError {
+	namespace := pat.Param(r, "namespace")
+	application := pat.Param(r, "deployName")
+
+	// The service is switched under the deploy lock, so a rollback does not race a deploy or the BlueGreenController
+	spec := app.Spec{Application: application, Namespace: namespace}
+	var result RollbackResult
+	err := withDeployLock(spec, rollbackLockHolder, "", api.Clientset, func() (err error) {
+		result, err = rollbackBlueGreen(spec, api.Clientset)
+		return err
+	})
+	if _, locked := err.(DeployLockedError); locked {
+		return &appError{err, fmt.Sprintf("%s is already being deployed to %s", application, namespace), http.StatusConflict}
+	} else if err == errNoPreviousColor {
+		return &appError{err, fmt.Sprintf("unable to roll back %s in %s", application, namespace), http.StatusConflict}
+	} else if err != nil {
+		return &appError{err, fmt.Sprintf("unable to roll back %s in %s", application, namespace), http.StatusInternalServerError}
+	}
+
+	glog.Infof("Rolled back %s in %s to %s\n", application, namespace, result.ActiveColor)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	return nil
+}
+
+func (api Api) pauseApplication(w http.ResponseWriter, r *http.Request) *appError {
+	return api.scaleApplication(w, r, true)
+}
+
+func (api Api) resumeApplication(w http.ResponseWriter, r *http.Request) *appError {
+	return api.scaleApplication(w, r, false)
+}
+
+func (api Api) scaleApplication(w http.ResponseWriter, r *http.Request, pause bool) *appError {
+	namespace := pat.Param(r, "namespace")
+	application := pat.Param(r, "deployName")
+	spec := app.Spec{Application: application, Namespace: namespace}
+
+	// The application is scaled under the deploy lock, so a deploy does not create a color or canary that the pause
+	// does not see
+	var result PauseResult
+	err := withDeployLock(spec, pauseLockHolder, "", api.Clientset, func() (err error) {
+		if pause {
+			result, err = pauseK8sResources(spec, api.Clientset)
+		} else {
+			result, err = resumeK8sResources(spec, api.Clientset)
+		}
+		return err
+	})
+	_, locked := err.(DeployLockedError)
+	switch {
+	case locked:
+		return &appError{err, fmt.Sprintf("%s is already being deployed to %s", application, namespace), http.StatusConflict}
+	case err == errNotDeployed:
+		return &appError{err, fmt.Sprintf("%s is not deployed to %s", application, namespace), http.StatusNotFound}
+	case err == errNotPausable:
+		return &appError{err, fmt.Sprintf("unable to scale %s in %s", application, namespace), http.StatusBadRequest}
+	case err != nil:
+		return &appError{err, fmt.Sprintf("unable to scale %s in %s", application, namespace), http.StatusInternalServerError}
+	}
+
+	glog.Infof("Scaled %s in %s (paused: %t)\n", application, namespace, pause)
+
+	body, err := json.Marshal(result)
+	if err != nil {
+		return &appError{err, "unable to encode JSON", http.StatusInternalServerError}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 	return nil
 }
 
@@ -317,6 +627,26 @@ func createResponse(deploymentResult DeploymentResult, warnings []string) []byte
 	if deploymentResult.Deployment != nil {
 		response += "- created deployment\n"
 	}
+	if deploymentResult.ServiceAccount != nil {
+		if expires, preview := deploymentResult.ServiceAccount.Annotations[PreviewExpiresAnnotation]; preview {
+			response += "- created preview " + deploymentResult.ServiceAccount.Name + ", which is deleted at " + expires + " unless deployed to again\n"
+		}
+	}
+	if deploymentResult.Canary != nil {
+		response += "- created canary deployment\n"
+	}
+	if deploymentResult.StatefulSet != nil {
+		response += "- created statefulset\n"
+	}
+	if deploymentResult.Job != nil {
+		response += "- created job\n"
+	}
+	if deploymentResult.CronJob != nil {
+		response += "- created cronjob\n"
+	}
+	if deploymentResult.BlueGreen != nil {
+		response += "- created " + deploymentResult.BlueGreen.Name + " deployment, traffic is switched to it when it is available\n"
+	}
 	if deploymentResult.Secret != nil {
 		response += "- created secret\n"
 	}
@@ -332,18 +662,40 @@ func createResponse(deploymentResult DeploymentResult, warnings []string) []byte
 	if deploymentResult.AlertsConfigMap != nil {
 		response += "- updated alerts configmap (app-rules)\n"
 	}
+
+	if deploymentResult.PrometheusRule != nil {
+		response += "- created prometheusrule\n"
+	}
+	if deploymentResult.AlertReceiversConfigMap != nil {
+		response += "- updated alert receivers configmap (app-receivers)\n"
+	}
+	if deploymentResult.AlertmanagerConfig != nil {
+		response += "- created alertmanagerconfig\n"
+	}
 	if deploymentResult.Redis != nil {
 		response += "- created redis\n"
 	}
 	if deploymentResult.RedisService != nil {
 		response += "- created redis service\n"
 	}
+	if deploymentResult.RedisConfigMap != nil {
+		response += "- created redis configmap\n"
+	}
+	if deploymentResult.RedisFailover != nil {
+		response += "- created redis failover\n"
+	}
+	if deploymentResult.RedisSecret != nil {
+		response += "- created redis secret\n"
+	}
 	if deploymentResult.ServiceAccount != nil {
 		response += "- created serviceaccount\n"
 	}
 	if deploymentResult.RoleBinding != nil {
 		response += "- created rolebinding\n"
 	}
+	for _, pruned := range deploymentResult.Pruned {
+		response += fmt.Sprintf("- pruned %s\n", pruned)
+	}
 
 	if len(warnings) > 0 {
 		response += "\nWarnings:\n"
@@ -370,6 +722,24 @@ func unmarshalDeploymentRequest(body io.ReadCloser) (naisrequest.Deploy, error)
 	return deploymentRequest, nil
 }
 
+// The delete request body is optional
+func unmarshalDeleteRequest(body io.ReadCloser) (naisrequest.Delete, error) {
+	deleteRequest := naisrequest.Delete{}
+
+	requestBody, err := ioutil.ReadAll(body)
+	if err != nil {
+		return deleteRequest, fmt.Errorf("could not read delete request body %s", err)
+	} else if len(requestBody) == 0 {
+		return deleteRequest, nil
+	}
+
+	if err = json.Unmarshal(requestBody, &deleteRequest); err != nil {
+		return naisrequest.Delete{}, fmt.Errorf("could not unmarshal body %s", err)
+	}
+
+	return deleteRequest, nil
+}
+
 func ensurePropertyCompatibility(deploy *naisrequest.Deploy) []string {
 	var warnings []string
 
@@ -4,24 +4,34 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/nais/naisd/api/app"
 	"github.com/nais/naisd/api/naisrequest"
 	"github.com/nais/naisd/pkg/event"
+	"github.com/nais/naisd/pkg/notify"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"goji.io"
 	"goji.io/pat"
 	"gopkg.in/h2non/gock.v1"
 	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes/fake"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 var (
 	fakeDeploymentHandler = func(event deployment.Event) {}
 )
 
+func newFakeDynamicClient(objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	return dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...)
+}
+
 type FakeDeployStatusViewer struct {
 	deployStatusToReturn DeployStatus
 	viewToReturn         DeploymentStatusView
@@ -32,6 +42,45 @@ func (d FakeDeployStatusViewer) DeploymentStatusView(namespace, deployName strin
 	return d.deployStatusToReturn, d.viewToReturn, d.errToReturn
 }
 
+type fakeLeaderStatus struct {
+	leader bool
+}
+
+func (f fakeLeaderStatus) IsLeader() bool {
+	return f.leader
+}
+
+func (f fakeLeaderStatus) Identity() string {
+	return "naisd-2"
+}
+
+func (f fakeLeaderStatus) Leader() string {
+	return "naisd-1"
+}
+
+func TestIsReady(t *testing.T) {
+	isReady := func(api Api) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/isready", nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("replica without leader election runs background tasks itself", func(t *testing.T) {
+		rr := isReady(Api{})
+
+		assert.Equal(t, 200, rr.Code)
+		assert.JSONEq(t, `{"leader": true}`, rr.Body.String())
+	})
+
+	t.Run("follower is ready and reports the current leader", func(t *testing.T) {
+		rr := isReady(Api{LeaderStatus: fakeLeaderStatus{leader: false}})
+
+		assert.Equal(t, 200, rr.Code)
+		assert.JSONEq(t, `{"leader": false, "identity": "naisd-2", "currentLeader": "naisd-1"}`, rr.Body.String())
+	})
+}
+
 func TestAnIncorrectPayloadGivesError(t *testing.T) {
 	api := Api{}
 
@@ -156,8 +205,10 @@ func TestValidDeploymentRequestAndManifestCreateResources(t *testing.T) {
 	zone := "zone"
 
 	clientset := fake.NewSimpleClientset()
+	var notifications []notify.Event
+	notifier := func(event notify.Event) { notifications = append(notifications, event) }
 
-	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler}
+	api := Api{clientset, newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler, nil, notifier}
 
 	depReq := naisrequest.Deploy{
 		Application:      appName,
@@ -234,6 +285,13 @@ func TestValidDeploymentRequestAndManifestCreateResources(t *testing.T) {
 	assert.Equal(t, 200, rr.Code)
 	assert.True(t, gock.IsDone())
 	assert.Equal(t, "result: \n- created deployment\n- created secret\n- created service\n- created ingress\n- created autoscaler\n- created serviceaccount\n- created rolebinding\n", string(rr.Body.Bytes()))
+
+	assert.Len(t, notifications, 2)
+	assert.Equal(t, notify.DeployStarted, notifications[0].Type)
+	assert.Equal(t, notify.DeploySucceeded, notifications[1].Type)
+	assert.Equal(t, appName, notifications[1].Application)
+	assert.Equal(t, version, notifications[1].Version)
+	assert.Equal(t, "test-cluster", notifications[1].ClusterName)
 }
 
 func TestValidDeploymentRequestAndManifestCreateAlerts(t *testing.T) {
@@ -247,7 +305,7 @@ func TestValidDeploymentRequestAndManifestCreateAlerts(t *testing.T) {
 
 	clientset := fake.NewSimpleClientset()
 
-	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler}
+	api := Api{clientset, newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler, nil, nil}
 
 	depReq := naisrequest.Deploy{
 		Application:      appName,
@@ -262,7 +320,7 @@ func TestValidDeploymentRequestAndManifestCreateAlerts(t *testing.T) {
 		Image: image,
 		Port:  321,
 		Team:  teamName,
-		Alerts: []PrometheusAlertRule{
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
 			{
 				Alert: alertName,
 				Expr:  alertExpr,
@@ -271,7 +329,7 @@ func TestValidDeploymentRequestAndManifestCreateAlerts(t *testing.T) {
 					"action": "alertAction",
 				},
 			},
-		},
+		}},
 	}
 
 	data, _ := yaml.Marshal(manifest)
@@ -318,7 +376,7 @@ func TestThatFasitIsSkippedOnValidDeployment(t *testing.T) {
 
 	clientset := fake.NewSimpleClientset()
 
-	api := Api{clientset, "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler}
+	api := Api{clientset, newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler, nil, nil}
 
 	depReq := naisrequest.Deploy{
 		Application: appName,
@@ -333,7 +391,7 @@ func TestThatFasitIsSkippedOnValidDeployment(t *testing.T) {
 		Image: image,
 		Port:  321,
 		Team:  teamName,
-		Alerts: []PrometheusAlertRule{
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
 			{
 				Alert: alertName,
 				Expr:  alertExpr,
@@ -342,7 +400,7 @@ func TestThatFasitIsSkippedOnValidDeployment(t *testing.T) {
 					"action": "alertAction",
 				},
 			},
-		},
+		}},
 	}
 
 	data, _ := yaml.Marshal(manifest)
@@ -369,6 +427,57 @@ func TestThatFasitIsSkippedOnValidDeployment(t *testing.T) {
 	assert.Equal(t, "result: \n- created deployment\n- created service\n- created ingress\n- created autoscaler\n- updated alerts configmap (app-rules)\n- created serviceaccount\n- created rolebinding\n", string(rr.Body.Bytes()))
 }
 
+func TestConcurrentDeployIsRefused(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	inProgress := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "122", CorrelationID: "in-progress"}
+	clientset := fake.NewSimpleClientset(createDeployLockDef(spec, inProgress, nil, time.Now()))
+
+	api := Api{clientset, newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, fakeDeploymentHandler, nil, nil}
+
+	depReq := naisrequest.Deploy{
+		Application: appName,
+		Version:     "123",
+		ManifestUrl: "http://repo.com/app",
+		SkipFasit:   true,
+		Zone:        "zone",
+		Namespace:   namespace,
+	}
+
+	data, _ := yaml.Marshal(NaisManifest{Image: image, Port: 321, Team: teamName})
+
+	defer gock.Off()
+	gock.New("http://repo.com").
+		Get("/app").
+		Times(2).
+		Reply(200).
+		BodyString(string(data))
+
+	deploy := func(depReq naisrequest.Deploy) *httptest.ResponseRecorder {
+		jsn, _ := json.Marshal(depReq)
+		req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(string(jsn)))
+		rr := httptest.NewRecorder()
+		http.Handler(appHandler(api.deploy)).ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("deploy is refused while another version is being deployed", func(t *testing.T) {
+		rr := deploy(depReq)
+
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Contains(t, rr.Body.String(), "version 122 is currently being deployed")
+	})
+
+	t.Run("forced deploy overrides the lock and releases it afterwards", func(t *testing.T) {
+		depReq.Force = true
+		rr := deploy(depReq)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		lease, err := getExistingDeployLock(spec, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+	})
+}
+
 func TestMissingResources(t *testing.T) {
 	resourceAlias := "alias1"
 	resourceType := "db"
@@ -407,7 +516,7 @@ func TestMissingResources(t *testing.T) {
 	req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(CreateDefaultDeploymentRequest()))
 
 	rr := httptest.NewRecorder()
-	api := Api{fake.NewSimpleClientset(), "https://fasit.local", "nais.example.tk", "clustername", false, false, nil, fakeDeploymentHandler}
+	api := Api{fake.NewSimpleClientset(), newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "clustername", false, false, nil, fakeDeploymentHandler, nil, nil}
 	handler := http.Handler(appHandler(api.deploy))
 
 	handler.ServeHTTP(rr, req)
@@ -507,3 +616,98 @@ func TestEnsurePropertyCompatibility(t *testing.T) {
 		assert.Len(t, warnings, 1)
 	})
 }
+
+func TestDeleteApplication(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+
+	deleteApp := func(api Api, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/app/%s/%s", namespace, appName), strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("per-resource results are returned as JSON and fasit is skipped without an environment", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceDef(spec), createServiceAccountDef(spec))
+		api := Api{Clientset: clientset, DynamicClient: newFakeDynamicClient(), FasitURL: "https://fasit.local"}
+
+		rr := deleteApp(api, "")
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response DeleteResponse
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.Equal(t, appName, response.Application)
+		assert.Contains(t, response.Resources, DeleteResult{Resource: "service", Name: appName, Status: DeleteStatusDeleted})
+		assert.Contains(t, response.Resources, DeleteResult{Resource: "fasit application instance", Name: appName, Status: DeleteStatusSkipped, Message: "no fasit environment given"})
+	})
+
+	t.Run("fasit application instance is deleted", func(t *testing.T) {
+		api := Api{Clientset: fake.NewSimpleClientset(), DynamicClient: newFakeDynamicClient(), FasitURL: "https://fasit.local"}
+
+		defer gock.Off()
+		gock.New("https://fasit.local").
+			Get(fmt.Sprintf("/api/v2/applicationinstances/environment/%s/application/%s", fasitEnvironment, appName)).
+			Reply(200).
+			JSON(map[string]int{"id": 4242})
+		gock.New("https://fasit.local").
+			Delete("/api/v2/applicationinstances/4242").
+			MatchHeader("Authorization", "Basic .+").
+			Reply(204)
+
+		rr := deleteApp(api, fmt.Sprintf(`{"fasitEnvironment": "%s", "fasitUsername": "user", "fasitPassword": "pass"}`, fasitEnvironment))
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.True(t, gock.IsDone())
+		assert.Contains(t, rr.Body.String(), `{"resource":"fasit application instance","name":"appname in testenv","status":"deleted"}`)
+	})
+
+	t.Run("dry run lists the resources without deleting them", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceDef(spec))
+		api := Api{Clientset: clientset, DynamicClient: newFakeDynamicClient(), FasitURL: "https://fasit.local"}
+
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/app/%s/%s?dryRun=true", namespace, appName), strings.NewReader(""))
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var response DeleteResponse
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.True(t, response.DryRun)
+		assert.Empty(t, response.ConfirmationToken)
+		assert.Contains(t, response.Resources, DeleteResult{Resource: "service", Name: appName, Status: DeleteStatusWouldDelete})
+
+		svc, err := getExistingAppService(spec, clientset)
+		assert.NoError(t, err)
+		assert.NotNil(t, svc)
+	})
+
+	t.Run("deleting requires the confirmation token from a dry run when confirmation is required", func(t *testing.T) {
+		viper.Set(EnvDeleteConfirmationRequired, true)
+		defer viper.Set(EnvDeleteConfirmationRequired, false)
+		viper.Set(EnvDeleteConfirmationKey, "shared-key")
+		defer viper.Set(EnvDeleteConfirmationKey, "")
+
+		clientset := fake.NewSimpleClientset(createServiceDef(spec))
+		api := Api{Clientset: clientset, DynamicClient: newFakeDynamicClient(), FasitURL: "https://fasit.local"}
+
+		rr := deleteApp(api, "")
+		assert.Equal(t, http.StatusPreconditionRequired, rr.Code)
+
+		req, _ := http.NewRequest("DELETE", fmt.Sprintf("/app/%s/%s?dryRun=true", namespace, appName), strings.NewReader(""))
+		rr = httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+
+		var response DeleteResponse
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &response))
+		assert.NotEmpty(t, response.ConfirmationToken)
+
+		req, _ = http.NewRequest("DELETE", fmt.Sprintf("/app/%s/%s?confirmationToken=%s", namespace, appName, response.ConfirmationToken), strings.NewReader(""))
+		rr = httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		svc, err := getExistingAppService(spec, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, svc)
+	})
+}
@@ -1,10 +1,19 @@
 package app
 
+import (
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
 // Spec is an identifier for a nais applications kubernetes resources
 type Spec struct {
 	Application string
 	Namespace   string
 	Team        string
+	// Version and CorrelationID identify the deploy that created or last updated the resources
+	Version       string
+	CorrelationID string
+	// Owner is referenced from the resources created for the application, if set
+	Owner *k8smeta.OwnerReference
 }
 
 // Determine and return the `name` for this resource
@@ -0,0 +1,260 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nais/naisd/internal/vault"
+	k8sapps "k8s.io/api/apps/v1"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
+	k8score "k8s.io/api/core/v1"
+	k8snetworkingv1beta1 "k8s.io/api/networking/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// ApplicationSummary describes an application deployed by naisd
+type ApplicationSummary struct {
+	Name              string     `json:"name"`
+	Namespace         string     `json:"namespace"`
+	Kind              string     `json:"kind"`
+	Team              string     `json:"team"`
+	Version           string     `json:"version"`
+	Image             string     `json:"image"`
+	Replicas          int32      `json:"replicas"`
+	AvailableReplicas int32      `json:"availableReplicas"`
+	IngressHosts      []string   `json:"ingressHosts"`
+	Redis             bool       `json:"redis"`
+	Vault             bool       `json:"vault"`
+	Paused            bool       `json:"paused,omitempty"`
+	LastDeploy        *time.Time `json:"lastDeploy,omitempty"`
+}
+
+func createManagedSelector(team string) string {
+	selector := labels.Set{ManagedByLabel: ManagedByNaisd}
+	if len(team) > 0 {
+		selector["team"] = team
+	}
+	return selector.String()
+}
+
+// listApplications finds the applications naisd has deployed to namespace, or to every namespace if it is empty,
+// optionally only those belonging to team
+func listApplications(namespace, team string, k8sClient kubernetes.Interface) ([]ApplicationSummary, error) {
+	listOptions := k8smeta.ListOptions{LabelSelector: createManagedSelector(team)}
+
+	deployments, err := k8sClient.AppsV1().Deployments(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list deployments: %s", err)
+	}
+
+	statefulSets, err := k8sClient.AppsV1().StatefulSets(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list statefulsets: %s", err)
+	}
+
+	cronJobs, err := k8sClient.BatchV1beta1().CronJobs(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list cronjobs: %s", err)
+	}
+
+	ingresses, err := k8sClient.NetworkingV1beta1().Ingresses(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list ingresses: %s", err)
+	}
+
+	services, err := k8sClient.CoreV1().Services(namespace).List(context.TODO(), listOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list services: %s", err)
+	}
+
+	hosts := createIngressHostsByApp(ingresses.Items)
+
+	applications := make(map[string]bool, len(deployments.Items))
+	for _, deployment := range deployments.Items {
+		applications[deployment.Namespace+"/"+deployment.Name] = true
+	}
+
+	colors := createShownColorsByApp(services.Items, applications)
+
+	summaries := make([]ApplicationSummary, 0, len(deployments.Items)+len(statefulSets.Items)+len(cronJobs.Items))
+	for _, deployment := range deployments.Items {
+		// Redis and canary deployments are part of the application they are created for
+		if deployment.Labels[CanaryTrackLabel] == CanaryTrack {
+			continue
+		}
+		if applications[deployment.Namespace+"/"+strings.TrimSuffix(deployment.Name, "-redis")] && strings.HasSuffix(deployment.Name, "-redis") {
+			continue
+		}
+		if color, found := deployment.Labels[ColorLabel]; found && color != colors[deployment.Namespace+"/"+deployment.Labels["app"]] {
+			continue
+		}
+
+		summary := createApplicationSummary(deployment)
+		summary.IngressHosts = hosts[deployment.Namespace+"/"+summary.Name]
+		summaries = append(summaries, summary)
+	}
+
+	for _, statefulSet := range statefulSets.Items {
+		summary := createStatefulSetSummary(statefulSet)
+		summary.IngressHosts = hosts[statefulSet.Namespace+"/"+summary.Name]
+		summaries = append(summaries, summary)
+	}
+
+	for _, cronJob := range cronJobs.Items {
+		summaries = append(summaries, createCronJobSummary(cronJob))
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Namespace != summaries[j].Namespace {
+			return summaries[i].Namespace < summaries[j].Namespace
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	return summaries, nil
+}
+
+// createShownColorsByApp finds the color to list for applications using the BlueGreen strategy: the one the service
+// sends traffic to, or the pending one for applications that have not been switched to a color yet and have no
+// deployment from before they used the strategy
+func createShownColorsByApp(services []k8score.Service, applications map[string]bool) map[string]string {
+	colors := make(map[string]string)
+
+	for _, service := range services {
+		key := service.Namespace + "/" + service.Labels["app"]
+		if color := service.Annotations[ActiveColorAnnotation]; len(color) > 0 {
+			colors[key] = color
+		} else if !applications[key] {
+			colors[key] = service.Annotations[PendingColorAnnotation]
+		}
+	}
+
+	return colors
+}
+
+func createIngressHostsByApp(ingresses []k8snetworkingv1beta1.Ingress) map[string][]string {
+	hosts := make(map[string][]string)
+
+	for _, ingress := range ingresses {
+		key := ingress.Namespace + "/" + ingress.Labels["app"]
+		for _, rule := range ingress.Spec.Rules {
+			hosts[key] = append(hosts[key], rule.Host)
+		}
+	}
+
+	return hosts
+}
+
+func createApplicationSummary(deployment k8sapps.Deployment) ApplicationSummary {
+	summary := createWorkloadSummary(WorkloadDeployment, deployment.ObjectMeta, deployment.Spec.Template.Spec)
+	summary.AvailableReplicas = deployment.Status.AvailableReplicas
+	summary.LastDeploy = findLastDeploy(deployment)
+
+	if deployment.Spec.Replicas != nil {
+		summary.Replicas = *deployment.Spec.Replicas
+	}
+
+	return summary
+}
+
+func createStatefulSetSummary(statefulSet k8sapps.StatefulSet) ApplicationSummary {
+	summary := createWorkloadSummary(WorkloadStatefulSet, statefulSet.ObjectMeta, statefulSet.Spec.Template.Spec)
+	summary.AvailableReplicas = statefulSet.Status.ReadyReplicas
+	summary.LastDeploy = findDeployedAt(statefulSet.ObjectMeta)
+
+	if statefulSet.Spec.Replicas != nil {
+		summary.Replicas = *statefulSet.Spec.Replicas
+	}
+
+	return summary
+}
+
+// createCronJobSummary summarises a cronjob, whose replicas are the jobs it is running
+func createCronJobSummary(cronJob k8sbatchv1beta1.CronJob) ApplicationSummary {
+	summary := createWorkloadSummary(WorkloadCronJob, cronJob.ObjectMeta, cronJob.Spec.JobTemplate.Spec.Template.Spec)
+	summary.Replicas = int32(len(cronJob.Status.Active))
+	summary.AvailableReplicas = summary.Replicas
+	summary.LastDeploy = findDeployedAt(cronJob.ObjectMeta)
+
+	return summary
+}
+
+// createWorkloadSummary summarises what every kind of workload has in common: its labels, annotations and the
+// application's container
+func createWorkloadSummary(kind string, objectMeta k8smeta.ObjectMeta, podSpec k8score.PodSpec) ApplicationSummary {
+	name := objectMeta.Labels["app"]
+	if len(name) == 0 {
+		name = objectMeta.Name
+	}
+
+	summary := ApplicationSummary{
+		Name:         name,
+		Namespace:    objectMeta.Namespace,
+		Kind:         kind,
+		Team:         objectMeta.Labels["team"],
+		Version:      objectMeta.Annotations[VersionAnnotation],
+		IngressHosts: []string{},
+		Vault:        vault.Used(podSpec),
+		Paused:       isPaused(objectMeta),
+	}
+
+	if container := findAppContainer(name, podSpec.Containers); container != nil {
+		summary.Image = container.Image
+		summary.Redis = hasEnvVar(container.Env, "REDIS_HOST")
+
+		if len(summary.Version) == 0 {
+			if i := strings.LastIndex(container.Image, ":"); i > 0 {
+				summary.Version = container.Image[i+1:]
+			}
+		}
+	}
+
+	return summary
+}
+
+func findAppContainer(application string, containers []k8score.Container) *k8score.Container {
+	for i := range containers {
+		if containers[i].Name == application {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func hasEnvVar(envVars []k8score.EnvVar, name string) bool {
+	for _, envVar := range envVars {
+		if envVar.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// findLastDeploy reads the time naisd last deployed the application. Deployments from before the time was recorded
+// fall back to when the deployment last progressed.
+func findLastDeploy(deployment k8sapps.Deployment) *time.Time {
+	if deployedAt := findDeployedAt(deployment.ObjectMeta); deployedAt != nil {
+		return deployedAt
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == k8sapps.DeploymentProgressing && !condition.LastUpdateTime.IsZero() {
+			lastUpdate := condition.LastUpdateTime.Time
+			return &lastUpdate
+		}
+	}
+
+	return nil
+}
+
+func findDeployedAt(objectMeta k8smeta.ObjectMeta) *time.Time {
+	if deployedAt, err := time.Parse(time.RFC3339, objectMeta.Annotations[DeployedAtAnnotation]); err == nil {
+		return &deployedAt
+	}
+	return nil
+}
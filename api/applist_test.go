@@ -0,0 +1,116 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListApplications(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName, Version: version}
+	otherSpec := app.Spec{Application: otherAppName, Namespace: "other", Team: otherTeamName}
+	deployedAt := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	manifest := newDefaultManifest()
+	manifest.Redis.Enabled = true
+	deployment, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}, nil, false)
+	deployment.Annotations[DeployedAtAnnotation] = deployedAt.Format(time.RFC3339)
+	deployment.Spec.Template.Spec.InitContainers = []k8score.Container{{Name: "vks-init"}}
+	otherDeployment, _ := createDeploymentDef(otherSpec, []NaisResource{}, newDefaultManifest(), naisrequest.Deploy{Application: otherAppName, Namespace: "other", Version: "1.0"}, nil, false)
+	redisDeployment := createRedisDeploymentDef(createRedisSpec(spec), updateDefaultRedisValues(Redis{Enabled: true}), nil)
+	unmanagedDeployment, _ := createDeploymentDef(app.Spec{Application: "unmanaged", Namespace: namespace}, []NaisResource{}, newDefaultManifest(), naisrequest.Deploy{}, nil, false)
+	delete(unmanagedDeployment.Labels, ManagedByLabel)
+
+	ingress := createIngressDef(spec)
+	ingress.Spec.Rules = append(ingress.Spec.Rules, createIngressRule(appName, "appname.nais.example.tk", ""))
+
+	clientset := fake.NewSimpleClientset(deployment, otherDeployment, redisDeployment, unmanagedDeployment, ingress)
+
+	t.Run("every naisd-managed application is listed, without its redis", func(t *testing.T) {
+		applications, err := listApplications("", "", clientset)
+		assert.NoError(t, err)
+		assert.Len(t, applications, 2)
+
+		application := applications[0]
+		assert.Equal(t, appName, application.Name)
+		assert.Equal(t, namespace, application.Namespace)
+		assert.Equal(t, WorkloadDeployment, application.Kind)
+		assert.Equal(t, teamName, application.Team)
+		assert.Equal(t, version, application.Version)
+		assert.Equal(t, int32(1), application.Replicas)
+		assert.Equal(t, []string{"appname.nais.example.tk"}, application.IngressHosts)
+		assert.True(t, application.Redis)
+		assert.True(t, application.Vault)
+		assert.Equal(t, deployedAt, application.LastDeploy.UTC())
+
+		assert.Equal(t, otherAppName, applications[1].Name)
+		assert.False(t, applications[1].Redis)
+		assert.False(t, applications[1].Vault)
+		assert.Empty(t, applications[1].IngressHosts)
+	})
+
+	t.Run("applications are filtered by namespace and team", func(t *testing.T) {
+		applications, err := listApplications("other", "", clientset)
+		assert.NoError(t, err)
+		assert.Len(t, applications, 1)
+		assert.Equal(t, otherAppName, applications[0].Name)
+
+		applications, err = listApplications("", teamName, clientset)
+		assert.NoError(t, err)
+		assert.Len(t, applications, 1)
+		assert.Equal(t, appName, applications[0].Name)
+	})
+
+	t.Run("applications are listed as JSON", func(t *testing.T) {
+		api := Api{Clientset: clientset}
+
+		for path, expected := range map[string]int{"/apps": 2, "/apps/other": 1, fmt.Sprintf("/apps?team=%s", otherTeamName): 1, "/apps/nonexisting": 0} {
+			req, _ := http.NewRequest("GET", path, nil)
+			rr := httptest.NewRecorder()
+			api.Handler().ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code, path)
+			var applications []ApplicationSummary
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &applications))
+			assert.Len(t, applications, expected, path)
+		}
+	})
+}
+
+func TestListApplicationsOfEveryKind(t *testing.T) {
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+	statefulSpec := app.Spec{Application: "stateful", Namespace: namespace, Team: teamName}
+	cronSpec := app.Spec{Application: "nightly", Namespace: namespace, Team: teamName}
+
+	statefulSet, _ := createStatefulSetDef(statefulSpec, []NaisResource{}, newStatefulSetManifest(), request, nil, false)
+	statefulSet.Status.ReadyReplicas = 1
+	cronJob, _ := createCronJobDef(cronSpec, request, newJobManifest(WorkloadCronJob), []NaisResource{}, nil)
+	cronJob = suspendCronJob(cronJob, true)
+	clientset := fake.NewSimpleClientset(statefulSet, cronJob)
+
+	applications, err := listApplications("", "", clientset)
+	assert.NoError(t, err)
+	assert.Len(t, applications, 2)
+
+	assert.Equal(t, "nightly", applications[0].Name)
+	assert.Equal(t, WorkloadCronJob, applications[0].Kind)
+	assert.Equal(t, teamName, applications[0].Team)
+	assert.Equal(t, version, applications[0].Version)
+	assert.True(t, applications[0].Paused)
+	assert.NotNil(t, applications[0].LastDeploy)
+
+	assert.Equal(t, "stateful", applications[1].Name)
+	assert.Equal(t, WorkloadStatefulSet, applications[1].Kind)
+	assert.Equal(t, int32(2), applications[1].Replicas)
+	assert.Equal(t, int32(1), applications[1].AvailableReplicas)
+	assert.Equal(t, image+":"+version, applications[1].Image)
+	assert.NotNil(t, applications[1].LastDeploy)
+}
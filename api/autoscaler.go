@@ -0,0 +1,246 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	k8sapps "k8s.io/api/apps/v1"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta2"
+	k8score "k8s.io/api/core/v1"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	ScalingMetricPods      = "Pods"
+	ScalingMetricExternal  = "External"
+	maxStabilizationWindow = time.Hour
+	maxScalingPolicyPeriod = 30 * time.Minute
+)
+
+// ScalingMetric is a custom or external metric the autoscaler scales on in addition to cpu and memory, e.g. the request
+// rate of the pods or the lag of a Kafka consumer group. The metric must be served by a metrics adapter in the cluster.
+type ScalingMetric struct {
+	Type               string
+	Name               string
+	Selector           map[string]string
+	TargetValue        string `yaml:"targetValue"`
+	TargetAverageValue string `yaml:"targetAverageValue"`
+}
+
+// ScalingBehavior limits how fast the autoscaler scales up and down. Rules that are left out get the defaults of the
+// cluster. Requires Kubernetes 1.18, older clusters ignore it.
+type ScalingBehavior struct {
+	ScaleUp   *ScalingRules `yaml:"scaleUp"`
+	ScaleDown *ScalingRules `yaml:"scaleDown"`
+}
+
+// ScalingRules are the policies for one direction of scaling. The autoscaler waits for the stabilization window before
+// scaling, and uses the policy selected by selectPolicy: Max, Min or Disabled.
+type ScalingRules struct {
+	StabilizationWindow string `yaml:"stabilizationWindow"`
+	SelectPolicy        string `yaml:"selectPolicy"`
+	Policies            []ScalingPolicy
+}
+
+// ScalingPolicy allows the replicas to change by value pods, or value percent of the replicas, within period
+type ScalingPolicy struct {
+	Type   string
+	Value  int
+	Period string
+}
+
+// isAutoscaled is false when the manifest fixes the number of replicas by setting min equal to max, in which case no
+// autoscaler is created
+func isAutoscaled(manifest NaisManifest) bool {
+	return manifest.Replicas.Min != manifest.Replicas.Max
+}
+
+// fixReplicas sets the replicas of a deployment that is not autoscaled. A paused deployment is resumed with them.
+func fixReplicas(deployment *k8sapps.Deployment, replicas int) *k8sapps.Deployment {
+	if isPaused(deployment.ObjectMeta) {
+		deployment.Annotations[PausedReplicasAnnotation] = strconv.Itoa(replicas)
+	} else {
+		deployment.Spec.Replicas = int32p(int32(replicas))
+	}
+
+	return deployment
+}
+
+func createAutoscalerMetrics(replicas Replicas) []k8sautoscaling.MetricSpec {
+	metrics := []k8sautoscaling.MetricSpec{createResourceMetric(k8score.ResourceCPU, replicas.CpuThresholdPercentage)}
+
+	if replicas.MemoryThresholdPercentage > 0 {
+		metrics = append(metrics, createResourceMetric(k8score.ResourceMemory, replicas.MemoryThresholdPercentage))
+	}
+
+	for _, metric := range replicas.Metrics {
+		identifier := k8sautoscaling.MetricIdentifier{Name: metric.Name}
+		if len(metric.Selector) > 0 {
+			identifier.Selector = &k8smeta.LabelSelector{MatchLabels: metric.Selector}
+		}
+
+		switch metric.Type {
+		case ScalingMetricPods:
+			metrics = append(metrics, k8sautoscaling.MetricSpec{
+				Type: k8sautoscaling.PodsMetricSourceType,
+				Pods: &k8sautoscaling.PodsMetricSource{Metric: identifier, Target: createMetricTarget(metric)},
+			})
+		case ScalingMetricExternal:
+			metrics = append(metrics, k8sautoscaling.MetricSpec{
+				Type:     k8sautoscaling.ExternalMetricSourceType,
+				External: &k8sautoscaling.ExternalMetricSource{Metric: identifier, Target: createMetricTarget(metric)},
+			})
+		}
+	}
+
+	return metrics
+}
+
+// The durations are parsed by validateScalingBehavior before the autoscaler is created
+func createAutoscalerBehavior(behavior *ScalingBehavior) *k8sautoscaling.HorizontalPodAutoscalerBehavior {
+	if behavior == nil {
+		return nil
+	}
+
+	return &k8sautoscaling.HorizontalPodAutoscalerBehavior{
+		ScaleUp:   createScalingRules(behavior.ScaleUp),
+		ScaleDown: createScalingRules(behavior.ScaleDown),
+	}
+}
+
+func createScalingRules(rules *ScalingRules) *k8sautoscaling.HPAScalingRules {
+	if rules == nil {
+		return nil
+	}
+
+	hpaRules := &k8sautoscaling.HPAScalingRules{}
+	if len(rules.StabilizationWindow) > 0 {
+		window, _ := time.ParseDuration(rules.StabilizationWindow)
+		hpaRules.StabilizationWindowSeconds = int32p(int32(window.Seconds()))
+	}
+	if len(rules.SelectPolicy) > 0 {
+		selectPolicy := k8sautoscaling.ScalingPolicySelect(rules.SelectPolicy)
+		hpaRules.SelectPolicy = &selectPolicy
+	}
+	for _, policy := range rules.Policies {
+		period, _ := time.ParseDuration(policy.Period)
+		hpaRules.Policies = append(hpaRules.Policies, k8sautoscaling.HPAScalingPolicy{
+			Type:          k8sautoscaling.HPAScalingPolicyType(policy.Type),
+			Value:         int32(policy.Value),
+			PeriodSeconds: int32(period.Seconds()),
+		})
+	}
+
+	return hpaRules
+}
+
+func createResourceMetric(resource k8score.ResourceName, utilizationPercentage int) k8sautoscaling.MetricSpec {
+	return k8sautoscaling.MetricSpec{
+		Type: k8sautoscaling.ResourceMetricSourceType,
+		Resource: &k8sautoscaling.ResourceMetricSource{
+			Name: resource,
+			Target: k8sautoscaling.MetricTarget{
+				Type:               k8sautoscaling.UtilizationMetricType,
+				AverageUtilization: int32p(int32(utilizationPercentage)),
+			},
+		},
+	}
+}
+
+// The target values are parsed by validateScalingMetrics before the autoscaler is created
+func createMetricTarget(metric ScalingMetric) k8sautoscaling.MetricTarget {
+	if len(metric.TargetValue) > 0 {
+		value := k8sresource.MustParse(metric.TargetValue)
+		return k8sautoscaling.MetricTarget{Type: k8sautoscaling.ValueMetricType, Value: &value}
+	}
+
+	averageValue := k8sresource.MustParse(metric.TargetAverageValue)
+	return k8sautoscaling.MetricTarget{Type: k8sautoscaling.AverageValueMetricType, AverageValue: &averageValue}
+}
+
+func validateScalingMetrics(manifest NaisManifest) *ValidationError {
+	if manifest.Replicas.MemoryThresholdPercentage != 0 && (manifest.Replicas.MemoryThresholdPercentage < 10 || manifest.Replicas.MemoryThresholdPercentage > 100) {
+		return &ValidationError{
+			ErrorMessage: "MemoryThreshold must be between 10 and 100.",
+			Fields:       map[string]string{"Replicas.MemoryThreshold": strconv.Itoa(manifest.Replicas.MemoryThresholdPercentage)},
+		}
+	}
+
+	for _, metric := range manifest.Replicas.Metrics {
+		fields := map[string]string{"Type": metric.Type, "Name": metric.Name, "TargetValue": metric.TargetValue, "TargetAverageValue": metric.TargetAverageValue}
+
+		if metric.Type != ScalingMetricPods && metric.Type != ScalingMetricExternal {
+			return &ValidationError{ErrorMessage: "Replicas.Metrics must be of type Pods or External", Fields: fields}
+		}
+		if len(metric.Name) == 0 {
+			return &ValidationError{ErrorMessage: "Replicas.Metrics must have a name", Fields: fields}
+		}
+
+		// Pods metrics are always averaged over the pods, while external metrics may be used as a total
+		target := metric.TargetAverageValue
+		if metric.Type == ScalingMetricExternal && len(metric.TargetValue) > 0 {
+			if len(metric.TargetAverageValue) > 0 {
+				return &ValidationError{ErrorMessage: "Replicas.Metrics can not have both a targetValue and a targetAverageValue", Fields: fields}
+			}
+			target = metric.TargetValue
+		} else if len(metric.TargetValue) > 0 {
+			return &ValidationError{ErrorMessage: "Replicas.Metrics of type Pods must use targetAverageValue", Fields: fields}
+		}
+
+		if _, err := k8sresource.ParseQuantity(target); err != nil {
+			return &ValidationError{ErrorMessage: "Replicas.Metrics must have a target quantity, e.g. 100 or 500m", Fields: fields}
+		}
+	}
+
+	return nil
+}
+
+func validateScalingBehavior(manifest NaisManifest) *ValidationError {
+	behavior := manifest.Replicas.Behavior
+	if behavior == nil {
+		return nil
+	}
+
+	for direction, rules := range map[string]*ScalingRules{"ScaleUp": behavior.ScaleUp, "ScaleDown": behavior.ScaleDown} {
+		if rules == nil {
+			continue
+		}
+		field := "Replicas.Behavior." + direction
+
+		if len(rules.StabilizationWindow) > 0 {
+			window, err := time.ParseDuration(rules.StabilizationWindow)
+			if err != nil || window < 0 || window > maxStabilizationWindow {
+				return &ValidationError{
+					ErrorMessage: "StabilizationWindow must be a duration of at most 1h, e.g. 5m",
+					Fields:       map[string]string{field + ".StabilizationWindow": rules.StabilizationWindow},
+				}
+			}
+		}
+
+		switch k8sautoscaling.ScalingPolicySelect(rules.SelectPolicy) {
+		case "", k8sautoscaling.MaxPolicySelect, k8sautoscaling.MinPolicySelect, k8sautoscaling.DisabledPolicySelect:
+		default:
+			return &ValidationError{
+				ErrorMessage: "SelectPolicy must be Max, Min or Disabled",
+				Fields:       map[string]string{field + ".SelectPolicy": rules.SelectPolicy},
+			}
+		}
+
+		for _, policy := range rules.Policies {
+			fields := map[string]string{field + ".Policies.Type": policy.Type, field + ".Policies.Value": strconv.Itoa(policy.Value), field + ".Policies.Period": policy.Period}
+
+			if policy.Type != string(k8sautoscaling.PodsScalingPolicy) && policy.Type != string(k8sautoscaling.PercentScalingPolicy) {
+				return &ValidationError{ErrorMessage: "Scaling policies must be of type Pods or Percent", Fields: fields}
+			}
+			if policy.Value <= 0 {
+				return &ValidationError{ErrorMessage: "Scaling policies must have a value above 0", Fields: fields}
+			}
+			if period, err := time.ParseDuration(policy.Period); err != nil || period < time.Second || period > maxScalingPolicyPeriod {
+				return &ValidationError{ErrorMessage: "Scaling policies must have a period between 1s and 30m, e.g. 60s", Fields: fields}
+			}
+		}
+	}
+
+	return nil
+}
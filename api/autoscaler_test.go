@@ -0,0 +1,150 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta2"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCreateAutoscalerMetrics(t *testing.T) {
+	metrics := createAutoscalerMetrics(Replicas{
+		CpuThresholdPercentage:    50,
+		MemoryThresholdPercentage: 80,
+		Metrics: []ScalingMetric{
+			{Type: ScalingMetricPods, Name: "http_requests_per_second", TargetAverageValue: "100"},
+			{Type: ScalingMetricExternal, Name: "kafka_consumergroup_lag", Selector: map[string]string{"topic": "events"}, TargetValue: "1k"},
+		},
+	})
+
+	assert.Len(t, metrics, 4)
+	assert.Equal(t, k8score.ResourceCPU, metrics[0].Resource.Name)
+	assert.Equal(t, int32p(50), metrics[0].Resource.Target.AverageUtilization)
+	assert.Equal(t, k8score.ResourceMemory, metrics[1].Resource.Name)
+	assert.Equal(t, int32p(80), metrics[1].Resource.Target.AverageUtilization)
+
+	assert.Equal(t, k8sautoscaling.PodsMetricSourceType, metrics[2].Type)
+	assert.Equal(t, "http_requests_per_second", metrics[2].Pods.Metric.Name)
+	assert.Equal(t, int64(100), metrics[2].Pods.Target.AverageValue.Value())
+
+	assert.Equal(t, k8sautoscaling.ExternalMetricSourceType, metrics[3].Type)
+	assert.Equal(t, "events", metrics[3].External.Metric.Selector.MatchLabels["topic"])
+	assert.Equal(t, k8sautoscaling.ValueMetricType, metrics[3].External.Target.Type)
+	assert.Equal(t, int64(1000), metrics[3].External.Target.Value.Value())
+}
+
+func TestFixedReplicas(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	clientset := fake.NewSimpleClientset(createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil))
+
+	manifest := newDefaultManifest()
+	manifest.Replicas = Replicas{Min: 3, Max: 3, CpuThresholdPercentage: 50}
+
+	result, err := createOrUpdateK8sResources(spec, request, manifest, []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+	assert.NoError(t, err)
+	assert.Nil(t, result.Autoscaler)
+	assert.Equal(t, int32(3), *result.Deployment.Spec.Replicas)
+
+	pruned, err := pruneK8sResources(spec, result, clientset, newFakeDynamicClient())
+	assert.NoError(t, err)
+	assert.Contains(t, pruned, "autoscaler "+appName)
+
+	t.Run("a paused deployment is resumed with the fixed replicas", func(t *testing.T) {
+		paused := pauseDeployment(result.Deployment)
+		deployment, err := createDeploymentDef(spec, []NaisResource{}, manifest, request, paused, false)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+		assert.Equal(t, "3", deployment.Annotations[PausedReplicasAnnotation])
+	})
+}
+
+func TestValidateScalingMetrics(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validateScalingMetrics(manifest))
+
+	manifest.Replicas.MemoryThresholdPercentage = 5
+	assert.Equal(t, "MemoryThreshold must be between 10 and 100.", validateScalingMetrics(manifest).ErrorMessage)
+
+	for _, test := range []struct {
+		metric ScalingMetric
+		error  string
+	}{
+		{ScalingMetric{Type: ScalingMetricPods, Name: "rps", TargetAverageValue: "100"}, ""},
+		{ScalingMetric{Type: ScalingMetricExternal, Name: "lag", TargetValue: "1000"}, ""},
+		{ScalingMetric{Type: ScalingMetricExternal, Name: "lag", TargetAverageValue: "500m"}, ""},
+		{ScalingMetric{Type: "Object", Name: "rps", TargetAverageValue: "100"}, "Replicas.Metrics must be of type Pods or External"},
+		{ScalingMetric{Type: ScalingMetricPods, TargetAverageValue: "100"}, "Replicas.Metrics must have a name"},
+		{ScalingMetric{Type: ScalingMetricPods, Name: "rps", TargetValue: "100"}, "Replicas.Metrics of type Pods must use targetAverageValue"},
+		{ScalingMetric{Type: ScalingMetricExternal, Name: "lag", TargetValue: "1", TargetAverageValue: "1"}, "Replicas.Metrics can not have both a targetValue and a targetAverageValue"},
+		{ScalingMetric{Type: ScalingMetricPods, Name: "rps", TargetAverageValue: "many"}, "Replicas.Metrics must have a target quantity, e.g. 100 or 500m"},
+	} {
+		manifest := newDefaultManifest()
+		manifest.Replicas.Metrics = []ScalingMetric{test.metric}
+
+		err := validateScalingMetrics(manifest)
+		if len(test.error) == 0 {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, test.error, err.ErrorMessage)
+		}
+	}
+}
+
+func TestCreateAutoscalerBehavior(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	assert.Nil(t, createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil).Spec.Behavior)
+
+	autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50, Behavior: &ScalingBehavior{
+		ScaleUp: &ScalingRules{Policies: []ScalingPolicy{{Type: "Pods", Value: 4, Period: "60s"}}},
+		ScaleDown: &ScalingRules{
+			StabilizationWindow: "10m",
+			SelectPolicy:        "Min",
+			Policies:            []ScalingPolicy{{Type: "Percent", Value: 10, Period: "1m"}},
+		},
+	}}, nil)
+
+	behavior := autoscaler.Spec.Behavior
+	assert.Nil(t, behavior.ScaleUp.StabilizationWindowSeconds)
+	assert.Nil(t, behavior.ScaleUp.SelectPolicy)
+	assert.Equal(t, []k8sautoscaling.HPAScalingPolicy{{Type: k8sautoscaling.PodsScalingPolicy, Value: 4, PeriodSeconds: 60}}, behavior.ScaleUp.Policies)
+	assert.Equal(t, int32p(600), behavior.ScaleDown.StabilizationWindowSeconds)
+	assert.Equal(t, k8sautoscaling.MinPolicySelect, *behavior.ScaleDown.SelectPolicy)
+	assert.Equal(t, []k8sautoscaling.HPAScalingPolicy{{Type: k8sautoscaling.PercentScalingPolicy, Value: 10, PeriodSeconds: 60}}, behavior.ScaleDown.Policies)
+}
+
+func TestValidateScalingBehavior(t *testing.T) {
+	manifest := newDefaultManifest()
+	assert.Nil(t, validateScalingBehavior(manifest))
+
+	for _, test := range []struct {
+		rules ScalingRules
+		error string
+	}{
+		{ScalingRules{StabilizationWindow: "5m", SelectPolicy: "Max", Policies: []ScalingPolicy{{Type: "Pods", Value: 2, Period: "15s"}}}, ""},
+		{ScalingRules{SelectPolicy: "Disabled"}, ""},
+		{ScalingRules{StabilizationWindow: "2h"}, "StabilizationWindow must be a duration of at most 1h, e.g. 5m"},
+		{ScalingRules{StabilizationWindow: "300"}, "StabilizationWindow must be a duration of at most 1h, e.g. 5m"},
+		{ScalingRules{SelectPolicy: "Fastest"}, "SelectPolicy must be Max, Min or Disabled"},
+		{ScalingRules{Policies: []ScalingPolicy{{Type: "Replicas", Value: 2, Period: "15s"}}}, "Scaling policies must be of type Pods or Percent"},
+		{ScalingRules{Policies: []ScalingPolicy{{Type: "Percent", Period: "15s"}}}, "Scaling policies must have a value above 0"},
+		{ScalingRules{Policies: []ScalingPolicy{{Type: "Percent", Value: 10}}}, "Scaling policies must have a period between 1s and 30m, e.g. 60s"},
+		{ScalingRules{Policies: []ScalingPolicy{{Type: "Percent", Value: 10, Period: "1h"}}}, "Scaling policies must have a period between 1s and 30m, e.g. 60s"},
+	} {
+		rules := test.rules
+		manifest := newDefaultManifest()
+		manifest.Replicas.Behavior = &ScalingBehavior{ScaleDown: &rules}
+
+		err := validateScalingBehavior(manifest)
+		if len(test.error) == 0 {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, test.error, err.ErrorMessage)
+		}
+	}
+}
@@ -0,0 +1,519 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	ColorLabel                 = "nais.io/color"
+	ColorBlue                  = "blue"
+	ColorGreen                 = "green"
+	ColorLegacy                = "legacy"
+	ActiveColorAnnotation      = "nais.io/active-color"
+	PendingColorAnnotation     = "nais.io/pending-color"
+	PreviousColorAnnotation    = "nais.io/previous-color"
+	BlueGreenAbortedAnnotation = "nais.io/bluegreen-aborted"
+	blueGreenCheckInterval     = 10 * time.Second
+)
+
+var errNoPreviousColor = fmt.Errorf("there is no previous version to roll back to")
+
+// BlueGreenStatusView shows which color the service sends traffic to in the deploy status
+type BlueGreenStatusView struct {
+	ActiveColor   string
+	PendingColor  string `json:",omitempty"`
+	PreviousColor string `json:",omitempty"`
+}
+
+// RollbackResult is the outcome of switching the service back to the previous color
+type RollbackResult struct {
+	Application   string `json:"application"`
+	Namespace     string `json:"namespace"`
+	ActiveColor   string `json:"activeColor"`
+	PreviousColor string `json:"previousColor"`
+}
+
+func ensureAnnotations(annotations map[string]string) map[string]string {
+	if annotations == nil {
+		return make(map[string]string, 3)
+	}
+	return annotations
+}
+
+func createColorName(spec app.Spec, color string) string {
+	return spec.ResourceName() + "-" + color
+}
+
+func otherColor(color string) string {
+	if color == ColorBlue {
+		return ColorGreen
+	}
+	return ColorBlue
+}
+
+func createColorPodSelector(spec app.Spec, color string) map[string]string {
+	selector := createPodSelector(spec)
+	selector[ColorLabel] = color
+	return selector
+}
+
+// createBlueGreenDeploymentDef creates the deployment of one color. The pods of both colors carry the application's
+// labels, and the service only selects the active color.
+func createBlueGreenDeploymentDef(spec app.Spec, naisResources []NaisResource, manifest NaisManifest, deploymentRequest naisrequest.Deploy, color string, replicas int32, existingDeployment *k8sapps.Deployment, istioEnabled bool) (*k8sapps.Deployment, error) {
+	deploymentSpec, err := createDeploymentSpec(spec, deploymentRequest, manifest, naisResources, istioEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	deploymentSpec.Replicas = int32p(replicas)
+	deploymentSpec.Selector.MatchLabels = createColorPodSelector(spec, color)
+	deploymentSpec.Template.Labels[ColorLabel] = color
+
+	deployment := existingDeployment
+	if deployment == nil {
+		deployment = &k8sapps.Deployment{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "Deployment",
+				APIVersion: "apps/v1",
+			},
+			ObjectMeta: createObjectMeta(createColorName(spec, color), spec.Namespace),
+		}
+	}
+
+	deployment.ObjectMeta = addLabelsToObjectMeta(deployment.ObjectMeta, spec)
+	deployment.Labels[ColorLabel] = color
+	deployment.Annotations = ensureAnnotations(deployment.Annotations)
+	deployment.Annotations[DeployedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	deployment.Spec = deploymentSpec
+
+	return deployment, nil
+}
+
+// blueGreenReplicas starts the new color with as many replicas as the version it replaces, unless the manifest fixes
+// the number of replicas. paused is true when the version it replaces is paused, in which case the new color is
+// created paused with the replicas it will be resumed with.
+func blueGreenReplicas(spec app.Spec, activeColor string, manifest NaisManifest, k8sClient kubernetes.Interface) (replicas int32, paused bool, err error) {
+	name := spec.ResourceName()
+	if len(activeColor) > 0 {
+		name = createColorName(spec, activeColor)
+	}
+
+	current, err := getExistingDeployment(name, spec.Namespace, k8sClient)
+	if err != nil {
+		return 0, false, err
+	}
+
+	paused = current != nil && isPaused(current.ObjectMeta)
+	if !isAutoscaled(manifest) {
+		return int32(manifest.Replicas.Min), paused, nil
+	}
+
+	if paused {
+		if pausedReplicas, err := strconv.Atoi(current.Annotations[PausedReplicasAnnotation]); err == nil && pausedReplicas > 0 {
+			return int32(pausedReplicas), paused, nil
+		}
+	} else if current != nil && current.Spec.Replicas != nil && *current.Spec.Replicas > 0 {
+		return *current.Spec.Replicas, paused, nil
+	}
+
+	return int32(manifest.Replicas.Min), paused, nil
+}
+
+// serviceColor is the color the service selects: the active color, or ColorLegacy while the deployment from before the
+// BlueGreen strategy is still serving traffic
+func serviceColor(service *k8score.Service) string {
+	if color := service.Annotations[ActiveColorAnnotation]; len(color) > 0 {
+		return color
+	}
+	if service.Spec.Selector[ColorLabel] == ColorLegacy {
+		return ColorLegacy
+	}
+	return ""
+}
+
+// pinServiceToLegacyDeployment labels the pods of the deployment from before the BlueGreen strategy with ColorLegacy,
+// and makes the service select only those. Otherwise the service would send traffic to the first color as soon as its
+// pods start, before it has been switched to.
+func pinServiceToLegacyDeployment(spec app.Spec, service *k8score.Service, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+	if service.Spec.Selector[ColorLabel] == ColorLegacy {
+		return service, nil
+	}
+
+	legacy, err := getExistingAppDeployment(spec, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+	if legacy == nil {
+		return service, nil
+	}
+
+	if legacy.Spec.Template.Labels[ColorLabel] != ColorLegacy {
+		if legacy.Spec.Template.Labels == nil {
+			legacy.Spec.Template.Labels = make(map[string]string, 1)
+		}
+		legacy.Spec.Template.Labels[ColorLabel] = ColorLegacy
+		if _, err := k8sClient.AppsV1().Deployments(spec.Namespace).Update(context.TODO(), legacy, k8smeta.UpdateOptions{}); err != nil {
+			return nil, fmt.Errorf("unable to label deployment %s: %s", legacy.Name, err)
+		}
+	}
+
+	// The running pods are labelled too, so they keep their traffic while the deployment rolls out the new label
+	pods, err := k8sClient.CoreV1().Pods(spec.Namespace).List(context.TODO(), k8smeta.ListOptions{LabelSelector: labels.SelectorFromSet(createPodSelector(spec)).String()})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list pods: %s", err)
+	}
+	for _, pod := range pods.Items {
+		if _, colored := pod.Labels[ColorLabel]; colored {
+			continue
+		}
+		pod.Labels[ColorLabel] = ColorLegacy
+		if _, err := k8sClient.CoreV1().Pods(spec.Namespace).Update(context.TODO(), &pod, k8smeta.UpdateOptions{}); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("unable to label pod %s: %s", pod.Name, err)
+		}
+	}
+
+	service.Spec.Selector = createColorPodSelector(spec, ColorLegacy)
+	service, err = k8sClient.CoreV1().Services(spec.Namespace).Update(context.TODO(), service, k8smeta.UpdateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to pin service to deployment %s: %s", legacy.Name, err)
+	}
+
+	return service, nil
+}
+
+// createOrUpdateBlueGreenDeployment deploys the new version to the color the service does not send traffic to, and
+// marks it as pending. The BlueGreenController switches the service to it once it is fully available.
+func createOrUpdateBlueGreenDeployment(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
+	service, err := getExistingAppService(spec, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing service: %s", err)
+	}
+	if service == nil {
+		return nil, fmt.Errorf("service %s not found in %s", spec.ResourceName(), spec.Namespace)
+	}
+	service.Annotations = ensureAnnotations(service.Annotations)
+
+	activeColor := service.Annotations[ActiveColorAnnotation]
+	color := otherColor(activeColor)
+
+	if len(activeColor) == 0 {
+		if service, err = pinServiceToLegacyDeployment(spec, service, k8sClient); err != nil {
+			return nil, err
+		}
+		service.Annotations = ensureAnnotations(service.Annotations)
+	}
+
+	replicas, paused, err := blueGreenReplicas(spec, activeColor, manifest, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get current deployment: %s", err)
+	}
+
+	existingDeployment, err := getExistingDeployment(createColorName(spec, color), spec.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing %s deployment: %s", color, err)
+	}
+
+	deploymentDef, err := createBlueGreenDeploymentDef(spec, naisResources, manifest, deploymentRequest, color, replicas, existingDeployment, istioEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create %s deployment: %s", color, err)
+	}
+	if paused {
+		deploymentDef = pauseDeployment(deploymentDef)
+	}
+
+	deployment, err := createOrUpdateDeploymentResource(deploymentDef, spec.Namespace, k8sClient)
+	if err != nil {
+		return nil, err
+	}
+
+	service.Annotations[PendingColorAnnotation] = color
+	delete(service.Annotations, BlueGreenAbortedAnnotation)
+	if _, err := k8sClient.CoreV1().Services(spec.Namespace).Update(context.TODO(), service, k8smeta.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("unable to mark %s as pending: %s", color, err)
+	}
+
+	return deployment, nil
+}
+
+// blueGreenScaleTarget is the deployment the autoscaler should scale: the active color, or the deployment from before
+// the BlueGreen strategy until the service has been switched to a color for the first time
+func blueGreenScaleTarget(spec app.Spec, k8sClient kubernetes.Interface) (string, error) {
+	service, err := getExistingAppService(spec, k8sClient)
+	if err != nil || service == nil {
+		return spec.ResourceName(), err
+	}
+
+	if color := service.Annotations[ActiveColorAnnotation]; len(color) > 0 {
+		return createColorName(spec, color), nil
+	}
+
+	return spec.ResourceName(), nil
+}
+
+// switchColor points the service and the autoscaler at the deployment of color, and keeps the color it replaces
+// running for rollback. The first switch also removes the deployment the application ran in before it used the
+// BlueGreen strategy.
+func switchColor(spec app.Spec, color string, k8sClient kubernetes.Interface) error {
+	var previousColor string
+
+	err := retryOnConflict(func() error {
+		service, err := getExistingAppService(spec, k8sClient)
+		if err != nil {
+			return err
+		}
+		if service == nil {
+			return fmt.Errorf("service %s not found in %s", spec.ResourceName(), spec.Namespace)
+		}
+
+		service.Annotations = ensureAnnotations(service.Annotations)
+		previousColor = service.Annotations[ActiveColorAnnotation]
+		fillServiceSpec(spec, &service.Spec, color)
+		service.Annotations[ActiveColorAnnotation] = color
+		if len(previousColor) > 0 && previousColor != color {
+			service.Annotations[PreviousColorAnnotation] = previousColor
+		}
+		delete(service.Annotations, PendingColorAnnotation)
+
+		_, err = k8sClient.CoreV1().Services(spec.Namespace).Update(context.TODO(), service, k8smeta.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to switch service to %s: %s", color, err)
+	}
+
+	err = retryOnConflict(func() error {
+		autoscaler, err := getExistingAutoscaler(spec, k8sClient)
+		if err != nil || autoscaler == nil {
+			return err
+		}
+
+		autoscaler.Spec.ScaleTargetRef.Name = createColorName(spec, color)
+		_, err = k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(spec.Namespace).Update(context.TODO(), autoscaler, k8smeta.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to switch autoscaler to %s: %s", color, err)
+	}
+
+	if len(previousColor) == 0 {
+		if err := deleteDeployment(spec, k8sClient); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete deployment replaced by %s: %s", color, err)
+		}
+	}
+
+	glog.Infof("Switched %s in %s to %s", spec.Application, spec.Namespace, color)
+	return nil
+}
+
+// abortBlueGreen leaves the service on the active color and records why the pending color was not switched to
+func abortBlueGreen(spec app.Spec, reason string, k8sClient kubernetes.Interface) error {
+	return retryOnConflict(func() error {
+		service, err := getExistingAppService(spec, k8sClient)
+		if err != nil || service == nil {
+			return err
+		}
+
+		service.Annotations = ensureAnnotations(service.Annotations)
+		service.Annotations[BlueGreenAbortedAnnotation] = fmt.Sprintf("%s: %s", service.Annotations[PendingColorAnnotation], reason)
+		delete(service.Annotations, PendingColorAnnotation)
+
+		_, err = k8sClient.CoreV1().Services(spec.Namespace).Update(context.TODO(), service, k8smeta.UpdateOptions{})
+		return err
+	})
+}
+
+func createBlueGreenAppSpec(service k8score.Service) app.Spec {
+	return app.Spec{Application: service.Labels["app"], Namespace: service.Namespace, Team: service.Labels["team"]}
+}
+
+// progressBlueGreen switches the service to the pending color when it is fully available, or gives up on it if its
+// rollout fails. It must hold the application's deploy lock.
+func progressBlueGreen(service k8score.Service, k8sClient kubernetes.Interface) error {
+	spec := createBlueGreenAppSpec(service)
+	color := service.Annotations[PendingColorAnnotation]
+
+	deployment, err := getExistingDeployment(createColorName(spec, color), spec.Namespace, k8sClient)
+	if err != nil {
+		return err
+	}
+	if deployment == nil {
+		return abortBlueGreen(spec, "deployment not found", k8sClient)
+	}
+
+	switch status, view := deploymentStatusAndView(*deployment); status {
+	case Success:
+		return switchColor(spec, color, k8sClient)
+	case Failed:
+		glog.Infof("Not switching %s in %s to %s: %s", spec.Application, spec.Namespace, color, view.Reason)
+		return abortBlueGreen(spec, view.Reason, k8sClient)
+	default:
+		return nil
+	}
+}
+
+// rollbackBlueGreen switches the service back to the previous color, which has been kept running
+func rollbackBlueGreen(spec app.Spec, k8sClient kubernetes.Interface) (RollbackResult, error) {
+	result := RollbackResult{Application: spec.Application, Namespace: spec.Namespace}
+
+	service, err := getExistingAppService(spec, k8sClient)
+	if err != nil {
+		return result, fmt.Errorf("unable to get existing service: %s", err)
+	}
+	if service == nil || len(service.Annotations[PreviousColorAnnotation]) == 0 {
+		return result, errNoPreviousColor
+	}
+
+	previousColor := service.Annotations[PreviousColorAnnotation]
+	previous, err := getExistingDeployment(createColorName(spec, previousColor), spec.Namespace, k8sClient)
+	if err != nil {
+		return result, fmt.Errorf("unable to get %s deployment: %s", previousColor, err)
+	}
+	if previous == nil || previous.Status.AvailableReplicas == 0 {
+		return result, errNoPreviousColor
+	}
+
+	if err := switchColor(spec, previousColor, k8sClient); err != nil {
+		return result, err
+	}
+
+	result.ActiveColor = previousColor
+	result.PreviousColor = service.Annotations[ActiveColorAnnotation]
+	return result, nil
+}
+
+// deleteBlueGreenDeployments removes the deployments of both colors once the application has been deployed with
+// another strategy
+func deleteBlueGreenDeployments(spec app.Spec, k8sClient kubernetes.Interface) error {
+	for _, color := range []string{ColorBlue, ColorGreen} {
+		err := k8sClient.AppsV1().Deployments(spec.Namespace).Delete(context.TODO(), createColorName(spec, color), k8smeta.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// blueGreenDeploymentStatus reports the status of the deployment of the pending color, or of the active color when
+// nothing is pending. found is false for applications not using the BlueGreen strategy.
+func blueGreenDeploymentStatus(spec app.Spec, k8sClient kubernetes.Interface) (status DeployStatus, view DeploymentStatusView, found bool, err error) {
+	service, err := getExistingAppService(spec, k8sClient)
+	if err != nil || service == nil {
+		return Failed, view, false, err
+	}
+
+	colors := &BlueGreenStatusView{
+		ActiveColor:   service.Annotations[ActiveColorAnnotation],
+		PendingColor:  service.Annotations[PendingColorAnnotation],
+		PreviousColor: service.Annotations[PreviousColorAnnotation],
+	}
+
+	_, aborted := service.Annotations[BlueGreenAbortedAnnotation]
+
+	// Until the service has been switched to a color, the deployment from before the BlueGreen strategy serves traffic
+	deploymentName := spec.ResourceName()
+	if len(colors.PendingColor) > 0 {
+		deploymentName = createColorName(spec, colors.PendingColor)
+	} else if len(colors.ActiveColor) > 0 {
+		deploymentName = createColorName(spec, colors.ActiveColor)
+	} else if !aborted {
+		return Failed, view, false, nil
+	}
+
+	deployment, err := getExistingDeployment(deploymentName, spec.Namespace, k8sClient)
+	if err != nil {
+		return Failed, view, true, err
+	}
+	if deployment == nil {
+		return Failed, view, true, fmt.Errorf("did not find deployment: %s namespace: %s", deploymentName, spec.Namespace)
+	}
+
+	status, view = deploymentStatusAndView(*deployment)
+	view.BlueGreen = colors
+
+	if len(colors.PendingColor) > 0 && status == Success {
+		status = InProgress
+		view.Status = status.String()
+		view.Reason = fmt.Sprintf("%s is available, waiting for the service to be switched to it", deployment.Name)
+	} else if aborted && len(colors.PendingColor) == 0 {
+		status = Failed
+		view.Status = status.String()
+		view.Reason = fmt.Sprintf("service was not switched to %s", service.Annotations[BlueGreenAbortedAnnotation])
+	}
+
+	return status, view, true, nil
+}
+
+// BlueGreenController switches services to the pending color of applications using the BlueGreen strategy. It must
+// only run in one naisd replica, and is registered as a leader task when leader election is enabled.
+type BlueGreenController struct {
+	client   kubernetes.Interface
+	identity string
+}
+
+// NewBlueGreenController creates a controller holding the deploy locks it takes as identity, typically the pod name
+func NewBlueGreenController(client kubernetes.Interface, identity string) *BlueGreenController {
+	return &BlueGreenController{client: client, identity: identity + "/bluegreen-controller"}
+}
+
+// Run checks the pending colors every blueGreenCheckInterval until ctx is done
+func (c *BlueGreenController) Run(ctx context.Context) {
+	runEvery(ctx, blueGreenCheckInterval, "blue/green deployments", c.reconcile)
+}
+
+func (c *BlueGreenController) reconcile(_ time.Time) error {
+	services, err := c.client.CoreV1().Services("").List(context.TODO(), k8smeta.ListOptions{LabelSelector: createManagedSelector("")})
+	if err != nil {
+		return fmt.Errorf("unable to list services: %s", err)
+	}
+
+	for _, service := range services.Items {
+		if len(service.Annotations[PendingColorAnnotation]) == 0 || isBlueGreenRollingOut(service, c.client) {
+			continue
+		}
+
+		// The service is only switched while holding the deploy lock, and the pending color is read again under it,
+		// as a deploy may have started rolling a new version out to it since the service was listed
+		spec := createBlueGreenAppSpec(service)
+		err := withDeployLock(spec, c.identity, service.Annotations[VersionAnnotation], c.client, func() error {
+			current, err := getExistingAppService(spec, c.client)
+			if err != nil || current == nil || len(current.Annotations[PendingColorAnnotation]) == 0 {
+				return err
+			}
+			return progressBlueGreen(*current, c.client)
+		})
+
+		if _, locked := err.(DeployLockedError); locked {
+			glog.Infof("Not switching %s in %s while it is being deployed: %s", service.Name, service.Namespace, err)
+		} else if err != nil {
+			glog.Errorf("Failed while switching %s in %s: %s", service.Name, service.Namespace, err)
+		}
+	}
+
+	return nil
+}
+
+// isBlueGreenRollingOut is true while the deployment of the pending color is still rolling out, which
+// progressBlueGreen leaves alone
+func isBlueGreenRollingOut(service k8score.Service, k8sClient kubernetes.Interface) bool {
+	spec := createBlueGreenAppSpec(service)
+	deployment, err := getExistingDeployment(createColorName(spec, service.Annotations[PendingColorAnnotation]), spec.Namespace, k8sClient)
+	if err != nil || deployment == nil {
+		return false
+	}
+
+	status, _ := deploymentStatusAndView(*deployment)
+	return status == InProgress
+}
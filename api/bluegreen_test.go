@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newBlueGreenManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.DeploymentStrategy = DeploymentStrategyBlueGreen
+	return manifest
+}
+
+func TestCreateOrUpdateBlueGreenDeployment(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newBlueGreenManifest()
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2"}
+
+	t.Run("the new version is deployed to the inactive color and marked as pending", func(t *testing.T) {
+		service := createServiceDef(spec)
+		fillServiceSpec(spec, &service.Spec, ColorBlue)
+		service.Annotations = map[string]string{ActiveColorAnnotation: ColorBlue}
+		blue, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, request, ColorBlue, 3, nil, false)
+		clientset := fake.NewSimpleClientset(service, blue)
+
+		green, err := createOrUpdateBlueGreenDeployment(spec, request, manifest, []NaisResource{}, false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-green", green.Name)
+		assert.Equal(t, int32(3), *green.Spec.Replicas)
+		assert.Equal(t, ColorGreen, green.Spec.Selector.MatchLabels[ColorLabel])
+		assert.Equal(t, ColorGreen, green.Spec.Template.Labels[ColorLabel])
+		assert.Equal(t, appName, green.Spec.Template.Labels["app"])
+
+		existingService, _ := getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, existingService.Spec.Selector[ColorLabel])
+		assert.Equal(t, ColorGreen, existingService.Annotations[PendingColorAnnotation])
+	})
+
+	t.Run("the first color gets no traffic or autoscaler before the service is switched to it", func(t *testing.T) {
+		service := createServiceDef(spec)
+		service.ResourceVersion = resourceVersion
+		fillServiceSpec(spec, &service.Spec, "")
+		legacy, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1"}, nil, false)
+		pod := &k8score.Pod{ObjectMeta: k8smeta.ObjectMeta{Name: appName + "-abc12", Namespace: namespace, Labels: createPodSelector(spec)}}
+		autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil)
+		autoscaler.ResourceVersion = resourceVersion
+		clientset := fake.NewSimpleClientset(service, legacy, pod, autoscaler)
+
+		blue, err := createOrUpdateBlueGreenDeployment(spec, request, manifest, []NaisResource{}, false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-blue", blue.Name)
+
+		existingService, _ := getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorLegacy, existingService.Spec.Selector[ColorLabel])
+		assert.Equal(t, ColorBlue, existingService.Annotations[PendingColorAnnotation])
+
+		existingLegacy, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, ColorLegacy, existingLegacy.Spec.Template.Labels[ColorLabel])
+		existingPod, _ := clientset.CoreV1().Pods(namespace).Get(context.TODO(), pod.Name, k8smeta.GetOptions{})
+		assert.Equal(t, ColorLegacy, existingPod.Labels[ColorLabel])
+
+		existingAutoscaler, err := createOrUpdateAutoscaler(spec, manifest, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName, existingAutoscaler.Spec.ScaleTargetRef.Name)
+
+		redeployedService, err := createOrUpdateService(spec, manifest, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, ColorLegacy, redeployedService.Spec.Selector[ColorLabel], "redeploys keep the service pinned")
+	})
+
+	t.Run("the service must exist before deploying a color", func(t *testing.T) {
+		_, err := createOrUpdateBlueGreenDeployment(spec, request, manifest, []NaisResource{}, false, fake.NewSimpleClientset())
+		assert.Error(t, err)
+	})
+}
+
+func TestProgressBlueGreen(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newBlueGreenManifest()
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2"}
+
+	setup := func() (*fake.Clientset, *k8sapps.Deployment) {
+		service := createServiceDef(spec)
+		fillServiceSpec(spec, &service.Spec, "")
+		service.Annotations = map[string]string{PendingColorAnnotation: ColorBlue}
+		legacy, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1"}, nil, false)
+		blue, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, request, ColorBlue, 2, nil, false)
+		autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil)
+		return fake.NewSimpleClientset(service, legacy, blue, autoscaler), blue
+	}
+
+	t.Run("a pending color that is still rolling out is left alone", func(t *testing.T) {
+		clientset, _ := setup()
+		service, _ := getExistingAppService(spec, clientset)
+		assert.NoError(t, progressBlueGreen(*service, clientset))
+
+		service, _ = getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, service.Annotations[PendingColorAnnotation])
+		assert.NotContains(t, service.Spec.Selector, ColorLabel)
+	})
+
+	t.Run("an available color gets the traffic, the autoscaler and replaces the old deployment", func(t *testing.T) {
+		clientset, blue := setup()
+		clientset.AppsV1().Deployments(namespace).Update(context.TODO(), markRolledOut(blue), k8smeta.UpdateOptions{})
+		service, _ := getExistingAppService(spec, clientset)
+		assert.NoError(t, progressBlueGreen(*service, clientset))
+
+		service, _ = getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, service.Spec.Selector[ColorLabel])
+		assert.Equal(t, ColorBlue, service.Annotations[ActiveColorAnnotation])
+		assert.NotContains(t, service.Annotations, PendingColorAnnotation)
+
+		autoscaler, _ := getExistingAutoscaler(spec, clientset)
+		assert.Equal(t, appName+"-blue", autoscaler.Spec.ScaleTargetRef.Name)
+
+		legacy, _ := getExistingAppDeployment(spec, clientset)
+		assert.Nil(t, legacy)
+	})
+
+	t.Run("a color whose rollout fails is not switched to", func(t *testing.T) {
+		clientset, blue := setup()
+		blue.Status.Conditions = []k8sapps.DeploymentCondition{{Type: k8sapps.DeploymentProgressing, Reason: "ProgressDeadlineExceeded"}}
+		clientset.AppsV1().Deployments(namespace).Update(context.TODO(), blue, k8smeta.UpdateOptions{})
+		service, _ := getExistingAppService(spec, clientset)
+		assert.NoError(t, progressBlueGreen(*service, clientset))
+
+		service, _ = getExistingAppService(spec, clientset)
+		assert.NotContains(t, service.Annotations, PendingColorAnnotation)
+		assert.NotContains(t, service.Spec.Selector, ColorLabel)
+		assert.Contains(t, service.Annotations[BlueGreenAbortedAnnotation], "exceeded its progress deadline")
+
+		legacy, _ := getExistingAppDeployment(spec, clientset)
+		assert.NotNil(t, legacy)
+
+		status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Failed, status)
+		assert.Contains(t, view.Reason, "service was not switched to blue")
+	})
+
+	t.Run("the controller only switches the service while no deploy holds the deploy lock", func(t *testing.T) {
+		clientset, blue := setup()
+		clientset.AppsV1().Deployments(namespace).Update(context.TODO(), markRolledOut(blue), k8smeta.UpdateOptions{})
+		controller := NewBlueGreenController(clientset, "naisd-0")
+		deployRequest := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "3", CorrelationID: "deploy-3"}
+
+		assert.NoError(t, acquireDeployLock(spec, deployRequest, clientset))
+		assert.NoError(t, controller.reconcile(time.Now()))
+		service, _ := getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, service.Annotations[PendingColorAnnotation])
+
+		assert.NoError(t, releaseDeployLock(spec, deployRequest, clientset))
+		assert.NoError(t, controller.reconcile(time.Now()))
+		service, _ = getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, service.Annotations[ActiveColorAnnotation])
+
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+	})
+}
+
+func TestRollbackBlueGreen(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newBlueGreenManifest()
+
+	setup := func(annotations map[string]string) *fake.Clientset {
+		service := createServiceDef(spec)
+		fillServiceSpec(spec, &service.Spec, ColorGreen)
+		service.Annotations = annotations
+		blue, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Version: "1"}, ColorBlue, 2, nil, false)
+		green, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Version: "2"}, ColorGreen, 2, nil, false)
+		return fake.NewSimpleClientset(service, markRolledOut(blue), markRolledOut(green))
+	}
+
+	t.Run("the service is switched back to the previous color", func(t *testing.T) {
+		clientset := setup(map[string]string{ActiveColorAnnotation: ColorGreen, PreviousColorAnnotation: ColorBlue})
+
+		status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Success, status)
+		assert.Equal(t, appName+"-green", view.Name)
+		assert.Equal(t, &BlueGreenStatusView{ActiveColor: ColorGreen, PreviousColor: ColorBlue}, view.BlueGreen)
+
+		result, err := rollbackBlueGreen(spec, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, ColorBlue, result.ActiveColor)
+		assert.Equal(t, ColorGreen, result.PreviousColor)
+
+		service, _ := getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorBlue, service.Spec.Selector[ColorLabel])
+		assert.Equal(t, ColorGreen, service.Annotations[PreviousColorAnnotation])
+	})
+
+	t.Run("there is nothing to roll back to before the second deploy", func(t *testing.T) {
+		clientset := setup(map[string]string{ActiveColorAnnotation: ColorGreen})
+
+		_, err := rollbackBlueGreen(spec, clientset)
+		assert.Equal(t, errNoPreviousColor, err)
+
+		api := Api{Clientset: clientset}
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/app/%s/%s/rollback", namespace, appName), nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+	})
+
+	t.Run("the rollback endpoint reports the colors", func(t *testing.T) {
+		api := Api{Clientset: setup(map[string]string{ActiveColorAnnotation: ColorGreen, PreviousColorAnnotation: ColorBlue})}
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/app/%s/%s/rollback", namespace, appName), nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var result RollbackResult
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		assert.Equal(t, ColorBlue, result.ActiveColor)
+	})
+
+	t.Run("an application being deployed is not rolled back", func(t *testing.T) {
+		clientset := setup(map[string]string{ActiveColorAnnotation: ColorGreen, PreviousColorAnnotation: ColorBlue})
+		assert.NoError(t, acquireDeployLock(spec, naisrequest.Deploy{Version: "3", CorrelationID: "deploy-3"}, clientset))
+
+		api := Api{Clientset: clientset}
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/app/%s/%s/rollback", namespace, appName), nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusConflict, rr.Code)
+		assert.Contains(t, rr.Body.String(), "version 3 is currently being deployed")
+
+		service, _ := getExistingAppService(spec, clientset)
+		assert.Equal(t, ColorGreen, service.Annotations[ActiveColorAnnotation])
+	})
+}
+
+func TestListBlueGreenApplications(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newBlueGreenManifest()
+
+	service := createServiceDef(spec)
+	service.ObjectMeta = addLabelsToObjectMeta(service.ObjectMeta, spec)
+	service.Annotations = map[string]string{ActiveColorAnnotation: ColorGreen, PendingColorAnnotation: ColorBlue}
+	blue, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Version: "3"}, ColorBlue, 2, nil, false)
+	green, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Version: "2"}, ColorGreen, 2, nil, false)
+
+	applications, err := listApplications("", "", fake.NewSimpleClientset(service, blue, green))
+	assert.NoError(t, err)
+	assert.Len(t, applications, 1)
+	assert.Equal(t, appName, applications[0].Name)
+	assert.Equal(t, "2", applications[0].Version)
+}
@@ -0,0 +1,382 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	k8sapps "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	CanaryTrackLabel         = "nais.io/track"
+	CanaryTrack              = "canary"
+	CanaryStartedAnnotation  = "nais.io/canary-started"
+	CanaryBakeTimeAnnotation = "nais.io/canary-bake-time"
+	CanaryAbortedAnnotation  = "nais.io/canary-aborted"
+	canaryCheckInterval      = 15 * time.Second
+)
+
+// Canary configures the Canary deployment strategy. The new version runs next to the current one on a share of the
+// replicas, and replaces it if it stays healthy for the bake time.
+type Canary struct {
+	ReplicaPercentage int    `yaml:"replicaPercentage"`
+	BakeTime          string `yaml:"bakeTime"`
+}
+
+// CanaryStatusView shows the progress of a canary in the deploy status
+type CanaryStatusView struct {
+	Name         string
+	Version      string
+	Desired      int32
+	Available    int32
+	Status       string
+	Reason       string
+	Started      time.Time
+	PromoteAfter time.Time
+}
+
+func createCanaryName(spec app.Spec) string {
+	return spec.ResourceName() + "-canary"
+}
+
+// canaryReplicas is the share of the main deployment's replicas running the canary, and at least one unless the main
+// deployment is scaled to zero
+func canaryReplicas(mainReplicas int32, replicaPercentage int) int32 {
+	if mainReplicas < 1 {
+		return 0
+	}
+
+	replicas := int32(math.Ceil(float64(mainReplicas) * float64(replicaPercentage) / 100))
+	if replicas < 1 {
+		return 1
+	}
+	return replicas
+}
+
+// createCanaryDeploymentDef creates the deployment running the new version next to the main deployment. Its pods
+// carry the application's labels, so the application's service sends them a share of the traffic matching their
+// share of the replicas, and a track label telling them apart from the main deployment's pods.
+func createCanaryDeploymentDef(spec app.Spec, naisResources []NaisResource, manifest NaisManifest, deploymentRequest naisrequest.Deploy, mainDeployment *k8sapps.Deployment, existingCanary *k8sapps.Deployment, istioEnabled bool, now time.Time) (*k8sapps.Deployment, error) {
+	deploymentSpec, err := createDeploymentSpec(spec, deploymentRequest, manifest, naisResources, istioEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	mainReplicas := int32(1)
+	if mainDeployment.Spec.Replicas != nil {
+		mainReplicas = *mainDeployment.Spec.Replicas
+	}
+
+	// The canary of a paused application is paused too, and gets its share of the replicas when it is resumed
+	paused := isPaused(mainDeployment.ObjectMeta)
+	if paused {
+		mainReplicas = *resumeReplicas(mainDeployment.ObjectMeta.DeepCopy())
+	}
+
+	deploymentSpec.Replicas = int32p(canaryReplicas(mainReplicas, manifest.Canary.ReplicaPercentage))
+	deploymentSpec.Selector.MatchLabels[CanaryTrackLabel] = CanaryTrack
+	deploymentSpec.Template.Labels[CanaryTrackLabel] = CanaryTrack
+
+	canary := existingCanary
+	if canary == nil {
+		canary = &k8sapps.Deployment{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "Deployment",
+				APIVersion: "apps/v1",
+			},
+			ObjectMeta: createObjectMeta(createCanaryName(spec), spec.Namespace),
+		}
+	}
+
+	canary.ObjectMeta = addLabelsToObjectMeta(canary.ObjectMeta, spec)
+	canary.Labels[CanaryTrackLabel] = CanaryTrack
+	if canary.Annotations == nil {
+		canary.Annotations = make(map[string]string, 3)
+	}
+	canary.Annotations[CanaryStartedAnnotation] = now.UTC().Format(time.RFC3339)
+	canary.Annotations[CanaryBakeTimeAnnotation] = manifest.Canary.BakeTime
+	canary.Annotations[DeployedAtAnnotation] = now.UTC().Format(time.RFC3339)
+	canary.Spec = deploymentSpec
+	if paused {
+		canary = pauseDeployment(canary)
+	}
+
+	return canary, nil
+}
+
+// createOrUpdateCanaryDeployment starts a canary of the new version, or restarts the bake time of the running one.
+// It returns nil if the application has no main deployment yet, which is then deployed as usual.
+func createOrUpdateCanaryDeployment(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
+	mainDeployment, err := getExistingAppDeployment(spec, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing deployment: %s", err)
+	}
+	if mainDeployment == nil {
+		return nil, nil
+	}
+
+	existingCanary, err := getExistingDeployment(createCanaryName(spec), spec.Namespace, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing canary deployment: %s", err)
+	}
+
+	canaryDef, err := createCanaryDeploymentDef(spec, naisResources, manifest, deploymentRequest, mainDeployment, existingCanary, istioEnabled, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("unable to create canary deployment: %s", err)
+	}
+
+	return createOrUpdateDeploymentResource(canaryDef, spec.Namespace, k8sClient)
+}
+
+// deleteCanaryDeployment removes a canary left running when the application is deployed with another strategy
+func deleteCanaryDeployment(spec app.Spec, k8sClient kubernetes.Interface) error {
+	err := k8sClient.AppsV1().Deployments(spec.Namespace).Delete(context.TODO(), createCanaryName(spec), k8smeta.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func getExistingCanary(spec app.Spec, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
+	return getExistingDeployment(createCanaryName(spec), spec.Namespace, k8sClient)
+}
+
+// canaryTimes reads when the canary was started and when it may be promoted
+func canaryTimes(canary k8sapps.Deployment) (started, promoteAfter time.Time, err error) {
+	started, err = time.Parse(time.RFC3339, canary.Annotations[CanaryStartedAnnotation])
+	if err != nil {
+		return started, promoteAfter, fmt.Errorf("canary %s has no valid start time: %s", canary.Name, err)
+	}
+
+	bakeTime, err := time.ParseDuration(canary.Annotations[CanaryBakeTimeAnnotation])
+	if err != nil {
+		return started, promoteAfter, fmt.Errorf("canary %s has no valid bake time: %s", canary.Name, err)
+	}
+
+	return started, started.Add(bakeTime), nil
+}
+
+func createCanaryStatusView(canary k8sapps.Deployment) *CanaryStatusView {
+	status, view := deploymentStatusAndView(canary)
+	started, promoteAfter, _ := canaryTimes(canary)
+
+	return &CanaryStatusView{
+		Name:         canary.Name,
+		Version:      canary.Annotations[VersionAnnotation],
+		Desired:      view.Desired,
+		Available:    view.Available,
+		Status:       status.String(),
+		Reason:       view.Reason,
+		Started:      started,
+		PromoteAfter: promoteAfter,
+	}
+}
+
+// canaryDeploymentStatus combines the status of the main deployment with that of a running canary. A deploy with
+// the Canary strategy is in progress until the canary has been promoted and the main deployment has rolled out, and
+// has failed if the canary is unhealthy or was rolled back.
+func canaryDeploymentStatus(status DeployStatus, view DeploymentStatusView, main k8sapps.Deployment, canary *k8sapps.Deployment) (DeployStatus, DeploymentStatusView) {
+	if canary == nil {
+		if reason, aborted := main.Annotations[CanaryAbortedAnnotation]; aborted {
+			view.Status = Failed.String()
+			view.Reason = fmt.Sprintf("canary was rolled back: %s", reason)
+			return Failed, view
+		}
+		return status, view
+	}
+
+	view.Canary = createCanaryStatusView(*canary)
+	if view.Canary.Status == Failed.String() {
+		view.Status = Failed.String()
+		view.Reason = fmt.Sprintf("canary %s failed and will be rolled back: %s", canary.Name, view.Canary.Reason)
+		return Failed, view
+	}
+
+	view.Status = InProgress.String()
+	view.Reason = fmt.Sprintf("canary %s is baking, it is promoted if it is healthy after %s", canary.Name, view.Canary.PromoteAfter.Format(time.RFC3339))
+	return InProgress, view
+}
+
+// CanaryController promotes or rolls back canaries when their bake time is over. It must only run in one naisd
+// replica, and is registered as a leader task when leader election is enabled.
+type CanaryController struct {
+	client   kubernetes.Interface
+	identity string
+}
+
+// NewCanaryController creates a controller holding the deploy locks it takes as identity, typically the pod name
+func NewCanaryController(client kubernetes.Interface, identity string) *CanaryController {
+	return &CanaryController{client: client, identity: identity + "/canary-controller"}
+}
+
+// Run checks the canaries every canaryCheckInterval until ctx is done
+func (c *CanaryController) Run(ctx context.Context) {
+	runEvery(ctx, canaryCheckInterval, "canaries", c.reconcile)
+}
+
+func (c *CanaryController) reconcile(now time.Time) error {
+	selector := labels.Set{ManagedByLabel: ManagedByNaisd, CanaryTrackLabel: CanaryTrack}.String()
+	canaries, err := c.client.AppsV1().Deployments("").List(context.TODO(), k8smeta.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("unable to list canary deployments: %s", err)
+	}
+
+	for _, canary := range canaries.Items {
+		if isCanaryBaking(canary, now) {
+			continue
+		}
+
+		// The main deployment is only changed while holding the deploy lock, and the canary is read again under it,
+		// as a deploy may have replaced or removed it since it was listed
+		spec := createCanaryAppSpec(canary)
+		err := withDeployLock(spec, c.identity, canary.Annotations[VersionAnnotation], c.client, func() error {
+			current, err := getExistingCanary(spec, c.client)
+			if err != nil || current == nil {
+				return err
+			}
+			return progressCanary(*current, now, c.client)
+		})
+
+		if _, locked := err.(DeployLockedError); locked {
+			glog.Infof("Not progressing canary %s in %s while it is being deployed: %s", canary.Name, canary.Namespace, err)
+		} else if err != nil {
+			glog.Errorf("Failed while progressing canary %s in %s: %s", canary.Name, canary.Namespace, err)
+		}
+	}
+
+	return nil
+}
+
+func createCanaryAppSpec(canary k8sapps.Deployment) app.Spec {
+	return app.Spec{Application: canary.Labels["app"], Namespace: canary.Namespace, Team: canary.Labels["team"]}
+}
+
+// isCanaryBaking is true for a canary that has not failed and whose bake time is not over, which progressCanary
+// leaves alone
+func isCanaryBaking(canary k8sapps.Deployment, now time.Time) bool {
+	if status, _ := deploymentStatusAndView(canary); status == Failed {
+		return false
+	}
+
+	_, promoteAfter, err := canaryTimes(canary)
+	return err == nil && now.Before(promoteAfter)
+}
+
+// progressCanary rolls back a canary as soon as it fails. When its bake time is over, a healthy canary is promoted
+// and one that is still not healthy is rolled back.
+func progressCanary(canary k8sapps.Deployment, now time.Time, k8sClient kubernetes.Interface) error {
+	spec := createCanaryAppSpec(canary)
+	status, view := deploymentStatusAndView(canary)
+
+	if status == Failed {
+		return rollbackCanary(spec, canary, view.Reason, k8sClient)
+	}
+
+	_, promoteAfter, err := canaryTimes(canary)
+	if err != nil {
+		return rollbackCanary(spec, canary, err.Error(), k8sClient)
+	}
+
+	if now.Before(promoteAfter) {
+		return nil
+	}
+
+	if status != Success {
+		return rollbackCanary(spec, canary, fmt.Sprintf("not healthy after the bake time: %s", view.Reason), k8sClient)
+	}
+
+	return promoteCanary(spec, canary, k8sClient)
+}
+
+// promoteCanary rolls the canary's pod template out to the main deployment and removes the canary
+func promoteCanary(spec app.Spec, canary k8sapps.Deployment, k8sClient kubernetes.Interface) error {
+	err := retryOnConflict(func() error {
+		main, err := getExistingAppDeployment(spec, k8sClient)
+		if err != nil {
+			return err
+		}
+		if main == nil {
+			return fmt.Errorf("deployment %s not found in %s", spec.ResourceName(), spec.Namespace)
+		}
+
+		if main.Annotations == nil {
+			main.Annotations = make(map[string]string, 3)
+		}
+		main.Spec.Template = *canary.Spec.Template.DeepCopy()
+		delete(main.Spec.Template.Labels, CanaryTrackLabel)
+
+		for _, annotation := range []string{VersionAnnotation, CorrelationIDAnnotation, DeployedAtAnnotation} {
+			if value, ok := canary.Annotations[annotation]; ok {
+				main.Annotations[annotation] = value
+			}
+		}
+		delete(main.Annotations, CanaryAbortedAnnotation)
+
+		_, err = k8sClient.AppsV1().Deployments(spec.Namespace).Update(context.TODO(), main, k8smeta.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to promote canary: %s", err)
+	}
+
+	glog.Infof("Promoted canary of %s version %s in %s", spec.Application, canary.Annotations[VersionAnnotation], spec.Namespace)
+	return deleteCanaryDeployment(spec, k8sClient)
+}
+
+// rollbackCanary removes the canary and records why on the main deployment, which still runs the previous version
+func rollbackCanary(spec app.Spec, canary k8sapps.Deployment, reason string, k8sClient kubernetes.Interface) error {
+	aborted := fmt.Sprintf("version %s: %s", canary.Annotations[VersionAnnotation], reason)
+
+	err := retryOnConflict(func() error {
+		main, err := getExistingAppDeployment(spec, k8sClient)
+		if err != nil || main == nil {
+			return err
+		}
+
+		if main.Annotations == nil {
+			main.Annotations = make(map[string]string, 1)
+		}
+		main.Annotations[CanaryAbortedAnnotation] = aborted
+
+		_, err = k8sClient.AppsV1().Deployments(spec.Namespace).Update(context.TODO(), main, k8smeta.UpdateOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to record canary rollback: %s", err)
+	}
+
+	glog.Infof("Rolled back canary of %s in %s, %s", spec.Application, spec.Namespace, aborted)
+	return deleteCanaryDeployment(spec, k8sClient)
+}
+
+func validateCanary(manifest NaisManifest) *ValidationError {
+	if manifest.DeploymentStrategy != DeploymentStrategyCanary {
+		return nil
+	}
+
+	if manifest.Canary.ReplicaPercentage < 1 || manifest.Canary.ReplicaPercentage > 100 {
+		return &ValidationError{
+			ErrorMessage: "Canary.ReplicaPercentage must be between 1 and 100",
+			Fields:       map[string]string{"Canary.ReplicaPercentage": strconv.Itoa(manifest.Canary.ReplicaPercentage)},
+		}
+	}
+
+	if bakeTime, err := time.ParseDuration(manifest.Canary.BakeTime); err != nil || bakeTime <= 0 {
+		return &ValidationError{
+			ErrorMessage: "Canary.BakeTime must be a positive duration, e.g. 10m",
+			Fields:       map[string]string{"Canary.BakeTime": manifest.Canary.BakeTime},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8sapps "k8s.io/api/apps/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+	"time"
+)
+
+func newCanaryManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.DeploymentStrategy = DeploymentStrategyCanary
+	manifest.Canary = Canary{ReplicaPercentage: 25, BakeTime: "10m"}
+	return manifest
+}
+
+// markRolledOut gives a deployment the status of a completed, healthy rollout
+func markRolledOut(deployment *k8sapps.Deployment) *k8sapps.Deployment {
+	deployment.Status.Replicas = *deployment.Spec.Replicas
+	deployment.Status.UpdatedReplicas = *deployment.Spec.Replicas
+	deployment.Status.AvailableReplicas = *deployment.Spec.Replicas
+	return deployment
+}
+
+func TestCanaryReplicas(t *testing.T) {
+	assert.Equal(t, int32(1), canaryReplicas(2, 10))
+	assert.Equal(t, int32(1), canaryReplicas(4, 25))
+	assert.Equal(t, int32(2), canaryReplicas(5, 25))
+	assert.Equal(t, int32(4), canaryReplicas(4, 100))
+	assert.Equal(t, int32(0), canaryReplicas(0, 25))
+}
+
+func TestCreateOrUpdateCanaryDeployment(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newCanaryManifest()
+	oldRequest := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1"}
+	newRequest := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2"}
+
+	t.Run("the first deploy has nothing to compare a canary with and creates no canary", func(t *testing.T) {
+		canary, err := createOrUpdateCanaryDeployment(spec, newRequest, manifest, []NaisResource{}, false, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Nil(t, canary)
+	})
+
+	t.Run("the new version runs in a canary next to the untouched main deployment", func(t *testing.T) {
+		main, _ := createDeploymentDef(spec, []NaisResource{}, manifest, oldRequest, nil, false)
+		main.Spec.Replicas = int32p(4)
+		clientset := fake.NewSimpleClientset(main)
+
+		canary, err := createOrUpdateCanaryDeployment(spec, newRequest, manifest, []NaisResource{}, false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-canary", canary.Name)
+		assert.Equal(t, int32(1), *canary.Spec.Replicas)
+		assert.Equal(t, image+":2", canary.Spec.Template.Spec.Containers[0].Image)
+		assert.Equal(t, CanaryTrack, canary.Spec.Selector.MatchLabels[CanaryTrackLabel])
+		assert.Equal(t, appName, canary.Spec.Template.Labels["app"])
+		assert.Equal(t, "10m", canary.Annotations[CanaryBakeTimeAnnotation])
+
+		existingMain, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, image+":1", existingMain.Spec.Template.Spec.Containers[0].Image)
+	})
+
+	t.Run("the canary of a paused application starts no pods until it is resumed", func(t *testing.T) {
+		main, _ := createDeploymentDef(spec, []NaisResource{}, manifest, oldRequest, nil, false)
+		main.Spec.Replicas = int32p(8)
+		main = pauseDeployment(main)
+		clientset := fake.NewSimpleClientset(main)
+
+		canary, err := createOrUpdateCanaryDeployment(spec, newRequest, manifest, []NaisResource{}, false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), *canary.Spec.Replicas)
+		assert.True(t, isPaused(canary.ObjectMeta))
+		assert.Equal(t, "2", canary.Annotations[PausedReplicasAnnotation])
+	})
+}
+
+func TestProgressCanary(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newCanaryManifest()
+	started := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+
+	setup := func() (*fake.Clientset, *k8sapps.Deployment) {
+		main, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1"}, nil, false)
+		spec := spec
+		spec.Version = "2"
+		canary, _ := createCanaryDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2"}, main, nil, false, started)
+		return fake.NewSimpleClientset(main, canary), canary
+	}
+
+	t.Run("a healthy canary keeps baking until the bake time is over", func(t *testing.T) {
+		clientset, canary := setup()
+		assert.NoError(t, progressCanary(*markRolledOut(canary), started.Add(5*time.Minute), clientset))
+
+		existingCanary, _ := getExistingCanary(spec, clientset)
+		assert.NotNil(t, existingCanary)
+	})
+
+	t.Run("a healthy canary is promoted after the bake time", func(t *testing.T) {
+		clientset, canary := setup()
+		assert.NoError(t, progressCanary(*markRolledOut(canary), started.Add(11*time.Minute), clientset))
+
+		existingCanary, _ := getExistingCanary(spec, clientset)
+		assert.Nil(t, existingCanary)
+
+		main, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, image+":2", main.Spec.Template.Spec.Containers[0].Image)
+		assert.NotContains(t, main.Spec.Template.Labels, CanaryTrackLabel)
+		assert.Equal(t, "2", main.Annotations[VersionAnnotation])
+	})
+
+	t.Run("a canary that is not healthy after the bake time is rolled back", func(t *testing.T) {
+		clientset, canary := setup()
+		assert.NoError(t, progressCanary(*canary, started.Add(11*time.Minute), clientset))
+
+		existingCanary, _ := getExistingCanary(spec, clientset)
+		assert.Nil(t, existingCanary)
+
+		main, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, image+":1", main.Spec.Template.Spec.Containers[0].Image)
+		assert.Contains(t, main.Annotations[CanaryAbortedAnnotation], "version 2: not healthy after the bake time")
+	})
+
+	t.Run("the status shows the canary while it bakes, and the rollback afterwards", func(t *testing.T) {
+		clientset, canary := setup()
+		viewer := NewDeploymentStatusViewer(clientset)
+
+		status, view, err := viewer.DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, InProgress, status)
+		assert.Equal(t, appName+"-canary", view.Canary.Name)
+		assert.Equal(t, "2", view.Canary.Version)
+		assert.Equal(t, started.Add(10*time.Minute), view.Canary.PromoteAfter)
+
+		assert.NoError(t, rollbackCanary(spec, *canary, "crashing", clientset))
+
+		status, view, err = viewer.DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Failed, status)
+		assert.Nil(t, view.Canary)
+		assert.Equal(t, "canary was rolled back: version 2: crashing", view.Reason)
+	})
+}
+
+func TestCanaryControllerTakesDeployLock(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	manifest := newCanaryManifest()
+	started := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	deployRequest := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "3", CorrelationID: "deploy-3"}
+
+	main, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1"}, nil, false)
+	canarySpec := spec
+	canarySpec.Version = "2"
+	canary, _ := createCanaryDeploymentDef(canarySpec, []NaisResource{}, manifest, naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2"}, main, nil, false, started)
+	clientset := fake.NewSimpleClientset(main, markRolledOut(canary))
+	controller := NewCanaryController(clientset, "naisd-0")
+
+	t.Run("a canary is left alone while the application is being deployed", func(t *testing.T) {
+		assert.NoError(t, acquireDeployLock(spec, deployRequest, clientset))
+		assert.NoError(t, controller.reconcile(started.Add(11*time.Minute)))
+
+		existingCanary, _ := getExistingCanary(spec, clientset)
+		assert.NotNil(t, existingCanary)
+	})
+
+	t.Run("a canary is promoted under the deploy lock once the deploy is done", func(t *testing.T) {
+		assert.NoError(t, releaseDeployLock(spec, deployRequest, clientset))
+		assert.NoError(t, controller.reconcile(started.Add(11*time.Minute)))
+
+		existingCanary, _ := getExistingCanary(spec, clientset)
+		assert.Nil(t, existingCanary)
+
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+		assert.Equal(t, "2", lease.Annotations[VersionAnnotation])
+	})
+}
+
+func TestValidateCanary(t *testing.T) {
+	manifest := newCanaryManifest()
+	assert.Nil(t, validateCanary(manifest))
+
+	manifest.Canary.ReplicaPercentage = 0
+	assert.Equal(t, "Canary.ReplicaPercentage must be between 1 and 100", validateCanary(manifest).ErrorMessage)
+
+	manifest.Canary = Canary{ReplicaPercentage: 10, BakeTime: "soon"}
+	assert.Equal(t, "Canary.BakeTime must be a positive duration, e.g. 10m", validateCanary(manifest).ErrorMessage)
+
+	manifest.DeploymentStrategy = DeploymentStrategyRollingUpdate
+	assert.Nil(t, validateCanary(manifest))
+}
@@ -0,0 +1,220 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/prometheus/common/model"
+)
+
+// The names of the default alerts, which are used to silence them
+const (
+	DefaultAlertUnavailableReplicas = "UnavailableReplicas"
+	DefaultAlertCrashLooping        = "CrashLooping"
+	DefaultAlertOOMKilled           = "OOMKilled"
+	DefaultAlertHighErrorRate       = "HighErrorRate"
+	DefaultAlertRedisDown           = "RedisDown"
+
+	defaultAlertUnavailableFor      = "5m"
+	defaultAlertRestarts            = 3
+	defaultAlertErrorRatePercentage = 5
+	defaultAlertErrorRateMetric     = "http_requests_total"
+)
+
+var defaultAlertNames = []string{
+	DefaultAlertUnavailableReplicas,
+	DefaultAlertCrashLooping,
+	DefaultAlertOOMKilled,
+	DefaultAlertHighErrorRate,
+	DefaultAlertRedisDown,
+}
+
+// Alerts are the application's own alert rules, and the standard alerts naisd generates for it when Defaults is set.
+// The alerts of older manifests are a list of rules, which is read as Rules.
+type Alerts struct {
+	Defaults   bool
+	Thresholds DefaultAlertThresholds
+	Silenced   []string
+	Rules      []PrometheusAlertRule
+	Receivers  AlertReceivers
+}
+
+// DefaultAlertThresholds tune the default alerts. Thresholds that are not set use the defaults.
+type DefaultAlertThresholds struct {
+	// UnavailableFor is how long replicas can be unavailable before UnavailableReplicas fires
+	UnavailableFor string `yaml:"unavailableFor"`
+	// Restarts is how many times a container can restart in 30 minutes before CrashLooping fires
+	Restarts int
+	// ErrorRatePercentage is the share of requests answered with a 5xx status that fires HighErrorRate
+	ErrorRatePercentage int `yaml:"errorRatePercentage"`
+	// ErrorRateMetric is the counter of requests with a code label the application exposes to Prometheus
+	ErrorRateMetric string `yaml:"errorRateMetric"`
+}
+
+func (a *Alerts) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var rules []PrometheusAlertRule
+	if err := unmarshal(&rules); err == nil {
+		*a = Alerts{Rules: rules}
+		return nil
+	}
+
+	type alerts Alerts
+	return unmarshal((*alerts)(a))
+}
+
+func updateDefaultAlertThresholds(thresholds DefaultAlertThresholds) DefaultAlertThresholds {
+	if thresholds.UnavailableFor == "" {
+		thresholds.UnavailableFor = defaultAlertUnavailableFor
+	}
+	if thresholds.Restarts == 0 {
+		thresholds.Restarts = defaultAlertRestarts
+	}
+	if thresholds.ErrorRatePercentage == 0 {
+		thresholds.ErrorRatePercentage = defaultAlertErrorRatePercentage
+	}
+	if thresholds.ErrorRateMetric == "" {
+		thresholds.ErrorRateMetric = defaultAlertErrorRateMetric
+	}
+	return thresholds
+}
+
+func defaultAlertSilenced(alerts Alerts, name string) bool {
+	for _, silenced := range alerts.Silenced {
+		if silenced == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createDefaultAlertRules generates the default alerts that apply to the application's workload, Prometheus and
+// Redis settings, leaving out those that are silenced. Jobs serve no requests and have no replicas to be unavailable.
+func createDefaultAlertRules(spec app.Spec, manifest NaisManifest) []PrometheusAlertRule {
+	if !manifest.Alerts.Defaults {
+		return nil
+	}
+
+	thresholds := updateDefaultAlertThresholds(manifest.Alerts.Thresholds)
+	container := fmt.Sprintf(`container="%s", namespace="%s"`, spec.ResourceName(), spec.Namespace)
+	var rules []PrometheusAlertRule
+
+	switch {
+	case isStatefulSet(manifest):
+		statefulSet := fmt.Sprintf(`statefulset="%s", namespace="%s"`, spec.ResourceName(), spec.Namespace)
+		rules = append(rules, PrometheusAlertRule{
+			Alert:       DefaultAlertUnavailableReplicas,
+			Expr:        fmt.Sprintf("kube_statefulset_replicas{%s} - kube_statefulset_status_replicas_ready{%s} > 0", statefulSet, statefulSet),
+			For:         thresholds.UnavailableFor,
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"action": fmt.Sprintf("kubectl describe statefulset %s -n %s, kubectl describe pod %s-*", spec.ResourceName(), spec.Namespace, spec.ResourceName())},
+		})
+	case !isBatchWorkload(manifest):
+		// BlueGreen and Canary applications run as the deployments of their colors and canary, besides the deployment
+		// they had before changing strategy
+		rules = append(rules, PrometheusAlertRule{
+			Alert:       DefaultAlertUnavailableReplicas,
+			Expr:        fmt.Sprintf(`kube_deployment_status_replicas_unavailable{deployment=~"%s(-blue|-green|-canary)?", namespace="%s"} > 0`, spec.ResourceName(), spec.Namespace),
+			For:         thresholds.UnavailableFor,
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"action": fmt.Sprintf("kubectl describe deployment -l app=%s -n %s, kubectl describe pod %s-*", spec.ResourceName(), spec.Namespace, spec.ResourceName())},
+		})
+	}
+
+	rules = append(rules,
+		PrometheusAlertRule{
+			Alert:       DefaultAlertCrashLooping,
+			Expr:        fmt.Sprintf("increase(kube_pod_container_status_restarts_total{%s}[30m]) > %d", container, thresholds.Restarts),
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"action": fmt.Sprintf("kubectl logs --previous -l app=%s -n %s, kubectl describe pod %s-*", spec.ResourceName(), spec.Namespace, spec.ResourceName())},
+		},
+		PrometheusAlertRule{
+			Alert:       DefaultAlertOOMKilled,
+			Expr:        fmt.Sprintf(`kube_pod_container_status_last_terminated_reason{%s, reason="OOMKilled"} == 1 and on(namespace, pod, container) increase(kube_pod_container_status_restarts_total{%s}[10m]) > 0`, container, container),
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"action": "The container used more memory than its limit. Raise resources.limits.memory or reduce the memory used by the application"},
+		},
+	)
+
+	if manifest.Prometheus.Enabled && !isBatchWorkload(manifest) {
+		requests := fmt.Sprintf(`%s{app="%s", kubernetes_namespace="%s"`, thresholds.ErrorRateMetric, spec.ResourceName(), spec.Namespace)
+		rules = append(rules, PrometheusAlertRule{
+			Alert:       DefaultAlertHighErrorRate,
+			Expr:        fmt.Sprintf(`100 * sum(rate(%s, code=~"5.."}[5m])) / sum(rate(%s}[5m])) > %d`, requests, requests, thresholds.ErrorRatePercentage),
+			For:         "5m",
+			Labels:      map[string]string{"severity": "warning"},
+			Annotations: map[string]string{"action": fmt.Sprintf("More than %d%% of the requests to %s fail, check the logs of the application", thresholds.ErrorRatePercentage, spec.ResourceName())},
+		})
+	}
+
+	if manifest.Redis.Enabled {
+		expr := fmt.Sprintf(`kube_deployment_status_replicas_available{deployment="%s", namespace="%s"} == 0`, createRedisSpec(spec).ResourceName(), spec.Namespace)
+		if manifest.Redis.Mode == RedisModeFailover {
+			expr = fmt.Sprintf(`kube_statefulset_status_replicas_ready{statefulset="rfr-%s", namespace="%s"} == 0`, spec.ResourceName(), spec.Namespace)
+		}
+		rules = append(rules, PrometheusAlertRule{
+			Alert:       DefaultAlertRedisDown,
+			Expr:        expr,
+			For:         "1m",
+			Labels:      map[string]string{"severity": "critical"},
+			Annotations: map[string]string{"action": fmt.Sprintf("No Redis pods for %s are ready, kubectl describe pod -l app=%s -n %s", spec.ResourceName(), createRedisSpec(spec).ResourceName(), spec.Namespace)},
+		})
+	}
+
+	var unsilenced []PrometheusAlertRule
+	for _, rule := range rules {
+		if !defaultAlertSilenced(manifest.Alerts, rule.Alert) {
+			unsilenced = append(unsilenced, rule)
+		}
+	}
+
+	return unsilenced
+}
+
+// createAlertRules is the application's alert rules, following the default alerts
+func createAlertRules(spec app.Spec, manifest NaisManifest) []PrometheusAlertRule {
+	return append(createDefaultAlertRules(spec, manifest), manifest.Alerts.Rules...)
+}
+
+func validateDefaultAlerts(manifest NaisManifest) *ValidationError {
+	for _, silenced := range manifest.Alerts.Silenced {
+		found := false
+		for _, name := range defaultAlertNames {
+			found = found || silenced == name
+		}
+		if !found {
+			return &ValidationError{
+				ErrorMessage: "Alerts.Silenced must be the names of default alerts: " + strings.Join(defaultAlertNames, ", "),
+				Fields:       map[string]string{"Alerts.Silenced": silenced},
+			}
+		}
+	}
+
+	thresholds := manifest.Alerts.Thresholds
+	if _, err := model.ParseDuration(thresholds.UnavailableFor); thresholds.UnavailableFor != "" && err != nil {
+		return &ValidationError{
+			ErrorMessage: "Alerts.Thresholds.UnavailableFor must be a duration, e.g. 5m",
+			Fields:       map[string]string{"Alerts.Thresholds.UnavailableFor": thresholds.UnavailableFor},
+		}
+	}
+	if thresholds.Restarts < 0 {
+		return &ValidationError{
+			ErrorMessage: "Alerts.Thresholds.Restarts can not be negative",
+			Fields:       map[string]string{"Alerts.Thresholds.Restarts": fmt.Sprint(thresholds.Restarts)},
+		}
+	}
+	if thresholds.ErrorRatePercentage < 0 || thresholds.ErrorRatePercentage > 100 {
+		return &ValidationError{
+			ErrorMessage: "Alerts.Thresholds.ErrorRatePercentage must be between 0 and 100",
+			Fields:       map[string]string{"Alerts.Thresholds.ErrorRatePercentage": fmt.Sprint(thresholds.ErrorRatePercentage)},
+		}
+	}
+	if thresholds.ErrorRateMetric != "" && !model.IsValidMetricName(model.LabelValue(thresholds.ErrorRateMetric)) {
+		return &ValidationError{
+			ErrorMessage: "Alerts.Thresholds.ErrorRateMetric must be a metric name",
+			Fields:       map[string]string{"Alerts.Thresholds.ErrorRateMetric": thresholds.ErrorRateMetric},
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func alertNames(rules []PrometheusAlertRule) []string {
+	var names []string
+	for _, rule := range rules {
+		names = append(names, rule.Alert)
+	}
+	return names
+}
+
+func TestUnmarshalAlerts(t *testing.T) {
+	var manifest NaisManifest
+	err := yaml.Unmarshal([]byte(`
+alerts:
+  defaults: true
+  thresholds:
+    unavailableFor: 10m
+    restarts: 5
+  silenced:
+  - OOMKilled
+  rules:
+  - alert: down
+    expr: up == 0
+`), &manifest)
+	assert.NoError(t, err)
+	assert.True(t, manifest.Alerts.Defaults)
+	assert.Equal(t, "10m", manifest.Alerts.Thresholds.UnavailableFor)
+	assert.Equal(t, 5, manifest.Alerts.Thresholds.Restarts)
+	assert.Equal(t, []string{DefaultAlertOOMKilled}, manifest.Alerts.Silenced)
+	assert.Equal(t, "down", manifest.Alerts.Rules[0].Alert)
+
+	t.Run("the list of rules in older manifests is read as the rules", func(t *testing.T) {
+		var manifest NaisManifest
+		err := yaml.Unmarshal([]byte("alerts:\n- alert: down\n  expr: up == 0\n"), &manifest)
+		assert.NoError(t, err)
+		assert.False(t, manifest.Alerts.Defaults)
+		assert.Len(t, manifest.Alerts.Rules, 1)
+	})
+}
+
+func TestCreateDefaultAlertRules(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+
+	t.Run("no default alerts unless enabled", func(t *testing.T) {
+		assert.Empty(t, createDefaultAlertRules(spec, newDefaultManifest()))
+	})
+
+	t.Run("a deployment gets alerts for its replicas and containers", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Alerts.Defaults = true
+		manifest.Prometheus.Enabled = false
+
+		rules := createDefaultAlertRules(spec, manifest)
+		assert.Equal(t, []string{DefaultAlertUnavailableReplicas, DefaultAlertCrashLooping, DefaultAlertOOMKilled}, alertNames(rules))
+		assert.Equal(t, `kube_deployment_status_replicas_unavailable{deployment=~"appname(-blue|-green|-canary)?", namespace="`+namespace+`"} > 0`, rules[0].Expr)
+		assert.Equal(t, "5m", rules[0].For)
+		assert.Contains(t, rules[1].Expr, "[30m]) > 3")
+	})
+
+	t.Run("a BlueGreen deployment is alerted on for the deployments of both colors", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Alerts.Defaults = true
+		manifest.DeploymentStrategy = DeploymentStrategyBlueGreen
+
+		rules := createDefaultAlertRules(spec, manifest)
+		assert.Equal(t, DefaultAlertUnavailableReplicas, rules[0].Alert)
+		assert.Contains(t, rules[0].Expr, `deployment=~"appname(-blue|-green|-canary)?"`)
+		assert.Equal(t, "kubectl describe deployment -l app=appname -n "+namespace+", kubectl describe pod appname-*", rules[0].Annotations["action"])
+		assert.NoError(t, parseAlertExpr(rules[0].Expr))
+	})
+
+	t.Run("prometheus and redis add alerts on the error rate and redis, and all parse as PromQL", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Alerts.Defaults = true
+		manifest.Prometheus.Enabled = true
+		manifest.Redis = Redis{Enabled: true, Mode: RedisModeFailover}
+
+		rules := createDefaultAlertRules(spec, manifest)
+		assert.Equal(t, []string{DefaultAlertUnavailableReplicas, DefaultAlertCrashLooping, DefaultAlertOOMKilled, DefaultAlertHighErrorRate, DefaultAlertRedisDown}, alertNames(rules))
+		assert.Contains(t, rules[3].Expr, `http_requests_total{app="appname", kubernetes_namespace="`+namespace+`", code=~"5.."}`)
+		assert.Contains(t, rules[4].Expr, `statefulset="rfr-appname"`)
+
+		for _, rule := range rules {
+			assert.NoError(t, parseAlertExpr(rule.Expr), rule.Alert)
+			assert.NotEmpty(t, rule.Annotations["action"], rule.Alert)
+		}
+	})
+
+	t.Run("thresholds are tunable and defaults can be silenced", func(t *testing.T) {
+		manifest := newJobManifest(WorkloadJob)
+		manifest.Alerts = Alerts{
+			Defaults:   true,
+			Thresholds: DefaultAlertThresholds{Restarts: 10},
+			Silenced:   []string{DefaultAlertOOMKilled},
+		}
+
+		rules := createDefaultAlertRules(spec, manifest)
+		assert.Equal(t, []string{DefaultAlertCrashLooping}, alertNames(rules), "jobs have no replicas to be unavailable and serve no requests")
+		assert.Contains(t, rules[0].Expr, "[30m]) > 10")
+	})
+
+	t.Run("the default alerts are deployed with the application's own alerts", func(t *testing.T) {
+		manifest := newDefaultManifest()
+		manifest.Team = teamName
+		manifest.Alerts = Alerts{
+			Defaults: true,
+			Silenced: []string{DefaultAlertCrashLooping, DefaultAlertOOMKilled, DefaultAlertHighErrorRate},
+			Rules:    []PrometheusAlertRule{{Alert: "down", Expr: "up == 0"}},
+		}
+
+		alertGroup := createAlertGroup(spec, manifest)
+		prefix := createDeploymentPrefix(spec)
+		assert.Equal(t, []string{prefixAlertName(prefix, DefaultAlertUnavailableReplicas), prefixAlertName(prefix, "down")}, alertNames(alertGroup.Rules))
+		assert.Equal(t, teamName, alertGroup.Rules[0].Labels["team"])
+		assert.Equal(t, "down", manifest.Alerts.Rules[0].Alert, "the manifest is left as it is")
+	})
+}
+
+func TestValidateDefaultAlerts(t *testing.T) {
+	manifest := newDefaultManifest()
+	manifest.Alerts = Alerts{Defaults: true, Silenced: []string{DefaultAlertRedisDown}, Thresholds: DefaultAlertThresholds{UnavailableFor: "15m", ErrorRatePercentage: 1}}
+	assert.Nil(t, validateDefaultAlerts(manifest))
+
+	manifest.Alerts.Silenced = []string{"Everything"}
+	assert.Equal(t, "Alerts.Silenced must be the names of default alerts: UnavailableReplicas, CrashLooping, OOMKilled, HighErrorRate, RedisDown", validateDefaultAlerts(manifest).ErrorMessage)
+
+	manifest.Alerts.Silenced = nil
+	manifest.Alerts.Thresholds.UnavailableFor = "a while"
+	assert.NotNil(t, validateDefaultAlerts(manifest))
+
+	manifest.Alerts.Thresholds = DefaultAlertThresholds{ErrorRatePercentage: 101}
+	assert.NotNil(t, validateDefaultAlerts(manifest))
+
+	manifest.Alerts.Thresholds = DefaultAlertThresholds{ErrorRateMetric: "http requests"}
+	assert.NotNil(t, validateDefaultAlerts(manifest))
+}
@@ -5,6 +5,12 @@ const (
 	NavTruststoreFasitAlias         = "nav_truststore"
 	DeploymentStrategyRollingUpdate = "RollingUpdate"
 	DeploymentStrategyRecreate      = "Recreate"
+	DeploymentStrategyCanary        = "Canary"
+	DeploymentStrategyBlueGreen     = "BlueGreen"
+	WorkloadDeployment              = "Deployment"
+	WorkloadStatefulSet             = "StatefulSet"
+	WorkloadJob                     = "Job"
+	WorkloadCronJob                 = "CronJob"
 )
 
 func DefaultResourceRequests() []ResourceRequest {
@@ -25,8 +31,22 @@ func GetDefaultManifest(application string) NaisManifest {
 			Max:                    4,
 			CpuThresholdPercentage: 50,
 		},
+		Kind:               WorkloadDeployment,
 		Port:               8080,
 		DeploymentStrategy: DeploymentStrategyRollingUpdate,
+		StatefulSet: StatefulSet{
+			PodManagementPolicy: "OrderedReady",
+		},
+		Job: Job{
+			ConcurrencyPolicy:          "Forbid",
+			SuccessfulJobsHistoryLimit: 3,
+			FailedJobsHistoryLimit:     1,
+			BackoffLimit:               6,
+		},
+		Canary: Canary{
+			ReplicaPercentage: 10,
+			BakeTime:          "5m",
+		},
 		Prometheus: PrometheusConfig{
 			Enabled: false,
 			Port:    DefaultPortName,
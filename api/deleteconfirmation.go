@@ -0,0 +1,80 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
+)
+
+const (
+	EnvDeleteConfirmationRequired = "NAISD_DELETE_CONFIRMATION_REQUIRED"
+	EnvDeleteConfirmationKey      = "NAISD_DELETE_CONFIRMATION_KEY"
+	deleteConfirmationTTL         = 5 * time.Minute
+)
+
+func init() {
+	viper.BindEnv(EnvDeleteConfirmationRequired, EnvDeleteConfirmationRequired)
+	viper.SetDefault(EnvDeleteConfirmationRequired, false)
+	viper.BindEnv(EnvDeleteConfirmationKey, EnvDeleteConfirmationKey)
+}
+
+// deleteConfirmationRequired is set for production clusters, where deleting an app takes a dry run followed by a delete
+// presenting the confirmation token from the dry run
+func deleteConfirmationRequired() bool {
+	return viper.GetBool(EnvDeleteConfirmationRequired)
+}
+
+// ValidateDeleteConfirmationConfig fails when confirmation is required without a configured key. Tokens are signed
+// rather than stored, so a token handed out by one replica is only accepted by the others when they share the key.
+func ValidateDeleteConfirmationConfig() error {
+	if deleteConfirmationRequired() && len(viper.GetString(EnvDeleteConfirmationKey)) == 0 {
+		return fmt.Errorf("%s must be set when %s is true, so every replica accepts the same confirmation tokens", EnvDeleteConfirmationKey, EnvDeleteConfirmationRequired)
+	}
+
+	return nil
+}
+
+func deleteConfirmationKey() []byte {
+	return []byte(viper.GetString(EnvDeleteConfirmationKey))
+}
+
+func signDeleteConfirmation(spec app.Spec, expires int64) string {
+	mac := hmac.New(sha256.New, deleteConfirmationKey())
+	fmt.Fprintf(mac, "%s/%s/%d", spec.Namespace, spec.Application, expires)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// createDeleteConfirmationToken returns a token confirming the deletion of the application, valid for a few minutes
+func createDeleteConfirmationToken(spec app.Spec, now time.Time) string {
+	expires := now.Add(deleteConfirmationTTL).Unix()
+	return fmt.Sprintf("%d.%s", expires, signDeleteConfirmation(spec, expires))
+}
+
+func validateDeleteConfirmationToken(spec app.Spec, token string, now time.Time) error {
+	if len(token) == 0 {
+		return fmt.Errorf("no confirmation token given, get one from a dry run (?dryRun=true)")
+	}
+
+	parts := strings.SplitN(token, ".", 2)
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return fmt.Errorf("malformed confirmation token")
+	}
+
+	if !hmac.Equal([]byte(parts[1]), []byte(signDeleteConfirmation(spec, expires))) {
+		return fmt.Errorf("confirmation token is not valid for %s in %s", spec.Application, spec.Namespace)
+	}
+
+	if now.Unix() > expires {
+		return fmt.Errorf("confirmation token has expired, get a new one from a dry run (?dryRun=true)")
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestDeleteConfirmationToken(t *testing.T) {
+	viper.Set(EnvDeleteConfirmationKey, "shared-key")
+	defer viper.Set(EnvDeleteConfirmationKey, "")
+
+	spec := app.Spec{Application: appName, Namespace: namespace}
+	now := time.Now()
+	token := createDeleteConfirmationToken(spec, now)
+
+	t.Run("token is valid for the app it was created for", func(t *testing.T) {
+		assert.NoError(t, validateDeleteConfirmationToken(spec, token, now.Add(time.Minute)))
+	})
+
+	t.Run("token is not valid for another app", func(t *testing.T) {
+		otherSpec := app.Spec{Application: otherAppName, Namespace: namespace}
+		assert.EqualError(t, validateDeleteConfirmationToken(otherSpec, token, now), "confirmation token is not valid for otherappname in default")
+	})
+
+	t.Run("token expires", func(t *testing.T) {
+		err := validateDeleteConfirmationToken(spec, token, now.Add(deleteConfirmationTTL+time.Second))
+		assert.EqualError(t, err, "confirmation token has expired, get a new one from a dry run (?dryRun=true)")
+	})
+
+	t.Run("missing or malformed tokens are rejected", func(t *testing.T) {
+		assert.Error(t, validateDeleteConfirmationToken(spec, "", now))
+		assert.EqualError(t, validateDeleteConfirmationToken(spec, "garbage", now), "malformed confirmation token")
+		assert.EqualError(t, validateDeleteConfirmationToken(spec, "123", now), "malformed confirmation token")
+	})
+}
+
+func TestValidateDeleteConfirmationConfig(t *testing.T) {
+	assert.NoError(t, ValidateDeleteConfirmationConfig())
+
+	viper.Set(EnvDeleteConfirmationRequired, true)
+	defer viper.Set(EnvDeleteConfirmationRequired, false)
+	assert.EqualError(t, ValidateDeleteConfirmationConfig(), "NAISD_DELETE_CONFIRMATION_KEY must be set when NAISD_DELETE_CONFIRMATION_REQUIRED is true, so every replica accepts the same confirmation tokens")
+
+	viper.Set(EnvDeleteConfirmationKey, "shared-key")
+	defer viper.Set(EnvDeleteConfirmationKey, "")
+	assert.NoError(t, ValidateDeleteConfirmationConfig())
+}
@@ -0,0 +1,239 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	k8scoordination "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// A deploy lock left behind by a naisd instance that died mid-deploy is taken over once it has not been renewed
+	// for this long. The holder renews it every deployLockRenewInterval for as long as the deploy runs.
+	deployLockDuration      = 2 * time.Minute
+	deployLockRenewInterval = 30 * time.Second
+	// The rollback and pause endpoints hold the deploy lock as these while they change the application
+	rollbackLockHolder = "rollback-api"
+	pauseLockHolder    = "pause-api"
+)
+
+// DeployLockedError is returned when another deploy of the same application holds its deploy lock. Holders other
+// than deploys, such as a rollback, hold it without a version.
+type DeployLockedError struct {
+	Version string
+	Holder  string
+	Since   time.Time
+}
+
+func (e DeployLockedError) Error() string {
+	if len(e.Version) == 0 {
+		return fmt.Sprintf("the application is currently being changed by %s (started %s), retry when it has finished or force the deploy", e.Holder, e.Since.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("version %s is currently being deployed (started %s), retry when it has finished or force the deploy", e.Version, e.Since.Format(time.RFC3339))
+}
+
+func createDeployLockName(spec app.Spec) string {
+	return fmt.Sprintf("%s-deploy-lock", spec.ResourceName())
+}
+
+func createDeployLockedError(lease *k8scoordination.Lease) DeployLockedError {
+	lockedError := DeployLockedError{Version: lease.Annotations[VersionAnnotation]}
+	if lease.Spec.HolderIdentity != nil {
+		lockedError.Holder = *lease.Spec.HolderIdentity
+	}
+	if lease.Spec.AcquireTime != nil {
+		lockedError.Since = lease.Spec.AcquireTime.Time
+	}
+
+	return lockedError
+}
+
+func isDeployLockHeld(lease *k8scoordination.Lease, now time.Time) bool {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || len(*spec.HolderIdentity) == 0 || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return false
+	}
+
+	return now.Before(spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second))
+}
+
+func createDeployLockDef(spec app.Spec, deploymentRequest naisrequest.Deploy, existingLease *k8scoordination.Lease, now time.Time) *k8scoordination.Lease {
+	spec.Version = deploymentRequest.Version
+	spec.CorrelationID = deploymentRequest.CorrelationID
+
+	lease := existingLease
+	if lease == nil {
+		lease = &k8scoordination.Lease{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "Lease",
+				APIVersion: "coordination.k8s.io/v1",
+			},
+			ObjectMeta: createObjectMeta(createDeployLockName(spec), spec.Namespace),
+		}
+	}
+
+	lease.ObjectMeta = addLabelsToObjectMeta(lease.ObjectMeta, spec)
+
+	transitions := int32(0)
+	if lease.Spec.LeaseTransitions != nil {
+		transitions = *lease.Spec.LeaseTransitions + 1
+	}
+
+	holder := deploymentRequest.CorrelationID
+	duration := int32(deployLockDuration.Seconds())
+	acquired := k8smeta.NewMicroTime(now)
+	lease.Spec = k8scoordination.LeaseSpec{
+		HolderIdentity:       &holder,
+		LeaseDurationSeconds: &duration,
+		AcquireTime:          &acquired,
+		RenewTime:            &acquired,
+		LeaseTransitions:     &transitions,
+	}
+
+	return lease
+}
+
+func getExistingDeployLock(spec app.Spec, k8sClient kubernetes.Interface) (*k8scoordination.Lease, error) {
+	lease, err := k8sClient.CoordinationV1().Leases(spec.Namespace).Get(context.TODO(), createDeployLockName(spec), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return lease, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+// acquireDeployLock takes the application's deploy lock on behalf of the deploy identified by the request's correlation ID.
+// The lock is a Lease in the application's namespace, so it is shared by every naisd replica. A lock held by another
+// deploy is only taken over when it has expired or the request forces the deploy.
+func acquireDeployLock(spec app.Spec, deploymentRequest naisrequest.Deploy, k8sClient kubernetes.Interface) error {
+	existingLease, err := getExistingDeployLock(spec, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing deploy lock: %s", err)
+	}
+
+	if existingLease != nil && isDeployLockHeld(existingLease, time.Now()) {
+		if !deploymentRequest.Force {
+			return createDeployLockedError(existingLease)
+		}
+		glog.Warningf("Forcing deploy of %s:%s in %s while version %s is being deployed", spec.Application, deploymentRequest.Version, spec.Namespace, existingLease.Annotations[VersionAnnotation])
+	}
+
+	leaseInterface := k8sClient.CoordinationV1().Leases(spec.Namespace)
+	lease := createDeployLockDef(spec, deploymentRequest, existingLease, time.Now())
+	if existingLease != nil {
+		_, err = leaseInterface.Update(context.TODO(), lease, k8smeta.UpdateOptions{})
+	} else {
+		_, err = leaseInterface.Create(context.TODO(), lease, k8smeta.CreateOptions{})
+	}
+
+	// another deploy took the lock between our read and write
+	if errors.IsConflict(err) || errors.IsAlreadyExists(err) {
+		if currentLease, getErr := getExistingDeployLock(spec, k8sClient); getErr == nil && currentLease != nil {
+			return createDeployLockedError(currentLease)
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("unable to acquire deploy lock: %s", err)
+	}
+
+	return nil
+}
+
+// renewDeployLock extends the application's deploy lock while the deploy identified by the request's correlation ID
+// holds it. A lock that has been taken over by a forced deploy is left alone.
+func renewDeployLock(spec app.Spec, deploymentRequest naisrequest.Deploy, now time.Time, k8sClient kubernetes.Interface) error {
+	lease, err := getExistingDeployLock(spec, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing deploy lock: %s", err)
+	} else if lease == nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != deploymentRequest.CorrelationID {
+		return fmt.Errorf("deploy lock is no longer held by %s", deploymentRequest.CorrelationID)
+	}
+
+	renewed := k8smeta.NewMicroTime(now)
+	lease.Spec.RenewTime = &renewed
+
+	if _, err := k8sClient.CoordinationV1().Leases(spec.Namespace).Update(context.TODO(), lease, k8smeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("unable to renew deploy lock: %s", err)
+	}
+
+	return nil
+}
+
+// keepDeployLock renews the application's deploy lock in the background, so a deploy running longer than
+// deployLockDuration keeps it. The returned function stops renewing, and must be called before the lock is released.
+func keepDeployLock(spec app.Spec, deploymentRequest naisrequest.Deploy, k8sClient kubernetes.Interface) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(deployLockRenewInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := renewDeployLock(spec, deploymentRequest, now, k8sClient); err != nil {
+					glog.Warningf("Failed while renewing deploy lock for %s in %s: %s", spec.Application, spec.Namespace, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// releaseDeployLock gives up the application's deploy lock, unless it has been taken over by a forced deploy
+func releaseDeployLock(spec app.Spec, deploymentRequest naisrequest.Deploy, k8sClient kubernetes.Interface) error {
+	lease, err := getExistingDeployLock(spec, k8sClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing deploy lock: %s", err)
+	} else if lease == nil || lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != deploymentRequest.CorrelationID {
+		return nil
+	}
+
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.RenewTime = nil
+
+	if _, err := k8sClient.CoordinationV1().Leases(spec.Namespace).Update(context.TODO(), lease, k8smeta.UpdateOptions{}); err != nil {
+		return fmt.Errorf("unable to release deploy lock: %s", err)
+	}
+
+	return nil
+}
+
+// withDeployLock runs fn while a background controller identified by holder holds the application's deploy lock, so
+// it does not change the application while it is being deployed. It returns a DeployLockedError without running fn
+// when a deploy holds the lock.
+func withDeployLock(spec app.Spec, holder, version string, k8sClient kubernetes.Interface, fn func() error) error {
+	lockRequest := naisrequest.Deploy{Application: spec.Application, Namespace: spec.Namespace, Version: version, CorrelationID: holder}
+	if err := acquireDeployLock(spec, lockRequest, k8sClient); err != nil {
+		return err
+	}
+	stopRenewing := keepDeployLock(spec, lockRequest, k8sClient)
+	defer func() {
+		stopRenewing()
+		if err := releaseDeployLock(spec, lockRequest, k8sClient); err != nil {
+			glog.Errorf("Failed while releasing deploy lock for %s in %s: %s", spec.Application, spec.Namespace, err)
+		}
+	}()
+
+	return fn()
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDeployLock(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	firstDeploy := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "1", CorrelationID: "first"}
+	secondDeploy := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2", CorrelationID: "second"}
+
+	t.Run("lock is created for the first deploy", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		lease, err := getExistingDeployLock(spec, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-deploy-lock", lease.Name)
+		assert.Equal(t, "first", *lease.Spec.HolderIdentity)
+		assert.Equal(t, "1", lease.Annotations[VersionAnnotation])
+		assert.Equal(t, ManagedByNaisd, lease.Labels[ManagedByLabel])
+	})
+
+	t.Run("a concurrent deploy is refused with the version being deployed", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		err := acquireDeployLock(spec, secondDeploy, clientset)
+
+		assert.IsType(t, DeployLockedError{}, err)
+		assert.Equal(t, "1", err.(DeployLockedError).Version)
+		assert.Contains(t, err.Error(), "version 1 is currently being deployed")
+	})
+
+	t.Run("a lock held by something other than a deploy names its holder", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, naisrequest.Deploy{CorrelationID: rollbackLockHolder}, clientset))
+
+		err := acquireDeployLock(spec, secondDeploy, clientset)
+		assert.Contains(t, err.Error(), "the application is currently being changed by rollback-api")
+	})
+
+	t.Run("a forced deploy takes over the lock", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		forcedDeploy := secondDeploy
+		forcedDeploy.Force = true
+		assert.NoError(t, acquireDeployLock(spec, forcedDeploy, clientset))
+
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.Equal(t, "second", *lease.Spec.HolderIdentity)
+		assert.Equal(t, int32(1), *lease.Spec.LeaseTransitions)
+
+		// the overridden deploy must not release the forced deploy's lock
+		assert.NoError(t, releaseDeployLock(spec, firstDeploy, clientset))
+		lease, _ = getExistingDeployLock(spec, clientset)
+		assert.Equal(t, "second", *lease.Spec.HolderIdentity)
+	})
+
+	t.Run("released lock can be acquired by the next deploy", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+		assert.NoError(t, releaseDeployLock(spec, firstDeploy, clientset))
+
+		assert.NoError(t, acquireDeployLock(spec, secondDeploy, clientset))
+	})
+
+	t.Run("expired lock is taken over", func(t *testing.T) {
+		expiredLease := createDeployLockDef(spec, firstDeploy, nil, time.Now().Add(-deployLockDuration-time.Minute))
+		clientset := fake.NewSimpleClientset(expiredLease)
+
+		assert.NoError(t, acquireDeployLock(spec, secondDeploy, clientset))
+	})
+
+	t.Run("a renewed lock is still held after the lock duration", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		renewed := time.Now().Add(deployLockDuration)
+		assert.NoError(t, renewDeployLock(spec, firstDeploy, renewed, clientset))
+
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.True(t, isDeployLockHeld(lease, renewed.Add(deployLockDuration-time.Second)))
+		assert.False(t, isDeployLockHeld(lease, renewed.Add(deployLockDuration+time.Second)))
+	})
+
+	t.Run("a lock taken over by a forced deploy is not renewed", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		forcedDeploy := secondDeploy
+		forcedDeploy.Force = true
+		assert.NoError(t, acquireDeployLock(spec, forcedDeploy, clientset))
+
+		assert.Error(t, renewDeployLock(spec, firstDeploy, time.Now(), clientset))
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.Equal(t, "second", *lease.Spec.HolderIdentity)
+	})
+
+	t.Run("renewing stops before the lock is released", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		assert.NoError(t, acquireDeployLock(spec, firstDeploy, clientset))
+
+		stopRenewing := keepDeployLock(spec, firstDeploy, clientset)
+		stopRenewing()
+		assert.NoError(t, releaseDeployLock(spec, firstDeploy, clientset))
+
+		lease, _ := getExistingDeployLock(spec, clientset)
+		assert.Nil(t, lease.Spec.HolderIdentity)
+	})
+}
@@ -16,10 +16,13 @@ import (
 func NewDeploymentEvent(request naisrequest.Deploy, manifest NaisManifest, clusterName string) deployment.Event {
 	image := ContainerImage(fmt.Sprintf("%s:%s", manifest.Image, request.Version))
 	ts := convertTimestamp(time.Now())
-	id := uuid.NewUUID()
+	id := request.CorrelationID
+	if len(id) == 0 {
+		id = string(uuid.NewUUID())
+	}
 
 	return deployment.Event{
-		CorrelationID: string(id),
+		CorrelationID: id,
 		Platform: &deployment.Platform{
 			Type: deployment.PlatformType_nais,
 		},
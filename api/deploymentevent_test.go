@@ -128,4 +128,10 @@ func TestNewDeploymentEvent(t *testing.T) {
 		assert.Equal(t, deployment.Environment_production, event.GetEnvironment())
 	})
 
+	t.Run("Correlation ID from the request is reused", func(t *testing.T) {
+		deploymentRequest.CorrelationID = "correlation-id"
+		event := api.NewDeploymentEvent(deploymentRequest, manifest, "test-cluster")
+		assert.Equal(t, "correlation-id", event.GetCorrelationID())
+	})
+
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/nais/naisd/api/app"
@@ -48,14 +49,37 @@ func NewDeploymentStatusViewer(clientset kubernetes.Interface) DeploymentStatusV
 func (d deploymentStatusViewerImpl) DeploymentStatusView(namespace, deployName string) (DeployStatus, DeploymentStatusView, error) {
 	// First, check new namespace
 	spec := app.Spec{Application: deployName, Namespace: namespace}
-	dep, err := d.client.AppsV1().Deployments(spec.Namespace).Get(spec.ResourceName(), k8smeta.GetOptions{})
+
+	if status, view, found, err := blueGreenDeploymentStatus(spec, d.client); found || err != nil {
+		return status, view, err
+	}
+
+	dep, err := d.client.AppsV1().Deployments(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
 	if err != nil {
+		if statefulSet, err := getExistingStatefulSet(spec, d.client); err != nil {
+			return Failed, DeploymentStatusView{}, fmt.Errorf("unable to get statefulset: %s", err)
+		} else if statefulSet != nil {
+			status, view := statefulSetStatusAndView(*statefulSet)
+			return status, view, nil
+		}
+
+		if status, view, found, err := batchWorkloadStatus(spec, d.client); found || err != nil {
+			return status, view, err
+		}
+
 		errMess := fmt.Sprintf("did not find deployment: %s namespace: %s", deployName, namespace)
 		glog.Error(errMess)
 		return Failed, DeploymentStatusView{}, fmt.Errorf("did not find deployment: %s namespace: %s", deployName, namespace)
 	}
 
 	status, view := deploymentStatusAndView(*dep)
+
+	canary, err := getExistingCanary(spec, d.client)
+	if err != nil {
+		return Failed, view, fmt.Errorf("unable to get canary deployment: %s", err)
+	}
+
+	status, view = canaryDeploymentStatus(status, view, *dep, canary)
 	return status, view, nil
 
 }
@@ -70,6 +94,8 @@ type DeploymentStatusView struct {
 	Images     []string
 	Status     string
 	Reason     string
+	Canary     *CanaryStatusView    `json:",omitempty"`
+	BlueGreen  *BlueGreenStatusView `json:",omitempty"`
 }
 
 func deploymentStatusViewFrom(status DeployStatus, reason string, deployment k8sapps.Deployment) DeploymentStatusView {
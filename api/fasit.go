@@ -84,6 +84,7 @@ type FasitClientAdapter interface {
 	GetScopedResources(resourcesRequests []ResourceRequest, fasitEnvironment string, application string, zone string) (resources []NaisResource, err error)
 	getLoadBalancerConfig(application string, fasitEnvironment string) (*NaisResource, error)
 	createApplicationInstance(deploymentRequest naisrequest.Deploy, fasitEnvironment, subDomain string, exposedResourceIds, usedResourceIds []int) error
+	deleteApplicationInstance(application, fasitEnvironment string) error
 }
 
 type FasitResource struct {
@@ -201,6 +202,45 @@ func (fasit FasitClient) createApplicationInstance(deploymentRequest naisrequest
 	return nil
 }
 
+func (fasit FasitClient) getApplicationInstanceId(application, fasitEnvironment string) (int, error) {
+	req, err := fasit.buildRequest("GET", fmt.Sprintf("/api/v2/applicationinstances/environment/%s/application/%s", fasitEnvironment, application), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	body, appErr := fasit.doRequest(req)
+	if appErr != nil {
+		return 0, appErr
+	}
+
+	var applicationInstance struct {
+		Id int `json:"id"`
+	}
+	if err := json.Unmarshal(body, &applicationInstance); err != nil {
+		return 0, fmt.Errorf("unable to read application instance from response: %s", err)
+	}
+
+	return applicationInstance.Id, nil
+}
+
+func (fasit FasitClient) deleteApplicationInstance(application, fasitEnvironment string) error {
+	id, err := fasit.getApplicationInstanceId(application, fasitEnvironment)
+	if err != nil {
+		return err
+	}
+
+	req, err := fasit.buildRequest("DELETE", fmt.Sprintf("/api/v2/applicationinstances/%d", id), nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(fasit.Username, fasit.Password)
+
+	if _, appErr := fasit.doRequest(req); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
 func (fasit FasitClient) getLoadBalancerConfig(application string, fasitEnvironment string) (*NaisResource, error) {
 	req, err := fasit.buildRequest("GET", "/api/v2/resources", map[string]string{
 		"environment": fasitEnvironment,
@@ -335,6 +335,10 @@ func (fasit FakeFasitClient) createApplicationInstance(deploymentRequest naisreq
 	return nil
 }
 
+func (fasit FakeFasitClient) deleteApplicationInstance(application, fasitEnvironment string) error {
+	return nil
+}
+
 func TestCreateOrUpdateFasitResources(t *testing.T) {
 
 	alias := "alias1"
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
+	k8snetworkingv1beta1 "k8s.io/api/networking/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EnvIngressAllowedDomains = "NAISD_INGRESS_ALLOWED_DOMAINS"
+	IngressClassAnnotation   = "kubernetes.io/ingress.class"
+	ClusterIssuerAnnotation  = "cert-manager.io/cluster-issuer"
+	ConnectTimeoutAnnotation = "nginx.ingress.kubernetes.io/proxy-connect-timeout"
+	ReadTimeoutAnnotation    = "nginx.ingress.kubernetes.io/proxy-read-timeout"
+	SendTimeoutAnnotation    = "nginx.ingress.kubernetes.io/proxy-send-timeout"
+	MaxBodySizeAnnotation    = "nginx.ingress.kubernetes.io/proxy-body-size"
+	AllowedSourcesAnnotation = "nginx.ingress.kubernetes.io/whitelist-source-range"
+)
+
+// The body size is given the way the ingress controller takes it, in bytes or with a k, m or g suffix
+var bodySizePattern = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+
+func init() {
+	viper.BindEnv(EnvIngressAllowedDomains, EnvIngressAllowedDomains)
+}
+
+// IngressHost is a host the application is reachable on in addition to the cluster's own hostname
+type IngressHost struct {
+	Host  string
+	Paths []string
+}
+
+// IngressTLS terminates TLS for the application's hosts with the certificate in SecretName. With a ClusterIssuer,
+// cert-manager issues the certificate and keeps it in the secret.
+type IngressTLS struct {
+	SecretName    string `yaml:"secretName"`
+	ClusterIssuer string `yaml:"clusterIssuer"`
+}
+
+type IngressTimeouts struct {
+	Connect string
+	Read    string
+	Send    string
+}
+
+// allowedIngressDomains are the domains hosts in the manifest may be under in this cluster, in addition to the
+// cluster's own subdomain
+func allowedIngressDomains(clusterSubdomain string) []string {
+	domains := []string{clusterSubdomain}
+
+	for _, domain := range strings.Split(viper.GetString(EnvIngressAllowedDomains), ",") {
+		if domain = strings.TrimSpace(domain); len(domain) > 0 {
+			domains = append(domains, domain)
+		}
+	}
+
+	return domains
+}
+
+// validateIngressDomains is checked when deploying rather than in ValidateManifest, as the allowed domains depend
+// on the cluster the manifest is deployed to
+func validateIngressDomains(manifest NaisManifest, clusterSubdomain string) error {
+	domains := allowedIngressDomains(clusterSubdomain)
+
+	for _, host := range manifest.Ingress.Hosts {
+		if !hostInDomains(host.Host, domains) {
+			return fmt.Errorf("ingress host %s is not in any of the domains allowed in this cluster: %s", host.Host, strings.Join(domains, ", "))
+		}
+	}
+
+	return nil
+}
+
+func hostInDomains(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func createManifestIngressRules(spec app.Spec, manifest NaisManifest) []k8snetworkingv1beta1.IngressRule {
+	var ingressRules []k8snetworkingv1beta1.IngressRule
+
+	for _, host := range manifest.Ingress.Hosts {
+		if len(host.Paths) == 0 {
+			ingressRules = append(ingressRules, createIngressRule(spec.ResourceName(), host.Host, ""))
+		}
+		for _, path := range host.Paths {
+			ingressRules = append(ingressRules, createIngressRule(spec.ResourceName(), host.Host, path))
+		}
+	}
+
+	return ingressRules
+}
+
+// createIngressTLS covers the hosts from the manifest. The cluster's own hostname is served with the ingress
+// controller's default certificate.
+func createIngressTLS(spec app.Spec, manifest NaisManifest) []k8snetworkingv1beta1.IngressTLS {
+	tls := manifest.Ingress.TLS
+	if (len(tls.SecretName) == 0 && len(tls.ClusterIssuer) == 0) || len(manifest.Ingress.Hosts) == 0 {
+		return nil
+	}
+
+	secretName := tls.SecretName
+	if len(secretName) == 0 {
+		secretName = spec.ResourceName() + "-tls"
+	}
+
+	var hosts []string
+	for _, host := range manifest.Ingress.Hosts {
+		hosts = append(hosts, host.Host)
+	}
+
+	return []k8snetworkingv1beta1.IngressTLS{{Hosts: hosts, SecretName: secretName}}
+}
+
+func addIngressSettingsToAnnotations(annotations map[string]string, ingress Ingress) map[string]string {
+	if len(ingress.Class) > 0 {
+		annotations[IngressClassAnnotation] = ingress.Class
+	}
+	if len(ingress.TLS.ClusterIssuer) > 0 {
+		annotations[ClusterIssuerAnnotation] = ingress.TLS.ClusterIssuer
+	}
+	if len(ingress.MaxBodySize) > 0 {
+		annotations[MaxBodySizeAnnotation] = ingress.MaxBodySize
+	}
+	if len(ingress.AllowedSources) > 0 {
+		annotations[AllowedSourcesAnnotation] = strings.Join(ingress.AllowedSources, ",")
+	}
+
+	// The ingress controller takes its timeouts in seconds
+	for annotation, timeout := range map[string]string{
+		ConnectTimeoutAnnotation: ingress.Timeouts.Connect,
+		ReadTimeoutAnnotation:    ingress.Timeouts.Read,
+		SendTimeoutAnnotation:    ingress.Timeouts.Send,
+	} {
+		if duration, err := time.ParseDuration(timeout); err == nil {
+			annotations[annotation] = strconv.Itoa(int(duration.Seconds()))
+		}
+	}
+
+	return annotations
+}
+
+func validateIngress(manifest NaisManifest) *ValidationError {
+	ingress := manifest.Ingress
+
+	for _, host := range ingress.Hosts {
+		fields := map[string]string{"Host": host.Host, "Paths": strings.Join(host.Paths, ", ")}
+
+		if len(validation.IsDNS1123Subdomain(host.Host)) > 0 {
+			return &ValidationError{ErrorMessage: "Ingress.Hosts must be valid hostnames", Fields: fields}
+		}
+		for _, path := range host.Paths {
+			if !strings.HasPrefix(path, "/") {
+				return &ValidationError{ErrorMessage: "Ingress.Hosts must have paths starting with /", Fields: fields}
+			}
+			if strings.ContainsAny(path, " ?#") {
+				return &ValidationError{ErrorMessage: "Ingress.Hosts must have paths without spaces, queries or fragments", Fields: fields}
+			}
+		}
+	}
+
+	if len(ingress.TLS.SecretName) > 0 && len(validation.IsDNS1123Subdomain(ingress.TLS.SecretName)) > 0 {
+		return &ValidationError{
+			ErrorMessage: "Ingress.TLS.SecretName must be a valid secret name",
+			Fields:       map[string]string{"Ingress.TLS.SecretName": ingress.TLS.SecretName},
+		}
+	}
+
+	for name, timeout := range map[string]string{"Ingress.Timeouts.Connect": ingress.Timeouts.Connect, "Ingress.Timeouts.Read": ingress.Timeouts.Read, "Ingress.Timeouts.Send": ingress.Timeouts.Send} {
+		if len(timeout) == 0 {
+			continue
+		}
+		if duration, err := time.ParseDuration(timeout); err != nil || duration < time.Second {
+			return &ValidationError{ErrorMessage: "Ingress.Timeouts must be durations of at least a second, e.g. 60s", Fields: map[string]string{name: timeout}}
+		}
+	}
+
+	if len(ingress.MaxBodySize) > 0 {
+		if !bodySizePattern.MatchString(ingress.MaxBodySize) {
+			return &ValidationError{
+				ErrorMessage: "Ingress.MaxBodySize must be a size, e.g. 8m",
+				Fields:       map[string]string{"Ingress.MaxBodySize": ingress.MaxBodySize},
+			}
+		}
+	}
+
+	for _, source := range ingress.AllowedSources {
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return &ValidationError{
+				ErrorMessage: "Ingress.AllowedSources must be CIDR ranges, e.g. 10.0.0.0/8",
+				Fields:       map[string]string{"Ingress.AllowedSources": source},
+			}
+		}
+	}
+
+	return nil
+}
+
+// IngressConflictError is returned when a host and path the application would be served on is already routed to
+// another application
+type IngressConflictError struct {
+	Host        string
+	Path        string
+	Application string
+	Namespace   string
+}
+
+func (e IngressConflictError) Error() string {
+	return fmt.Sprintf("%s%s is already used by %s in %s", e.Host, e.Path, e.Application, e.Namespace)
+}
+
+// checkIngressConflicts compares the rules the application would get with those of every other ingress naisd manages
+// in the cluster. Only identical host and path pairs conflict, as nested paths are routed to the longest matching
+// prefix.
+func checkIngressConflicts(spec app.Spec, rules []k8snetworkingv1beta1.IngressRule, k8sClient kubernetes.Interface) error {
+	// Ingresses created before naisd labelled its objects as managed only carry the app and environment labels,
+	// which naisd has always set, so those are what the ingresses are selected by
+	ingresses, err := k8sClient.NetworkingV1beta1().Ingresses("").List(context.TODO(), k8smeta.ListOptions{LabelSelector: "app,environment"})
+	if err != nil {
+		return fmt.Errorf("unable to list ingresses: %s", err)
+	}
+
+	claimed := make(map[string]k8snetworkingv1beta1.Ingress)
+	for _, ingress := range ingresses.Items {
+		if ingress.Namespace == spec.Namespace && ingress.Name == spec.ResourceName() {
+			continue
+		}
+		for _, hostPath := range ingressHostPaths(ingress.Spec.Rules) {
+			claimed[hostPath] = ingress
+		}
+	}
+
+	for _, rule := range rules {
+		for _, path := range rule.HTTP.Paths {
+			if owner, found := claimed[createHostPath(rule.Host, path.Path)]; found {
+				return IngressConflictError{Host: rule.Host, Path: path.Path, Application: owner.Labels["app"], Namespace: owner.Namespace}
+			}
+		}
+	}
+
+	return nil
+}
+
+func ingressHostPaths(rules []k8snetworkingv1beta1.IngressRule) []string {
+	var hostPaths []string
+
+	for _, rule := range rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			hostPaths = append(hostPaths, createHostPath(rule.Host, path.Path))
+		}
+	}
+
+	return hostPaths
+}
+
+// A trailing slash does not make a path distinct
+func createHostPath(host, path string) string {
+	return strings.ToLower(host) + "/" + strings.Trim(path, "/")
+}
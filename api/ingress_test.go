@@ -0,0 +1,156 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/constant"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	k8snetworkingv1beta1 "k8s.io/api/networking/v1beta1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newIngressManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Ingress = Ingress{
+		Hosts: []IngressHost{
+			{Host: "myapp.example.no", Paths: []string{"/api", "/internal"}},
+			{Host: "www.myapp.example.no"},
+		},
+		TLS:            IngressTLS{ClusterIssuer: "letsencrypt"},
+		Class:          "nginx",
+		Timeouts:       IngressTimeouts{Read: "2m"},
+		MaxBodySize:    "8m",
+		AllowedSources: []string{"10.0.0.0/8", "192.168.1.0/24"},
+	}
+	return manifest
+}
+
+func TestCreateOrUpdateIngressFromManifest(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: "default", Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: "default"}
+
+	ingress, err := createOrUpdateIngress(spec, newIngressManifest(), request, "nais.example.no", []NaisResource{}, fake.NewSimpleClientset())
+	assert.NoError(t, err)
+
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		hosts = append(hosts, rule.Host+rule.HTTP.Paths[0].Path)
+	}
+	assert.Equal(t, []string{"appname.nais.example.no/", "myapp.example.no/api", "myapp.example.no/internal", "www.myapp.example.no/"}, hosts)
+
+	assert.Len(t, ingress.Spec.TLS, 1)
+	assert.Equal(t, "appname-tls", ingress.Spec.TLS[0].SecretName)
+	assert.Equal(t, []string{"myapp.example.no", "www.myapp.example.no"}, ingress.Spec.TLS[0].Hosts)
+
+	assert.Equal(t, "nginx", ingress.Annotations[IngressClassAnnotation])
+	assert.Equal(t, "letsencrypt", ingress.Annotations[ClusterIssuerAnnotation])
+	assert.Equal(t, "120", ingress.Annotations[ReadTimeoutAnnotation])
+	assert.NotContains(t, ingress.Annotations, ConnectTimeoutAnnotation)
+	assert.Equal(t, "8m", ingress.Annotations[MaxBodySizeAnnotation])
+	assert.Equal(t, "10.0.0.0/8,192.168.1.0/24", ingress.Annotations[AllowedSourcesAnnotation])
+
+	t.Run("a preview only gets its own hostname", func(t *testing.T) {
+		request := request
+		request.Preview = "1"
+		preview := app.Spec{Application: request.DeployName(), Namespace: "default", Team: teamName}
+
+		ingress, err := createOrUpdateIngress(preview, newIngressManifest(), request, "nais.example.no", []NaisResource{}, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Len(t, ingress.Spec.Rules, 1)
+		assert.Empty(t, ingress.Spec.TLS)
+	})
+}
+
+func TestValidateIngressDomains(t *testing.T) {
+	manifest := newIngressManifest()
+	assert.Error(t, validateIngressDomains(manifest, "nais.example.no"))
+
+	viper.Set(EnvIngressAllowedDomains, "example.com, example.no")
+	defer viper.Set(EnvIngressAllowedDomains, "")
+	assert.NoError(t, validateIngressDomains(manifest, "nais.example.no"))
+
+	manifest.Ingress.Hosts = []IngressHost{{Host: "myapp.nais.example.no"}, {Host: "notexample.no"}}
+	assert.EqualError(t, validateIngressDomains(manifest, "nais.example.no"), "ingress host notexample.no is not in any of the domains allowed in this cluster: nais.example.no, example.com, example.no")
+}
+
+func TestValidateIngress(t *testing.T) {
+	assert.Nil(t, validateIngress(newIngressManifest()))
+
+	manifest := newIngressManifest()
+	manifest.Ingress.Hosts[0].Host = "my_app.example.no"
+	assert.Equal(t, "Ingress.Hosts must be valid hostnames", validateIngress(manifest).ErrorMessage)
+
+	manifest = newIngressManifest()
+	manifest.Ingress.Hosts[0].Paths = []string{"/api?debug"}
+	assert.NotNil(t, validateIngress(manifest))
+
+	manifest = newIngressManifest()
+	manifest.Ingress.Hosts[0].Paths = []string{"/api", "internal"}
+	assert.Equal(t, "Ingress.Hosts must have paths starting with /", validateIngress(manifest).ErrorMessage)
+
+	manifest = newIngressManifest()
+	manifest.Ingress.Timeouts.Connect = "500ms"
+	assert.Equal(t, "Ingress.Timeouts must be durations of at least a second, e.g. 60s", validateIngress(manifest).ErrorMessage)
+
+	manifest = newIngressManifest()
+	manifest.Ingress.MaxBodySize = "8 megabytes"
+	assert.Equal(t, "Ingress.MaxBodySize must be a size, e.g. 8m", validateIngress(manifest).ErrorMessage)
+
+	manifest = newIngressManifest()
+	manifest.Ingress.AllowedSources = []string{"10.0.0.1"}
+	assert.Equal(t, "Ingress.AllowedSources must be CIDR ranges, e.g. 10.0.0.0/8", validateIngress(manifest).ErrorMessage)
+}
+
+func TestCheckIngressConflicts(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: "default", Team: teamName}
+	other := app.Spec{Application: otherAppName, Namespace: "t0", Team: otherTeamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: "default"}
+
+	otherIngress := createIngressDef(other)
+	otherIngress.Spec.Rules = []k8snetworkingv1beta1.IngressRule{
+		createIngressRule(other.ResourceName(), "myapp.example.no", "/api/"),
+		createIngressRule(other.ResourceName(), "tjenester.nav.no", "otherappname"),
+	}
+	ownIngress := createIngressDef(spec)
+	ownIngress.Spec.Rules = []k8snetworkingv1beta1.IngressRule{createIngressRule(spec.ResourceName(), "www.myapp.example.no", "")}
+	clientset := fake.NewSimpleClientset(otherIngress, ownIngress)
+
+	t.Run("identical host and path pairs conflict", func(t *testing.T) {
+		_, err := createOrUpdateK8sResources(spec, request, newIngressManifest(), []NaisResource{}, "nais.example.no", false, clientset, newFakeDynamicClient())
+		assert.Equal(t, IngressConflictError{Host: "myapp.example.no", Path: "/api", Application: otherAppName, Namespace: "t0"}, err)
+
+		deployment, _ := getExistingAppDeployment(spec, clientset)
+		assert.Nil(t, deployment, "nothing is deployed")
+	})
+
+	t.Run("nested paths and the application's own ingress do not conflict", func(t *testing.T) {
+		manifest := newIngressManifest()
+		manifest.Ingress.Hosts[0].Paths = []string{"/api/v2", "/"}
+
+		rules := createIngressRules(spec, manifest, request, "nais.example.no", []NaisResource{})
+		assert.NoError(t, checkIngressConflicts(spec, rules, clientset))
+	})
+
+	t.Run("the SBS public host is checked as well", func(t *testing.T) {
+		rules := createIngressRules(other, newDefaultManifest(), naisrequest.Deploy{Application: otherAppName, Namespace: "t1", Zone: constant.ZONE_SBS, FasitEnvironment: "p"}, "nais.example.no", []NaisResource{})
+		other := other
+		other.Namespace = "t1"
+		assert.EqualError(t, checkIngressConflicts(other, rules, clientset), "tjenester.nav.no/otherappname is already used by otherappname in t0")
+	})
+
+	t.Run("ingresses from before naisd labelled them as managed conflict as well", func(t *testing.T) {
+		legacy := app.Spec{Application: "legacyapp", Namespace: "t1", Team: otherTeamName}
+		legacyIngress := createIngressDef(legacy)
+		delete(legacyIngress.Labels, ManagedByLabel)
+		legacyIngress.Spec.Rules = []k8snetworkingv1beta1.IngressRule{createIngressRule(legacy.ResourceName(), "legacy.example.no", "/")}
+		clientset := fake.NewSimpleClientset(legacyIngress)
+
+		manifest := newIngressManifest()
+		manifest.Ingress.Hosts = []IngressHost{{Host: "legacy.example.no", Paths: []string{"/"}}}
+		rules := createIngressRules(spec, manifest, request, "nais.example.no", []NaisResource{})
+		assert.Equal(t, IngressConflictError{Host: "legacy.example.no", Path: "/", Application: "legacyapp", Namespace: "t1"}, checkIngressConflicts(spec, rules, clientset))
+	})
+}
@@ -0,0 +1,348 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Job configures the workloads of kind Job and CronJob
+type Job struct {
+	Schedule                   string
+	ConcurrencyPolicy          string `yaml:"concurrencyPolicy"`
+	SuccessfulJobsHistoryLimit int    `yaml:"successfulJobsHistoryLimit"`
+	FailedJobsHistoryLimit     int    `yaml:"failedJobsHistoryLimit"`
+	BackoffLimit               int    `yaml:"backoffLimit"`
+}
+
+// isBatchWorkload is true for applications that run to completion, which get no service, ingress or autoscaler
+func isBatchWorkload(manifest NaisManifest) bool {
+	return manifest.Kind == WorkloadJob || manifest.Kind == WorkloadCronJob
+}
+
+// createJobPodTemplate wires the pod like the pod of a deployment, except for what would keep it from completing or
+// restart it while it works: probes, the pre stop hook and the Istio sidecar
+func createJobPodTemplate(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource) (k8score.PodTemplateSpec, error) {
+	podSpec, err := createPodSpec(spec, deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return k8score.PodTemplateSpec{}, err
+	}
+
+	container := &podSpec.Containers[0]
+	container.LivenessProbe = nil
+	container.ReadinessProbe = nil
+	container.Lifecycle = nil
+	podSpec.RestartPolicy = k8score.RestartPolicyNever
+
+	return k8score.PodTemplateSpec{
+		ObjectMeta: createPodObjectMetaWithAnnotations(spec, manifest, false),
+		Spec:       podSpec,
+	}, nil
+}
+
+func createJobSpec(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource) (k8sbatch.JobSpec, error) {
+	template, err := createJobPodTemplate(spec, deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return k8sbatch.JobSpec{}, err
+	}
+
+	return k8sbatch.JobSpec{
+		BackoffLimit: int32p(int32(manifest.Job.BackoffLimit)),
+		Template:     template,
+	}, nil
+}
+
+func createJobDef(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource) (*k8sbatch.Job, error) {
+	jobSpec, err := createJobSpec(spec, deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return nil, err
+	}
+
+	return &k8sbatch.Job{
+		TypeMeta: k8smeta.TypeMeta{
+			Kind:       "Job",
+			APIVersion: "batch/v1",
+		},
+		ObjectMeta: generateObjectMeta(spec),
+		Spec:       jobSpec,
+	}, nil
+}
+
+// Creates a Kubernetes CronJob object
+// If existingCronJob is provided, this is updated with modifiable fields
+func createCronJobDef(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, existingCronJob *k8sbatchv1beta1.CronJob) (*k8sbatchv1beta1.CronJob, error) {
+	jobSpec, err := createJobSpec(spec, deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return nil, err
+	}
+
+	cronJob := existingCronJob
+	if cronJob == nil {
+		cronJob = &k8sbatchv1beta1.CronJob{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "CronJob",
+				APIVersion: "batch/v1beta1",
+			},
+			ObjectMeta: createObjectMeta(spec.ResourceName(), spec.Namespace),
+		}
+	}
+
+	// A paused cronjob stays suspended until it is resumed
+	suspended := isPaused(cronJob.ObjectMeta)
+
+	cronJob.ObjectMeta = addLabelsToObjectMeta(cronJob.ObjectMeta, spec)
+	if cronJob.Annotations == nil {
+		cronJob.Annotations = make(map[string]string, 1)
+	}
+	cronJob.Annotations[DeployedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	cronJob.Spec = k8sbatchv1beta1.CronJobSpec{
+		Schedule:                   manifest.Job.Schedule,
+		Suspend:                    &suspended,
+		ConcurrencyPolicy:          k8sbatchv1beta1.ConcurrencyPolicy(manifest.Job.ConcurrencyPolicy),
+		SuccessfulJobsHistoryLimit: int32p(int32(manifest.Job.SuccessfulJobsHistoryLimit)),
+		FailedJobsHistoryLimit:     int32p(int32(manifest.Job.FailedJobsHistoryLimit)),
+		JobTemplate: k8sbatchv1beta1.JobTemplateSpec{
+			ObjectMeta: generatePodObjectMeta(spec),
+			Spec:       jobSpec,
+		},
+	}
+
+	return cronJob, nil
+}
+
+// createOrUpdateJob starts the job for the deployed version. The pod template of a job cannot be changed, so a job from
+// an earlier deploy is deleted first, stopping it if it is still running.
+func createOrUpdateJob(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, k8sClient kubernetes.Interface) (*k8sbatch.Job, error) {
+	if err := deleteJob(spec, k8sClient); err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to delete job from the previous deploy: %s", err)
+	}
+
+	job, err := createJobDef(spec, deploymentRequest, manifest, naisResources)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create job: %s", err)
+	}
+
+	return k8sClient.BatchV1().Jobs(spec.Namespace).Create(context.TODO(), job, k8smeta.CreateOptions{})
+}
+
+func createOrUpdateCronJob(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, k8sClient kubernetes.Interface) (*k8sbatchv1beta1.CronJob, error) {
+	existingCronJob, err := getExistingCronJob(spec, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing cronjob: %s", err)
+	}
+
+	cronJob, err := createCronJobDef(spec, deploymentRequest, manifest, naisResources, existingCronJob)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cronjob: %s", err)
+	}
+
+	if cronJob.ResourceVersion != "" {
+		return k8sClient.BatchV1beta1().CronJobs(spec.Namespace).Update(context.TODO(), cronJob, k8smeta.UpdateOptions{})
+	}
+	return k8sClient.BatchV1beta1().CronJobs(spec.Namespace).Create(context.TODO(), cronJob, k8smeta.CreateOptions{})
+}
+
+func getExistingJob(spec app.Spec, k8sClient kubernetes.Interface) (*k8sbatch.Job, error) {
+	job, err := k8sClient.BatchV1().Jobs(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return job, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func getExistingCronJob(spec app.Spec, k8sClient kubernetes.Interface) (*k8sbatchv1beta1.CronJob, error) {
+	cronJob, err := k8sClient.BatchV1beta1().CronJobs(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return cronJob, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// The job's pods are deleted along with it
+func deleteJob(spec app.Spec, k8sClient kubernetes.Interface) error {
+	backgroundDeletion := k8smeta.DeletePropagationBackground
+	return k8sClient.BatchV1().Jobs(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{PropagationPolicy: &backgroundDeletion})
+}
+
+func deleteCronJob(spec app.Spec, k8sClient kubernetes.Interface) error {
+	backgroundDeletion := k8smeta.DeletePropagationBackground
+	return k8sClient.BatchV1beta1().CronJobs(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{PropagationPolicy: &backgroundDeletion})
+}
+
+// jobStatusAndView reports a job as successful once it has completed, and as failed once it has run out of retries
+func jobStatusAndView(job k8sbatch.Job) (DeployStatus, DeploymentStatusView) {
+	status, reason := InProgress, fmt.Sprintf("job %s is running", job.Name)
+
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != k8score.ConditionTrue {
+			continue
+		}
+
+		switch condition.Type {
+		case k8sbatch.JobComplete:
+			status, reason = Success, fmt.Sprintf("job %s completed", job.Name)
+		case k8sbatch.JobFailed:
+			status, reason = Failed, fmt.Sprintf("job %s failed: %s", job.Name, condition.Message)
+		}
+	}
+
+	containers, images := findContainerImages(job.Spec.Template.Spec.Containers)
+	desired := int32(1)
+	if job.Spec.Completions != nil {
+		desired = *job.Spec.Completions
+	}
+
+	return status, DeploymentStatusView{
+		Name:       job.Name,
+		Desired:    desired,
+		Current:    job.Status.Active,
+		UpToDate:   job.Status.Active + job.Status.Succeeded,
+		Available:  job.Status.Succeeded,
+		Containers: containers,
+		Images:     images,
+		Status:     status.String(),
+		Reason:     reason,
+	}
+}
+
+// cronJobStatusAndView reports a cronjob as deployed once it is scheduled. How its jobs went is up to the application's
+// alerts, as a failed run does not make the deployed version fail.
+func cronJobStatusAndView(cronJob k8sbatchv1beta1.CronJob) (DeployStatus, DeploymentStatusView) {
+	reason := fmt.Sprintf("cronjob %s is scheduled %s", cronJob.Name, cronJob.Spec.Schedule)
+	if cronJob.Status.LastScheduleTime != nil {
+		reason += fmt.Sprintf(", and last ran at %s", cronJob.Status.LastScheduleTime.UTC().Format(time.RFC3339))
+	}
+
+	containers, images := findContainerImages(cronJob.Spec.JobTemplate.Spec.Template.Spec.Containers)
+
+	return Success, DeploymentStatusView{
+		Name:       cronJob.Name,
+		Current:    int32(len(cronJob.Status.Active)),
+		Containers: containers,
+		Images:     images,
+		Status:     Success.String(),
+		Reason:     reason,
+	}
+}
+
+// batchWorkloadStatus reports the status of the application's job or cronjob. found is false for applications that
+// have neither.
+func batchWorkloadStatus(spec app.Spec, k8sClient kubernetes.Interface) (status DeployStatus, view DeploymentStatusView, found bool, err error) {
+	job, err := getExistingJob(spec, k8sClient)
+	if err != nil {
+		return Failed, view, false, fmt.Errorf("unable to get job: %s", err)
+	} else if job != nil {
+		status, view = jobStatusAndView(*job)
+		return status, view, true, nil
+	}
+
+	cronJob, err := getExistingCronJob(spec, k8sClient)
+	if err != nil {
+		return Failed, view, false, fmt.Errorf("unable to get cronjob: %s", err)
+	} else if cronJob != nil {
+		status, view = cronJobStatusAndView(*cronJob)
+		return status, view, true, nil
+	}
+
+	return Failed, view, false, nil
+}
+
+func validateKind(manifest NaisManifest) *ValidationError {
+	if !(manifest.Kind == "" || manifest.Kind == WorkloadDeployment || manifest.Kind == WorkloadStatefulSet || isBatchWorkload(manifest)) {
+		return &ValidationError{
+			ErrorMessage: "Not valid Kind, use Deployment, StatefulSet, Job or CronJob",
+			Fields:       map[string]string{"Kind": manifest.Kind},
+		}
+	}
+
+	if len(manifest.Workload) > 0 && manifest.Workload != manifest.Kind {
+		return &ValidationError{
+			ErrorMessage: "Workload is another name for Kind, and they can not differ",
+			Fields:       map[string]string{"Kind": manifest.Kind, "Workload": manifest.Workload},
+		}
+	}
+
+	if !isBatchWorkload(manifest) {
+		return nil
+	}
+
+	if manifest.DeploymentStrategy == DeploymentStrategyCanary || manifest.DeploymentStrategy == DeploymentStrategyBlueGreen {
+		return &ValidationError{
+			ErrorMessage: "The Canary and BlueGreen deployment strategies can not be used with jobs",
+			Fields:       map[string]string{"DeploymentStrategy": manifest.DeploymentStrategy},
+		}
+	}
+
+	// Sidecars run until they are stopped, and would keep the job from completing
+	if manifest.LeaderElection || manifest.Vault.Sidecar {
+		return &ValidationError{
+			ErrorMessage: "Jobs can not use leader election or the Vault sidecar",
+			Fields:       map[string]string{"LeaderElection": fmt.Sprint(manifest.LeaderElection), "Vault.Sidecar": fmt.Sprint(manifest.Vault.Sidecar)},
+		}
+	}
+
+	return nil
+}
+
+func validateJob(manifest NaisManifest) *ValidationError {
+	if !isBatchWorkload(manifest) {
+		return nil
+	}
+
+	schedule := manifest.Job.Schedule
+	if manifest.Kind == WorkloadJob && len(schedule) > 0 {
+		return &ValidationError{
+			ErrorMessage: "Job.Schedule is only used with kind CronJob",
+			Fields:       map[string]string{"Job.Schedule": schedule},
+		}
+	}
+
+	if manifest.Kind == WorkloadCronJob && len(strings.Fields(schedule)) != 5 && !strings.HasPrefix(schedule, "@") {
+		return &ValidationError{
+			ErrorMessage: "Job.Schedule must be a cron schedule, e.g. \"0 4 * * *\", for kind CronJob",
+			Fields:       map[string]string{"Job.Schedule": schedule},
+		}
+	}
+
+	switch k8sbatchv1beta1.ConcurrencyPolicy(manifest.Job.ConcurrencyPolicy) {
+	case k8sbatchv1beta1.AllowConcurrent, k8sbatchv1beta1.ForbidConcurrent, k8sbatchv1beta1.ReplaceConcurrent:
+	default:
+		return &ValidationError{
+			ErrorMessage: "Job.ConcurrencyPolicy must be Allow, Forbid or Replace",
+			Fields:       map[string]string{"Job.ConcurrencyPolicy": manifest.Job.ConcurrencyPolicy},
+		}
+	}
+
+	if manifest.Job.BackoffLimit < 0 || manifest.Job.SuccessfulJobsHistoryLimit < 0 || manifest.Job.FailedJobsHistoryLimit < 0 {
+		return &ValidationError{
+			ErrorMessage: "Job.BackoffLimit and the history limits can not be negative",
+			Fields: map[string]string{
+				"Job.BackoffLimit":               fmt.Sprint(manifest.Job.BackoffLimit),
+				"Job.SuccessfulJobsHistoryLimit": fmt.Sprint(manifest.Job.SuccessfulJobsHistoryLimit),
+				"Job.FailedJobsHistoryLimit":     fmt.Sprint(manifest.Job.FailedJobsHistoryLimit),
+			},
+		}
+	}
+
+	return nil
+}
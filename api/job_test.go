@@ -0,0 +1,152 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newJobManifest(kind string) NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Kind = kind
+	manifest.Job = Job{ConcurrencyPolicy: "Forbid", SuccessfulJobsHistoryLimit: 3, FailedJobsHistoryLimit: 1, BackoffLimit: 2}
+	if kind == WorkloadCronJob {
+		manifest.Job.Schedule = "0 4 * * *"
+	}
+	return manifest
+}
+
+func TestCreateJobDef(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	job, err := createJobDef(spec, request, newJobManifest(WorkloadJob), []NaisResource{})
+	assert.NoError(t, err)
+	assert.Equal(t, appName, job.Name)
+	assert.Equal(t, int32(2), *job.Spec.BackoffLimit)
+	assert.Equal(t, k8score.RestartPolicyNever, job.Spec.Template.Spec.RestartPolicy)
+
+	container := job.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, image+":"+version, container.Image)
+	assert.Nil(t, container.LivenessProbe)
+	assert.Nil(t, container.ReadinessProbe)
+	assert.Nil(t, container.Lifecycle)
+	assert.Equal(t, "APP_NAME", container.Env[0].Name)
+}
+
+func TestCreateOrUpdateK8sResourcesForJobs(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	t.Run("a cronjob gets no service, ingress or autoscaler", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		result, err := createOrUpdateK8sResources(spec, request, newJobManifest(WorkloadCronJob), []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Nil(t, result.Deployment)
+		assert.Nil(t, result.Service)
+		assert.Nil(t, result.Ingress)
+		assert.Nil(t, result.Autoscaler)
+		assert.Equal(t, "0 4 * * *", result.CronJob.Spec.Schedule)
+		assert.Equal(t, "Forbid", string(result.CronJob.Spec.ConcurrencyPolicy))
+		assert.Equal(t, int32(3), *result.CronJob.Spec.SuccessfulJobsHistoryLimit)
+		assert.Equal(t, appName, result.CronJob.Spec.JobTemplate.Labels["app"])
+
+		status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+		assert.NoError(t, err)
+		assert.Equal(t, Success, status)
+		assert.Equal(t, "cronjob appname is scheduled 0 4 * * *", view.Reason)
+	})
+
+	t.Run("a deployed app that becomes a job has its deployment, service and autoscaler pruned", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateK8sResources(spec, request, newDefaultManifest(), []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+
+		result, err := createOrUpdateK8sResources(spec, request, newJobManifest(WorkloadJob), []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.NotNil(t, result.Job)
+
+		pruned, err := pruneK8sResources(spec, result, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Contains(t, pruned, "deployment "+appName)
+		assert.Contains(t, pruned, "service "+appName)
+		assert.Contains(t, pruned, "autoscaler "+appName)
+		assert.Contains(t, pruned, "ingress "+appName)
+	})
+
+	t.Run("redeploying a job replaces it, and the job is deleted with the app", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset()
+		_, err := createOrUpdateJob(spec, request, newJobManifest(WorkloadJob), []NaisResource{}, clientset)
+		assert.NoError(t, err)
+
+		request := request
+		request.Version = "14"
+		job, err := createOrUpdateJob(spec, request, newJobManifest(WorkloadJob), []NaisResource{}, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, image+":14", job.Spec.Template.Spec.Containers[0].Image)
+
+		results, err := deleteK8sResouces(spec, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Contains(t, results, DeleteResult{Resource: "job", Name: appName, Status: DeleteStatusDeleted})
+
+		existingJob, _ := getExistingJob(spec, clientset)
+		assert.Nil(t, existingJob)
+	})
+}
+
+func TestJobStatusAndView(t *testing.T) {
+	job := k8sbatch.Job{}
+	job.Name = appName
+	job.Status.Active = 1
+
+	status, view := jobStatusAndView(job)
+	assert.Equal(t, InProgress, status)
+	assert.Equal(t, int32(1), view.Current)
+
+	job.Status.Conditions = []k8sbatch.JobCondition{{Type: k8sbatch.JobFailed, Status: k8score.ConditionTrue, Message: "Job has reached the specified backoff limit"}}
+	status, view = jobStatusAndView(job)
+	assert.Equal(t, Failed, status)
+	assert.Equal(t, "job appname failed: Job has reached the specified backoff limit", view.Reason)
+
+	job.Status.Succeeded = 1
+	job.Status.Conditions = []k8sbatch.JobCondition{{Type: k8sbatch.JobComplete, Status: k8score.ConditionTrue}}
+	status, view = jobStatusAndView(job)
+	assert.Equal(t, Success, status)
+	assert.Equal(t, int32(1), view.Available)
+}
+
+func TestValidateJobs(t *testing.T) {
+	assert.Nil(t, validateKind(newDefaultManifest()))
+	assert.Nil(t, validateKind(newJobManifest(WorkloadJob)))
+	assert.Nil(t, validateJob(newJobManifest(WorkloadJob)))
+	assert.Nil(t, validateJob(newJobManifest(WorkloadCronJob)))
+
+	manifest := newJobManifest(WorkloadCronJob)
+	manifest.Kind = "Daemon"
+	assert.Equal(t, "Not valid Kind, use Deployment, StatefulSet, Job or CronJob", validateKind(manifest).ErrorMessage)
+
+	manifest = newJobManifest(WorkloadJob)
+	manifest.LeaderElection = true
+	assert.Equal(t, "Jobs can not use leader election or the Vault sidecar", validateKind(manifest).ErrorMessage)
+
+	manifest = newJobManifest(WorkloadJob)
+	manifest.DeploymentStrategy = DeploymentStrategyCanary
+	assert.NotNil(t, validateKind(manifest))
+
+	manifest = newJobManifest(WorkloadJob)
+	manifest.Job.Schedule = "@daily"
+	assert.Equal(t, "Job.Schedule is only used with kind CronJob", validateJob(manifest).ErrorMessage)
+
+	manifest = newJobManifest(WorkloadCronJob)
+	manifest.Job.Schedule = "every night"
+	assert.NotNil(t, validateJob(manifest))
+
+	manifest.Job.Schedule = "@daily"
+	manifest.Job.ConcurrencyPolicy = "Sometimes"
+	assert.Equal(t, "Job.ConcurrencyPolicy must be Allow, Forbid or Replace", validateJob(manifest).ErrorMessage)
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -55,9 +56,14 @@ type Vault struct {
 
 type NaisManifest struct {
 	Team               string
+	Kind               string
+	Workload           string
+	StatefulSet        StatefulSet `yaml:"statefulSet"`
+	Job                Job
 	Image              string
 	Port               int
 	DeploymentStrategy string
+	Canary             Canary
 	Healthcheck        Healthcheck
 	PreStopHookPath    string `yaml:"preStopHookPath"`
 	Prometheus         PrometheusConfig
@@ -68,7 +74,7 @@ type NaisManifest struct {
 	FasitResources     FasitResources `yaml:"fasitResources"`
 	LeaderElection     bool           `yaml:"leaderElection"`
 	Redis              Redis          `yaml:"redis"`
-	Alerts             []PrometheusAlertRule
+	Alerts             Alerts
 	Logformat          string
 	Logtransform       string
 	Secrets            bool  `yaml:"secrets"`
@@ -77,13 +83,22 @@ type NaisManifest struct {
 }
 
 type Ingress struct {
-	Disabled bool
+	Disabled       bool
+	Hosts          []IngressHost
+	TLS            IngressTLS `yaml:"tls"`
+	Class          string
+	Timeouts       IngressTimeouts
+	MaxBodySize    string   `yaml:"maxBodySize"`
+	AllowedSources []string `yaml:"allowedSources"`
 }
 
 type Replicas struct {
-	Min                    int
-	Max                    int
-	CpuThresholdPercentage int `yaml:"cpuThresholdPercentage"`
+	Min                       int
+	Max                       int
+	CpuThresholdPercentage    int `yaml:"cpuThresholdPercentage"`
+	MemoryThresholdPercentage int `yaml:"memoryThresholdPercentage"`
+	Metrics                   []ScalingMetric
+	Behavior                  *ScalingBehavior
 }
 
 type FasitResources struct {
@@ -178,6 +193,11 @@ func createManifestUrl(application, version string) []string {
 }
 
 func AddDefaultManifestValues(manifest *NaisManifest, application string) error {
+	// workload is another name for kind
+	if len(manifest.Kind) == 0 {
+		manifest.Kind = manifest.Workload
+	}
+
 	return mergo.Merge(manifest, GetDefaultManifest(application))
 }
 func fetchManifest(url string) (NaisManifest, error) {
@@ -221,11 +241,25 @@ func ValidateManifest(manifest NaisManifest) ValidationErrors {
 		validateLimitsCpuQuantity,
 		validateResources,
 		validateAlertRules,
+		validateDefaultAlerts,
+		validateAlertReceivers,
 		validateDeploymentStrategy,
+		validateCanary,
+		validateKind,
+		validateJob,
+		validateStatefulSet,
+		validateScalingMetrics,
+		validateScalingBehavior,
+		validateIngress,
 		validateRedisRequestMemoryQuantity,
 		validateRedisLimitsMemoryQuantity,
 		validateRedisRequestCpuQuantity,
 		validateRedisLimitsCpuQuantity,
+		validateRedisMode,
+		validateRedisMaxMemory,
+		validateRedisMaxMemoryPolicy,
+		validateRedisAppendFsync,
+		validateRedisConfig,
 	}
 
 	var validationErrors ValidationErrors
@@ -371,9 +405,11 @@ func (errors ValidationErrors) Error() (s string) {
 
 func validateDeploymentStrategy(manifest NaisManifest) *ValidationError {
 	if !(manifest.DeploymentStrategy == DeploymentStrategyRollingUpdate ||
-		manifest.DeploymentStrategy == DeploymentStrategyRecreate) {
+		manifest.DeploymentStrategy == DeploymentStrategyRecreate ||
+		manifest.DeploymentStrategy == DeploymentStrategyCanary ||
+		manifest.DeploymentStrategy == DeploymentStrategyBlueGreen) {
 		validationError := new(ValidationError)
-		validationError.ErrorMessage = "Not valid DeploymentStrategy, use RollingUpdate or Recreate"
+		validationError.ErrorMessage = "Not valid DeploymentStrategy, use RollingUpdate, Recreate, Canary or BlueGreen"
 		validationError.Fields = make(map[string]string)
 		validationError.Fields["DeploymentStrategy"] = manifest.DeploymentStrategy
 		return validationError
@@ -421,3 +457,130 @@ func validateRedisLimitsCpuQuantity(manifest NaisManifest) *ValidationError {
 	}
 	return nil
 }
+
+func validateRedisMode(manifest NaisManifest) *ValidationError {
+	mode := manifest.Redis.Mode
+	if mode != "" && mode != RedisModeStandalone && mode != RedisModeFailover {
+		validationError := new(ValidationError)
+		validationError.ErrorMessage = "Not valid Redis.Mode, use standalone or failover"
+		validationError.Fields = make(map[string]string)
+		validationError.Fields["Redis.Mode"] = mode
+		return validationError
+	}
+
+	return nil
+}
+
+var redisMaxMemoryPattern = regexp.MustCompile(`(?i)^[0-9]+(b|k|kb|m|mb|g|gb)?$`)
+
+func validateRedisMaxMemory(manifest NaisManifest) *ValidationError {
+	maxMemory := manifest.Redis.MaxMemory
+	if maxMemory != "" && !redisMaxMemoryPattern.MatchString(maxMemory) {
+		return &ValidationError{
+			"Not valid Redis.MaxMemory, use bytes or a unit such as 100mb or 1gb",
+			map[string]string{"Redis.MaxMemory": maxMemory},
+		}
+	}
+
+	return nil
+}
+
+func validateRedisMaxMemoryPolicy(manifest NaisManifest) *ValidationError {
+	policy := manifest.Redis.MaxMemoryPolicy
+	if policy == "" {
+		return nil
+	}
+
+	for _, validPolicy := range []string{"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random", "volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl"} {
+		if policy == validPolicy {
+			return nil
+		}
+	}
+
+	return &ValidationError{
+		"Not valid Redis.MaxMemoryPolicy, see https://redis.io/topics/lru-cache for eviction policies",
+		map[string]string{"Redis.MaxMemoryPolicy": policy},
+	}
+}
+
+func validateRedisAppendFsync(manifest NaisManifest) *ValidationError {
+	appendFsync := manifest.Redis.AppendFsync
+	if appendFsync != "" && appendFsync != "always" && appendFsync != "everysec" && appendFsync != "no" {
+		return &ValidationError{
+			"Not valid Redis.AppendFsync, use always, everysec or no",
+			map[string]string{"Redis.AppendFsync": appendFsync},
+		}
+	}
+
+	return nil
+}
+
+// managedRedisDirectives are set by naisd, and cannot be overridden from the manifest
+var managedRedisDirectives = []string{"requirepass", "masterauth", "port", "bind"}
+
+func isManagedRedisDirective(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	for _, directive := range managedRedisDirectives {
+		if strings.ToLower(fields[0]) == directive {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateRedisConfig rejects extra parameters that naisd manages itself, and keys or values that would add
+// directives of their own to redis.conf
+func validateRedisConfig(manifest NaisManifest) *ValidationError {
+	redis := manifest.Redis
+	values := map[string]string{
+		"Redis.MaxMemory":       redis.MaxMemory,
+		"Redis.MaxMemoryPolicy": redis.MaxMemoryPolicy,
+		"Redis.AppendFsync":     redis.AppendFsync,
+	}
+	for i, save := range redis.Save {
+		values[fmt.Sprintf("Redis.Save[%d]", i)] = save
+	}
+
+	for key, value := range redis.Config {
+		if len(key) == 0 || strings.ContainsAny(key, " \t\r\n") {
+			return &ValidationError{
+				"Redis.Config keys must be a single redis.conf parameter",
+				map[string]string{"Redis.Config": key},
+			}
+		}
+		if isManagedRedisDirective(key) {
+			return &ValidationError{
+				"Redis.Config cannot override parameters managed by naisd",
+				map[string]string{"Redis.Config": key},
+			}
+		}
+		values["Redis.Config."+key] = value
+	}
+
+	for field, value := range values {
+		if !strings.ContainsAny(value, "\r\n") {
+			continue
+		}
+
+		for _, line := range strings.FieldsFunc(value, func(r rune) bool { return r == '\r' || r == '\n' }) {
+			if isManagedRedisDirective(line) {
+				return &ValidationError{
+					"Redis.Config cannot override parameters managed by naisd",
+					map[string]string{field: strings.Fields(line)[0]},
+				}
+			}
+		}
+
+		return &ValidationError{
+			"Redis configuration values cannot contain line breaks",
+			map[string]string{field: value},
+		}
+	}
+
+	return nil
+}
@@ -52,11 +52,11 @@ func TestManifestUnmarshal(t *testing.T) {
 	assert.Equal(t, 69, manifest.Healthcheck.Liveness.Timeout)
 	assert.Equal(t, "/stop", manifest.PreStopHookPath)
 	assert.Equal(t, true, manifest.Ingress.Disabled)
-	assert.Equal(t, "Nais-testapp deployed", manifest.Alerts[0].Alert)
-	assert.Equal(t, "kube_deployment_status_replicas_unavailable{deployment=\"nais-testapp\"} > 0", manifest.Alerts[0].Expr)
-	assert.Equal(t, "5m", manifest.Alerts[0].For)
-	assert.Equal(t, "Investigate why nais-testapp can't spawn pods. kubectl describe deployment nais-testapp, kubectl describe pod nais-testapp-*.", manifest.Alerts[0].Annotations["action"])
-	assert.Equal(t, "Critical", manifest.Alerts[1].Labels["severity"])
+	assert.Equal(t, "Nais-testapp deployed", manifest.Alerts.Rules[0].Alert)
+	assert.Equal(t, "kube_deployment_status_replicas_unavailable{deployment=\"nais-testapp\"} > 0", manifest.Alerts.Rules[0].Expr)
+	assert.Equal(t, "5m", manifest.Alerts.Rules[0].For)
+	assert.Equal(t, "Investigate why nais-testapp can't spawn pods. kubectl describe deployment nais-testapp, kubectl describe pod nais-testapp-*.", manifest.Alerts.Rules[0].Annotations["action"])
+	assert.Equal(t, "Critical", manifest.Alerts.Rules[1].Labels["severity"])
 	assert.Equal(t, true, manifest.Secrets)
 	assert.Equal(t, false, manifest.Redis.Enabled)
 }
@@ -400,3 +400,49 @@ func TestValidateResource(t *testing.T) {
 	assert.Equal(t, "Alias and ResourceType must be specified", err2.ErrorMessage)
 	assert.Nil(t, noErr)
 }
+
+func TestValidateRedisConfiguration(t *testing.T) {
+	t.Run("valid redis tunables give no errors", func(t *testing.T) {
+		manifest := NaisManifest{Redis: Redis{
+			MaxMemory:       "100mb",
+			MaxMemoryPolicy: "allkeys-lru",
+			AppendFsync:     "everysec",
+			Config:          map[string]string{"timeout": "300"},
+		}}
+
+		assert.Nil(t, validateRedisMaxMemory(manifest))
+		assert.Nil(t, validateRedisMaxMemoryPolicy(manifest))
+		assert.Nil(t, validateRedisAppendFsync(manifest))
+		assert.Nil(t, validateRedisConfig(manifest))
+	})
+
+	t.Run("invalid redis tunables give validation errors", func(t *testing.T) {
+		manifest := NaisManifest{Redis: Redis{
+			MaxMemory:       "100 megs",
+			MaxMemoryPolicy: "evict-everything",
+			AppendFsync:     "sometimes",
+			Config:          map[string]string{"requirepass": "hunter2"},
+		}}
+
+		assert.Equal(t, "Not valid Redis.MaxMemory, use bytes or a unit such as 100mb or 1gb", validateRedisMaxMemory(manifest).ErrorMessage)
+		assert.Equal(t, "evict-everything", validateRedisMaxMemoryPolicy(manifest).Fields["Redis.MaxMemoryPolicy"])
+		assert.Equal(t, "Not valid Redis.AppendFsync, use always, everysec or no", validateRedisAppendFsync(manifest).ErrorMessage)
+		assert.Equal(t, "requirepass", validateRedisConfig(manifest).Fields["Redis.Config"])
+	})
+
+	t.Run("values cannot inject directives into redis.conf", func(t *testing.T) {
+		manifest := NaisManifest{Redis: Redis{MaxMemory: "1gb\nrequirepass x"}}
+		err := validateRedisConfig(manifest)
+		assert.Equal(t, "Redis.Config cannot override parameters managed by naisd", err.ErrorMessage)
+		assert.Equal(t, "requirepass", err.Fields["Redis.MaxMemory"])
+
+		manifest = NaisManifest{Redis: Redis{Config: map[string]string{"timeout": "300\r\nbind 0.0.0.0"}}}
+		assert.Equal(t, "bind", validateRedisConfig(manifest).Fields["Redis.Config.timeout"])
+
+		manifest = NaisManifest{Redis: Redis{Save: []string{"900 1\nappendonly no"}}}
+		assert.Equal(t, "Redis configuration values cannot contain line breaks", validateRedisConfig(manifest).ErrorMessage)
+
+		manifest = NaisManifest{Redis: Redis{Config: map[string]string{"timeout 300\nport": "6380"}}}
+		assert.Equal(t, "Redis.Config keys must be a single redis.conf parameter", validateRedisConfig(manifest).ErrorMessage)
+	})
+}
@@ -0,0 +1,8 @@
+package naisrequest
+
+// Delete optionally identifies the Fasit application instance to remove along with the application's resources
+type Delete struct {
+	FasitEnvironment string `json:"fasitEnvironment,omitempty"`
+	FasitUsername    string `json:"fasitUsername,omitempty"`
+	FasitPassword    string `json:"fasitPassword,omitempty"`
+}
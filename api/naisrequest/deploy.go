@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/nais/naisd/api/constant"
 	"k8s.io/apimachinery/pkg/util/validation"
+	"time"
 )
 
 type Deploy struct {
@@ -19,7 +20,11 @@ type Deploy struct {
 	OnBehalfOf       string `json:"onbehalfof,omitempty"`
 	Namespace        string `json:"namespace,omitempty"`
 	Environment      string `json:"environment,omitempty"`
+	Force            bool   `json:"force,omitempty"`
+	Preview          string `json:"preview,omitempty"`
+	PreviewTTL       string `json:"previewTtl,omitempty"`
 	ClusterName      string
+	CorrelationID    string
 }
 
 func (r Deploy) Validate() []error {
@@ -58,6 +63,38 @@ func (r Deploy) Validate() []error {
 		errs = append(errs, fmt.Errorf("invalid application name: %s", e))
 	}
 
+	return append(errs, r.ValidatePreview()...)
+}
+
+// DeployName is the name the application is deployed under, which differs from the application for previews
+func (r Deploy) DeployName() string {
+	if len(r.Preview) == 0 {
+		return r.Application
+	}
+	return r.Application + "-pr-" + r.Preview
+}
+
+// ValidatePreview checks the preview ID and TTL, which naisd also checks for requests not made with the CLI
+func (r Deploy) ValidatePreview() []error {
+	var errs []error
+
+	if len(r.Preview) == 0 {
+		if len(r.PreviewTTL) > 0 {
+			errs = append(errs, fmt.Errorf("previewTtl is only used with preview"))
+		}
+		return errs
+	}
+
+	for _, e := range validation.IsDNS1123Label(r.DeployName()) {
+		errs = append(errs, fmt.Errorf("invalid preview name: %s", e))
+	}
+
+	if len(r.PreviewTTL) > 0 {
+		if ttl, err := time.ParseDuration(r.PreviewTTL); err != nil || ttl <= 0 {
+			errs = append(errs, fmt.Errorf("previewTtl must be a positive duration, like 48h"))
+		}
+	}
+
 	return errs
 }
 
@@ -35,3 +35,20 @@ func TestStringMethodInDeployNaisRequestShouldNotHidePasswordAndUsername(t *test
 	assert.Contains(t, string(jsonValue), "password")
 	assert.Contains(t, string(jsonValue), "fasitPassword")
 }
+
+func TestValidatePreview(t *testing.T) {
+	deployRequest := Deploy{Application: "app"}
+	assert.Empty(t, deployRequest.ValidatePreview())
+	assert.Equal(t, "app", deployRequest.DeployName())
+
+	deployRequest.Preview = "42"
+	deployRequest.PreviewTTL = "48h"
+	assert.Empty(t, deployRequest.ValidatePreview())
+	assert.Equal(t, "app-pr-42", deployRequest.DeployName())
+
+	deployRequest.Preview = "feature/x"
+	deployRequest.PreviewTTL = "two days"
+	assert.Len(t, deployRequest.ValidatePreview(), 2)
+
+	assert.Len(t, Deploy{Application: "app", PreviewTTL: "48h"}.ValidatePreview(), 1)
+}
@@ -0,0 +1,34 @@
+package api
+
+import (
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/nais/naisd/pkg/notify"
+)
+
+type deploymentNotifier func(notify.Event)
+
+// notify tells the notifiers about the deploy or delete without waiting for them. Previews are not announced.
+func (api Api) notify(eventType notify.EventType, spec app.Spec, deploymentRequest naisrequest.Deploy, cause error) {
+	if api.DeploymentNotifier == nil || len(deploymentRequest.Preview) > 0 {
+		return
+	}
+
+	event := notify.Event{
+		Type:          eventType,
+		Application:   spec.Application,
+		Namespace:     spec.Namespace,
+		Team:          spec.Team,
+		Version:       deploymentRequest.Version,
+		ClusterName:   api.ClusterName,
+		CorrelationID: deploymentRequest.CorrelationID,
+		Time:          time.Now(),
+	}
+	if cause != nil {
+		event.Error = cause.Error()
+	}
+
+	api.DeploymentNotifier(event)
+}
@@ -0,0 +1,329 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/nais/naisd/api/app"
+	k8sapps "k8s.io/api/apps/v1"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta2"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	PausedAnnotation            = "nais.io/paused"
+	PausedReplicasAnnotation    = "nais.io/paused-replicas"
+	PausedMaxReplicasAnnotation = "nais.io/paused-max-replicas"
+)
+
+var (
+	errNotDeployed = fmt.Errorf("no deployment, statefulset or cronjob found")
+	errNotPausable = fmt.Errorf("a job runs to completion and cannot be paused")
+)
+
+// PauseResult tells which of the application's resources were scaled when pausing or resuming it
+type PauseResult struct {
+	Application string `json:"application"`
+	Namespace   string `json:"namespace"`
+	Paused      bool   `json:"paused"`
+	Deployment  bool   `json:"deployment"`
+	StatefulSet bool   `json:"statefulSet"`
+	CronJob     bool   `json:"cronJob"`
+	Redis       bool   `json:"redis"`
+	Autoscaler  bool   `json:"autoscaler"`
+}
+
+func isPaused(objectMeta k8smeta.ObjectMeta) bool {
+	return objectMeta.Annotations[PausedAnnotation] == "true"
+}
+
+// pauseReplicas marks the object as paused and remembers its replica count in an annotation. It returns the replica
+// count of a paused workload.
+func pauseReplicas(objectMeta *k8smeta.ObjectMeta, replicas *int32) *int32 {
+	pausedReplicas := int32(1)
+	if replicas != nil {
+		pausedReplicas = *replicas
+	}
+
+	if objectMeta.Annotations == nil {
+		objectMeta.Annotations = make(map[string]string, 2)
+	}
+	objectMeta.Annotations[PausedAnnotation] = "true"
+	objectMeta.Annotations[PausedReplicasAnnotation] = strconv.Itoa(int(pausedReplicas))
+
+	return int32p(0)
+}
+
+// resumeReplicas removes the pause from the object and returns the replica count it had when it was paused
+func resumeReplicas(objectMeta *k8smeta.ObjectMeta) *int32 {
+	replicas, err := strconv.Atoi(objectMeta.Annotations[PausedReplicasAnnotation])
+	if err != nil || replicas < 1 {
+		replicas = 1
+	}
+
+	delete(objectMeta.Annotations, PausedAnnotation)
+	delete(objectMeta.Annotations, PausedReplicasAnnotation)
+
+	return int32p(int32(replicas))
+}
+
+// pauseDeployment scales the deployment to zero, remembering its replica count in an annotation
+func pauseDeployment(deployment *k8sapps.Deployment) *k8sapps.Deployment {
+	deployment.Spec.Replicas = pauseReplicas(&deployment.ObjectMeta, deployment.Spec.Replicas)
+	return deployment
+}
+
+// resumeDeployment restores the replica count the deployment had when it was paused
+func resumeDeployment(deployment *k8sapps.Deployment) *k8sapps.Deployment {
+	deployment.Spec.Replicas = resumeReplicas(&deployment.ObjectMeta)
+	return deployment
+}
+
+func pauseStatefulSet(statefulSet *k8sapps.StatefulSet) *k8sapps.StatefulSet {
+	statefulSet.Spec.Replicas = pauseReplicas(&statefulSet.ObjectMeta, statefulSet.Spec.Replicas)
+	return statefulSet
+}
+
+func resumeStatefulSet(statefulSet *k8sapps.StatefulSet) *k8sapps.StatefulSet {
+	statefulSet.Spec.Replicas = resumeReplicas(&statefulSet.ObjectMeta)
+	return statefulSet
+}
+
+// suspendCronJob keeps the cronjob from starting jobs while it is paused. Jobs that are already running are left
+// to complete.
+func suspendCronJob(cronJob *k8sbatchv1beta1.CronJob, suspend bool) *k8sbatchv1beta1.CronJob {
+	if suspend {
+		if cronJob.Annotations == nil {
+			cronJob.Annotations = make(map[string]string, 1)
+		}
+		cronJob.Annotations[PausedAnnotation] = "true"
+	} else {
+		delete(cronJob.Annotations, PausedAnnotation)
+	}
+	cronJob.Spec.Suspend = &suspend
+
+	return cronJob
+}
+
+// pinAutoscaler keeps the autoscaler from scaling a paused application by setting its maximum to its minimum.
+// The maximum from the manifest is kept in an annotation, so redeploying a paused application only updates the
+// value it is restored to.
+func pinAutoscaler(autoscaler *k8sautoscaling.HorizontalPodAutoscaler) *k8sautoscaling.HorizontalPodAutoscaler {
+	min := int32(1)
+	if autoscaler.Spec.MinReplicas != nil {
+		min = *autoscaler.Spec.MinReplicas
+	}
+
+	if autoscaler.Annotations == nil {
+		autoscaler.Annotations = make(map[string]string, 2)
+	}
+	autoscaler.Annotations[PausedAnnotation] = "true"
+	autoscaler.Annotations[PausedMaxReplicasAnnotation] = strconv.Itoa(int(autoscaler.Spec.MaxReplicas))
+	autoscaler.Spec.MaxReplicas = min
+
+	return autoscaler
+}
+
+func unpinAutoscaler(autoscaler *k8sautoscaling.HorizontalPodAutoscaler) *k8sautoscaling.HorizontalPodAutoscaler {
+	if max, err := strconv.Atoi(autoscaler.Annotations[PausedMaxReplicasAnnotation]); err == nil && int32(max) >= autoscaler.Spec.MaxReplicas {
+		autoscaler.Spec.MaxReplicas = int32(max)
+	}
+
+	delete(autoscaler.Annotations, PausedAnnotation)
+	delete(autoscaler.Annotations, PausedMaxReplicasAnnotation)
+
+	return autoscaler
+}
+
+// pauseK8sResources scales the application and its Redis deployment to zero and pins the autoscaler. A cronjob is
+// suspended instead. The pause is recorded in annotations, which later deploys keep. Redis in failover mode is managed
+// by the Redis operator and is left running.
+func pauseK8sResources(spec app.Spec, k8sClient kubernetes.Interface) (PauseResult, error) {
+	return scaleK8sResources(spec, true, k8sClient)
+}
+
+// resumeK8sResources restores what pauseK8sResources scaled down
+func resumeK8sResources(spec app.Spec, k8sClient kubernetes.Interface) (PauseResult, error) {
+	return scaleK8sResources(spec, false, k8sClient)
+}
+
+func scaleK8sResources(spec app.Spec, pause bool, k8sClient kubernetes.Interface) (PauseResult, error) {
+	result := PauseResult{Application: spec.Application, Namespace: spec.Namespace, Paused: pause}
+
+	deploymentNames, err := appDeploymentNames(spec, k8sClient)
+	if err != nil {
+		return result, fmt.Errorf("unable to get existing deployments: %s", err)
+	}
+	statefulSet, err := getExistingStatefulSet(spec, k8sClient)
+	if err != nil {
+		return result, fmt.Errorf("unable to get existing statefulset: %s", err)
+	}
+	cronJob, err := getExistingCronJob(spec, k8sClient)
+	if err != nil {
+		return result, fmt.Errorf("unable to get existing cronjob: %s", err)
+	}
+
+	if len(deploymentNames) == 0 && statefulSet == nil && cronJob == nil {
+		job, err := getExistingJob(spec, k8sClient)
+		if err != nil {
+			return result, fmt.Errorf("unable to get existing job: %s", err)
+		}
+		if job != nil {
+			return result, errNotPausable
+		}
+		return result, errNotDeployed
+	}
+
+	// The autoscaler is pinned before, and released after, the deployment is scaled, so it never acts on a
+	// half-paused application
+	if pause {
+		err = retryOnConflict(func() (err error) {
+			result.Autoscaler, err = scaleAutoscaler(spec, pause, k8sClient)
+			return err
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to pin autoscaler: %s", err)
+		}
+	}
+
+	for _, name := range deploymentNames {
+		var scaled bool
+		err = retryOnConflict(func() (err error) {
+			scaled, err = scaleDeployment(name, spec.Namespace, pause, k8sClient)
+			return err
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to scale deployment %s: %s", name, err)
+		}
+		result.Deployment = result.Deployment || scaled
+	}
+
+	if statefulSet != nil {
+		err = retryOnConflict(func() (err error) {
+			result.StatefulSet, err = scaleStatefulSet(spec, pause, k8sClient)
+			return err
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to scale statefulset: %s", err)
+		}
+	}
+
+	if cronJob != nil {
+		err = retryOnConflict(func() (err error) {
+			result.CronJob, err = scaleCronJob(spec, pause, k8sClient)
+			return err
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to suspend cronjob: %s", err)
+		}
+	}
+
+	redisSpec := createRedisSpec(spec)
+	err = retryOnConflict(func() (err error) {
+		result.Redis, err = scaleDeployment(redisSpec.ResourceName(), redisSpec.Namespace, pause, k8sClient)
+		return err
+	})
+	if err != nil {
+		return result, fmt.Errorf("unable to scale redis deployment: %s", err)
+	}
+
+	if !pause {
+		err = retryOnConflict(func() (err error) {
+			result.Autoscaler, err = scaleAutoscaler(spec, pause, k8sClient)
+			return err
+		})
+		if err != nil {
+			return result, fmt.Errorf("unable to release autoscaler: %s", err)
+		}
+	}
+
+	return result, nil
+}
+
+// appDeploymentNames returns the application's deployments. A BlueGreen application has one for each color, and
+// the one from before the BlueGreen strategy until the service has been switched to a color. A Canary application
+// has a canary deployment while a canary bakes.
+func appDeploymentNames(spec app.Spec, k8sClient kubernetes.Interface) ([]string, error) {
+	var names []string
+	for _, name := range []string{spec.ResourceName(), createCanaryName(spec), createColorName(spec, ColorBlue), createColorName(spec, ColorGreen)} {
+		deployment, err := getExistingDeployment(name, spec.Namespace, k8sClient)
+		if err != nil {
+			return nil, err
+		}
+		if deployment != nil {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// scaleDeployment pauses or resumes the named deployment. It returns false if the deployment does not exist or is
+// already in the requested state.
+func scaleDeployment(name, namespace string, pause bool, k8sClient kubernetes.Interface) (bool, error) {
+	deployment, err := getExistingDeployment(name, namespace, k8sClient)
+	if err != nil || deployment == nil || isPaused(deployment.ObjectMeta) == pause {
+		return false, err
+	}
+
+	if pause {
+		deployment = pauseDeployment(deployment)
+	} else {
+		deployment = resumeDeployment(deployment)
+	}
+
+	_, err = k8sClient.AppsV1().Deployments(namespace).Update(context.TODO(), deployment, k8smeta.UpdateOptions{})
+	return err == nil, err
+}
+
+func scaleStatefulSet(spec app.Spec, pause bool, k8sClient kubernetes.Interface) (bool, error) {
+	statefulSet, err := getExistingStatefulSet(spec, k8sClient)
+	if err != nil || statefulSet == nil || isPaused(statefulSet.ObjectMeta) == pause {
+		return false, err
+	}
+
+	if pause {
+		statefulSet = pauseStatefulSet(statefulSet)
+	} else {
+		statefulSet = resumeStatefulSet(statefulSet)
+	}
+
+	_, err = k8sClient.AppsV1().StatefulSets(spec.Namespace).Update(context.TODO(), statefulSet, k8smeta.UpdateOptions{})
+	return err == nil, err
+}
+
+func scaleCronJob(spec app.Spec, pause bool, k8sClient kubernetes.Interface) (bool, error) {
+	cronJob, err := getExistingCronJob(spec, k8sClient)
+	if err != nil || cronJob == nil || isPaused(cronJob.ObjectMeta) == pause {
+		return false, err
+	}
+
+	_, err = k8sClient.BatchV1beta1().CronJobs(spec.Namespace).Update(context.TODO(), suspendCronJob(cronJob, pause), k8smeta.UpdateOptions{})
+	return err == nil, err
+}
+
+func scaleAutoscaler(spec app.Spec, pause bool, k8sClient kubernetes.Interface) (bool, error) {
+	autoscaler, err := getExistingAutoscaler(spec, k8sClient)
+	if err != nil || autoscaler == nil || isPaused(autoscaler.ObjectMeta) == pause {
+		return false, err
+	}
+
+	// The pin must apply to the deployment serving traffic, which is the active color of a BlueGreen application
+	if autoscaler.Spec.ScaleTargetRef.Kind == "Deployment" {
+		if autoscaler.Spec.ScaleTargetRef.Name, err = blueGreenScaleTarget(spec, k8sClient); err != nil {
+			return false, err
+		}
+	}
+
+	if pause {
+		autoscaler = pinAutoscaler(autoscaler)
+	} else {
+		autoscaler = unpinAutoscaler(autoscaler)
+	}
+
+	_, err = k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(spec.Namespace).Update(context.TODO(), autoscaler, k8smeta.UpdateOptions{})
+	return err == nil, err
+}
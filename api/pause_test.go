@@ -0,0 +1,262 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	naisDeploymentRequest := naisrequest.Deploy{Namespace: namespace, Application: appName, Version: version}
+	manifest := newDefaultManifest()
+
+	deploymentDef, _ := createDeploymentDef(spec, []NaisResource{}, manifest, naisDeploymentRequest, nil, false)
+	deploymentDef.Spec.Replicas = int32p(3)
+	redisDef := createRedisDeploymentDef(createRedisSpec(spec), updateDefaultRedisValues(Redis{Enabled: true}), nil)
+	autoscalerDef := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil)
+	clientset := fake.NewSimpleClientset(deploymentDef, redisDef, autoscalerDef)
+
+	t.Run("pausing scales the deployment and redis to zero and pins the autoscaler", func(t *testing.T) {
+		result, err := pauseK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, PauseResult{Application: appName, Namespace: namespace, Paused: true, Deployment: true, Redis: true, Autoscaler: true}, result)
+
+		deployment, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+		assert.Equal(t, "true", deployment.Annotations[PausedAnnotation])
+		assert.Equal(t, "3", deployment.Annotations[PausedReplicasAnnotation])
+
+		redis, _ := getExistingDeployment(createRedisSpec(spec).ResourceName(), namespace, clientset)
+		assert.Equal(t, int32(0), *redis.Spec.Replicas)
+
+		autoscaler, _ := getExistingAutoscaler(spec, clientset)
+		assert.Equal(t, int32(2), autoscaler.Spec.MaxReplicas)
+		assert.Equal(t, "4", autoscaler.Annotations[PausedMaxReplicasAnnotation])
+	})
+
+	t.Run("pausing a paused app changes nothing", func(t *testing.T) {
+		result, err := pauseK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.False(t, result.Deployment)
+		assert.False(t, result.Autoscaler)
+	})
+
+	t.Run("redeploying a paused app keeps it paused", func(t *testing.T) {
+		existingDeployment, _ := getExistingAppDeployment(spec, clientset)
+		deployment, err := createDeploymentDef(spec, []NaisResource{}, manifest, naisDeploymentRequest, existingDeployment, false)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+		assert.True(t, isPaused(deployment.ObjectMeta))
+
+		existingRedis, _ := getExistingDeployment(createRedisSpec(spec).ResourceName(), namespace, clientset)
+		redis := createRedisDeploymentDef(createRedisSpec(spec), updateDefaultRedisValues(Redis{Enabled: true}), existingRedis)
+		assert.Equal(t, int32(0), *redis.Spec.Replicas)
+
+		existingAutoscaler, _ := getExistingAutoscaler(spec, clientset)
+		autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 6, CpuThresholdPercentage: 50}, existingAutoscaler)
+		assert.Equal(t, int32(2), autoscaler.Spec.MaxReplicas)
+		assert.Equal(t, "6", autoscaler.Annotations[PausedMaxReplicasAnnotation])
+	})
+
+	t.Run("resuming restores replicas and releases the autoscaler", func(t *testing.T) {
+		result, err := resumeK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, PauseResult{Application: appName, Namespace: namespace, Paused: false, Deployment: true, Redis: true, Autoscaler: true}, result)
+
+		deployment, _ := getExistingAppDeployment(spec, clientset)
+		assert.Equal(t, int32(3), *deployment.Spec.Replicas)
+		assert.False(t, isPaused(deployment.ObjectMeta))
+		assert.NotContains(t, deployment.Annotations, PausedReplicasAnnotation)
+
+		redis, _ := getExistingDeployment(createRedisSpec(spec).ResourceName(), namespace, clientset)
+		assert.Equal(t, int32(1), *redis.Spec.Replicas)
+
+		autoscaler, _ := getExistingAutoscaler(spec, clientset)
+		assert.Equal(t, int32(4), autoscaler.Spec.MaxReplicas)
+		assert.False(t, isPaused(autoscaler.ObjectMeta))
+	})
+}
+
+func TestPauseAndResumeBlueGreen(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Namespace: namespace, Application: appName, Version: version}
+	manifest := newBlueGreenManifest()
+
+	service := createServiceDef(spec)
+	fillServiceSpec(spec, &service.Spec, ColorBlue)
+	service.Annotations = map[string]string{ActiveColorAnnotation: ColorBlue, PreviousColorAnnotation: ColorGreen}
+	service.ResourceVersion = resourceVersion
+	blue, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, request, ColorBlue, 3, nil, false)
+	green, _ := createBlueGreenDeploymentDef(spec, []NaisResource{}, manifest, request, ColorGreen, 2, nil, false)
+	green.ResourceVersion = resourceVersion
+	autoscalerDef := createOrUpdateAutoscalerDef(spec, Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}, nil)
+	clientset := fake.NewSimpleClientset(service, blue, green, autoscalerDef)
+
+	t.Run("pausing scales both colors to zero and pins the autoscaler on the active color", func(t *testing.T) {
+		result, err := pauseK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.Deployment)
+		assert.True(t, result.Autoscaler)
+
+		for color, replicas := range map[string]string{ColorBlue: "3", ColorGreen: "2"} {
+			deployment, _ := getExistingDeployment(createColorName(spec, color), namespace, clientset)
+			assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+			assert.Equal(t, replicas, deployment.Annotations[PausedReplicasAnnotation])
+		}
+
+		autoscaler, _ := getExistingAutoscaler(spec, clientset)
+		assert.Equal(t, createColorName(spec, ColorBlue), autoscaler.Spec.ScaleTargetRef.Name)
+		assert.Equal(t, int32(2), autoscaler.Spec.MaxReplicas)
+	})
+
+	t.Run("a color deployed while paused is created paused", func(t *testing.T) {
+		deployment, err := createOrUpdateBlueGreenDeployment(spec, request, manifest, []NaisResource{}, false, clientset)
+		assert.NoError(t, err)
+		assert.Equal(t, createColorName(spec, ColorGreen), deployment.Name)
+		assert.True(t, isPaused(deployment.ObjectMeta))
+		assert.Equal(t, int32(0), *deployment.Spec.Replicas)
+		assert.Equal(t, "3", deployment.Annotations[PausedReplicasAnnotation])
+	})
+
+	t.Run("resuming restores both colors", func(t *testing.T) {
+		result, err := resumeK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.Deployment)
+
+		for _, color := range []string{ColorBlue, ColorGreen} {
+			deployment, _ := getExistingDeployment(createColorName(spec, color), namespace, clientset)
+			assert.Equal(t, int32(3), *deployment.Spec.Replicas)
+			assert.False(t, isPaused(deployment.ObjectMeta))
+		}
+
+		autoscaler, _ := getExistingAutoscaler(spec, clientset)
+		assert.Equal(t, int32(4), autoscaler.Spec.MaxReplicas)
+	})
+}
+
+func TestPauseAndResumeStatefulSetAndCronJob(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Namespace: namespace, Application: appName, Version: version}
+
+	t.Run("a statefulset is scaled to zero and keeps its pause when redeployed", func(t *testing.T) {
+		manifest := newStatefulSetManifest()
+		statefulSetDef, _ := createStatefulSetDef(spec, []NaisResource{}, manifest, request, nil, false)
+		statefulSetDef.Spec.Replicas = int32p(3)
+		statefulSetDef.ResourceVersion = resourceVersion
+		clientset := fake.NewSimpleClientset(statefulSetDef)
+
+		result, err := pauseK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.StatefulSet)
+		assert.False(t, result.Deployment)
+
+		statefulSet, _ := getExistingStatefulSet(spec, clientset)
+		assert.Equal(t, int32(0), *statefulSet.Spec.Replicas)
+		assert.Equal(t, "3", statefulSet.Annotations[PausedReplicasAnnotation])
+
+		redeployed, err := createStatefulSetDef(spec, []NaisResource{}, manifest, request, statefulSet, false)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), *redeployed.Spec.Replicas)
+
+		result, err = resumeK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.StatefulSet)
+
+		statefulSet, _ = getExistingStatefulSet(spec, clientset)
+		assert.Equal(t, int32(3), *statefulSet.Spec.Replicas)
+		assert.False(t, isPaused(statefulSet.ObjectMeta))
+	})
+
+	t.Run("a cronjob is suspended and stays suspended when redeployed", func(t *testing.T) {
+		manifest := newJobManifest(WorkloadCronJob)
+		cronJobDef, _ := createCronJobDef(spec, request, manifest, []NaisResource{}, nil)
+		assert.False(t, *cronJobDef.Spec.Suspend)
+		cronJobDef.ResourceVersion = resourceVersion
+		clientset := fake.NewSimpleClientset(cronJobDef)
+
+		result, err := pauseK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.CronJob)
+
+		cronJob, _ := getExistingCronJob(spec, clientset)
+		assert.True(t, *cronJob.Spec.Suspend)
+
+		redeployed, err := createCronJobDef(spec, request, manifest, []NaisResource{}, cronJob)
+		assert.NoError(t, err)
+		assert.True(t, *redeployed.Spec.Suspend)
+
+		result, err = resumeK8sResources(spec, clientset)
+		assert.NoError(t, err)
+		assert.True(t, result.CronJob)
+
+		cronJob, _ = getExistingCronJob(spec, clientset)
+		assert.False(t, *cronJob.Spec.Suspend)
+		assert.False(t, isPaused(cronJob.ObjectMeta))
+	})
+
+	t.Run("a job cannot be paused", func(t *testing.T) {
+		job, _ := createJobDef(spec, request, newJobManifest(WorkloadJob), []NaisResource{})
+		api := Api{Clientset: fake.NewSimpleClientset(job), DynamicClient: newFakeDynamicClient()}
+
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/app/%s/%s/pause", namespace, appName), nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Contains(t, rr.Body.String(), errNotPausable.Error())
+	})
+}
+
+func TestPauseHandler(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	deploymentDef, _ := createDeploymentDef(spec, []NaisResource{}, newDefaultManifest(), naisrequest.Deploy{Application: appName, Namespace: namespace}, nil, false)
+	api := Api{Clientset: fake.NewSimpleClientset(deploymentDef), DynamicClient: newFakeDynamicClient()}
+
+	post := func(path string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", path, nil)
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("an app that is being deployed is not paused", func(t *testing.T) {
+		deployRequest := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: "2", CorrelationID: "deploy-2"}
+		assert.NoError(t, acquireDeployLock(spec, deployRequest, api.Clientset))
+		defer releaseDeployLock(spec, deployRequest, api.Clientset)
+
+		rr := post(fmt.Sprintf("/app/%s/%s/pause", namespace, appName))
+		assert.Equal(t, http.StatusConflict, rr.Code)
+
+		deployment, _ := getExistingAppDeployment(spec, api.Clientset)
+		assert.False(t, isPaused(deployment.ObjectMeta))
+	})
+
+	t.Run("pausing an app that is not deployed is not found", func(t *testing.T) {
+		rr := post(fmt.Sprintf("/app/%s/%s/pause", namespace, otherAppName))
+		assert.Equal(t, http.StatusNotFound, rr.Code)
+	})
+
+	t.Run("pause and resume report what was scaled", func(t *testing.T) {
+		rr := post(fmt.Sprintf("/app/%s/%s/pause", namespace, appName))
+		assert.Equal(t, http.StatusOK, rr.Code)
+
+		var result PauseResult
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		assert.True(t, result.Paused)
+		assert.True(t, result.Deployment)
+		assert.False(t, result.Redis)
+
+		rr = post(fmt.Sprintf("/app/%s/%s/resume", namespace, appName))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &result))
+		assert.False(t, result.Paused)
+		assert.True(t, result.Deployment)
+	})
+}
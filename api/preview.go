@@ -0,0 +1,128 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/spf13/viper"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EnvPreviewTTL            = "NAISD_PREVIEW_TTL"
+	PreviewLabel             = "nais.io/preview"
+	PreviewExpiresAnnotation = "nais.io/preview-expires"
+	previewCheckInterval     = time.Minute
+)
+
+func init() {
+	viper.BindEnv(EnvPreviewTTL, EnvPreviewTTL)
+	viper.SetDefault(EnvPreviewTTL, "72h")
+}
+
+// previewTTL is how long a preview lives after its last deploy, unless the deploy request asks for another TTL
+func previewTTL(deploymentRequest naisrequest.Deploy) time.Duration {
+	if ttl, err := time.ParseDuration(deploymentRequest.PreviewTTL); err == nil && ttl > 0 {
+		return ttl
+	}
+
+	ttl, err := time.ParseDuration(viper.GetString(EnvPreviewTTL))
+	if err != nil || ttl <= 0 {
+		glog.Warningf("%s is not a positive duration, previews expire after 72h", EnvPreviewTTL)
+		return 72 * time.Hour
+	}
+
+	return ttl
+}
+
+// markPreview labels the service account of a preview with its ID and when it expires. Every kind of workload has a
+// service account, and it owns the preview's other resources. Each deploy to the preview pushes the expiry forward.
+func markPreview(serviceAccount *k8score.ServiceAccount, deploymentRequest naisrequest.Deploy, now time.Time, k8sClient kubernetes.Interface) (*k8score.ServiceAccount, error) {
+	if serviceAccount.Labels == nil {
+		serviceAccount.Labels = make(map[string]string, 1)
+	}
+	if serviceAccount.Annotations == nil {
+		serviceAccount.Annotations = make(map[string]string, 1)
+	}
+
+	serviceAccount.Labels[PreviewLabel] = deploymentRequest.Preview
+	serviceAccount.Annotations[PreviewExpiresAnnotation] = now.Add(previewTTL(deploymentRequest)).UTC().Format(time.RFC3339)
+
+	return k8sClient.CoreV1().ServiceAccounts(serviceAccount.Namespace).Update(context.TODO(), serviceAccount, k8smeta.UpdateOptions{})
+}
+
+// previewExpired is true for previews whose expiry has passed, or cannot be read
+func previewExpired(serviceAccount k8score.ServiceAccount, now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, serviceAccount.Annotations[PreviewExpiresAnnotation])
+	return err != nil || !now.Before(expires)
+}
+
+// PreviewJanitor deletes previews that have not been deployed to within their TTL. It must only run in one naisd
+// replica, and is registered as a leader task when leader election is enabled.
+type PreviewJanitor struct {
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
+	identity      string
+}
+
+// NewPreviewJanitor creates a janitor holding the deploy locks it takes as identity, typically the pod name
+func NewPreviewJanitor(client kubernetes.Interface, dynamicClient dynamic.Interface, identity string) *PreviewJanitor {
+	return &PreviewJanitor{client: client, dynamicClient: dynamicClient, identity: identity + "/preview-janitor"}
+}
+
+// Run deletes expired previews every previewCheckInterval until ctx is done
+func (j *PreviewJanitor) Run(ctx context.Context) {
+	runEvery(ctx, previewCheckInterval, "expired previews", j.reconcile)
+}
+
+func (j *PreviewJanitor) reconcile(now time.Time) error {
+	selector := createManagedSelector("") + "," + PreviewLabel
+	serviceAccounts, err := j.client.CoreV1().ServiceAccounts("").List(context.TODO(), k8smeta.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return fmt.Errorf("unable to list previews: %s", err)
+	}
+
+	for _, serviceAccount := range serviceAccounts.Items {
+		if !previewExpired(serviceAccount, now) {
+			continue
+		}
+
+		// The preview is deleted under the deploy lock, and its expiry is read again under it, as a deploy may have
+		// pushed the expiry forward since the service accounts were listed
+		spec := app.Spec{Application: serviceAccount.Labels["app"], Namespace: serviceAccount.Namespace, Team: serviceAccount.Labels["team"]}
+		var deleted bool
+		err := withDeployLock(spec, j.identity, serviceAccount.Annotations[VersionAnnotation], j.client, func() error {
+			current, err := j.client.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), serviceAccount.Name, k8smeta.GetOptions{})
+			if errors.IsNotFound(err) {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !previewExpired(*current, now) {
+				return nil
+			}
+
+			_, err = deleteK8sResouces(spec, j.client, j.dynamicClient)
+			deleted = err == nil
+			return err
+		})
+
+		if _, locked := err.(DeployLockedError); locked {
+			glog.Infof("Not deleting expired preview %s in %s while it is being deployed", spec.Application, spec.Namespace)
+		} else if err != nil {
+			glog.Errorf("Failed while deleting expired preview %s in %s: %s", spec.Application, spec.Namespace, err)
+		} else if deleted {
+			glog.Infof("Deleted preview %s in %s, which expired at %s", spec.Application, spec.Namespace, serviceAccount.Annotations[PreviewExpiresAnnotation])
+		}
+	}
+
+	return nil
+}
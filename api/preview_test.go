@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/nais/naisd/pkg/event"
+	"github.com/nais/naisd/pkg/notify"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/h2non/gock.v1"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestPreviewTTL(t *testing.T) {
+	assert.Equal(t, 72*time.Hour, previewTTL(naisrequest.Deploy{}))
+	assert.Equal(t, 2*time.Hour, previewTTL(naisrequest.Deploy{PreviewTTL: "2h"}))
+
+	viper.Set(EnvPreviewTTL, "24h")
+	defer viper.Set(EnvPreviewTTL, "72h")
+	assert.Equal(t, 24*time.Hour, previewTTL(naisrequest.Deploy{}))
+}
+
+func TestPreviewJanitor(t *testing.T) {
+	deployed := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	clientset := fake.NewSimpleClientset()
+
+	for _, preview := range []naisrequest.Deploy{
+		{Application: appName, Namespace: namespace, Preview: "1", PreviewTTL: "1h"},
+		{Application: appName, Namespace: namespace, Preview: "2", PreviewTTL: "48h"},
+	} {
+		spec := app.Spec{Application: preview.DeployName(), Namespace: namespace, Team: teamName}
+		serviceAccount, _ := clientset.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), createServiceAccountDef(spec), k8smeta.CreateOptions{})
+		clientset.CoreV1().Services(namespace).Create(context.TODO(), createServiceDef(spec), k8smeta.CreateOptions{})
+		_, err := markPreview(serviceAccount, preview, deployed, clientset)
+		assert.NoError(t, err)
+	}
+
+	application := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	clientset.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), createServiceAccountDef(application), k8smeta.CreateOptions{})
+
+	janitor := NewPreviewJanitor(clientset, newFakeDynamicClient(), "naisd-0")
+	assert.NoError(t, janitor.reconcile(deployed.Add(2*time.Hour)))
+
+	_, err := clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), appName+"-pr-1", k8smeta.GetOptions{})
+	assert.Error(t, err, "the expired preview is deleted")
+	_, err = clientset.CoreV1().Services(namespace).Get(context.TODO(), appName+"-pr-1", k8smeta.GetOptions{})
+	assert.Error(t, err)
+
+	preview, err := clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), appName+"-pr-2", k8smeta.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", preview.Labels[PreviewLabel])
+	assert.Equal(t, "2019-08-03T12:00:00Z", preview.Annotations[PreviewExpiresAnnotation])
+
+	_, err = clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), appName, k8smeta.GetOptions{})
+	assert.NoError(t, err, "applications are not previews")
+}
+
+func TestPreviewJanitorLeavesPreviewsBeingDeployed(t *testing.T) {
+	deployed := time.Date(2019, 8, 1, 12, 0, 0, 0, time.UTC)
+	preview := naisrequest.Deploy{Application: appName, Namespace: namespace, Preview: "1", PreviewTTL: "1h", CorrelationID: "deploy-pr-1"}
+	spec := app.Spec{Application: preview.DeployName(), Namespace: namespace, Team: teamName}
+
+	clientset := fake.NewSimpleClientset()
+	serviceAccount, _ := clientset.CoreV1().ServiceAccounts(namespace).Create(context.TODO(), createServiceAccountDef(spec), k8smeta.CreateOptions{})
+	serviceAccount, _ = markPreview(serviceAccount, preview, deployed, clientset)
+	janitor := NewPreviewJanitor(clientset, newFakeDynamicClient(), "naisd-0")
+
+	t.Run("an expired preview is not deleted while it is being deployed", func(t *testing.T) {
+		assert.NoError(t, acquireDeployLock(spec, preview, clientset))
+		assert.NoError(t, janitor.reconcile(deployed.Add(2*time.Hour)))
+
+		_, err := clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+		assert.NoError(t, err)
+	})
+
+	t.Run("a preview whose expiry was pushed forward after it was listed is kept", func(t *testing.T) {
+		assert.NoError(t, releaseDeployLock(spec, preview, clientset))
+
+		// The janitor lists the expired service account, and a deploy renews the preview before the janitor acts
+		stale := serviceAccount.DeepCopy()
+		clientset.PrependReactor("list", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			return true, &k8score.ServiceAccountList{Items: []k8score.ServiceAccount{*stale}}, nil
+		})
+		_, err := markPreview(serviceAccount, preview, deployed.Add(2*time.Hour), clientset)
+		assert.NoError(t, err)
+
+		assert.NoError(t, janitor.reconcile(deployed.Add(2*time.Hour)))
+
+		current, err := clientset.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+		assert.NoError(t, err)
+		assert.False(t, previewExpired(*current, deployed.Add(2*time.Hour)))
+	})
+}
+
+func TestPreviewDeploy(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	events := 0
+	eventHandler := func(event deployment.Event) { events++ }
+	notifications := 0
+	notifier := func(event notify.Event) { notifications++ }
+	api := Api{clientset, newFakeDynamicClient(), "https://fasit.local", "nais.example.tk", "test-cluster", false, false, nil, eventHandler, nil, notifier}
+
+	manifest := NaisManifest{
+		Image: image,
+		Port:  port,
+		Team:  teamName,
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
+			{Alert: "alert", Expr: "up == 0", For: "5m", Annotations: map[string]string{"action": "restart"}},
+		}},
+	}
+	data, _ := yaml.Marshal(manifest)
+
+	defer gock.Off()
+	gock.New("http://repo.com").
+		Get("/app").
+		Reply(200).
+		BodyString(string(data))
+
+	jsn, _ := json.Marshal(naisrequest.Deploy{
+		Application: appName,
+		Version:     version,
+		ManifestUrl: "http://repo.com/app",
+		SkipFasit:   true,
+		Zone:        "fss",
+		Namespace:   namespace,
+		Preview:     "42",
+	})
+
+	req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(string(jsn)))
+	rr := httptest.NewRecorder()
+	api.Handler().ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "- created preview appname-pr-42")
+	assert.NotContains(t, rr.Body.String(), "alerts")
+	assert.Equal(t, 0, events, "previews send no deployment events")
+	assert.Equal(t, 0, notifications, "previews are not announced")
+
+	preview := app.Spec{Application: appName + "-pr-42", Namespace: namespace}
+	deployment, err := getExistingAppDeployment(preview, clientset)
+	assert.NoError(t, err)
+	assert.Equal(t, appName+"-pr-42", deployment.Spec.Template.Spec.Containers[0].Name)
+
+	ingress, err := getExistingIngress(preview, clientset)
+	assert.NoError(t, err)
+	assert.Len(t, ingress.Spec.Rules, 1)
+	assert.Equal(t, "appname-pr-42.nais.example.tk", ingress.Spec.Rules[0].Host)
+
+	application, _ := getExistingAppDeployment(app.Spec{Application: appName, Namespace: namespace}, clientset)
+	assert.Nil(t, application, "the application itself is left alone")
+
+	t.Run("an invalid preview ID is refused", func(t *testing.T) {
+		jsn, _ := json.Marshal(naisrequest.Deploy{Application: appName, Version: version, SkipFasit: true, Zone: "fss", Namespace: namespace, Preview: "PR_42"})
+		req, _ := http.NewRequest("POST", "/deploy", strings.NewReader(string(jsn)))
+		rr := httptest.NewRecorder()
+		api.Handler().ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+	})
+}
@@ -4,11 +4,17 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/promql/parser"
 	"gopkg.in/yaml.v2"
 	k8score "k8s.io/api/core/v1"
-	"strings"
+	"regexp"
 )
 
+// alertVariables can be used in the expr and annotations of alerts, e.g. $app, and are substituted when deploying
+var alertVariables = []string{"app", "team", "namespace", "cluster", "version"}
+
 type PrometheusAlertGroups struct {
 	Groups []PrometheusAlertGroup
 }
@@ -38,12 +44,41 @@ func prefixAlertNames(alertRules []PrometheusAlertRule, prefix string) {
 	return
 }
 
-func substituteNamespaceVariables(alertRules []PrometheusAlertRule, namespace string) {
+func createAlertVariables(spec app.Spec, deploymentRequest naisrequest.Deploy) map[string]string {
+	return map[string]string{
+		"app":       spec.Application,
+		"team":      spec.Team,
+		"namespace": spec.Namespace,
+		"cluster":   deploymentRequest.ClusterName,
+		"version":   deploymentRequest.Version,
+	}
+}
+
+// alertVariablePattern matches a whole variable name, so $application is not taken for $app
+var alertVariablePattern = regexp.MustCompile(`\$[A-Za-z_][A-Za-z0-9_]*`)
+
+// substituteAlertVariables replaces the alert variables found in variables in the expr and annotations of the alerts.
+// Variables that are not found are left as they are.
+func substituteAlertVariables(alertRules []PrometheusAlertRule, variables map[string]string) {
+	replace := func(text string) string {
+		return alertVariablePattern.ReplaceAllStringFunc(text, func(variable string) string {
+			if value, ok := variables[variable[1:]]; ok {
+				return value
+			}
+			return variable
+		})
+	}
+
 	for i := range alertRules {
-		alertRules[i].Expr = strings.Replace(alertRules[i].Expr, "$namespace", namespace, -1)
+		alertRules[i].Expr = replace(alertRules[i].Expr)
+		for key, value := range alertRules[i].Annotations {
+			alertRules[i].Annotations[key] = replace(value)
+		}
 	}
+}
 
-	return
+func substituteNamespaceVariables(alertRules []PrometheusAlertRule, namespace string) {
+	substituteAlertVariables(alertRules, map[string]string{"namespace": namespace})
 }
 
 func addTeamLabel(alertRules []PrometheusAlertRule, teamName string) {
@@ -64,14 +99,23 @@ func createDeploymentPrefix(spec app.Spec) string {
 	return spec.Team + "-" + spec.Application + "-" + spec.Namespace
 }
 
-func addRulesToConfigMap(spec app.Spec, configMap *k8score.ConfigMap, manifest NaisManifest) (*k8score.ConfigMap, error) {
+// createAlertGroup is the rule group of the application's alerts, including the default alerts, which are labelled
+// with the team and prefixed with the application so they are unique in Prometheus
+func createAlertGroup(spec app.Spec, manifest NaisManifest) PrometheusAlertGroup {
 	deploymentPrefix := createDeploymentPrefix(spec)
+	alertRules := createAlertRules(spec, manifest)
+
+	addTeamLabel(alertRules, manifest.Team)
+	prefixAlertNames(alertRules, deploymentPrefix)
+	substituteNamespaceVariables(alertRules, spec.Namespace)
 
-	addTeamLabel(manifest.Alerts, manifest.Team)
-	prefixAlertNames(manifest.Alerts, deploymentPrefix)
-	substituteNamespaceVariables(manifest.Alerts, spec.Namespace)
+	return PrometheusAlertGroup{Name: deploymentPrefix, Rules: alertRules}
+}
+
+func addRulesToConfigMap(spec app.Spec, configMap *k8score.ConfigMap, manifest NaisManifest) (*k8score.ConfigMap, error) {
+	deploymentPrefix := createDeploymentPrefix(spec)
 
-	alertGroup := PrometheusAlertGroup{Name: deploymentPrefix, Rules: manifest.Alerts}
+	alertGroup := createAlertGroup(spec, manifest)
 	alertGroups := PrometheusAlertGroups{Groups: []PrometheusAlertGroup{alertGroup}}
 
 	alertGroupYamlBytes, err := yaml.Marshal(alertGroups)
@@ -101,7 +145,7 @@ func removeRulesFromConfigMap(configMap *k8score.ConfigMap, spec app.Spec) *k8sc
 }
 
 func validateAlertRules(manifest NaisManifest) *ValidationError {
-	for _, alertRule := range manifest.Alerts {
+	for _, alertRule := range manifest.Alerts.Rules {
 		if alertRule.Alert == "" {
 			return &ValidationError{
 				"Alert must be specified",
@@ -114,6 +158,18 @@ func validateAlertRules(manifest NaisManifest) *ValidationError {
 				map[string]string{"Expr": alertRule.Expr},
 			}
 		}
+		if err := parseAlertExpr(alertRule.Expr); err != nil {
+			return &ValidationError{
+				"Expr must be a valid PromQL expression",
+				map[string]string{"Expr": alertRule.Expr, "Error": err.Error()},
+			}
+		}
+		if _, err := model.ParseDuration(alertRule.For); alertRule.For != "" && err != nil {
+			return &ValidationError{
+				"For must be a duration, e.g. 5m",
+				map[string]string{"For": alertRule.For},
+			}
+		}
 		if action, exists := alertRule.Annotations["action"]; !exists {
 			return &ValidationError{
 				"An annotation named action must be specified",
@@ -124,3 +180,18 @@ func validateAlertRules(manifest NaisManifest) *ValidationError {
 
 	return nil
 }
+
+// parseAlertExpr parses the expr of an alert as Prometheus would, with the alert variables substituted by a value
+// that is valid wherever a variable can be used
+func parseAlertExpr(expr string) error {
+	variables := make(map[string]string, len(alertVariables))
+	for _, name := range alertVariables {
+		variables[name] = "variable"
+	}
+
+	alertRules := []PrometheusAlertRule{{Expr: expr}}
+	substituteAlertVariables(alertRules, variables)
+
+	_, err := parser.ParseExpr(alertRules[0].Expr)
+	return err
+}
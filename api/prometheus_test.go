@@ -2,6 +2,7 @@ package api
 
 import (
 	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
 	"github.com/stretchr/testify/assert"
 	"gopkg.in/yaml.v2"
 	"k8s.io/api/core/v1"
@@ -10,21 +11,21 @@ import (
 
 func TestValidatePrometheusAlertRules(t *testing.T) {
 	invalidManifest := NaisManifest{
-		Alerts: []PrometheusAlertRule{{Alert: "Name"}},
+		Alerts: Alerts{Rules: []PrometheusAlertRule{{Alert: "Name"}}},
 	}
 
 	invalidManifestNoAction := NaisManifest{
-		Alerts: []PrometheusAlertRule{
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
 			{
 				Alert: "Name",
-				For:   "For",
+				For:   "5m",
 				Expr:  "Expression",
 			},
-		},
+		}},
 	}
 
 	validManifest := NaisManifest{
-		Alerts: []PrometheusAlertRule{
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
 			{
 				Alert: "Name",
 				Expr:  "Expression",
@@ -32,14 +33,14 @@ func TestValidatePrometheusAlertRules(t *testing.T) {
 					"action": "action",
 				},
 			},
-		},
+		}},
 	}
 
 	validManifestWithLabels := NaisManifest{
-		Alerts: []PrometheusAlertRule{
+		Alerts: Alerts{Rules: []PrometheusAlertRule{
 			{
 				Alert: "Name",
-				For:   "For",
+				For:   "5m",
 				Expr:  "Expression",
 				Annotations: map[string]string{
 					"action": "action",
@@ -48,7 +49,7 @@ func TestValidatePrometheusAlertRules(t *testing.T) {
 					"label": "label",
 				},
 			},
-		},
+		}},
 	}
 
 	err := validateAlertRules(invalidManifest)
@@ -64,6 +65,30 @@ func TestValidatePrometheusAlertRules(t *testing.T) {
 	assert.Nil(t, noErr2)
 }
 
+func TestValidateAlertExprAndFor(t *testing.T) {
+	alert := PrometheusAlertRule{
+		Alert:       "Name",
+		Expr:        `sum(rate(http_requests_total{app="$app", namespace="$namespace", status=~"5.."}[5m])) by (cluster) > 0`,
+		For:         "5m",
+		Annotations: map[string]string{"action": "action"},
+	}
+	assert.Nil(t, validateAlertRules(NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{alert}}}))
+
+	invalidExpr := alert
+	invalidExpr.Expr = `up{app="$app"} >`
+	err := validateAlertRules(NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{invalidExpr}}})
+	assert.Equal(t, "Expr must be a valid PromQL expression", err.ErrorMessage)
+	assert.NotEmpty(t, err.Fields["Error"])
+
+	unknownVariable := alert
+	unknownVariable.Expr = `up{app="$app"} == $threshold`
+	assert.NotNil(t, validateAlertRules(NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{unknownVariable}}}))
+
+	invalidFor := alert
+	invalidFor.For = "5 minutes"
+	assert.Equal(t, "For must be a duration, e.g. 5m", validateAlertRules(NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{invalidFor}}}).ErrorMessage)
+}
+
 func TestAddRulesToConfigMap(t *testing.T) {
 	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
 	deploymentPrefix := createDeploymentPrefix(spec)
@@ -87,7 +112,7 @@ func TestAddRulesToConfigMap(t *testing.T) {
 
 	manifest := NaisManifest{
 		Team:   teamName,
-		Alerts: []PrometheusAlertRule{alertRule},
+		Alerts: Alerts{Rules: []PrometheusAlertRule{alertRule}},
 	}
 
 	resultingConfigMap, err := addRulesToConfigMap(spec, configMap, manifest)
@@ -116,7 +141,7 @@ func TestAddTeamLabel(t *testing.T) {
 	alerts := []PrometheusAlertRule{
 		{
 			Alert: "Name",
-			For:   "For",
+			For:   "5m",
 			Expr:  "Expression",
 			Annotations: map[string]string{
 				"action": "action",
@@ -141,7 +166,7 @@ func TestPrefixAlertNames(t *testing.T) {
 	alerts := []PrometheusAlertRule{
 		{
 			Alert: alert1,
-			For:   "For",
+			For:   "5m",
 			Expr:  "Expression",
 			Annotations: map[string]string{
 				"action": "action",
@@ -149,7 +174,7 @@ func TestPrefixAlertNames(t *testing.T) {
 		},
 		{
 			Alert: alert2,
-			For:   "For",
+			For:   "5m",
 			Expr:  "Expression",
 			Annotations: map[string]string{
 				"action": "action",
@@ -169,7 +194,7 @@ func TestNamespaceSubstitution(t *testing.T) {
 	alerts := []PrometheusAlertRule{
 		{
 			Alert: "alert1",
-			For:   "For",
+			For:   "5m",
 			Expr:  "up{kubernetes_namespace=\"$namespace\"} > 0",
 			Annotations: map[string]string{
 				"action": "action",
@@ -182,3 +207,31 @@ func TestNamespaceSubstitution(t *testing.T) {
 	substituteNamespaceVariables(alerts, "q1")
 	assert.Equal(t, alerts[0].Expr, "up{kubernetes_namespace=\"q1\"} > 0")
 }
+
+func TestAlertVariableSubstitution(t *testing.T) {
+	alerts := []PrometheusAlertRule{
+		{
+			Alert: "alert1",
+			Expr:  `kube_pod_container_status_restarts_total{container="$app", namespace="$namespace"} > 0`,
+			Annotations: map[string]string{
+				"action":      "Ask $team about $app $version in $cluster",
+				"description": "$unknown is left as it is",
+			},
+		},
+	}
+
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	substituteAlertVariables(alerts, createAlertVariables(spec, naisrequest.Deploy{ClusterName: "prod-fss", Version: version}))
+
+	assert.Equal(t, `kube_pod_container_status_restarts_total{container="appname", namespace="`+namespace+`"} > 0`, alerts[0].Expr)
+	assert.Equal(t, "Ask "+teamName+" about appname "+version+" in prod-fss", alerts[0].Annotations["action"])
+	assert.Equal(t, "$unknown is left as it is", alerts[0].Annotations["description"])
+
+	t.Run("only whole variable names are substituted", func(t *testing.T) {
+		alerts := []PrometheusAlertRule{{Expr: `up{application="$application", app="$app"} == 0`, Annotations: map[string]string{"action": "$app_owner: $labels.app is $value"}}}
+		substituteAlertVariables(alerts, createAlertVariables(spec, naisrequest.Deploy{}))
+
+		assert.Equal(t, `up{application="$application", app="appname"} == 0`, alerts[0].Expr)
+		assert.Equal(t, "$app_owner: $labels.app is $value", alerts[0].Annotations["action"])
+	})
+}
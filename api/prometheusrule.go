@@ -0,0 +1,289 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	EnvAlertsOutput             = "NAISD_ALERTS_OUTPUT"
+	EnvPrometheusRuleLabels     = "NAISD_PROMETHEUSRULE_LABELS"
+	AlertsOutputConfigMap       = "configmap"
+	AlertsOutputPrometheusRule  = "prometheusrule"
+	alertRulesMigrationInterval = 10 * time.Minute
+)
+
+// PrometheusRuleResource is the custom resource the Prometheus Operator (github.com/coreos/prometheus-operator) loads
+// alert rules from
+var PrometheusRuleResource = schema.GroupVersionResource{
+	Group:    "monitoring.coreos.com",
+	Version:  "v1",
+	Resource: "prometheusrules",
+}
+
+func init() {
+	viper.BindEnv(EnvAlertsOutput, EnvAlertsOutput)
+	viper.SetDefault(EnvAlertsOutput, AlertsOutputConfigMap)
+	viper.BindEnv(EnvPrometheusRuleLabels, EnvPrometheusRuleLabels)
+	viper.SetDefault(EnvPrometheusRuleLabels, "prometheus=kube-prometheus,role=alert-rules")
+}
+
+// alertsToPrometheusRules is set in clusters running the Prometheus Operator, where each application's alert rules
+// are kept in a PrometheusRule in its own namespace rather than in the shared app-rules configmap
+func alertsToPrometheusRules() bool {
+	return viper.GetString(EnvAlertsOutput) == AlertsOutputPrometheusRule
+}
+
+// prometheusRuleLabels are the labels the Prometheus Operator selects rules by, as configured in its ruleSelector
+func prometheusRuleLabels() map[string]string {
+	ruleLabels, err := labels.ConvertSelectorToLabelsMap(viper.GetString(EnvPrometheusRuleLabels))
+	if err != nil {
+		glog.Warningf("%s is not a list of labels: %s", EnvPrometheusRuleLabels, err)
+	}
+
+	return ruleLabels
+}
+
+func createPrometheusRuleGroups(alertGroups []PrometheusAlertGroup) []interface{} {
+	groups := []interface{}{}
+
+	for _, alertGroup := range alertGroups {
+		rules := []interface{}{}
+		for _, alertRule := range alertGroup.Rules {
+			rule := map[string]interface{}{
+				"alert":       alertRule.Alert,
+				"expr":        alertRule.Expr,
+				"labels":      createStringMap(alertRule.Labels),
+				"annotations": createStringMap(alertRule.Annotations),
+			}
+			if len(alertRule.For) > 0 {
+				rule["for"] = alertRule.For
+			}
+			rules = append(rules, rule)
+		}
+
+		groups = append(groups, map[string]interface{}{"name": alertGroup.Name, "rules": rules})
+	}
+
+	return groups
+}
+
+// Unstructured objects only hold values they can deep copy, so string maps are converted
+func createStringMap(values map[string]string) map[string]interface{} {
+	stringMap := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		stringMap[k] = v
+	}
+	return stringMap
+}
+
+// Creates a PrometheusRule custom resource
+// If existingRule is provided, its groups are replaced and metadata such as resourceVersion is kept
+func createPrometheusRuleDef(spec app.Spec, alertGroups []PrometheusAlertGroup, existingRule *unstructured.Unstructured) *unstructured.Unstructured {
+	prometheusRule := existingRule
+	if prometheusRule == nil {
+		prometheusRule = &unstructured.Unstructured{}
+		prometheusRule.SetAPIVersion(PrometheusRuleResource.GroupVersion().String())
+		prometheusRule.SetKind("PrometheusRule")
+		prometheusRule.SetName(spec.ResourceName())
+		prometheusRule.SetNamespace(spec.Namespace)
+	}
+
+	objectMeta := addLabelsToObjectMeta(k8smeta.ObjectMeta{
+		Labels:          prometheusRule.GetLabels(),
+		Annotations:     prometheusRule.GetAnnotations(),
+		OwnerReferences: prometheusRule.GetOwnerReferences(),
+	}, spec)
+	for k, v := range prometheusRuleLabels() {
+		objectMeta.Labels[k] = v
+	}
+
+	prometheusRule.SetLabels(objectMeta.Labels)
+	prometheusRule.SetAnnotations(objectMeta.Annotations)
+	prometheusRule.SetOwnerReferences(objectMeta.OwnerReferences)
+	prometheusRule.Object["spec"] = map[string]interface{}{"groups": createPrometheusRuleGroups(alertGroups)}
+
+	return prometheusRule
+}
+
+func getExistingPrometheusRule(spec app.Spec, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	prometheusRule, err := dynamicClient.Resource(PrometheusRuleResource).Namespace(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return prometheusRule, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+func createOrUpdatePrometheusRule(spec app.Spec, alertGroups []PrometheusAlertGroup, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	existingRule, err := getExistingPrometheusRule(spec, dynamicClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing prometheusrule: %s", err)
+	}
+
+	prometheusRule := createPrometheusRuleDef(spec, alertGroups, existingRule)
+	prometheusRuleInterface := dynamicClient.Resource(PrometheusRuleResource).Namespace(spec.Namespace)
+
+	if prometheusRule.GetResourceVersion() != "" {
+		return prometheusRuleInterface.Update(context.TODO(), prometheusRule, k8smeta.UpdateOptions{})
+	}
+	return prometheusRuleInterface.Create(context.TODO(), prometheusRule, k8smeta.CreateOptions{})
+}
+
+func createOrUpdateAppPrometheusRule(spec app.Spec, manifest NaisManifest, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	if len(createAlertRules(spec, manifest)) == 0 {
+		return nil, nil
+	}
+
+	return createOrUpdatePrometheusRule(spec, []PrometheusAlertGroup{createAlertGroup(spec, manifest)}, dynamicClient)
+}
+
+func deletePrometheusRule(spec app.Spec, dynamicClient dynamic.Interface) error {
+	return dynamicClient.Resource(PrometheusRuleResource).Namespace(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
+}
+
+// AlertRulesMigrator moves the rules of applications from the shared app-rules configmap to PrometheusRules when
+// naisd is configured to write alerts as PrometheusRules. Applications that are deployed are migrated by the deploy,
+// this covers those that are not. It must only run in one naisd replica.
+type AlertRulesMigrator struct {
+	client        kubernetes.Interface
+	dynamicClient dynamic.Interface
+	identity      string
+}
+
+// NewAlertRulesMigrator creates a migrator holding the deploy locks it takes as identity, typically the pod name
+func NewAlertRulesMigrator(client kubernetes.Interface, dynamicClient dynamic.Interface, identity string) *AlertRulesMigrator {
+	return &AlertRulesMigrator{client: client, dynamicClient: dynamicClient, identity: identity + "/alert-rules-migrator"}
+}
+
+// Run migrates alert rules every alertRulesMigrationInterval until ctx is done
+func (m *AlertRulesMigrator) Run(ctx context.Context) {
+	runEvery(ctx, alertRulesMigrationInterval, "alert rules to migrate", m.reconcile)
+}
+
+func (m *AlertRulesMigrator) reconcile(now time.Time) error {
+	if !alertsToPrometheusRules() {
+		return nil
+	}
+
+	configMap, err := getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, m.client)
+	if err != nil {
+		return fmt.Errorf("unable to get existing configmap: %s", err)
+	} else if configMap == nil || len(configMap.Data) == 0 {
+		return nil
+	}
+
+	for key := range configMap.Data {
+		serviceAccount, err := m.findServiceAccount(key)
+		if err != nil {
+			glog.Errorf("Failed while finding the application of alert rules %s: %s", key, err)
+			continue
+		} else if serviceAccount == nil {
+			continue
+		}
+
+		spec := app.Spec{
+			Application: serviceAccount.Labels["app"],
+			Namespace:   serviceAccount.Namespace,
+			Team:        serviceAccount.Labels["team"],
+			Owner:       createOwnerReference(serviceAccount),
+		}
+
+		err = withDeployLock(spec, m.identity, serviceAccount.Annotations[VersionAnnotation], m.client, func() error {
+			return m.migrate(spec)
+		})
+		if _, locked := err.(DeployLockedError); locked {
+			glog.Infof("Not migrating alert rules of %s in %s while it is being deployed", spec.Application, spec.Namespace)
+			continue
+		} else if err != nil {
+			glog.Errorf("Failed while migrating alert rules of %s in %s: %s", spec.Application, spec.Namespace, err)
+			continue
+		}
+
+		glog.Infof("Migrated alert rules of %s in %s to a prometheusrule", spec.Application, spec.Namespace)
+	}
+
+	return nil
+}
+
+// findServiceAccount finds the service account of the application whose rule group is stored under key. The rule
+// groups are named <team>-<application>-<namespace>.yml, and as all three may contain dashes, every way of splitting
+// the name is tried. Service accounts created before naisd labelled its objects as managed are found as well, as they
+// are looked up by name and matched on the app and team labels naisd has always set.
+func (m *AlertRulesMigrator) findServiceAccount(key string) (*k8score.ServiceAccount, error) {
+	if !strings.HasSuffix(key, ".yml") {
+		return nil, nil
+	}
+
+	parts := strings.Split(strings.TrimSuffix(key, ".yml"), "-")
+	for appStart := 1; appStart < len(parts)-1; appStart++ {
+		for namespaceStart := appStart + 1; namespaceStart < len(parts); namespaceStart++ {
+			application := strings.Join(parts[appStart:namespaceStart], "-")
+			namespace := strings.Join(parts[namespaceStart:], "-")
+
+			serviceAccount, err := m.client.CoreV1().ServiceAccounts(namespace).Get(context.TODO(), application, k8smeta.GetOptions{})
+			if errors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			spec := app.Spec{Application: serviceAccount.Labels["app"], Namespace: namespace, Team: serviceAccount.Labels["team"]}
+			if createDeploymentPrefix(spec)+".yml" == key {
+				return serviceAccount, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// migrate must hold the application's deploy lock. The rules in the configmap are already prefixed and labelled, so
+// they are moved as they are. A PrometheusRule that already exists was written by a deploy, and the rules left in the
+// configmap are older than it, so they are only removed.
+func (m *AlertRulesMigrator) migrate(spec app.Spec) error {
+	configMap, err := getConfigMapRules(spec, m.client)
+	if errors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	ruleGroup := configMap.Data[createDeploymentPrefix(spec)+".yml"]
+
+	existingRule, err := getExistingPrometheusRule(spec, m.dynamicClient)
+	if err != nil {
+		return fmt.Errorf("unable to get existing prometheusrule: %s", err)
+	}
+
+	if existingRule == nil {
+		var alertGroups PrometheusAlertGroups
+		if err := yaml.Unmarshal([]byte(ruleGroup), &alertGroups); err != nil {
+			return fmt.Errorf("unable to parse rule group: %s", err)
+		}
+
+		if _, err := createOrUpdatePrometheusRule(spec, alertGroups.Groups, m.dynamicClient); err != nil {
+			return err
+		}
+	}
+
+	return deleteConfigMapRules(spec, m.client)
+}
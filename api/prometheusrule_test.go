@@ -0,0 +1,180 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newAlertsManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Team = teamName
+	manifest.Alerts.Rules = []PrometheusAlertRule{
+		{Alert: "down", Expr: `up{namespace="$namespace"} == 0`, For: "5m", Annotations: map[string]string{"action": "restart"}},
+	}
+	return manifest
+}
+
+func prometheusRuleGroups(prometheusRule *unstructured.Unstructured) []interface{} {
+	groups, _, _ := unstructured.NestedSlice(prometheusRule.Object, "spec", "groups")
+	return groups
+}
+
+func TestCreatePrometheusRuleDef(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+
+	prometheusRule := createPrometheusRuleDef(spec, []PrometheusAlertGroup{createAlertGroup(spec, newAlertsManifest())}, nil)
+	assert.Equal(t, "PrometheusRule", prometheusRule.GetKind())
+	assert.Equal(t, namespace, prometheusRule.GetNamespace())
+	assert.Equal(t, appName, prometheusRule.GetLabels()["app"])
+	assert.Equal(t, "kube-prometheus", prometheusRule.GetLabels()["prometheus"])
+	assert.Equal(t, "alert-rules", prometheusRule.GetLabels()["role"])
+
+	groups := prometheusRuleGroups(prometheusRule)
+	assert.Len(t, groups, 1)
+	group := groups[0].(map[string]interface{})
+	assert.Equal(t, "aura-appname-default", group["name"])
+
+	rule := group["rules"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "aura-appname-default_down", rule["alert"])
+	assert.Equal(t, `up{namespace="default"} == 0`, rule["expr"])
+	assert.Equal(t, "5m", rule["for"])
+	assert.Equal(t, teamName, rule["labels"].(map[string]interface{})["team"])
+	assert.Equal(t, "restart", rule["annotations"].(map[string]interface{})["action"])
+}
+
+func TestAlertsToPrometheusRules(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+	configMap, _ = addRulesToConfigMap(spec, configMap, newAlertsManifest())
+	configMap.ResourceVersion = resourceVersion
+	clientset := fake.NewSimpleClientset(configMap)
+	dynamicClient := newFakeDynamicClient()
+
+	viper.Set(EnvAlertsOutput, AlertsOutputPrometheusRule)
+	defer viper.Set(EnvAlertsOutput, AlertsOutputConfigMap)
+
+	t.Run("the alerts are written to a prometheusrule, and removed from the shared configmap", func(t *testing.T) {
+		result, err := createOrUpdateK8sResources(spec, request, newAlertsManifest(), []NaisResource{}, "nais.example.yo", false, clientset, dynamicClient)
+		assert.NoError(t, err)
+		assert.Nil(t, result.AlertsConfigMap)
+		assert.NotNil(t, result.PrometheusRule)
+
+		pruned, err := pruneK8sResources(spec, result, clientset, dynamicClient)
+		assert.NoError(t, err)
+		assert.Contains(t, pruned, "alert rules aura-appname-default.yml")
+
+		prometheusRule, err := getExistingPrometheusRule(spec, dynamicClient)
+		assert.NoError(t, err)
+		assert.Len(t, prometheusRuleGroups(prometheusRule), 1)
+	})
+
+	t.Run("the prometheusrule is pruned when the alerts are written to the configmap again", func(t *testing.T) {
+		viper.Set(EnvAlertsOutput, AlertsOutputConfigMap)
+		defer viper.Set(EnvAlertsOutput, AlertsOutputPrometheusRule)
+
+		result, err := createOrUpdateK8sResources(spec, request, newAlertsManifest(), []NaisResource{}, "nais.example.yo", false, fake.NewSimpleClientset(), dynamicClient)
+		assert.NoError(t, err)
+		assert.NotNil(t, result.AlertsConfigMap)
+
+		pruned, err := pruneK8sResources(spec, result, fake.NewSimpleClientset(), dynamicClient)
+		assert.NoError(t, err)
+		assert.Contains(t, pruned, "prometheusrule "+appName)
+	})
+}
+
+func TestAlertRulesMigrator(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	other := app.Spec{Application: otherAppName, Namespace: namespace, Team: otherTeamName}
+
+	configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+	configMap, _ = addRulesToConfigMap(spec, configMap, newAlertsManifest())
+	configMap.Data["removed-app-default.yml"] = "groups: []"
+	configMap.ResourceVersion = resourceVersion
+
+	serviceAccount := createServiceAccountDef(spec)
+	serviceAccount.UID = "uid"
+	clientset := fake.NewSimpleClientset(configMap, serviceAccount, createServiceAccountDef(other))
+	dynamicClient := newFakeDynamicClient()
+	migrator := NewAlertRulesMigrator(clientset, dynamicClient, "naisd-0")
+
+	assert.NoError(t, migrator.reconcile(time.Now()))
+	prometheusRule, _ := getExistingPrometheusRule(spec, dynamicClient)
+	assert.Nil(t, prometheusRule, "nothing is migrated while the alerts are written to the configmap")
+
+	viper.Set(EnvAlertsOutput, AlertsOutputPrometheusRule)
+	defer viper.Set(EnvAlertsOutput, AlertsOutputConfigMap)
+
+	assert.NoError(t, migrator.reconcile(time.Now()))
+
+	prometheusRule, err := getExistingPrometheusRule(spec, dynamicClient)
+	assert.NoError(t, err)
+	assert.Equal(t, "uid", string(prometheusRule.GetOwnerReferences()[0].UID))
+	rule := prometheusRuleGroups(prometheusRule)[0].(map[string]interface{})["rules"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "aura-appname-default_down", rule["alert"])
+
+	configMap, _ = getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, clientset)
+	assert.NotContains(t, configMap.Data, "aura-appname-default.yml")
+	assert.Contains(t, configMap.Data, "removed-app-default.yml", "rules of unknown applications are left alone")
+
+	otherRule, _ := getExistingPrometheusRule(other, dynamicClient)
+	assert.Nil(t, otherRule)
+}
+
+func TestAlertRulesMigratorLegacyAndLockedApplications(t *testing.T) {
+	legacy := app.Spec{Application: "my-app", Namespace: "team-ns", Team: teamName}
+	locked := app.Spec{Application: "locked", Namespace: namespace, Team: teamName}
+	deployed := app.Spec{Application: "deployed", Namespace: namespace, Team: teamName}
+
+	configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+	for _, spec := range []app.Spec{legacy, locked, deployed} {
+		configMap, _ = addRulesToConfigMap(spec, configMap, newAlertsManifest())
+	}
+	configMap.ResourceVersion = resourceVersion
+
+	// Service accounts created before naisd labelled its objects as managed only carry the app and team labels
+	legacyServiceAccount := createServiceAccountDef(legacy)
+	delete(legacyServiceAccount.Labels, ManagedByLabel)
+
+	clientset := fake.NewSimpleClientset(configMap, legacyServiceAccount, createServiceAccountDef(locked), createServiceAccountDef(deployed))
+	dynamicClient := newFakeDynamicClient()
+	migrator := NewAlertRulesMigrator(clientset, dynamicClient, "naisd-0")
+
+	deployRequest := naisrequest.Deploy{Application: locked.Application, Namespace: namespace, Version: "2", CorrelationID: "deploy-2"}
+	assert.NoError(t, acquireDeployLock(locked, deployRequest, clientset))
+	_, err := createOrUpdatePrometheusRule(deployed, []PrometheusAlertGroup{}, dynamicClient)
+	assert.NoError(t, err)
+
+	viper.Set(EnvAlertsOutput, AlertsOutputPrometheusRule)
+	defer viper.Set(EnvAlertsOutput, AlertsOutputConfigMap)
+
+	assert.NoError(t, migrator.reconcile(time.Now()))
+	configMap, _ = getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, clientset)
+
+	t.Run("applications whose service account is not labelled as managed are migrated", func(t *testing.T) {
+		prometheusRule, _ := getExistingPrometheusRule(legacy, dynamicClient)
+		assert.NotNil(t, prometheusRule)
+		assert.NotContains(t, configMap.Data, "aura-my-app-team-ns.yml")
+	})
+
+	t.Run("applications being deployed are left for the deploy", func(t *testing.T) {
+		prometheusRule, _ := getExistingPrometheusRule(locked, dynamicClient)
+		assert.Nil(t, prometheusRule)
+		assert.Contains(t, configMap.Data, "aura-locked-default.yml")
+	})
+
+	t.Run("a prometheusrule written by a deploy is not replaced by the older rules in the configmap", func(t *testing.T) {
+		prometheusRule, _ := getExistingPrometheusRule(deployed, dynamicClient)
+		assert.Empty(t, prometheusRuleGroups(prometheusRule))
+		assert.NotContains(t, configMap.Data, "aura-deployed-default.yml")
+	})
+}
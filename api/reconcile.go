@@ -0,0 +1,26 @@
+package api
+
+import (
+	"context"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// runEvery calls reconcile every interval until ctx is done. It is the loop of the background tasks naisd runs in a
+// single replica.
+func runEvery(ctx context.Context, interval time.Duration, task string, reconcile func(now time.Time) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := reconcile(now); err != nil {
+				glog.Errorf("Failed while checking %s: %s", task, err)
+			}
+		}
+	}
+}
@@ -1,14 +1,20 @@
 package api
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/nais/naisd/api/app"
+	"github.com/spf13/viper"
 	k8sapps "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 const (
@@ -16,16 +22,41 @@ const (
 	defaultRedisExporterPort  = 9121
 	defaultRedisExporterImage = "oliver006/redis_exporter:v1.3.4-alpine"
 	defaultRedisImage         = "redis:5-alpine"
+	redisPasswordKey          = "password"
+	redisPasswordLength       = 32
+	redisConfigKey            = "redis.conf"
+	redisConfigMountPath      = "/usr/local/etc/redis"
+	//EnvRedisExporterImage is the environment name for looking up the Redis exporter image to use
+	EnvRedisExporterImage = "NAISD_REDIS_EXPORTER_IMAGE"
 )
 
+func init() {
+	viper.BindEnv(EnvRedisExporterImage, EnvRedisExporterImage)
+	viper.SetDefault(EnvRedisExporterImage, defaultRedisExporterImage)
+}
+
 type Redis struct {
-	Enabled  bool
-	Image    string
-	Limits   ResourceList
-	Requests ResourceList
+	Enabled         bool
+	Mode            string
+	Replicas        int
+	Image           string
+	Limits          ResourceList
+	Requests        ResourceList
+	MaxMemory       string            `yaml:"maxMemory"`
+	MaxMemoryPolicy string            `yaml:"maxMemoryPolicy"`
+	AppendOnly      bool              `yaml:"appendOnly"`
+	AppendFsync     string            `yaml:"appendFsync"`
+	Save            []string          `yaml:"save"`
+	Config          map[string]string `yaml:"config"`
 }
 
 func updateDefaultRedisValues(redis Redis) Redis {
+	if redis.Mode == "" {
+		redis.Mode = RedisModeStandalone
+	}
+	if redis.Mode == RedisModeFailover && redis.Replicas == 0 {
+		redis.Replicas = defaultRedisFailoverReplicas
+	}
 	if redis.Image == "" {
 		redis.Image = defaultRedisImage
 	}
@@ -44,7 +75,62 @@ func updateDefaultRedisValues(redis Redis) Redis {
 	return redis
 }
 
-func createRedisPodSpec(redis Redis) v1.PodSpec {
+// createRedisSpec returns the spec identifying the Redis resources belonging to an application
+func createRedisSpec(spec app.Spec) app.Spec {
+	return app.Spec{
+		Application:   fmt.Sprintf("%s-redis", spec.ResourceName()),
+		Namespace:     spec.Namespace,
+		Team:          spec.Team,
+		Version:       spec.Version,
+		CorrelationID: spec.CorrelationID,
+		Owner:         spec.Owner,
+	}
+}
+
+// createRedisEnvironmentVariables points the application at the Redis deployed for the given mode
+func createRedisEnvironmentVariables(spec app.Spec, redis Redis) []v1.EnvVar {
+	redisSpec := createRedisSpec(spec)
+
+	if redis.Mode == RedisModeFailover {
+		return []v1.EnvVar{
+			createEnvVar("REDIS_HOST", createRedisSentinelHostname(spec)),
+			createEnvVar("REDIS_PORT", strconv.Itoa(defaultRedisSentinelPort)),
+			createEnvVar("REDIS_SENTINEL_MASTER", redisSentinelMasterName),
+			createRedisPasswordEnvVar(redisSpec.ResourceName()),
+		}
+	}
+
+	return []v1.EnvVar{
+		createEnvVar("REDIS_HOST", redisSpec.ResourceName()),
+		createEnvVar("REDIS_PORT", strconv.Itoa(defaultRedisPort)),
+		createRedisPasswordEnvVar(redisSpec.ResourceName()),
+	}
+}
+
+// createRedisPasswordEnvVar references the generated Redis password in the secret named secretName
+func createRedisPasswordEnvVar(secretName string) v1.EnvVar {
+	return v1.EnvVar{
+		Name: "REDIS_PASSWORD",
+		ValueFrom: &v1.EnvVarSource{
+			SecretKeyRef: &v1.SecretKeySelector{
+				LocalObjectReference: v1.LocalObjectReference{
+					Name: secretName,
+				},
+				Key: redisPasswordKey,
+			},
+		},
+	}
+}
+
+// redisExporterImage returns the exporter image configured for this daemon
+func redisExporterImage() string {
+	return viper.GetString(EnvRedisExporterImage)
+}
+
+func createRedisPodSpec(redisSpec app.Spec, redis Redis) v1.PodSpec {
+	passwordEnvVar := createRedisPasswordEnvVar(redisSpec.ResourceName())
+	configVolumeName := validLabelName(redisSpec.ResourceName() + "-config")
+
 	return v1.PodSpec{
 		Containers: []v1.Container{
 			{
@@ -53,6 +139,8 @@ func createRedisPodSpec(redis Redis) v1.PodSpec {
 				Resources: createResourceLimits(redis.Requests.Cpu, redis.Requests.Memory,
 					redis.Limits.Cpu, redis.Limits.Memory),
 				ImagePullPolicy: v1.PullIfNotPresent,
+				Env:             []v1.EnvVar{passwordEnvVar},
+				Args:            []string{"redis-server", redisConfigMountPath + "/" + redisConfigKey, "--requirepass", "$(REDIS_PASSWORD)"},
 				Ports: []v1.ContainerPort{
 					{
 						ContainerPort: int32(defaultRedisPort),
@@ -60,13 +148,20 @@ func createRedisPodSpec(redis Redis) v1.PodSpec {
 						Protocol:      v1.ProtocolTCP,
 					},
 				},
+				VolumeMounts: []v1.VolumeMount{
+					{
+						Name:      configVolumeName,
+						MountPath: redisConfigMountPath,
+					},
+				},
 			},
 			{
 				Name:  "exporter",
-				Image: defaultRedisExporterImage,
+				Image: redisExporterImage(),
 				Resources: createResourceLimits("100m", "100Mi",
 					"100m", "100Mi"),
 				ImagePullPolicy: v1.PullIfNotPresent,
+				Env:             []v1.EnvVar{passwordEnvVar},
 				Ports: []v1.ContainerPort{
 					{
 						ContainerPort: int32(defaultRedisExporterPort),
@@ -76,15 +171,28 @@ func createRedisPodSpec(redis Redis) v1.PodSpec {
 				},
 			},
 		},
+		Volumes: []v1.Volume{
+			{
+				Name: configVolumeName,
+				VolumeSource: v1.VolumeSource{
+					ConfigMap: &v1.ConfigMapVolumeSource{
+						LocalObjectReference: v1.LocalObjectReference{
+							Name: redisSpec.ResourceName(),
+						},
+					},
+				},
+			},
+		},
 	}
 }
 
 func createRedisDeploymentSpec(redisSpec app.Spec, redis Redis) k8sapps.DeploymentSpec {
-	objectMeta := generateObjectMeta(redisSpec)
+	objectMeta := generatePodObjectMeta(redisSpec)
 	objectMeta.Annotations = map[string]string{
-		"prometheus.io/scrape": "true",
-		"prometheus.io/port":   strconv.Itoa(defaultRedisExporterPort),
-		"prometheus.io/path":   "/metrics",
+		"prometheus.io/scrape":      "true",
+		"prometheus.io/port":        strconv.Itoa(defaultRedisExporterPort),
+		"prometheus.io/path":        "/metrics",
+		"nais.io/redis-conf-sha256": createRedisConfigChecksum(redis),
 	}
 
 	return k8sapps.DeploymentSpec{
@@ -99,7 +207,7 @@ func createRedisDeploymentSpec(redisSpec app.Spec, redis Redis) k8sapps.Deployme
 		RevisionHistoryLimit:    int32p(10),
 		Template: v1.PodTemplateSpec{
 			ObjectMeta: objectMeta,
-			Spec:       createRedisPodSpec(redis),
+			Spec:       createRedisPodSpec(redisSpec, redis),
 		},
 	}
 }
@@ -107,6 +215,9 @@ func createRedisDeploymentSpec(redisSpec app.Spec, redis Redis) k8sapps.Deployme
 func createRedisDeploymentDef(redisSpec app.Spec, redis Redis, existingDeployment *k8sapps.Deployment) *k8sapps.Deployment {
 	deploymentSpec := createRedisDeploymentSpec(redisSpec, redis)
 	if existingDeployment != nil {
+		if isPaused(existingDeployment.ObjectMeta) {
+			deploymentSpec.Replicas = existingDeployment.Spec.Replicas
+		}
 		existingDeployment.ObjectMeta = addLabelsToObjectMeta(existingDeployment.ObjectMeta, redisSpec)
 		existingDeployment.Spec = deploymentSpec
 		return existingDeployment
@@ -123,11 +234,7 @@ func createRedisDeploymentDef(redisSpec app.Spec, redis Redis, existingDeploymen
 }
 
 func createOrUpdateRedisInstance(spec app.Spec, redis Redis, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
-	redisSpec := app.Spec{
-		Application: fmt.Sprintf("%s-redis", spec.ResourceName()),
-		Namespace:   spec.Namespace,
-		Team:        spec.Team,
-	}
+	redisSpec := createRedisSpec(spec)
 	existingDeployment, err := getExistingDeployment(redisSpec.ResourceName(), redisSpec.Namespace, k8sClient)
 
 	if err != nil {
@@ -167,11 +274,7 @@ func createRedisServiceDef(redisSpec app.Spec) *v1.Service {
 }
 
 func createOrUpdateRedisService(spec app.Spec, k8sClient kubernetes.Interface) (*v1.Service, error) {
-	redisSpec := app.Spec{
-		Application: fmt.Sprintf("%s-redis", spec.ResourceName()),
-		Namespace:   spec.Namespace,
-		Team:        spec.Team,
-	}
+	redisSpec := createRedisSpec(spec)
 	service, err := getExistingService(redisSpec.ResourceName(), redisSpec.Namespace, k8sClient)
 
 	if err != nil {
@@ -183,3 +286,138 @@ func createOrUpdateRedisService(spec app.Spec, k8sClient kubernetes.Interface) (
 	service.ObjectMeta = addLabelsToObjectMeta(service.ObjectMeta, redisSpec)
 	return createOrUpdateServiceResource(service, redisSpec.Namespace, k8sClient)
 }
+
+func generateRedisPassword() (string, error) {
+	b := make([]byte, redisPasswordLength)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate random password: %s", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Creates a Kubernetes Secret object holding the Redis password
+// If existingSecret is provided, its password is kept so the application and Redis stay in sync across deploys
+func createRedisSecretDef(redisSpec app.Spec, existingSecret *v1.Secret) (*v1.Secret, error) {
+	secret := existingSecret
+	if secret == nil {
+		secret = &v1.Secret{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "Secret",
+				APIVersion: "v1",
+			},
+			ObjectMeta: generateObjectMeta(redisSpec),
+			Type:       "Opaque",
+		}
+	}
+
+	secret.ObjectMeta = addLabelsToObjectMeta(secret.ObjectMeta, redisSpec)
+
+	if len(secret.Data[redisPasswordKey]) == 0 {
+		password, err := generateRedisPassword()
+		if err != nil {
+			return nil, err
+		}
+
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte, 1)
+		}
+		secret.Data[redisPasswordKey] = []byte(password)
+	}
+
+	return secret, nil
+}
+
+func createOrUpdateRedisSecret(spec app.Spec, k8sClient kubernetes.Interface) (*v1.Secret, error) {
+	redisSpec := createRedisSpec(spec)
+	existingSecret, err := getExistingSecret(redisSpec, k8sClient)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing secret: %s", err)
+	}
+
+	secretDef, err := createRedisSecretDef(redisSpec, existingSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	return createOrUpdateSecretResource(secretDef, redisSpec.Namespace, k8sClient)
+}
+
+// createRedisConfigLines renders the tunables from the manifest as redis.conf directives.
+// Extra parameters are sorted to keep the rendered configuration stable across deploys.
+func createRedisConfigLines(redis Redis) []string {
+	var lines []string
+
+	if len(redis.MaxMemory) > 0 {
+		lines = append(lines, "maxmemory "+redis.MaxMemory)
+	}
+	if len(redis.MaxMemoryPolicy) > 0 {
+		lines = append(lines, "maxmemory-policy "+redis.MaxMemoryPolicy)
+	}
+	if redis.AppendOnly {
+		lines = append(lines, "appendonly yes")
+		if len(redis.AppendFsync) > 0 {
+			lines = append(lines, "appendfsync "+redis.AppendFsync)
+		}
+	}
+	for _, save := range redis.Save {
+		lines = append(lines, "save "+save)
+	}
+
+	keys := make([]string, 0, len(redis.Config))
+	for k := range redis.Config {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, k+" "+redis.Config[k])
+	}
+
+	return lines
+}
+
+func createRedisConfig(redis Redis) string {
+	lines := createRedisConfigLines(redis)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// createRedisConfigChecksum is put on the pod template so Redis is restarted when its configuration changes
+func createRedisConfigChecksum(redis Redis) string {
+	checksum := sha256.Sum256([]byte(createRedisConfig(redis)))
+	return hex.EncodeToString(checksum[:])
+}
+
+// Creates a Kubernetes ConfigMap object holding redis.conf
+// If existingConfigMap is provided, this is updated with the rendered configuration
+func createRedisConfigMapDef(redisSpec app.Spec, redis Redis, existingConfigMap *v1.ConfigMap) *v1.ConfigMap {
+	configMap := existingConfigMap
+	if configMap == nil {
+		configMap = &v1.ConfigMap{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "ConfigMap",
+				APIVersion: "v1",
+			},
+			ObjectMeta: generateObjectMeta(redisSpec),
+		}
+	}
+
+	configMap.ObjectMeta = addLabelsToObjectMeta(configMap.ObjectMeta, redisSpec)
+	configMap.Data = map[string]string{redisConfigKey: createRedisConfig(redis)}
+
+	return configMap
+}
+
+func createOrUpdateRedisConfigMap(spec app.Spec, redis Redis, k8sClient kubernetes.Interface) (*v1.ConfigMap, error) {
+	redisSpec := createRedisSpec(spec)
+	existingConfigMap, err := getExistingConfigMap(redisSpec.ResourceName(), redisSpec.Namespace, k8sClient)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	}
+
+	configMap := createRedisConfigMapDef(redisSpec, redis, existingConfigMap)
+	return createOrUpdateConfigMapResource(configMap, redisSpec.Namespace, k8sClient)
+}
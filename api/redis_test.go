@@ -1,11 +1,16 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"github.com/nais/naisd/api/app"
 	"github.com/nais/naisd/api/naisrequest"
 	"github.com/stretchr/testify/assert"
 	v1 "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+	"os"
 	"testing"
 )
 
@@ -55,7 +60,8 @@ func TestRedisResource(t *testing.T) {
 		}
 		manifest.Redis = updateDefaultRedisValues(manifest.Redis)
 
-		podSpec := createRedisPodSpec(manifest.Redis)
+		redisSpec := app.Spec{Application: redisName, Namespace: namespace, Team: "teamBeam"}
+		podSpec := createRedisPodSpec(redisSpec, manifest.Redis)
 		container := podSpec.Containers[0]
 		assert.Equal(t, "redis", container.Name)
 		resources := container.Resources
@@ -65,13 +71,163 @@ func TestRedisResource(t *testing.T) {
 		assert.Equal(t, "512Mi", resources.Requests.Memory().String())
 	})
 
-	t.Run("REDIS_HOST env var should be set when redis: true", func(t *testing.T) {
+	t.Run("REDIS_HOST env var should point at the redis service when redis: true", func(t *testing.T) {
 		spec := app.Spec{Application: appName, Namespace: namespace, Team: "teamBeam"}
 		manifest := NaisManifest{Redis: Redis{Enabled: true}}
 		manifest.Redis = updateDefaultRedisValues(manifest.Redis)
 		env, err := createEnvironmentVariables(spec, naisrequest.Deploy{}, manifest, []NaisResource{})
 
+		assert.NoError(t, err)
+		assert.Contains(t, env, v1.EnvVar{Name: "REDIS_HOST", Value: redisName})
+	})
+
+	t.Run("REDIS_HOST env var should point at the sentinels in failover mode", func(t *testing.T) {
+		spec := app.Spec{Application: appName, Namespace: namespace, Team: "teamBeam"}
+		manifest := NaisManifest{Redis: Redis{Enabled: true, Mode: RedisModeFailover}}
+		env, err := createEnvironmentVariables(spec, naisrequest.Deploy{}, manifest, []NaisResource{})
+
 		assert.NoError(t, err)
 		assert.Contains(t, env, v1.EnvVar{Name: "REDIS_HOST", Value: "rfs-" + spec.ResourceName()})
+		assert.Contains(t, env, v1.EnvVar{Name: "REDIS_PORT", Value: "26379"})
+		assert.Contains(t, env, v1.EnvVar{Name: "REDIS_SENTINEL_MASTER", Value: redisSentinelMasterName})
+		assert.Contains(t, env, createRedisPasswordEnvVar(redisName))
+	})
+
+	t.Run("REDIS_PORT and REDIS_PASSWORD env vars should be set when redis: true", func(t *testing.T) {
+		spec := app.Spec{Application: appName, Namespace: namespace, Team: "teamBeam"}
+		manifest := NaisManifest{Redis: Redis{Enabled: true}}
+		env, err := createEnvironmentVariables(spec, naisrequest.Deploy{}, manifest, []NaisResource{})
+
+		assert.NoError(t, err)
+		assert.Contains(t, env, v1.EnvVar{Name: "REDIS_PORT", Value: "6379"})
+		assert.Contains(t, env, createRedisPasswordEnvVar(redisName))
+	})
+
+	t.Run("redis and exporter should be configured with the password from the redis secret", func(t *testing.T) {
+		redisSpec := app.Spec{Application: redisName, Namespace: namespace, Team: "teamBeam"}
+		podSpec := createRedisPodSpec(redisSpec, updateDefaultRedisValues(Redis{Enabled: true}))
+
+		redis, exporter := podSpec.Containers[0], podSpec.Containers[1]
+		assert.Equal(t, []string{"--requirepass", "$(REDIS_PASSWORD)"}, redis.Args[2:])
+		assert.Equal(t, redisName, redis.Env[0].ValueFrom.SecretKeyRef.Name)
+		assert.Equal(t, redisPasswordKey, redis.Env[0].ValueFrom.SecretKeyRef.Key)
+		assert.Equal(t, redis.Env, exporter.Env)
+	})
+}
+
+func TestRedisConfig(t *testing.T) {
+	redisName := fmt.Sprintf("%s-redis", appName)
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+
+	t.Run("tunables are rendered as redis.conf directives", func(t *testing.T) {
+		redis := Redis{
+			MaxMemory:       "100mb",
+			MaxMemoryPolicy: "allkeys-lru",
+			AppendOnly:      true,
+			AppendFsync:     "everysec",
+			Save:            []string{"900 1", "300 10"},
+			Config:          map[string]string{"timeout": "300", "databases": "4"},
+		}
+
+		expected := "maxmemory 100mb\nmaxmemory-policy allkeys-lru\nappendonly yes\nappendfsync everysec\nsave 900 1\nsave 300 10\ndatabases 4\ntimeout 300\n"
+		assert.Equal(t, expected, createRedisConfig(redis))
+	})
+
+	t.Run("redis.conf is stored in a configmap mounted into the redis container", func(t *testing.T) {
+		redis := updateDefaultRedisValues(Redis{Enabled: true, MaxMemory: "64mb"})
+		configMap, err := createOrUpdateRedisConfigMap(spec, redis, fake.NewSimpleClientset())
+		assert.NoError(t, err)
+		assert.Equal(t, redisName, configMap.Name)
+		assert.Equal(t, "maxmemory 64mb\n", configMap.Data[redisConfigKey])
+
+		podSpec := createRedisPodSpec(createRedisSpec(spec), redis)
+		assert.Equal(t, redisName, podSpec.Volumes[0].ConfigMap.Name)
+		assert.Equal(t, podSpec.Volumes[0].Name, podSpec.Containers[0].VolumeMounts[0].Name)
+		assert.Equal(t, redisConfigMountPath+"/"+redisConfigKey, podSpec.Containers[0].Args[1])
+	})
+
+	t.Run("pod template changes when the configuration changes", func(t *testing.T) {
+		redisSpec := createRedisSpec(spec)
+		before := createRedisDeploymentSpec(redisSpec, updateDefaultRedisValues(Redis{Enabled: true}))
+		after := createRedisDeploymentSpec(redisSpec, updateDefaultRedisValues(Redis{Enabled: true, MaxMemory: "64mb"}))
+		assert.NotEqual(t, before.Template.Annotations["nais.io/redis-conf-sha256"], after.Template.Annotations["nais.io/redis-conf-sha256"])
+	})
+
+	t.Run("failover mode passes tunables as custom config", func(t *testing.T) {
+		redis := updateDefaultRedisValues(Redis{Enabled: true, Mode: RedisModeFailover, MaxMemory: "64mb"})
+		customConfig, _, _ := unstructured.NestedStringSlice(createRedisFailoverDef(spec, redis, nil).Object, "spec", "redis", "customConfig")
+		assert.Equal(t, []string{"maxmemory 64mb"}, customConfig)
+	})
+
+	t.Run("exporter image can be overridden through daemon config", func(t *testing.T) {
+		assert.Equal(t, defaultRedisExporterImage, createRedisPodSpec(createRedisSpec(spec), updateDefaultRedisValues(Redis{})).Containers[1].Image)
+
+		os.Setenv(EnvRedisExporterImage, "registry.local/redis_exporter:v2")
+		defer os.Unsetenv(EnvRedisExporterImage)
+		assert.Equal(t, "registry.local/redis_exporter:v2", createRedisPodSpec(createRedisSpec(spec), updateDefaultRedisValues(Redis{})).Containers[1].Image)
+	})
+}
+
+func TestRedisSecret(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	clientset := fake.NewSimpleClientset()
+
+	t.Run("password is generated when redis is first enabled", func(t *testing.T) {
+		secret, err := createOrUpdateRedisSecret(spec, clientset)
+
+		assert.NoError(t, err)
+		assert.Equal(t, appName+"-redis", secret.Name)
+		assert.Equal(t, teamName, secret.Labels["team"])
+		assert.Len(t, secret.Data[redisPasswordKey], 2*redisPasswordLength)
+	})
+
+	t.Run("password is kept across deploys", func(t *testing.T) {
+		existing, err := getExistingSecret(createRedisSpec(spec), clientset)
+		assert.NoError(t, err)
+		existing.ResourceVersion = resourceVersion
+		_, err = clientset.CoreV1().Secrets(namespace).Update(context.TODO(), existing, k8smeta.UpdateOptions{})
+		assert.NoError(t, err)
+
+		secret, err := createOrUpdateRedisSecret(spec, clientset)
+
+		assert.NoError(t, err)
+		assert.Equal(t, existing.Data[redisPasswordKey], secret.Data[redisPasswordKey])
+	})
+}
+
+func TestRedisFailover(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	redis := updateDefaultRedisValues(Redis{Enabled: true, Mode: RedisModeFailover})
+	dynamicClient := newFakeDynamicClient()
+
+	t.Run("defaults to three redis replicas", func(t *testing.T) {
+		assert.Equal(t, defaultRedisFailoverReplicas, redis.Replicas)
+	})
+
+	t.Run("redis failover is created with the redis password secret", func(t *testing.T) {
+		redisFailover, err := createOrUpdateRedisFailover(spec, redis, dynamicClient)
+		assert.NoError(t, err)
+		assert.Equal(t, appName, redisFailover.GetName())
+		assert.Equal(t, teamName, redisFailover.GetLabels()["team"])
+
+		secretPath, _, _ := unstructured.NestedString(redisFailover.Object, "spec", "auth", "secretPath")
+		assert.Equal(t, appName+"-redis", secretPath)
+
+		replicas, _, _ := unstructured.NestedInt64(redisFailover.Object, "spec", "redis", "replicas")
+		assert.Equal(t, int64(3), replicas)
+	})
+
+	t.Run("existing redis failover is updated", func(t *testing.T) {
+		existing, err := getExistingRedisFailover(spec, dynamicClient)
+		assert.NoError(t, err)
+		existing.SetResourceVersion(resourceVersion)
+		_, err = dynamicClient.Resource(RedisFailoverResource).Namespace(namespace).Update(context.TODO(), existing, k8smeta.UpdateOptions{})
+		assert.NoError(t, err)
+
+		redisFailover, err := createOrUpdateRedisFailover(spec, updateDefaultRedisValues(Redis{Enabled: true, Mode: RedisModeFailover, Replicas: 5}), dynamicClient)
+		assert.NoError(t, err)
+
+		replicas, _, _ := unstructured.NestedInt64(redisFailover.Object, "spec", "redis", "replicas")
+		assert.Equal(t, int64(5), replicas)
 	})
 }
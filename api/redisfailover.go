@@ -0,0 +1,133 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/nais/naisd/api/app"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeFailover   = "failover"
+
+	defaultRedisFailoverReplicas = 3
+	defaultRedisSentinelReplicas = 3
+	defaultRedisSentinelPort     = 26379
+	redisSentinelMasterName      = "mymaster"
+)
+
+// RedisFailoverResource is the custom resource handled by the Redis failover operator (github.com/spotahome/redis-operator).
+// The operator runs Redis master/replicas behind Sentinels, exposed through the Sentinel service rfs-<name>.
+var RedisFailoverResource = schema.GroupVersionResource{
+	Group:    "databases.spotahome.com",
+	Version:  "v1",
+	Resource: "redisfailovers",
+}
+
+// createRedisSentinelHostname returns the name of the Sentinel service the operator creates for a RedisFailover
+func createRedisSentinelHostname(spec app.Spec) string {
+	return fmt.Sprintf("rfs-%s", spec.ResourceName())
+}
+
+func createResourceRequirementsMap(requests, limits ResourceList) map[string]interface{} {
+	return map[string]interface{}{
+		"requests": map[string]interface{}{
+			"cpu":    requests.Cpu,
+			"memory": requests.Memory,
+		},
+		"limits": map[string]interface{}{
+			"cpu":    limits.Cpu,
+			"memory": limits.Memory,
+		},
+	}
+}
+
+func createCustomConfig(redis Redis) []interface{} {
+	customConfig := []interface{}{}
+	for _, line := range createRedisConfigLines(redis) {
+		customConfig = append(customConfig, line)
+	}
+	return customConfig
+}
+
+func createRedisFailoverSpec(redisSpec app.Spec, redis Redis) map[string]interface{} {
+	return map[string]interface{}{
+		"sentinel": map[string]interface{}{
+			"replicas":  int64(defaultRedisSentinelReplicas),
+			"resources": createResourceRequirementsMap(ResourceList{Cpu: "100m", Memory: "100Mi"}, ResourceList{Cpu: "100m", Memory: "100Mi"}),
+		},
+		"redis": map[string]interface{}{
+			"replicas":     int64(redis.Replicas),
+			"image":        redis.Image,
+			"resources":    createResourceRequirementsMap(redis.Requests, redis.Limits),
+			"customConfig": createCustomConfig(redis),
+			"exporter": map[string]interface{}{
+				"enabled": true,
+				"image":   redisExporterImage(),
+			},
+		},
+		"auth": map[string]interface{}{
+			"secretPath": redisSpec.ResourceName(),
+		},
+	}
+}
+
+// Creates a RedisFailover custom resource
+// If existingFailover is provided, its spec is replaced and metadata such as resourceVersion is kept
+func createRedisFailoverDef(spec app.Spec, redis Redis, existingFailover *unstructured.Unstructured) *unstructured.Unstructured {
+	redisFailover := existingFailover
+	if redisFailover == nil {
+		redisFailover = &unstructured.Unstructured{}
+		redisFailover.SetAPIVersion(RedisFailoverResource.GroupVersion().String())
+		redisFailover.SetKind("RedisFailover")
+		redisFailover.SetName(spec.ResourceName())
+		redisFailover.SetNamespace(spec.Namespace)
+	}
+
+	objectMeta := addLabelsToObjectMeta(k8smeta.ObjectMeta{
+		Labels:          redisFailover.GetLabels(),
+		Annotations:     redisFailover.GetAnnotations(),
+		OwnerReferences: redisFailover.GetOwnerReferences(),
+	}, spec)
+	redisFailover.SetLabels(objectMeta.Labels)
+	redisFailover.SetAnnotations(objectMeta.Annotations)
+	redisFailover.SetOwnerReferences(objectMeta.OwnerReferences)
+	redisFailover.Object["spec"] = createRedisFailoverSpec(createRedisSpec(spec), redis)
+
+	return redisFailover
+}
+
+func getExistingRedisFailover(spec app.Spec, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	redisFailover, err := dynamicClient.Resource(RedisFailoverResource).Namespace(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return redisFailover, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected error: %s", err)
+	}
+}
+
+func createOrUpdateRedisFailover(spec app.Spec, redis Redis, dynamicClient dynamic.Interface) (*unstructured.Unstructured, error) {
+	existingFailover, err := getExistingRedisFailover(spec, dynamicClient)
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing redis failover: %s", err)
+	}
+
+	redisFailover := createRedisFailoverDef(spec, redis, existingFailover)
+	redisFailoverInterface := dynamicClient.Resource(RedisFailoverResource).Namespace(spec.Namespace)
+
+	if redisFailover.GetResourceVersion() != "" {
+		return redisFailoverInterface.Update(context.TODO(), redisFailover, k8smeta.UpdateOptions{})
+	} else {
+		return redisFailoverInterface.Create(context.TODO(), redisFailover, k8smeta.CreateOptions{})
+	}
+}
@@ -1,10 +1,12 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/nais/naisd/api/app"
 	"github.com/nais/naisd/proxyopts"
@@ -12,14 +14,18 @@ import (
 	"github.com/nais/naisd/api/constant"
 	"github.com/nais/naisd/api/naisrequest"
 	"github.com/nais/naisd/internal/vault"
-	k8sautoscaling "k8s.io/api/autoscaling/v1"
+	k8sautoscaling "k8s.io/api/autoscaling/v2beta2"
+	k8sbatch "k8s.io/api/batch/v1"
+	k8sbatchv1beta1 "k8s.io/api/batch/v1beta1"
 	k8score "k8s.io/api/core/v1"
 	k8sapps "k8s.io/api/apps/v1"
 	k8snetworkingv1beta1 "k8s.io/api/networking/v1beta1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	k8sresource "k8s.io/apimachinery/pkg/api/resource"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
@@ -27,19 +33,37 @@ const (
 	RootMountPoint           = "/var/run/secrets/naisd.io/"
 	AlertsConfigMapNamespace = "nais"
 	AlertsConfigMapName      = "app-rules"
+	ManagedByLabel           = "app.kubernetes.io/managed-by"
+	ManagedByNaisd           = "naisd"
+	VersionAnnotation        = "nais.io/version"
+	CorrelationIDAnnotation  = "nais.io/correlation-id"
+	DeployedAtAnnotation     = "nais.io/deployed-at"
 )
 
 type DeploymentResult struct {
 	Autoscaler      *k8sautoscaling.HorizontalPodAutoscaler
 	Ingress         *k8snetworkingv1beta1.Ingress
 	Deployment      *k8sapps.Deployment
+	Canary          *k8sapps.Deployment
+	BlueGreen       *k8sapps.Deployment
+	StatefulSet     *k8sapps.StatefulSet
+	Job             *k8sbatch.Job
+	CronJob         *k8sbatchv1beta1.CronJob
 	Secret          *k8score.Secret
 	Service         *k8score.Service
 	Redis           *k8sapps.Deployment
 	RedisService    *k8score.Service
+	RedisSecret     *k8score.Secret
+	RedisConfigMap  *k8score.ConfigMap
+	RedisFailover   *unstructured.Unstructured
 	AlertsConfigMap *k8score.ConfigMap
-	ServiceAccount  *k8score.ServiceAccount
-	RoleBinding     *rbacv1.RoleBinding
+	PrometheusRule  *unstructured.Unstructured
+	// AlertReceiversConfigMap and AlertmanagerConfig hold the application's alert receivers
+	AlertReceiversConfigMap *k8score.ConfigMap
+	AlertmanagerConfig      *unstructured.Unstructured
+	ServiceAccount          *k8score.ServiceAccount
+	RoleBinding             *rbacv1.RoleBinding
+	Pruned                  []string
 }
 
 // Creates a Kubernetes Service object
@@ -61,9 +85,13 @@ func createPodSelector(spec app.Spec) map[string]string {
 	return selector
 }
 
-func fillServiceSpec(spec app.Spec, serviceSpec *k8score.ServiceSpec) {
+// fillServiceSpec selects the application's pods, or only those of the active color for the BlueGreen strategy
+func fillServiceSpec(spec app.Spec, serviceSpec *k8score.ServiceSpec, activeColor string) {
 	serviceSpec.Type = k8score.ServiceTypeClusterIP
 	serviceSpec.Selector = createPodSelector(spec)
+	if len(activeColor) > 0 {
+		serviceSpec.Selector = createColorPodSelector(spec, activeColor)
+	}
 	serviceSpec.Ports = []k8score.ServicePort{
 		{
 			Name:     "http",
@@ -91,13 +119,14 @@ func createDeploymentDef(spec app.Spec, naisResources []NaisResource, manifest N
 		return nil, err
 	}
 
-	if existingDeployment != nil {
-		deploymentSpec.Replicas = existingDeployment.Spec.Replicas
-		existingDeployment.ObjectMeta = addLabelsToObjectMeta(existingDeployment.ObjectMeta, spec)
-		existingDeployment.Spec = deploymentSpec
-		return existingDeployment, nil
+	deployment := existingDeployment
+	if deployment != nil {
+		deploymentSpec.Replicas = deployment.Spec.Replicas
+		deployment.ObjectMeta = addLabelsToObjectMeta(deployment.ObjectMeta, spec)
+		delete(deployment.Annotations, CanaryAbortedAnnotation)
+		deployment.Spec = deploymentSpec
 	} else {
-		deployment := &k8sapps.Deployment{
+		deployment = &k8sapps.Deployment{
 			TypeMeta: k8smeta.TypeMeta{
 				Kind:       "Deployment",
 				APIVersion: "apps/v1beta1",
@@ -105,8 +134,12 @@ func createDeploymentDef(spec app.Spec, naisResources []NaisResource, manifest N
 			ObjectMeta: generateObjectMeta(spec),
 			Spec:       deploymentSpec,
 		}
-		return deployment, nil
 	}
+
+	if !isAutoscaled(manifest) {
+		return fixReplicas(deployment, manifest.Replicas.Min), nil
+	}
+	return deployment, nil
 }
 
 func createDeploymentSpec(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool) (k8sapps.DeploymentSpec, error) {
@@ -121,7 +154,8 @@ func createDeploymentSpec(spec app.Spec, deploymentRequest naisrequest.Deploy, m
 		strategy = k8sapps.DeploymentStrategy{
 			Type: k8sapps.RecreateDeploymentStrategyType,
 		}
-	} else if manifest.DeploymentStrategy == DeploymentStrategyRollingUpdate {
+	} else if manifest.DeploymentStrategy == DeploymentStrategyRollingUpdate || manifest.DeploymentStrategy == DeploymentStrategyCanary || manifest.DeploymentStrategy == DeploymentStrategyBlueGreen {
+		// A promoted canary is rolled out to the main deployment, and a blue/green color is updated, like any other update
 		strategy = k8sapps.DeploymentStrategy{
 			Type: k8sapps.RollingUpdateDeploymentStrategyType,
 			RollingUpdate: &k8sapps.RollingUpdateDeployment{
@@ -153,7 +187,7 @@ func createDeploymentSpec(spec app.Spec, deploymentRequest naisrequest.Deploy, m
 }
 
 func createPodObjectMetaWithAnnotations(spec app.Spec, manifest NaisManifest, istioEnabled bool) k8smeta.ObjectMeta {
-	objectMeta := generateObjectMeta(spec)
+	objectMeta := generatePodObjectMeta(spec)
 
 	objectMeta.Annotations = map[string]string{
 		"prometheus.io/scrape": strconv.FormatBool(manifest.Prometheus.Enabled),
@@ -378,7 +412,7 @@ func createEnvironmentVariables(spec app.Spec, deploymentRequest naisrequest.Dep
 	envVars := createDefaultEnvironmentVariables(&deploymentRequest)
 
 	if manifest.Redis.Enabled {
-		envVars = append(envVars, createEnvVar("REDIS_HOST", fmt.Sprintf("rfs-%s", spec.ResourceName())))
+		envVars = append(envVars, createRedisEnvironmentVariables(spec, updateDefaultRedisValues(manifest.Redis))...)
 	}
 
 	for _, res := range naisResources {
@@ -558,26 +592,27 @@ func createResourceLimits(requestsCpu string, requestsMemory string, limitsCpu s
 
 // Creates a Kubernetes Secret object
 // If existingSecretId is provided, this is included in object so it can be used to update object
+// Returns nil when there is no secret data, leaving an existing secret to be pruned
 func createSecretDef(spec app.Spec, naisResources []NaisResource, existingSecret *k8score.Secret) *k8score.Secret {
+	data := createSecretData(naisResources)
+	if len(data) == 0 {
+		return nil
+	}
+
 	if existingSecret != nil {
 		existingSecret.ObjectMeta = addLabelsToObjectMeta(existingSecret.ObjectMeta, spec)
-		existingSecret.Data = createSecretData(naisResources)
+		existingSecret.Data = data
 		return existingSecret
 	} else {
-		secret := &k8score.Secret{
+		return &k8score.Secret{
 			TypeMeta: k8smeta.TypeMeta{
 				Kind:       "Secret",
 				APIVersion: "v1",
 			},
 			ObjectMeta: generateObjectMeta(spec),
-			Data:       createSecretData(naisResources),
+			Data:       data,
 			Type:       "Opaque",
 		}
-
-		if len(secret.Data) > 0 {
-			return secret
-		}
-		return nil
 	}
 }
 
@@ -647,104 +682,313 @@ func createIngressRule(serviceName, host, path string) k8snetworkingv1beta1.Ingr
 }
 
 // Creates a Kubernetes HorizontalPodAutoscaler object
-// If existingAutoscaler is provided, this is updated with provided parameters
-func createOrUpdateAutoscalerDef(spec app.Spec, min, max, cpuTargetPercentage int, existingAutoscaler *k8sautoscaling.HorizontalPodAutoscaler) *k8sautoscaling.HorizontalPodAutoscaler {
+// If existingAutoscaler is provided, this is updated with provided parameters, and stays pinned if the app is paused
+func createOrUpdateAutoscalerDef(spec app.Spec, replicas Replicas, existingAutoscaler *k8sautoscaling.HorizontalPodAutoscaler) *k8sautoscaling.HorizontalPodAutoscaler {
 	if existingAutoscaler != nil {
 		existingAutoscaler.ObjectMeta = addLabelsToObjectMeta(existingAutoscaler.ObjectMeta, spec)
-		existingAutoscaler.Spec = createAutoscalerSpec(min, max, cpuTargetPercentage, spec.ResourceName())
+		existingAutoscaler.Spec = createAutoscalerSpec(replicas, spec.ResourceName())
 
+		if isPaused(existingAutoscaler.ObjectMeta) {
+			return pinAutoscaler(existingAutoscaler)
+		}
 		return existingAutoscaler
 	} else {
 
 		return &k8sautoscaling.HorizontalPodAutoscaler{
 			TypeMeta: k8smeta.TypeMeta{
 				Kind:       "HorizontalPodAutoscaler",
-				APIVersion: "autoscaling/v1",
+				APIVersion: "autoscaling/v2beta2",
 			},
 			ObjectMeta: generateObjectMeta(spec),
-			Spec:       createAutoscalerSpec(min, max, cpuTargetPercentage, spec.ResourceName()),
+			Spec:       createAutoscalerSpec(replicas, spec.ResourceName()),
 		}
 	}
 }
 
-func createAutoscalerSpec(min, max, cpuTargetPercentage int, objectName string) k8sautoscaling.HorizontalPodAutoscalerSpec {
+func createAutoscalerSpec(replicas Replicas, objectName string) k8sautoscaling.HorizontalPodAutoscalerSpec {
 	return k8sautoscaling.HorizontalPodAutoscalerSpec{
-		MinReplicas:                    int32p(int32(min)),
-		MaxReplicas:                    int32(max),
-		TargetCPUUtilizationPercentage: int32p(int32(cpuTargetPercentage)),
+		MinReplicas: int32p(int32(replicas.Min)),
+		MaxReplicas: int32(replicas.Max),
+		Metrics:     createAutoscalerMetrics(replicas),
+		Behavior:    createAutoscalerBehavior(replicas.Behavior),
 		ScaleTargetRef: k8sautoscaling.CrossVersionObjectReference{
-			APIVersion: "extensions/v1beta1",
+			APIVersion: "apps/v1",
 			Kind:       "Deployment",
 			Name:       objectName,
 		},
 	}
 }
 
-func createOrUpdateK8sResources(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface) (DeploymentResult, error) {
+func createOrUpdateK8sResources(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, resources []NaisResource, clusterSubdomain string, istioEnabled bool, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) (DeploymentResult, error) {
 	var deploymentResult DeploymentResult
 	client := clientHolder{k8sClient}
 
-	serviceAccount, err := NewServiceAccountInterface(k8sClient).CreateServiceAccountIfNotExist(spec)
+	spec.Version = deploymentRequest.Version
+	spec.CorrelationID = deploymentRequest.CorrelationID
+
+	// Hosts taken by other applications are refused before anything is deployed
+	if !manifest.Ingress.Disabled && !isBatchWorkload(manifest) {
+		rules := createIngressRules(spec, manifest, deploymentRequest, clusterSubdomain, resources)
+		if err := checkIngressConflicts(spec, rules, k8sClient); err != nil {
+			return deploymentResult, err
+		}
+	}
+
+	var serviceAccount *k8score.ServiceAccount
+	err := retryOnConflict(func() (err error) {
+		serviceAccount, err = NewServiceAccountInterface(k8sClient).CreateServiceAccountIfNotExist(spec)
+		return err
+	})
 	if err != nil {
 		return deploymentResult, fmt.Errorf("failed while creating service account: %s", err)
 	}
 	deploymentResult.ServiceAccount = serviceAccount
+	spec.Owner = createOwnerReference(serviceAccount)
+
+	if len(deploymentRequest.Preview) > 0 {
+		now := time.Now()
+		err = retryOnConflict(func() (err error) {
+			if serviceAccount, err = k8sClient.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{}); err != nil {
+				return err
+			}
+			serviceAccount, err = markPreview(serviceAccount, deploymentRequest, now, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while marking preview: %s", err)
+		}
+		deploymentResult.ServiceAccount = serviceAccount
+	}
 
 	roleRef := createRoleRef("ClusterRole", "serviceaccount-in-app-namespace")
-	roleBinding, err := client.createOrUpdateRoleBinding(spec, roleRef)
+	var roleBinding *rbacv1.RoleBinding
+	err = retryOnConflict(func() (err error) {
+		roleBinding, err = client.createOrUpdateRoleBinding(spec, roleRef)
+		return err
+	})
 	if err != nil {
 		return deploymentResult, fmt.Errorf("failed while creating role binding: %s", err)
 	}
 	deploymentResult.RoleBinding = roleBinding
 
-	service, err := createOrUpdateService(spec, k8sClient)
-	if err != nil {
-		return deploymentResult, fmt.Errorf("failed while creating service: %s", err)
+	if !isBatchWorkload(manifest) {
+		var service *k8score.Service
+		err = retryOnConflict(func() (err error) {
+			service, err = createOrUpdateService(spec, manifest, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating service: %s", err)
+		}
+		deploymentResult.Service = service
 	}
-	deploymentResult.Service = service
 
 	if manifest.Redis.Enabled {
 		manifest.Redis = updateDefaultRedisValues(manifest.Redis)
-		redis, err := createOrUpdateRedisInstance(spec, manifest.Redis, k8sClient)
+		var redisSecret *k8score.Secret
+		err = retryOnConflict(func() (err error) {
+			redisSecret, err = createOrUpdateRedisSecret(spec, k8sClient)
+			return err
+		})
 		if err != nil {
-			return deploymentResult, fmt.Errorf("failed while creating or updating Redis instance: %s", err)
+			return deploymentResult, fmt.Errorf("failed while creating or updating Redis secret: %s", err)
+		}
+		deploymentResult.RedisSecret = redisSecret
+
+		if manifest.Redis.Mode == RedisModeFailover {
+			var redisFailover *unstructured.Unstructured
+			err = retryOnConflict(func() (err error) {
+				redisFailover, err = createOrUpdateRedisFailover(spec, manifest.Redis, dynamicClient)
+				return err
+			})
+			if err != nil {
+				return deploymentResult, fmt.Errorf("failed while creating or updating Redis failover: %s", err)
+			}
+			deploymentResult.RedisFailover = redisFailover
+		} else {
+			var redisConfigMap *k8score.ConfigMap
+			err = retryOnConflict(func() (err error) {
+				redisConfigMap, err = createOrUpdateRedisConfigMap(spec, manifest.Redis, k8sClient)
+				return err
+			})
+			if err != nil {
+				return deploymentResult, fmt.Errorf("failed while creating or updating Redis configmap: %s", err)
+			}
+			deploymentResult.RedisConfigMap = redisConfigMap
+
+			var redis *k8sapps.Deployment
+			err = retryOnConflict(func() (err error) {
+				redis, err = createOrUpdateRedisInstance(spec, manifest.Redis, k8sClient)
+				return err
+			})
+			if err != nil {
+				return deploymentResult, fmt.Errorf("failed while creating or updating Redis instance: %s", err)
+			}
+			deploymentResult.Redis = redis
+
+			var redisService *k8score.Service
+			err = retryOnConflict(func() (err error) {
+				redisService, err = createOrUpdateRedisService(spec, k8sClient)
+				return err
+			})
+			if err != nil {
+				return deploymentResult, fmt.Errorf("failed while creating or updating Redis service: %s", err)
+			}
+			deploymentResult.RedisService = redisService
 		}
-		deploymentResult.Redis = redis
+	}
 
-		redisService, err := createOrUpdateRedisService(spec, k8sClient)
+	if manifest.DeploymentStrategy == DeploymentStrategyCanary {
+		var canary *k8sapps.Deployment
+		err = retryOnConflict(func() (err error) {
+			canary, err = createOrUpdateCanaryDeployment(spec, deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+			return err
+		})
 		if err != nil {
-			return deploymentResult, fmt.Errorf("failed while creating or updating Redis service: %s", err)
+			return deploymentResult, fmt.Errorf("failed while creating or updating canary deployment: %s", err)
 		}
-		deploymentResult.RedisService = redisService
+		deploymentResult.Canary = canary
+	} else if err := deleteCanaryDeployment(spec, k8sClient); err != nil {
+		return deploymentResult, fmt.Errorf("failed while deleting canary deployment: %s", err)
 	}
 
-	deployment, err := createOrUpdateDeployment(spec, deploymentRequest, manifest, resources, istioEnabled, k8sClient)
-	if err != nil {
-		return deploymentResult, fmt.Errorf("failed while creating or updating deployment: %s", err)
+	if manifest.Kind == WorkloadJob {
+		var job *k8sbatch.Job
+		err = retryOnConflict(func() (err error) {
+			job, err = createOrUpdateJob(spec, deploymentRequest, manifest, resources, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating job: %s", err)
+		}
+		deploymentResult.Job = job
+	} else if manifest.Kind == WorkloadCronJob {
+		var cronJob *k8sbatchv1beta1.CronJob
+		err = retryOnConflict(func() (err error) {
+			cronJob, err = createOrUpdateCronJob(spec, deploymentRequest, manifest, resources, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating cronjob: %s", err)
+		}
+		deploymentResult.CronJob = cronJob
+	} else if isStatefulSet(manifest) {
+		var statefulSet *k8sapps.StatefulSet
+		err = retryOnConflict(func() (err error) {
+			statefulSet, err = createOrUpdateStatefulSet(spec, deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating statefulset: %s", err)
+		}
+		deploymentResult.StatefulSet = statefulSet
+	} else if manifest.DeploymentStrategy == DeploymentStrategyBlueGreen {
+		var blueGreen *k8sapps.Deployment
+		err = retryOnConflict(func() (err error) {
+			blueGreen, err = createOrUpdateBlueGreenDeployment(spec, deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating blue/green deployment: %s", err)
+		}
+		deploymentResult.BlueGreen = blueGreen
+	} else if deploymentResult.Canary == nil {
+		// With a canary running, the main deployment keeps the current version until the canary is promoted
+		var deployment *k8sapps.Deployment
+		err = retryOnConflict(func() (err error) {
+			deployment, err = createOrUpdateDeployment(spec, deploymentRequest, manifest, resources, istioEnabled, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating deployment: %s", err)
+		}
+		deploymentResult.Deployment = deployment
+
+		if err := deleteBlueGreenDeployments(spec, k8sClient); err != nil {
+			return deploymentResult, fmt.Errorf("failed while deleting blue/green deployments: %s", err)
+		}
 	}
-	deploymentResult.Deployment = deployment
 
-	secret, err := createOrUpdateSecret(spec, resources, k8sClient)
+	var secret *k8score.Secret
+	err = retryOnConflict(func() (err error) {
+		secret, err = createOrUpdateSecret(spec, resources, k8sClient)
+		return err
+	})
 	if err != nil {
 		return deploymentResult, fmt.Errorf("failed while creating or updating secret: %s", err)
 	}
 	deploymentResult.Secret = secret
 
-	autoscaler, err := createOrUpdateAutoscaler(spec, manifest, k8sClient)
-	if err != nil {
-		return deploymentResult, fmt.Errorf("failed while creating or updating autoscaler: %s", err)
+	// Without an autoscaler the workload runs the fixed number of replicas from the manifest, and an autoscaler from an
+	// earlier deploy is pruned
+	if !isBatchWorkload(manifest) && isAutoscaled(manifest) {
+		var autoscaler *k8sautoscaling.HorizontalPodAutoscaler
+		err = retryOnConflict(func() (err error) {
+			autoscaler, err = createOrUpdateAutoscaler(spec, manifest, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating autoscaler: %s", err)
+		}
+
+		deploymentResult.Autoscaler = autoscaler
 	}
 
-	deploymentResult.Autoscaler = autoscaler
+	substituteAlertVariables(manifest.Alerts.Rules, createAlertVariables(spec, deploymentRequest))
 
-	alertsConfigMap, err := createOrUpdateAlertRules(spec, manifest, k8sClient)
-	if err != nil {
-		return deploymentResult, fmt.Errorf("failed while creating or updating alerts configmap (app-rules) %s", err)
+	// Previews are not alerted on, as the alerts are routed to the team like those of the application. Writing the
+	// alerts to a PrometheusRule leaves the application's rules in the shared configmap to be pruned.
+	if len(deploymentRequest.Preview) == 0 && alertsToPrometheusRules() {
+		var prometheusRule *unstructured.Unstructured
+		err = retryOnConflict(func() (err error) {
+			prometheusRule, err = createOrUpdateAppPrometheusRule(spec, manifest, dynamicClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating prometheusrule: %s", err)
+		}
+		deploymentResult.PrometheusRule = prometheusRule
+	} else if len(deploymentRequest.Preview) == 0 {
+		var alertsConfigMap *k8score.ConfigMap
+		err = retryOnConflict(func() (err error) {
+			alertsConfigMap, err = createOrUpdateAlertRules(spec, manifest, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating alerts configmap (app-rules) %s", err)
+		}
+		deploymentResult.AlertsConfigMap = alertsConfigMap
 	}
-	deploymentResult.AlertsConfigMap = alertsConfigMap
 
-	if !manifest.Ingress.Disabled {
-		ingress, err := createOrUpdateIngress(spec, manifest, deploymentRequest, clusterSubdomain, resources, k8sClient)
+	// The receivers follow the alerts, to an AlertmanagerConfig in clusters running the Prometheus Operator
+	if len(deploymentRequest.Preview) == 0 && alertsToPrometheusRules() {
+		var alertmanagerConfig *unstructured.Unstructured
+		err = retryOnConflict(func() (err error) {
+			alertmanagerConfig, err = createOrUpdateAlertmanagerConfig(spec, manifest, dynamicClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating alertmanagerconfig: %s", err)
+		}
+		deploymentResult.AlertmanagerConfig = alertmanagerConfig
+	} else if len(deploymentRequest.Preview) == 0 {
+		var receiversConfigMap *k8score.ConfigMap
+		err = retryOnConflict(func() (err error) {
+			receiversConfigMap, err = createOrUpdateAlertReceivers(spec, manifest, k8sClient)
+			return err
+		})
+		if err != nil {
+			return deploymentResult, fmt.Errorf("failed while creating or updating alert receivers configmap (app-receivers) %s", err)
+		}
+		deploymentResult.AlertReceiversConfigMap = receiversConfigMap
+	}
+
+	if !manifest.Ingress.Disabled && !isBatchWorkload(manifest) {
+		var ingress *k8snetworkingv1beta1.Ingress
+		err = retryOnConflict(func() (err error) {
+			ingress, err = createOrUpdateIngress(spec, manifest, deploymentRequest, clusterSubdomain, resources, k8sClient)
+			return err
+		})
 		if err != nil {
 			return deploymentResult, fmt.Errorf("failed while creating ingress: %s", err)
 		}
@@ -755,7 +999,7 @@ func createOrUpdateK8sResources(spec app.Spec, deploymentRequest naisrequest.Dep
 }
 
 func createOrUpdateAlertRules(spec app.Spec, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
-	if len(manifest.Alerts) == 0 {
+	if len(createAlertRules(spec, manifest)) == 0 {
 		return nil, nil
 	}
 
@@ -784,7 +1028,18 @@ func createOrUpdateAutoscaler(spec app.Spec, manifest NaisManifest, k8sClient ku
 		return nil, fmt.Errorf("unable to get existing autoscaler: %s", err)
 	}
 
-	autoscalerDef := createOrUpdateAutoscalerDef(spec, manifest.Replicas.Min, manifest.Replicas.Max, manifest.Replicas.CpuThresholdPercentage, autoscaler)
+	autoscalerDef := createOrUpdateAutoscalerDef(spec, manifest.Replicas, autoscaler)
+
+	if manifest.DeploymentStrategy == DeploymentStrategyBlueGreen {
+		if autoscalerDef.Spec.ScaleTargetRef.Name, err = blueGreenScaleTarget(spec, k8sClient); err != nil {
+			return nil, fmt.Errorf("unable to find the active blue/green deployment: %s", err)
+		}
+	}
+
+	if isStatefulSet(manifest) {
+		autoscalerDef.Spec.ScaleTargetRef.Kind = "StatefulSet"
+	}
+
 	return createOrUpdateAutoscalerResource(autoscalerDef, spec.Namespace, k8sClient)
 }
 
@@ -801,17 +1056,28 @@ func createOrUpdateIngress(spec app.Spec, manifest NaisManifest, deploymentReque
 	}
 
 	ingress.Annotations = createIngressAnnotations(manifest)
+	ingress.ObjectMeta = addLabelsToObjectMeta(ingress.ObjectMeta, spec)
 
-	ingress.Spec.Rules = createIngressRules(spec, deploymentRequest, clusterSubdomain, naisResources)
+	ingress.Spec.Rules = createIngressRules(spec, manifest, deploymentRequest, clusterSubdomain, naisResources)
+	if len(deploymentRequest.Preview) == 0 {
+		ingress.Spec.TLS = createIngressTLS(spec, manifest)
+	}
 	return createOrUpdateIngressResource(ingress, spec.Namespace, k8sClient)
 }
 
-func createIngressRules(spec app.Spec, deploymentRequest naisrequest.Deploy, clusterSubdomain string, naisResources []NaisResource) []k8snetworkingv1beta1.IngressRule {
+func createIngressRules(spec app.Spec, manifest NaisManifest, deploymentRequest naisrequest.Deploy, clusterSubdomain string, naisResources []NaisResource) []k8snetworkingv1beta1.IngressRule {
 	var ingressRules []k8snetworkingv1beta1.IngressRule
 
 	defaultIngressRule := createIngressRule(spec.ResourceName(), createIngressHostname(spec.Application, deploymentRequest.Namespace, clusterSubdomain), "")
 	ingressRules = append(ingressRules, defaultIngressRule)
 
+	// The public, manifest and load balancer hosts belong to the application, so a preview only gets its own hostname
+	if len(deploymentRequest.Preview) > 0 {
+		return ingressRules
+	}
+
+	ingressRules = append(ingressRules, createManifestIngressRules(spec, manifest)...)
+
 	if deploymentRequest.Zone == constant.ZONE_SBS {
 		ingressRules = append(ingressRules, createIngressRule(spec.ResourceName(), createSBSPublicHostname(deploymentRequest), spec.Application))
 	}
@@ -827,17 +1093,39 @@ func createIngressRules(spec app.Spec, deploymentRequest naisrequest.Deploy, clu
 	return ingressRules
 }
 
-func createOrUpdateService(spec app.Spec, k8sClient kubernetes.Interface) (*k8score.Service, error) {
+// The service keeps selecting the active color with the BlueGreen strategy, and forgets the colors otherwise. A
+// StatefulSet gets a headless service, giving each of its pods a stable DNS name.
+func createOrUpdateService(spec app.Spec, manifest NaisManifest, k8sClient kubernetes.Interface) (*k8score.Service, error) {
 	service, err := getExistingAppService(spec, k8sClient)
+	headless := isStatefulSet(manifest)
 
 	if err != nil {
 		return nil, fmt.Errorf("unable to get existing service: %s", err)
+	} else if service != nil && (service.Spec.ClusterIP == k8score.ClusterIPNone) != headless {
+		// The cluster IP of a service can not be changed, so the service is replaced
+		if err := deleteService(spec, k8sClient); err != nil && !errors.IsNotFound(err) {
+			return nil, fmt.Errorf("unable to replace service: %s", err)
+		}
+		service = createServiceDef(spec)
 	} else if service == nil {
 		service = createServiceDef(spec)
 	}
 
 	service.ObjectMeta = addLabelsToObjectMeta(service.ObjectMeta, spec)
-	fillServiceSpec(spec, &service.Spec)
+
+	activeColor := serviceColor(service)
+	if manifest.DeploymentStrategy != DeploymentStrategyBlueGreen {
+		activeColor = ""
+		for _, annotation := range []string{ActiveColorAnnotation, PendingColorAnnotation, PreviousColorAnnotation, BlueGreenAbortedAnnotation} {
+			delete(service.Annotations, annotation)
+		}
+	}
+
+	fillServiceSpec(spec, &service.Spec, activeColor)
+	if headless {
+		service.Spec.ClusterIP = k8score.ClusterIPNone
+	}
+
 	return createOrUpdateServiceResource(service, spec.Namespace, k8sClient)
 }
 
@@ -854,6 +1142,11 @@ func createOrUpdateDeployment(spec app.Spec, deploymentRequest naisrequest.Deplo
 		return nil, fmt.Errorf("unable to create deployment: %s", err)
 	}
 
+	if deploymentDef.Annotations == nil {
+		deploymentDef.Annotations = make(map[string]string, 1)
+	}
+	deploymentDef.Annotations[DeployedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+
 	return createOrUpdateDeploymentResource(deploymentDef, spec.Namespace, k8sClient)
 }
 
@@ -877,7 +1170,7 @@ func getExistingAppService(spec app.Spec, k8sClient kubernetes.Interface) (*k8sc
 
 func getExistingService(resourceName, namespace string, k8sClient kubernetes.Interface) (*k8score.Service, error) {
 	serviceClient := k8sClient.CoreV1().Services(namespace)
-	service, err := serviceClient.Get(resourceName, k8smeta.GetOptions{})
+	service, err := serviceClient.Get(context.TODO(), resourceName, k8smeta.GetOptions{})
 
 	switch {
 	case err == nil:
@@ -891,7 +1184,7 @@ func getExistingService(resourceName, namespace string, k8sClient kubernetes.Int
 
 func getExistingSecret(spec app.Spec, k8sClient kubernetes.Interface) (*k8score.Secret, error) {
 	secretClient := k8sClient.CoreV1().Secrets(spec.Namespace)
-	secret, err := secretClient.Get(spec.ResourceName(), k8smeta.GetOptions{})
+	secret, err := secretClient.Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
 	switch {
 	case err == nil:
 		return secret, err
@@ -908,7 +1201,7 @@ func getExistingAppDeployment(spec app.Spec, k8sClient kubernetes.Interface) (*k
 
 func getExistingDeployment(resourceName, namespace string, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
 	deploymentClient := k8sClient.AppsV1().Deployments(namespace)
-	deployment, err := deploymentClient.Get(resourceName, k8smeta.GetOptions{})
+	deployment, err := deploymentClient.Get(context.TODO(), resourceName, k8smeta.GetOptions{})
 
 	switch {
 	case err == nil:
@@ -922,7 +1215,7 @@ func getExistingDeployment(resourceName, namespace string, k8sClient kubernetes.
 
 func getExistingIngress(spec app.Spec, k8sClient kubernetes.Interface) (*k8snetworkingv1beta1.Ingress, error) {
 	ingressClient := k8sClient.NetworkingV1beta1().Ingresses(spec.Namespace)
-	ingress, err := ingressClient.Get(spec.ResourceName(), k8smeta.GetOptions{})
+	ingress, err := ingressClient.Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
 
 	switch {
 	case err == nil:
@@ -935,8 +1228,8 @@ func getExistingIngress(spec app.Spec, k8sClient kubernetes.Interface) (*k8snetw
 }
 
 func getExistingAutoscaler(spec app.Spec, k8sClient kubernetes.Interface) (*k8sautoscaling.HorizontalPodAutoscaler, error) {
-	autoscalerClient := k8sClient.AutoscalingV1().HorizontalPodAutoscalers(spec.Namespace)
-	autoscaler, err := autoscalerClient.Get(spec.ResourceName(), k8smeta.GetOptions{})
+	autoscalerClient := k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(spec.Namespace)
+	autoscaler, err := autoscalerClient.Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
 
 	switch {
 	case err == nil:
@@ -950,7 +1243,7 @@ func getExistingAutoscaler(spec app.Spec, k8sClient kubernetes.Interface) (*k8sa
 
 func getExistingConfigMap(configMapName string, namespace string, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
 	configMapClient := k8sClient.CoreV1().ConfigMaps(namespace)
-	configMap, err := configMapClient.Get(configMapName, k8smeta.GetOptions{})
+	configMap, err := configMapClient.Get(context.TODO(), configMapName, k8smeta.GetOptions{})
 
 	switch {
 	case err == nil:
@@ -964,25 +1257,25 @@ func getExistingConfigMap(configMapName string, namespace string, k8sClient kube
 
 func createOrUpdateAutoscalerResource(autoscalerSpec *k8sautoscaling.HorizontalPodAutoscaler, namespace string, k8sClient kubernetes.Interface) (*k8sautoscaling.HorizontalPodAutoscaler, error) {
 	if autoscalerSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.AutoscalingV1().HorizontalPodAutoscalers(namespace).Update(autoscalerSpec)
+		return k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Update(context.TODO(), autoscalerSpec, k8smeta.UpdateOptions{})
 	} else {
-		return k8sClient.AutoscalingV1().HorizontalPodAutoscalers(namespace).Create(autoscalerSpec)
+		return k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Create(context.TODO(), autoscalerSpec, k8smeta.CreateOptions{})
 	}
 }
 
 func createOrUpdateIngressResource(ingressSpec *k8snetworkingv1beta1.Ingress, namespace string, k8sClient kubernetes.Interface) (*k8snetworkingv1beta1.Ingress, error) {
 	if ingressSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.NetworkingV1beta1().Ingresses(namespace).Update(ingressSpec)
+		return k8sClient.NetworkingV1beta1().Ingresses(namespace).Update(context.TODO(), ingressSpec, k8smeta.UpdateOptions{})
 	} else {
-		return k8sClient.NetworkingV1beta1().Ingresses(namespace).Create(ingressSpec)
+		return k8sClient.NetworkingV1beta1().Ingresses(namespace).Create(context.TODO(), ingressSpec, k8smeta.CreateOptions{})
 	}
 }
 
 func createOrUpdateDeploymentResource(deploymentSpec *k8sapps.Deployment, namespace string, k8sClient kubernetes.Interface) (*k8sapps.Deployment, error) {
 	if deploymentSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.AppsV1().Deployments(namespace).Update(deploymentSpec)
+		return k8sClient.AppsV1().Deployments(namespace).Update(context.TODO(), deploymentSpec, k8smeta.UpdateOptions{})
 	} else {
-		return k8sClient.AppsV1().Deployments(namespace).Create(deploymentSpec)
+		return k8sClient.AppsV1().Deployments(namespace).Create(context.TODO(), deploymentSpec, k8smeta.CreateOptions{})
 	}
 }
 
@@ -990,25 +1283,25 @@ func createOrUpdateServiceResource(serviceSpec *k8score.Service, namespace strin
 	serviceInterface := k8sClient.CoreV1().Services(namespace)
 
 	if serviceSpec.ResourceVersion != "" {
-		return serviceInterface.Update(serviceSpec)
+		return serviceInterface.Update(context.TODO(), serviceSpec, k8smeta.UpdateOptions{})
 	} else {
-		return serviceInterface.Create(serviceSpec)
+		return serviceInterface.Create(context.TODO(), serviceSpec, k8smeta.CreateOptions{})
 	}
 }
 
 func createOrUpdateSecretResource(secretSpec *k8score.Secret, namespace string, k8sClient kubernetes.Interface) (*k8score.Secret, error) {
 	if secretSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.CoreV1().Secrets(namespace).Update(secretSpec)
+		return k8sClient.CoreV1().Secrets(namespace).Update(context.TODO(), secretSpec, k8smeta.UpdateOptions{})
 	} else {
-		return k8sClient.CoreV1().Secrets(namespace).Create(secretSpec)
+		return k8sClient.CoreV1().Secrets(namespace).Create(context.TODO(), secretSpec, k8smeta.CreateOptions{})
 	}
 }
 
 func createOrUpdateConfigMapResource(configMapSpec *k8score.ConfigMap, namespace string, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
 	if configMapSpec.ObjectMeta.ResourceVersion != "" {
-		return k8sClient.CoreV1().ConfigMaps(namespace).Update(configMapSpec)
+		return k8sClient.CoreV1().ConfigMaps(namespace).Update(context.TODO(), configMapSpec, k8smeta.UpdateOptions{})
 	} else {
-		return k8sClient.CoreV1().ConfigMaps(namespace).Create(configMapSpec)
+		return k8sClient.CoreV1().ConfigMaps(namespace).Create(context.TODO(), configMapSpec, k8smeta.CreateOptions{})
 	}
 }
 
@@ -1022,7 +1315,7 @@ func createIngressAnnotations(manifest NaisManifest) map[string]string {
 	annotations["prometheus.io/scrape"] = "true"
 	annotations["prometheus.io/path"] = manifest.Healthcheck.Liveness.Path
 
-	return annotations
+	return addIngressSettingsToAnnotations(annotations, manifest.Ingress)
 }
 
 func generateObjectMeta(spec app.Spec) k8smeta.ObjectMeta {
@@ -1030,6 +1323,13 @@ func generateObjectMeta(spec app.Spec) k8smeta.ObjectMeta {
 	return addLabelsToObjectMeta(objectMeta, spec)
 }
 
+// Pod templates only carry labels. Deploy annotations and owner references belong on the objects naisd manages,
+// and changing them on the template would roll the pods on every deploy.
+func generatePodObjectMeta(spec app.Spec) k8smeta.ObjectMeta {
+	objectMeta := createObjectMeta(spec.ResourceName(), spec.Namespace)
+	return addAppLabelsToObjectMeta(objectMeta, spec)
+}
+
 func createObjectMeta(objectName, namespace string) k8smeta.ObjectMeta {
 	return k8smeta.ObjectMeta{Name: objectName, Namespace: namespace}
 }
@@ -1044,14 +1344,61 @@ func mergeObjectMeta(exisitingObjectMeta, newObjectMeta k8smeta.ObjectMeta) k8sm
 	return exisitingObjectMeta
 }
 
+// addLabelsToObjectMeta marks the object as managed by naisd for the application in spec,
+// records the deploy that last touched it and references the owning object
 func addLabelsToObjectMeta(objectMeta k8smeta.ObjectMeta, spec app.Spec) k8smeta.ObjectMeta {
+	objectMeta = addAppLabelsToObjectMeta(objectMeta, spec)
+
+	if len(spec.Version) > 0 || len(spec.CorrelationID) > 0 {
+		if objectMeta.Annotations == nil {
+			objectMeta.Annotations = make(map[string]string, 2)
+		}
+		objectMeta.Annotations[VersionAnnotation] = spec.Version
+		objectMeta.Annotations[CorrelationIDAnnotation] = spec.CorrelationID
+	}
+
+	if spec.Owner != nil {
+		objectMeta.OwnerReferences = addOwnerReference(objectMeta.OwnerReferences, *spec.Owner)
+	}
+
+	return objectMeta
+}
+
+func addAppLabelsToObjectMeta(objectMeta k8smeta.ObjectMeta, spec app.Spec) k8smeta.ObjectMeta {
 	if objectMeta.Labels == nil {
-		objectMeta.Labels = make(map[string]string, 3)
+		objectMeta.Labels = make(map[string]string, 4)
 	}
 
 	objectMeta.Labels["app"] = spec.Application
 	objectMeta.Labels["environment"] = spec.Namespace
 	objectMeta.Labels["team"] = spec.Team
+	objectMeta.Labels[ManagedByLabel] = ManagedByNaisd
 
 	return objectMeta
 }
+
+func addOwnerReference(ownerReferences []k8smeta.OwnerReference, owner k8smeta.OwnerReference) []k8smeta.OwnerReference {
+	for _, ownerReference := range ownerReferences {
+		if ownerReference.UID == owner.UID {
+			return ownerReferences
+		}
+	}
+
+	return append(ownerReferences, owner)
+}
+
+// createOwnerReference makes the application's service account the owner of its other resources.
+// The service account is created first and is shared by every kind of workload, so deleting it lets
+// Kubernetes garbage collection remove everything naisd created for the application.
+func createOwnerReference(serviceAccount *k8score.ServiceAccount) *k8smeta.OwnerReference {
+	if serviceAccount == nil || len(serviceAccount.UID) == 0 {
+		return nil
+	}
+
+	return &k8smeta.OwnerReference{
+		APIVersion: "v1",
+		Kind:       "ServiceAccount",
+		Name:       serviceAccount.Name,
+		UID:        serviceAccount.UID,
+	}
+}
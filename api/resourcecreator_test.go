@@ -13,6 +13,7 @@ import (
 	k8score "k8s.io/api/core/v1"
 	k8sextensions "k8s.io/api/extensions/v1beta1"
 	"k8s.io/apimachinery/pkg/api/resource"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 )
@@ -42,6 +43,11 @@ func newDefaultManifest() NaisManifest {
 		Image: image,
 		Port:  port,
 		DeploymentStrategy: DeploymentStrategyRollingUpdate,
+		Replicas: Replicas{
+			Min:                    2,
+			Max:                    4,
+			CpuThresholdPercentage: 50,
+		},
 		Healthcheck: Healthcheck{
 			Readiness: Probe{
 				Path:             readinessPath,
@@ -85,7 +91,7 @@ func TestService(t *testing.T) {
 	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
 	otherSpec := app.Spec{Application: otherAppName, Namespace: namespace, Team: otherTeamName}
 	service := createServiceDef(spec)
-	fillServiceSpec(spec, &service.Spec)
+	fillServiceSpec(spec, &service.Spec, "")
 	service.Spec.ClusterIP = clusterIP
 	clientset := fake.NewSimpleClientset(service)
 
@@ -103,7 +109,7 @@ func TestService(t *testing.T) {
 	})
 
 	t.Run("when no service exists, a new one is created", func(t *testing.T) {
-		service, err := createOrUpdateService(otherSpec, clientset)
+		service, err := createOrUpdateService(otherSpec, newDefaultManifest(), clientset)
 
 		assert.NoError(t, err)
 		assert.Equal(t, otherSpec.ResourceName(), service.Name)
@@ -785,6 +791,12 @@ func TestCreateOrUpdateSecret(t *testing.T) {
 		assert.Equal(t, []byte(updatedSecretValue), secret.Data["r1_alias_password"])
 		assert.Equal(t, updatedFileValue, secret.Data["r1_alias_filekey1"])
 	})
+
+	t.Run("when a secret exists but there is no secret data, it's left for pruning", func(t *testing.T) {
+		secret, err := createOrUpdateSecret(spec, []NaisResource{}, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, secret)
+	})
 }
 
 func TestCreateOrUpdateAutoscaler(t *testing.T) {
@@ -792,7 +804,7 @@ func TestCreateOrUpdateAutoscaler(t *testing.T) {
 	nonExistingSpec := app.Spec{Application: "nonexisting", Namespace: namespace, Team: teamName}
 	otherSpec := app.Spec{Application: otherAppName, Namespace: namespace, Team: otherTeamName}
 
-	autoscaler := createOrUpdateAutoscalerDef(spec, 1, 2, 3, nil)
+	autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 1, Max: 2, CpuThresholdPercentage: 3}, nil)
 	autoscaler.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(autoscaler)
 
@@ -814,7 +826,7 @@ func TestCreateOrUpdateAutoscaler(t *testing.T) {
 		assert.Equal(t, "", autoscaler.ResourceVersion)
 		assert.Equal(t, int32(1), autoscaler.Spec.MaxReplicas)
 		assert.Equal(t, int32p(2), autoscaler.Spec.MinReplicas)
-		assert.Equal(t, int32p(69), autoscaler.Spec.TargetCPUUtilizationPercentage)
+		assert.Equal(t, int32p(69), autoscaler.Spec.Metrics[0].Resource.Target.AverageUtilization)
 		assert.Equal(t, otherSpec.Namespace, autoscaler.Namespace)
 		assert.Equal(t, otherSpec.ResourceName(), autoscaler.Name)
 		assert.Equal(t, otherTeamName, autoscaler.Labels["team"])
@@ -835,7 +847,7 @@ func TestCreateOrUpdateAutoscaler(t *testing.T) {
 		assert.Equal(t, spec.ResourceName(), autoscaler.ObjectMeta.Name)
 		assert.Equal(t, teamName, autoscaler.Labels["team"])
 		assert.Equal(t, namespace, autoscaler.Labels["environment"])
-		assert.Equal(t, int32p(int32(cpuThreshold)), autoscaler.Spec.TargetCPUUtilizationPercentage)
+		assert.Equal(t, int32p(int32(cpuThreshold)), autoscaler.Spec.Metrics[0].Resource.Target.AverageUtilization)
 		assert.Equal(t, int32p(int32(minReplicas)), autoscaler.Spec.MinReplicas)
 		assert.Equal(t, int32(maxReplicas), autoscaler.Spec.MaxReplicas)
 		assert.Equal(t, spec.ResourceName(), autoscaler.Spec.ScaleTargetRef.Name)
@@ -889,8 +901,9 @@ func TestCreateK8sResources(t *testing.T) {
 	manifest := NaisManifest{
 		Image:   image,
 		Port:    port,
-		Team:    teamName,
-		Ingress: Ingress{Disabled: false},
+		Team:     teamName,
+		Ingress:  Ingress{Disabled: false},
+		Replicas: Replicas{Min: 6, Max: 9, CpuThresholdPercentage: 6},
 		Resources: ResourceRequirements{
 			Requests: ResourceList{
 				Cpu:    cpuRequest,
@@ -918,15 +931,15 @@ func TestCreateK8sResources(t *testing.T) {
 	}
 
 	service := createServiceDef(spec)
-	fillServiceSpec(spec, &service.Spec)
+	fillServiceSpec(spec, &service.Spec, "")
 	service.ResourceVersion = "abc"
 
-	autoscaler := createOrUpdateAutoscalerDef(spec, 6, 9, 6, nil)
+	autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 6, Max: 9, CpuThresholdPercentage: 6}, nil)
 	autoscaler.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(autoscaler, service)
 
 	t.Run("creates all resources", func(t *testing.T) {
-		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResources, "nais.example.yo", false, clientset)
+		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResources, "nais.example.yo", false, clientset, newFakeDynamicClient())
 		assert.NoError(t, err)
 
 		assert.NotEmpty(t, deploymentResult.Secret)
@@ -955,7 +968,7 @@ func TestCreateK8sResources(t *testing.T) {
 	}
 
 	t.Run("omits secret creation when no secret resources ex", func(t *testing.T) {
-		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, fake.NewSimpleClientset())
+		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, fake.NewSimpleClientset(), newFakeDynamicClient())
 		assert.NoError(t, err)
 
 		assert.Empty(t, deploymentResult.Secret)
@@ -965,12 +978,51 @@ func TestCreateK8sResources(t *testing.T) {
 	t.Run("omits ingress creation when disabled", func(t *testing.T) {
 		manifest.Ingress.Disabled = true
 
-		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, fake.NewSimpleClientset())
+		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, fake.NewSimpleClientset(), newFakeDynamicClient())
 		assert.NoError(t, err)
 
 		assert.Empty(t, deploymentResult.Ingress)
 	})
 
+	t.Run("resources are owned by the service account and record the deploy", func(t *testing.T) {
+		manifest.Ingress.Disabled = false
+		manifest.Redis = Redis{Enabled: true}
+		deploymentRequest.CorrelationID = "correlation-id"
+		serviceAccount := &k8score.ServiceAccount{ObjectMeta: generateObjectMeta(spec)}
+		serviceAccount.UID = "service-account-uid"
+
+		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResources, "nais.example.yo", false, fake.NewSimpleClientset(serviceAccount), newFakeDynamicClient())
+		assert.NoError(t, err)
+
+		expectedOwner := k8smeta.OwnerReference{APIVersion: "v1", Kind: "ServiceAccount", Name: appName, UID: "service-account-uid"}
+		for _, objectMeta := range []k8smeta.ObjectMeta{
+			deploymentResult.Deployment.ObjectMeta,
+			deploymentResult.Secret.ObjectMeta,
+			deploymentResult.Service.ObjectMeta,
+			deploymentResult.Ingress.ObjectMeta,
+			deploymentResult.Autoscaler.ObjectMeta,
+			deploymentResult.RoleBinding.ObjectMeta,
+			deploymentResult.Redis.ObjectMeta,
+			deploymentResult.RedisService.ObjectMeta,
+			deploymentResult.RedisSecret.ObjectMeta,
+			deploymentResult.RedisConfigMap.ObjectMeta,
+		} {
+			assert.Equal(t, []k8smeta.OwnerReference{expectedOwner}, objectMeta.OwnerReferences, objectMeta.Name)
+			assert.Equal(t, ManagedByNaisd, objectMeta.Labels[ManagedByLabel], objectMeta.Name)
+			assert.Equal(t, version, objectMeta.Annotations[VersionAnnotation], objectMeta.Name)
+			assert.Equal(t, "correlation-id", objectMeta.Annotations[CorrelationIDAnnotation], objectMeta.Name)
+		}
+
+		assert.Empty(t, deploymentResult.Deployment.Spec.Template.OwnerReferences)
+		assert.NotContains(t, deploymentResult.Deployment.Spec.Template.Annotations, CorrelationIDAnnotation)
+	})
+
+	t.Run("no owner reference is set when the service account has no uid", func(t *testing.T) {
+		deploymentResult, err := createOrUpdateK8sResources(spec, deploymentRequest, manifest, naisResourcesNoSecret, "nais.example.yo", false, fake.NewSimpleClientset(), newFakeDynamicClient())
+		assert.NoError(t, err)
+
+		assert.Empty(t, deploymentResult.Deployment.OwnerReferences)
+	})
 }
 
 func TestCheckForDuplicates(t *testing.T) {
@@ -1109,6 +1161,23 @@ func TestCreateObjectMeta(t *testing.T) {
 		assert.Equal(t, appName, objectMeta.Labels["app"], "App label should be equal to app name.")
 		assert.Equal(t, spec.ResourceName(), objectMeta.Name, "Resource name should equal app name.")
 		assert.Equal(t, spec.Namespace, objectMeta.Namespace, "Resource namespace should equal namespace.")
+		assert.Equal(t, ManagedByNaisd, objectMeta.Labels[ManagedByLabel], "Resource should be marked as managed by naisd.")
+	})
+
+	t.Run("Owner and deploy annotations are added", func(t *testing.T) {
+		owner := k8smeta.OwnerReference{APIVersion: "v1", Kind: "ServiceAccount", Name: appName, UID: "uid"}
+		spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName, Version: version, CorrelationID: "id", Owner: &owner}
+
+		objectMeta := addLabelsToObjectMeta(generateObjectMeta(spec), spec)
+
+		assert.Equal(t, []k8smeta.OwnerReference{owner}, objectMeta.OwnerReferences)
+		assert.Equal(t, version, objectMeta.Annotations[VersionAnnotation])
+		assert.Equal(t, "id", objectMeta.Annotations[CorrelationIDAnnotation])
+
+		podObjectMeta := generatePodObjectMeta(spec)
+		assert.Empty(t, podObjectMeta.OwnerReferences)
+		assert.Empty(t, podObjectMeta.Annotations)
+		assert.Equal(t, ManagedByNaisd, podObjectMeta.Labels[ManagedByLabel])
 	})
 }
 
@@ -1,155 +1,304 @@
 package api
 
 import (
+	"context"
 	"fmt"
+	"strings"
+
 	"github.com/nais/naisd/api/app"
+	k8score "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 )
 
-func deleteK8sResouces(spec app.Spec, k8sClient kubernetes.Interface) (results []string, e error) {
-	res, err := deleteService(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
-	}
+const (
+	DeleteStatusDeleted     = "deleted"
+	DeleteStatusNotFound    = "not found"
+	DeleteStatusFailed      = "failed"
+	DeleteStatusSkipped     = "skipped"
+	DeleteStatusWouldDelete = "would be deleted"
+)
 
-	res, err = deleteDeployment(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
-	}
+// DeleteResult is the outcome of deleting one of the resources naisd created for an application
+type DeleteResult struct {
+	Resource string `json:"resource"`
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+}
 
-	res, err = deleteRedisDeployment(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		results = append(results, err.Error())
+type deleteTarget struct {
+	resource string
+	name     string
+	get      func() error
+	delete   func() error
+}
+
+func createDeleteResult(resource, name string, err error, successStatus string) DeleteResult {
+	result := DeleteResult{Resource: resource, Name: name}
+
+	switch {
+	case err == nil:
+		result.Status = successStatus
+	case errors.IsNotFound(err):
+		result.Status = DeleteStatusNotFound
+	default:
+		result.Status = DeleteStatusFailed
+		result.Message = err.Error()
 	}
 
-	res, err = deleteRedisService(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		results = append(results, err.Error())
+	return result
+}
+
+func (t deleteTarget) run() DeleteResult {
+	return createDeleteResult(t.resource, t.name, t.delete(), DeleteStatusDeleted)
+}
+
+func (t deleteTarget) plan() DeleteResult {
+	return createDeleteResult(t.resource, t.name, t.get(), DeleteStatusWouldDelete)
+}
+
+// The service account goes last, as it owns the other resources
+func createDeleteTargets(spec app.Spec, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) []deleteTarget {
+	redisSpec := createRedisSpec(spec)
+	client := clientHolder{k8sClient}
+	getOptions := k8smeta.GetOptions{}
+	ns, name, redisName, canaryName := spec.Namespace, spec.ResourceName(), redisSpec.ResourceName(), createCanaryName(spec)
+	blueName, greenName := createColorName(spec, ColorBlue), createColorName(spec, ColorGreen)
+	core := k8sClient.CoreV1()
+
+	return []deleteTarget{
+		{"service", name,
+			func() error { return errorOf(core.Services(ns).Get(context.TODO(), name, getOptions)) },
+			func() error { return deleteService(spec, k8sClient) }},
+		{"deployment", name,
+			func() error { return errorOf(k8sClient.AppsV1().Deployments(ns).Get(context.TODO(), name, getOptions)) },
+			func() error { return deleteDeployment(spec, k8sClient) }},
+		{"blue deployment", blueName,
+			func() error {
+				return errorOf(k8sClient.AppsV1().Deployments(ns).Get(context.TODO(), blueName, getOptions))
+			},
+			func() error {
+				return k8sClient.AppsV1().Deployments(ns).Delete(context.TODO(), blueName, k8smeta.DeleteOptions{})
+			}},
+		{"green deployment", greenName,
+			func() error {
+				return errorOf(k8sClient.AppsV1().Deployments(ns).Get(context.TODO(), greenName, getOptions))
+			},
+			func() error {
+				return k8sClient.AppsV1().Deployments(ns).Delete(context.TODO(), greenName, k8smeta.DeleteOptions{})
+			}},
+		{"statefulset", name,
+			func() error {
+				return errorOf(k8sClient.AppsV1().StatefulSets(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteStatefulSet(spec, k8sClient) }},
+		{"job", name,
+			func() error { return errorOf(k8sClient.BatchV1().Jobs(ns).Get(context.TODO(), name, getOptions)) },
+			func() error { return deleteJob(spec, k8sClient) }},
+		{"cronjob", name,
+			func() error {
+				return errorOf(k8sClient.BatchV1beta1().CronJobs(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteCronJob(spec, k8sClient) }},
+		{"canary deployment", canaryName,
+			func() error {
+				return errorOf(k8sClient.AppsV1().Deployments(ns).Get(context.TODO(), canaryName, getOptions))
+			},
+			func() error {
+				return k8sClient.AppsV1().Deployments(ns).Delete(context.TODO(), canaryName, k8smeta.DeleteOptions{})
+			}},
+		{"redis deployment", redisName,
+			func() error {
+				return errorOf(k8sClient.AppsV1().Deployments(ns).Get(context.TODO(), redisName, getOptions))
+			},
+			func() error { return deleteRedisDeployment(spec, k8sClient) }},
+		{"redis service", redisName,
+			func() error { return errorOf(core.Services(ns).Get(context.TODO(), redisName, getOptions)) },
+			func() error { return deleteRedisService(spec, k8sClient) }},
+		{"redis configmap", redisName,
+			func() error { return errorOf(core.ConfigMaps(ns).Get(context.TODO(), redisName, getOptions)) },
+			func() error { return deleteRedisConfigMap(spec, k8sClient) }},
+		{"redis failover", name,
+			func() error {
+				return errorOf(dynamicClient.Resource(RedisFailoverResource).Namespace(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteRedisFailover(spec, dynamicClient) }},
+		{"prometheusrule", name,
+			func() error {
+				return errorOf(dynamicClient.Resource(PrometheusRuleResource).Namespace(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deletePrometheusRule(spec, dynamicClient) }},
+		{"alertmanagerconfig", name,
+			func() error {
+				return errorOf(dynamicClient.Resource(AlertmanagerConfigResource).Namespace(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteAlertmanagerConfig(spec, dynamicClient) }},
+		{"redis secret", redisName,
+			func() error { return errorOf(core.Secrets(ns).Get(context.TODO(), redisName, getOptions)) },
+			func() error { return deleteRedisSecret(spec, k8sClient) }},
+		{"secret", name,
+			func() error { return errorOf(core.Secrets(ns).Get(context.TODO(), name, getOptions)) },
+			func() error { return deleteSecret(spec, k8sClient) }},
+		{"ingress", name,
+			func() error {
+				return errorOf(k8sClient.NetworkingV1beta1().Ingresses(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteIngress(spec, k8sClient) }},
+		{"autoscaler", name,
+			func() error {
+				return errorOf(k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return deleteAutoscaler(spec, k8sClient) }},
+		{"alert rules", createDeploymentPrefix(spec) + ".yml",
+			func() error { return errorOf(getConfigMapRules(spec, k8sClient)) },
+			func() error { return deleteConfigMapRules(spec, k8sClient) }},
+		{"alert receivers", createDeploymentPrefix(spec) + ".yml",
+			func() error { return errorOf(getConfigMapReceivers(spec, k8sClient)) },
+			func() error { return deleteConfigMapReceivers(spec, k8sClient) }},
+		{"rolebinding", name,
+			func() error {
+				return errorOf(k8sClient.RbacV1().RoleBindings(ns).Get(context.TODO(), name, getOptions))
+			},
+			func() error { return client.deleteRoleBinding(spec) }},
+		{"deploy lock", createDeployLockName(spec),
+			func() error {
+				return errorOf(k8sClient.CoordinationV1().Leases(ns).Get(context.TODO(), createDeployLockName(spec), getOptions))
+			},
+			func() error { return deleteDeployLock(spec, k8sClient) }},
+		{"serviceaccount", name,
+			func() error { return errorOf(core.ServiceAccounts(ns).Get(context.TODO(), name, getOptions)) },
+			func() error { return client.DeleteServiceAccount(spec) }},
 	}
+}
 
-	res, err = deleteSecret(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
+// errorOf discards the object returned by a get
+func errorOf(_ interface{}, err error) error {
+	return err
+}
+
+// planK8sResourceDeletion lists what deleteK8sResouces would delete, without deleting anything
+func planK8sResourceDeletion(spec app.Spec, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) (results []DeleteResult) {
+	for _, target := range createDeleteTargets(spec, k8sClient, dynamicClient) {
+		results = append(results, target.plan())
 	}
 
-	res, err = deleteIngress(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
+	return results
+}
+
+// resolveTeam fills in the team owning the application from the labels of its service account, as delete requests only
+// name the application and namespace
+func resolveTeam(spec app.Spec, k8sClient kubernetes.Interface) app.Spec {
+	if len(spec.Team) > 0 {
+		return spec
 	}
 
-	res, err = deleteAutoscaler(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
+	if serviceAccount, err := k8sClient.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{}); err == nil {
+		spec.Team = serviceAccount.Labels["team"]
 	}
 
-	res, err = deleteConfigMapRules(spec, k8sClient)
-	results = append(results, res)
-	if err != nil {
-		return results, err
+	return spec
+}
+
+// deleteK8sResouces deletes every resource naisd creates for the application. All resources are attempted even if
+// some of them fail, and the returned error names the ones that could not be deleted.
+func deleteK8sResouces(spec app.Spec, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) (results []DeleteResult, e error) {
+	var failed []string
+
+	for _, target := range createDeleteTargets(spec, k8sClient, dynamicClient) {
+		result := target.run()
+		results = append(results, result)
+
+		if result.Status == DeleteStatusFailed {
+			failed = append(failed, fmt.Sprintf("%s %s: %s", result.Resource, result.Name, result.Message))
+		}
 	}
 
-	if err := NewServiceAccountInterface(k8sClient).DeleteServiceAccount(spec); err != nil {
-		return results, err
-	} else {
-		results = append(results, "service account: OK")
+	if len(failed) > 0 {
+		return results, fmt.Errorf("unable to delete %s", strings.Join(failed, ", "))
 	}
 
 	return results, nil
 }
 
-func deleteService(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	if err := k8sClient.CoreV1().Services(spec.Namespace).Delete(spec.ResourceName(), &k8smeta.DeleteOptions{}); err != nil {
-		return filterNotFound(fmt.Sprintf("service: "), err)
-	}
-	return "service: OK", nil
+func deleteService(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return k8sClient.CoreV1().Services(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
 }
 
-func deleteDeployment(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
+func deleteDeployment(spec app.Spec, k8sClient kubernetes.Interface) error {
 	deploymentDeleteOption := k8smeta.DeletePropagationForeground
-	if err := k8sClient.AppsV1().Deployments(spec.Namespace).Delete(spec.ResourceName(), &k8smeta.DeleteOptions{PropagationPolicy: &deploymentDeleteOption}); err != nil {
-		return filterNotFound("deployment: ", err)
-	}
-	return "deployment: OK", nil
+	return k8sClient.AppsV1().Deployments(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{PropagationPolicy: &deploymentDeleteOption})
 }
 
-func deleteSecret(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	if err := k8sClient.CoreV1().Secrets(spec.Namespace).Delete(spec.ResourceName(), &k8smeta.DeleteOptions{}); err != nil {
-		return filterNotFound("secret: ", err)
-	}
-	return "secret: OK", nil
+func deleteSecret(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return k8sClient.CoreV1().Secrets(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
 }
 
-func deleteConfigMapRules(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
+// getConfigMapRules returns the shared alerts configmap, or a not found error if it has no rules for the application
+func getConfigMapRules(spec app.Spec, k8sClient kubernetes.Interface) (*k8score.ConfigMap, error) {
+	ruleGroupName := createDeploymentPrefix(spec) + ".yml"
+
 	configMap, err := getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, k8sClient)
 	if err != nil {
-		return "app alerts: FAIL", fmt.Errorf("unable to get existing configmap: %s", err)
+		return nil, fmt.Errorf("unable to get existing configmap: %s", err)
+	} else if configMap == nil {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "configmaps"}, AlertsConfigMapName)
+	} else if _, exists := configMap.Data[ruleGroupName]; !exists {
+		return nil, errors.NewNotFound(schema.GroupResource{Resource: "alert rules"}, ruleGroupName)
 	}
 
-	configMap = removeRulesFromConfigMap(configMap, spec)
-	configMap, err = createOrUpdateConfigMapResource(configMap, AlertsConfigMapNamespace, k8sClient)
-
-	if err != nil {
-		return filterNotFound("app alerts: ", err)
-	}
-	return "alert rules: OK", nil
+	return configMap, nil
 }
 
-func deleteAutoscaler(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	autoscaler, err := getExistingAutoscaler(spec, k8sClient)
-	if autoscaler != nil {
-		err = k8sClient.AutoscalingV1().HorizontalPodAutoscalers(spec.Namespace).Delete(spec.ResourceName(), &k8smeta.DeleteOptions{})
-	}
+// deleteConfigMapRules removes the application's rules from the shared alerts configmap
+func deleteConfigMapRules(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return retryOnConflict(func() error {
+		configMap, err := getConfigMapRules(spec, k8sClient)
+		if err != nil {
+			return err
+		}
 
-	if err != nil {
-		return filterNotFound("autoscaler: ", err)
-	}
-
-	return "autoscaler: OK", nil
+		_, err = createOrUpdateConfigMapResource(removeRulesFromConfigMap(configMap, spec), AlertsConfigMapNamespace, k8sClient)
+		return err
+	})
 }
 
-func deleteIngress(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	ingress, err := getExistingIngress(spec, k8sClient)
-	if ingress != nil {
-		err = k8sClient.NetworkingV1beta1().Ingresses(spec.Namespace).Delete(spec.ResourceName(), &k8smeta.DeleteOptions{})
-	}
+func deleteAutoscaler(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
+}
 
-	if err != nil {
-		return filterNotFound("ingress: ", err)
-	}
+func deleteIngress(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return k8sClient.NetworkingV1beta1().Ingresses(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
+}
 
-	return "ingress OK", nil
+func deleteDeployLock(spec app.Spec, k8sClient kubernetes.Interface) error {
+	return k8sClient.CoordinationV1().Leases(spec.Namespace).Delete(context.TODO(), createDeployLockName(spec), k8smeta.DeleteOptions{})
 }
 
-func deleteRedisDeployment(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	resourceName := fmt.Sprintf("%s-redis", spec.ResourceName())
+func deleteRedisDeployment(spec app.Spec, k8sClient kubernetes.Interface) error {
+	redisSpec := createRedisSpec(spec)
 	deploymentDeleteOption := k8smeta.DeletePropagationForeground
-	if err := k8sClient.ExtensionsV1beta1().Deployments(spec.Namespace).Delete(resourceName, &k8smeta.DeleteOptions{PropagationPolicy: &deploymentDeleteOption}); err != nil {
-		return filterNotFound("deployment: ", err)
-	}
-	return "deployment: OK", nil
+	return k8sClient.AppsV1().Deployments(redisSpec.Namespace).Delete(context.TODO(), redisSpec.ResourceName(), k8smeta.DeleteOptions{PropagationPolicy: &deploymentDeleteOption})
 }
 
-func deleteRedisService(spec app.Spec, k8sClient kubernetes.Interface) (result string, e error) {
-	resourceName := fmt.Sprintf("%s-redis", spec.ResourceName())
-	if err := k8sClient.CoreV1().Services(spec.Namespace).Delete(resourceName, &k8smeta.DeleteOptions{}); err != nil {
-		return filterNotFound(fmt.Sprintf("service: "), err)
-	}
-	return "service: OK", nil
+func deleteRedisService(spec app.Spec, k8sClient kubernetes.Interface) error {
+	redisSpec := createRedisSpec(spec)
+	return k8sClient.CoreV1().Services(redisSpec.Namespace).Delete(context.TODO(), redisSpec.ResourceName(), k8smeta.DeleteOptions{})
 }
 
-func filterNotFound(resultMessage string, err error) (result string, e error) {
-	if errors.IsNotFound(err) {
-		return resultMessage + "N/A", nil
-	}
+func deleteRedisConfigMap(spec app.Spec, k8sClient kubernetes.Interface) error {
+	redisSpec := createRedisSpec(spec)
+	return k8sClient.CoreV1().ConfigMaps(redisSpec.Namespace).Delete(context.TODO(), redisSpec.ResourceName(), k8smeta.DeleteOptions{})
+}
+
+func deleteRedisFailover(spec app.Spec, dynamicClient dynamic.Interface) error {
+	return dynamicClient.Resource(RedisFailoverResource).Namespace(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{})
+}
 
-	return resultMessage + "FAIL", err
+func deleteRedisSecret(spec app.Spec, k8sClient kubernetes.Interface) error {
+	redisSpec := createRedisSpec(spec)
+	return k8sClient.CoreV1().Secrets(redisSpec.Namespace).Delete(context.TODO(), redisSpec.ResourceName(), k8smeta.DeleteOptions{})
 }
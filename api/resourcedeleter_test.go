@@ -1,6 +1,8 @@
 package api
 
 import (
+	"context"
+	"fmt"
 	"github.com/nais/naisd/api/app"
 	"github.com/nais/naisd/api/constant"
 	"github.com/nais/naisd/api/naisrequest"
@@ -8,7 +10,9 @@ import (
 	k8score "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 	"testing"
 )
 
@@ -46,15 +50,18 @@ func TestDeleteK8sResouces(t *testing.T) {
 	configMapDef := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
 	configMapDef.ObjectMeta.ResourceVersion = resourceVersion
 	serviceAccountDef := createServiceAccountDef(spec)
-	clientset := fake.NewSimpleClientset(serviceDef, deploymentDef, secretDef, configMapDef, serviceAccountDef)
+	roleBindingDef := createRoleBindingDef(spec, createRoleRef("ClusterRole", "serviceaccount-in-app-namespace"))
+	redisDeploymentDef := createRedisDeploymentDef(createRedisSpec(spec), updateDefaultRedisValues(Redis{Enabled: true}), nil)
+	clientset := fake.NewSimpleClientset(serviceDef, deploymentDef, secretDef, configMapDef, serviceAccountDef, roleBindingDef, redisDeploymentDef)
 
 	t.Run("Deleting non-existing app should return no error", func(t *testing.T) {
-		_, err := deleteK8sResouces(nonExistingSpec, clientset)
+		results, err := deleteK8sResouces(nonExistingSpec, clientset, newFakeDynamicClient())
 		assert.NoError(t, err)
+		assert.Contains(t, results, DeleteResult{Resource: "deployment", Name: "nonexisting", Status: DeleteStatusNotFound})
 	})
 
 	t.Run("Deleting existing app should delete all created resources", func(t *testing.T) {
-		result, err := deleteK8sResouces(spec, clientset)
+		result, err := deleteK8sResouces(spec, clientset, newFakeDynamicClient())
 		assert.NoError(t, err)
 		assert.NotEmpty(t, result)
 
@@ -70,10 +77,58 @@ func TestDeleteK8sResouces(t *testing.T) {
 		assert.NoError(t, err)
 		assert.Nil(t, secret)
 
-		account, e := clientset.CoreV1().ServiceAccounts(spec.Namespace).Get(spec.ResourceName(), v1.GetOptions{})
+		account, e := clientset.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), spec.ResourceName(), v1.GetOptions{})
 		assert.Error(t, e)
 		assert.True(t, errors.IsNotFound(e))
 		assert.Nil(t, account)
+
+		_, e = clientset.RbacV1().RoleBindings(spec.Namespace).Get(context.TODO(), spec.ResourceName(), v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(e))
+
+		redisDeployment, err := getExistingDeployment(createRedisSpec(spec).ResourceName(), spec.Namespace, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, redisDeployment)
+
+		assert.Contains(t, result, DeleteResult{Resource: "deployment", Name: appName, Status: DeleteStatusDeleted})
+		assert.Contains(t, result, DeleteResult{Resource: "redis deployment", Name: appName + "-redis", Status: DeleteStatusDeleted})
+		assert.Contains(t, result, DeleteResult{Resource: "ingress", Name: appName, Status: DeleteStatusNotFound})
+	})
+
+	t.Run("Team is resolved from the service account", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceAccountDef(spec))
+
+		resolved := resolveTeam(app.Spec{Application: appName, Namespace: namespace}, clientset)
+		assert.Equal(t, teamName, resolved.Team)
+	})
+
+	t.Run("A dry run lists the resources without deleting them", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceDef(spec), createServiceAccountDef(spec))
+
+		results := planK8sResourceDeletion(spec, clientset, newFakeDynamicClient())
+		assert.Contains(t, results, DeleteResult{Resource: "service", Name: appName, Status: DeleteStatusWouldDelete})
+		assert.Contains(t, results, DeleteResult{Resource: "serviceaccount", Name: appName, Status: DeleteStatusWouldDelete})
+		assert.Contains(t, results, DeleteResult{Resource: "deployment", Name: appName, Status: DeleteStatusNotFound})
+
+		svc, err := getExistingAppService(spec, clientset)
+		assert.NoError(t, err)
+		assert.NotNil(t, svc)
+	})
+
+	t.Run("Failures are reported per resource and the rest is still deleted", func(t *testing.T) {
+		clientset := fake.NewSimpleClientset(createServiceDef(spec), createServiceAccountDef(spec))
+		clientset.PrependReactor("delete", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.(k8stesting.DeleteAction).GetName() != appName {
+				return false, nil, nil
+			}
+			return true, nil, fmt.Errorf("api server unavailable")
+		})
+
+		results, err := deleteK8sResouces(spec, clientset, newFakeDynamicClient())
+		assert.EqualError(t, err, "unable to delete service appname: api server unavailable")
+		assert.Contains(t, results, DeleteResult{Resource: "service", Name: appName, Status: DeleteStatusFailed, Message: "api server unavailable"})
+
+		_, e := clientset.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), spec.ResourceName(), v1.GetOptions{})
+		assert.True(t, errors.IsNotFound(e))
 	})
 }
 
@@ -81,20 +136,20 @@ func TestDeleteAutoscaler(t *testing.T) {
 	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
 	nonExistingSpec := app.Spec{Application: "nonexisting", Namespace: namespace, Team: teamName}
 
-	autoscaler := createOrUpdateAutoscalerDef(spec, 1, 2, 3, nil)
+	autoscaler := createOrUpdateAutoscalerDef(spec, Replicas{Min: 1, Max: 2, CpuThresholdPercentage: 3}, nil)
 	autoscaler.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(autoscaler)
 
-	t.Run("no error when autoscaler not existant", func(t *testing.T) {
-		_, err := deleteAutoscaler(nonExistingSpec, clientset)
-		assert.NoError(t, err)
+	t.Run("not found when autoscaler not existant", func(t *testing.T) {
+		err := deleteAutoscaler(nonExistingSpec, clientset)
+		assert.True(t, errors.IsNotFound(err))
 		autoscaler, err = getExistingAutoscaler(spec, clientset)
 		assert.NoError(t, err)
 		assert.NotNil(t, autoscaler)
 	})
 
 	t.Run("no error when deleting existant autoscaler", func(t *testing.T) {
-		_, err := deleteAutoscaler(spec, clientset)
+		err := deleteAutoscaler(spec, clientset)
 		assert.NoError(t, err)
 	})
 
@@ -113,16 +168,16 @@ func TestDeleteIngress(t *testing.T) {
 	ingress.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(ingress)
 
-	t.Run("No error when ingress not present", func(t *testing.T) {
-		_, err := deleteIngress(nonExistingSpec, clientset)
-		assert.NoError(t, err)
+	t.Run("Not found when ingress not present", func(t *testing.T) {
+		err := deleteIngress(nonExistingSpec, clientset)
+		assert.True(t, errors.IsNotFound(err))
 		ingress, err := getExistingIngress(spec, clientset)
 		assert.NoError(t, err)
 		assert.NotNil(t, ingress)
 	})
 
 	t.Run("No error when deleting existant ingress", func(t *testing.T) {
-		_, err := deleteIngress(spec, clientset)
+		err := deleteIngress(spec, clientset)
 		assert.NoError(t, err)
 		ingress, err := getExistingIngress(spec, clientset)
 		assert.NoError(t, err)
@@ -131,20 +186,21 @@ func TestDeleteIngress(t *testing.T) {
 }
 
 func TestDeleteConfigMapRules(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	nonExistingSpec := app.Spec{Application: "nonexisting", Namespace: namespace, Team: teamName}
+
 	configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+	configMap, _ = addRulesToConfigMap(spec, configMap, NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{{Alert: "alert", Expr: "up == 0"}}}})
 	configMap.ObjectMeta.ResourceVersion = resourceVersion
 	clientset := fake.NewSimpleClientset(configMap)
 
-	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
-	nonExistingSpec := app.Spec{Application: "nonexisting", Namespace: namespace, Team: teamName}
-
-	t.Run("No error when deleting nonexistant app from alerts configmap", func(t *testing.T) {
-		_, err := deleteConfigMapRules(nonExistingSpec, clientset)
-		assert.NoError(t, err)
+	t.Run("Not found when deleting nonexistant app from alerts configmap", func(t *testing.T) {
+		err := deleteConfigMapRules(nonExistingSpec, clientset)
+		assert.True(t, errors.IsNotFound(err))
 	})
 
 	t.Run("No error when deleting alerts configmap for existing configmap", func(t *testing.T) {
-		_, err := deleteConfigMapRules(spec, clientset)
+		err := deleteConfigMapRules(spec, clientset)
 		assert.NoError(t, err)
 	})
 
@@ -152,7 +208,6 @@ func TestDeleteConfigMapRules(t *testing.T) {
 		configmap, err := getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, clientset)
 		assert.NoError(t, err)
 		assert.NotNil(t, configmap)
-		alert, _ := configmap.Data[teamName+appName+namespace+".yml"]
-		assert.Empty(t, alert)
+		assert.NotContains(t, configmap.Data, createDeploymentPrefix(spec)+".yml")
 	})
 }
@@ -0,0 +1,324 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/nais/naisd/api/app"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+)
+
+// pruneTarget is a kind of resource naisd creates for an application, and whether the current deploy produced it
+type pruneTarget struct {
+	kind     string
+	owner    app.Spec
+	produced bool
+	list     func(options k8smeta.ListOptions) ([]string, error)
+	delete   func(name string) error
+}
+
+// createAppLabelSelector selects on the app and environment labels naisd has always set, so resources created before
+// naisd labelled its objects as managed are pruned as well
+func createAppLabelSelector(spec app.Spec) string {
+	return labels.SelectorFromSet(map[string]string{
+		"app":         spec.Application,
+		"environment": spec.Namespace,
+	}).String()
+}
+
+// prune deletes resources carrying the owner's labels when the current deploy no longer produces them.
+// Only objects with the name naisd gives the resource are considered, so look-alikes created by hand are left alone.
+func (t pruneTarget) prune() (pruned []string, err error) {
+	if t.produced {
+		return nil, nil
+	}
+
+	names, err := t.list(k8smeta.ListOptions{LabelSelector: createAppLabelSelector(t.owner)})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s: %s", t.kind, err)
+	}
+
+	for _, name := range names {
+		if name != t.owner.ResourceName() {
+			continue
+		}
+
+		if err := t.delete(name); err != nil && !errors.IsNotFound(err) {
+			return pruned, fmt.Errorf("unable to delete %s %s: %s", t.kind, name, err)
+		}
+
+		glog.Infof("Pruned %s %s in %s", t.kind, name, t.owner.Namespace)
+		pruned = append(pruned, fmt.Sprintf("%s %s", t.kind, name))
+	}
+
+	return pruned, nil
+}
+
+// objectNames returns the names of the items in a list returned by a List call
+func objectNames(list runtime.Object, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := meta.ExtractList(list)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, item := range items {
+		accessor, err := meta.Accessor(item)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, accessor.GetName())
+	}
+
+	return names, nil
+}
+
+func createPruneTargets(spec app.Spec, deploymentResult DeploymentResult, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) []pruneTarget {
+	redisSpec := createRedisSpec(spec)
+	namespace := spec.Namespace
+	deleteOptions := &k8smeta.DeleteOptions{}
+	foregroundDeletion := k8smeta.DeletePropagationForeground
+
+	listSecrets := func(options k8smeta.ListOptions) ([]string, error) {
+		return objectNames(k8sClient.CoreV1().Secrets(namespace).List(context.TODO(), options))
+	}
+	deleteSecret := func(name string) error {
+		return k8sClient.CoreV1().Secrets(namespace).Delete(context.TODO(), name, *deleteOptions)
+	}
+
+	backgroundDeletion := k8smeta.DeletePropagationBackground
+	otherWorkload := deploymentResult.StatefulSet != nil || deploymentResult.Job != nil || deploymentResult.CronJob != nil
+
+	return []pruneTarget{
+		{
+			kind:     "service",
+			owner:    spec,
+			produced: deploymentResult.Service != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.CoreV1().Services(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.CoreV1().Services(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			// The canary and BlueGreen strategies leave the deployment to their controllers, so it is only pruned
+			// when the application has become another kind of workload
+			kind:     "deployment",
+			owner:    spec,
+			produced: !otherWorkload,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.AppsV1().Deployments(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.AppsV1().Deployments(namespace).Delete(context.TODO(), name, k8smeta.DeleteOptions{PropagationPolicy: &foregroundDeletion})
+			},
+		},
+		{
+			kind:     "statefulset",
+			owner:    spec,
+			produced: deploymentResult.StatefulSet != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.AppsV1().StatefulSets(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.AppsV1().StatefulSets(namespace).Delete(context.TODO(), name, k8smeta.DeleteOptions{PropagationPolicy: &foregroundDeletion})
+			},
+		},
+		{
+			kind:     "job",
+			owner:    spec,
+			produced: deploymentResult.Job != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.BatchV1().Jobs(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.BatchV1().Jobs(namespace).Delete(context.TODO(), name, k8smeta.DeleteOptions{PropagationPolicy: &backgroundDeletion})
+			},
+		},
+		{
+			kind:     "cronjob",
+			owner:    spec,
+			produced: deploymentResult.CronJob != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.BatchV1beta1().CronJobs(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.BatchV1beta1().CronJobs(namespace).Delete(context.TODO(), name, k8smeta.DeleteOptions{PropagationPolicy: &backgroundDeletion})
+			},
+		},
+		{
+			kind:     "autoscaler",
+			owner:    spec,
+			produced: deploymentResult.Autoscaler != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.AutoscalingV2beta2().HorizontalPodAutoscalers(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "ingress",
+			owner:    spec,
+			produced: deploymentResult.Ingress != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.NetworkingV1beta1().Ingresses(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.NetworkingV1beta1().Ingresses(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "secret",
+			owner:    spec,
+			produced: deploymentResult.Secret != nil,
+			list:     listSecrets,
+			delete:   deleteSecret,
+		},
+		{
+			kind:     "redis deployment",
+			owner:    redisSpec,
+			produced: deploymentResult.Redis != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.AppsV1().Deployments(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.AppsV1().Deployments(namespace).Delete(context.TODO(), name, k8smeta.DeleteOptions{PropagationPolicy: &foregroundDeletion})
+			},
+		},
+		{
+			kind:     "redis service",
+			owner:    redisSpec,
+			produced: deploymentResult.RedisService != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.CoreV1().Services(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.CoreV1().Services(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "redis configmap",
+			owner:    redisSpec,
+			produced: deploymentResult.RedisConfigMap != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(k8sClient.CoreV1().ConfigMaps(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return k8sClient.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "redis secret",
+			owner:    redisSpec,
+			produced: deploymentResult.RedisSecret != nil,
+			list:     listSecrets,
+			delete:   deleteSecret,
+		},
+		{
+			kind:     "redis failover",
+			owner:    spec,
+			produced: deploymentResult.RedisFailover != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(dynamicClient.Resource(RedisFailoverResource).Namespace(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return dynamicClient.Resource(RedisFailoverResource).Namespace(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "prometheusrule",
+			owner:    spec,
+			produced: deploymentResult.PrometheusRule != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(dynamicClient.Resource(PrometheusRuleResource).Namespace(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return dynamicClient.Resource(PrometheusRuleResource).Namespace(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+		{
+			kind:     "alertmanagerconfig",
+			owner:    spec,
+			produced: deploymentResult.AlertmanagerConfig != nil,
+			list: func(options k8smeta.ListOptions) ([]string, error) {
+				return objectNames(dynamicClient.Resource(AlertmanagerConfigResource).Namespace(namespace).List(context.TODO(), options))
+			},
+			delete: func(name string) error {
+				return dynamicClient.Resource(AlertmanagerConfigResource).Namespace(namespace).Delete(context.TODO(), name, *deleteOptions)
+			},
+		},
+	}
+}
+
+// pruneAlertRules removes the application's rules from the shared alerts configmap when the manifest no longer has
+// alerts, or they have moved to a PrometheusRule
+func pruneAlertRules(spec app.Spec, deploymentResult DeploymentResult, k8sClient kubernetes.Interface) ([]string, error) {
+	if deploymentResult.AlertsConfigMap != nil {
+		return nil, nil
+	}
+
+	ruleGroupName := createDeploymentPrefix(spec) + ".yml"
+	removed := false
+
+	err := retryOnConflict(func() error {
+		configMap, err := getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, k8sClient)
+		if err != nil {
+			return fmt.Errorf("unable to get existing configmap: %s", err)
+		}
+
+		if configMap == nil {
+			return nil
+		} else if _, exists := configMap.Data[ruleGroupName]; !exists {
+			return nil
+		}
+
+		if _, err := createOrUpdateConfigMapResource(removeRulesFromConfigMap(configMap, spec), AlertsConfigMapNamespace, k8sClient); err != nil {
+			return err
+		}
+
+		removed = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to remove alert rules from configmap: %s", err)
+	} else if !removed {
+		return nil, nil
+	}
+
+	glog.Infof("Pruned alert rules %s from %s", ruleGroupName, AlertsConfigMapName)
+	return []string{fmt.Sprintf("alert rules %s", ruleGroupName)}, nil
+}
+
+// pruneK8sResources deletes resources created by earlier deploys of the application that the current deploy no longer produces
+func pruneK8sResources(spec app.Spec, deploymentResult DeploymentResult, k8sClient kubernetes.Interface, dynamicClient dynamic.Interface) (pruned []string, err error) {
+	for _, target := range createPruneTargets(spec, deploymentResult, k8sClient, dynamicClient) {
+		res, err := target.prune()
+		pruned = append(pruned, res...)
+		if err != nil {
+			return pruned, err
+		}
+	}
+
+	res, err := pruneAlertRules(spec, deploymentResult, k8sClient)
+	pruned = append(pruned, res...)
+	if err != nil {
+		return pruned, err
+	}
+
+	res, err = pruneAlertReceivers(spec, deploymentResult, k8sClient)
+	pruned = append(pruned, res...)
+
+	return pruned, err
+}
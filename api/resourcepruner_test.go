@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"github.com/nais/naisd/api/app"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"testing"
+)
+
+func TestPruneK8sResources(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	otherSpec := app.Spec{Application: otherAppName, Namespace: namespace, Team: teamName}
+	redisSpec := createRedisSpec(spec)
+
+	t.Run("resources no longer produced by the manifest are pruned", func(t *testing.T) {
+		redis := updateDefaultRedisValues(Redis{Enabled: true})
+		clientset := fake.NewSimpleClientset(
+			createIngressDef(spec),
+			createRedisDeploymentDef(redisSpec, redis, nil),
+			createRedisServiceDef(redisSpec),
+			createRedisConfigMapDef(redisSpec, redis, nil),
+		)
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{}, clientset, newFakeDynamicClient())
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ingress appname", "redis deployment appname-redis", "redis service appname-redis", "redis configmap appname-redis"}, pruned)
+
+		ingress, err := getExistingIngress(spec, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, ingress)
+
+		deployment, err := getExistingDeployment(redisSpec.ResourceName(), namespace, clientset)
+		assert.NoError(t, err)
+		assert.Nil(t, deployment)
+	})
+
+	t.Run("resources from before naisd labelled them as managed are pruned", func(t *testing.T) {
+		legacyIngress := createIngressDef(spec)
+		delete(legacyIngress.Labels, ManagedByLabel)
+		legacyRedis := createRedisDeploymentDef(redisSpec, updateDefaultRedisValues(Redis{Enabled: true}), nil)
+		delete(legacyRedis.Labels, ManagedByLabel)
+		clientset := fake.NewSimpleClientset(legacyIngress, legacyRedis)
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{}, clientset, newFakeDynamicClient())
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"ingress appname", "redis deployment appname-redis"}, pruned)
+	})
+
+	t.Run("resources produced by the current deploy are kept", func(t *testing.T) {
+		ingress := createIngressDef(spec)
+		clientset := fake.NewSimpleClientset(ingress)
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{Ingress: ingress}, clientset, newFakeDynamicClient())
+
+		assert.NoError(t, err)
+		assert.Empty(t, pruned)
+	})
+
+	t.Run("resources belonging to other apps or not named by naisd are left alone", func(t *testing.T) {
+		adHocIngress := createIngressDef(spec)
+		adHocIngress.Name = "made-by-hand"
+		clientset := fake.NewSimpleClientset(createIngressDef(otherSpec), adHocIngress)
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{}, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Empty(t, pruned)
+
+		ingresses, err := clientset.NetworkingV1beta1().Ingresses(namespace).List(context.TODO(), k8smeta.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, ingresses.Items, 2)
+	})
+
+	t.Run("redis failover is pruned when switching back to standalone", func(t *testing.T) {
+		dynamicClient := newFakeDynamicClient(createRedisFailoverDef(spec, updateDefaultRedisValues(Redis{Enabled: true, Mode: RedisModeFailover}), nil))
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{}, fake.NewSimpleClientset(), dynamicClient)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"redis failover appname"}, pruned)
+
+		redisFailover, err := getExistingRedisFailover(spec, dynamicClient)
+		assert.NoError(t, err)
+		assert.Nil(t, redisFailover)
+	})
+
+	t.Run("alert rules are removed from the shared configmap when the manifest has no alerts", func(t *testing.T) {
+		configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+		configMap.ResourceVersion = resourceVersion
+		configMap, err := addRulesToConfigMap(spec, configMap, NaisManifest{Team: teamName, Alerts: Alerts{Rules: []PrometheusAlertRule{{Alert: "alert", Expr: "up == 0"}}}})
+		assert.NoError(t, err)
+		clientset := fake.NewSimpleClientset(configMap)
+
+		pruned, err := pruneK8sResources(spec, DeploymentResult{}, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"alert rules aura-appname-default.yml"}, pruned)
+
+		configMap, err = getExistingConfigMap(AlertsConfigMapName, AlertsConfigMapNamespace, clientset)
+		assert.NoError(t, err)
+		assert.Empty(t, configMap.Data)
+	})
+}
@@ -0,0 +1,36 @@
+package api
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+var conflictBackoff = retry.DefaultBackoff
+
+// retryOnConflict runs fn again with backoff when the API server rejects a write because the object was changed, or
+// created, by someone else since it was read. fn has to read the object itself, so every attempt builds on the latest version.
+func retryOnConflict(fn func() error) error {
+	var lastErr error
+
+	err := wait.ExponentialBackoff(conflictBackoff, func() (bool, error) {
+		lastErr = fn()
+
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case errors.IsConflict(lastErr), errors.IsAlreadyExists(lastErr):
+			glog.Infof("Retrying after conflicting write: %s", lastErr)
+			return false, nil
+		default:
+			return false, lastErr
+		}
+	})
+
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+
+	return err
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/stretchr/testify/assert"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestRetryOnConflict(t *testing.T) {
+	configMaps := schema.GroupResource{Resource: "configmaps"}
+
+	t.Run("conflicts are retried until the write succeeds", func(t *testing.T) {
+		attempts := 0
+		err := retryOnConflict(func() error {
+			attempts++
+			if attempts < 3 {
+				return errors.NewConflict(configMaps, AlertsConfigMapName, fmt.Errorf("object has been modified"))
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("objects created concurrently are retried", func(t *testing.T) {
+		attempts := 0
+		err := retryOnConflict(func() error {
+			attempts++
+			if attempts == 1 {
+				return errors.NewAlreadyExists(configMaps, AlertsConfigMapName)
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("other errors are returned immediately", func(t *testing.T) {
+		attempts := 0
+		err := retryOnConflict(func() error {
+			attempts++
+			return fmt.Errorf("boom")
+		})
+
+		assert.EqualError(t, err, "boom")
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("the conflict is returned when retries are exhausted", func(t *testing.T) {
+		err := retryOnConflict(func() error {
+			return errors.NewConflict(configMaps, AlertsConfigMapName, fmt.Errorf("object has been modified"))
+		})
+
+		assert.True(t, errors.IsConflict(err))
+	})
+
+	t.Run("alert rules of another app written in between are kept", func(t *testing.T) {
+		configMap := &k8score.ConfigMap{ObjectMeta: createObjectMeta(AlertsConfigMapName, AlertsConfigMapNamespace)}
+		configMap.ResourceVersion = resourceVersion
+		clientset := fake.NewSimpleClientset(configMap)
+
+		otherSpec := app.Spec{Application: otherAppName, Namespace: namespace, Team: otherTeamName}
+		clientset.PrependReactor("update", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			clientset.ReactionChain = clientset.ReactionChain[1:]
+
+			configMapsResource := schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+			existing, _ := clientset.Tracker().Get(configMapsResource, AlertsConfigMapNamespace, AlertsConfigMapName)
+			withOtherRules, _ := addRulesToConfigMap(otherSpec, existing.(*k8score.ConfigMap), NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{{Alert: "other", Expr: "up == 0"}}}})
+			clientset.Tracker().Update(configMapsResource, withOtherRules, AlertsConfigMapNamespace)
+
+			return true, nil, errors.NewConflict(configMaps, AlertsConfigMapName, fmt.Errorf("object has been modified"))
+		})
+
+		spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+		manifest := NaisManifest{Alerts: Alerts{Rules: []PrometheusAlertRule{{Alert: "mine", Expr: "up == 0"}}}}
+
+		var result *k8score.ConfigMap
+		err := retryOnConflict(func() (err error) {
+			result, err = createOrUpdateAlertRules(spec, manifest, clientset)
+			return err
+		})
+
+		assert.NoError(t, err)
+		assert.Contains(t, result.Data, createDeploymentPrefix(spec)+".yml")
+		assert.Contains(t, result.Data, createDeploymentPrefix(otherSpec)+".yml")
+	})
+}
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/nais/naisd/api/app"
 	"k8s.io/api/rbac/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -11,11 +12,11 @@ func (c clientHolder) createOrUpdateRoleBinding(subject app.Spec, roleRef v1.Rol
 	roleBindingInterface := c.client.RbacV1().RoleBindings(subject.Namespace)
 	def := createRoleBindingDef(subject, roleRef)
 
-	if _, err := roleBindingInterface.Get(subject.ResourceName(), k8smeta.GetOptions{}); err == nil {
-		return roleBindingInterface.Update(def)
+	if _, err := roleBindingInterface.Get(context.TODO(), subject.ResourceName(), k8smeta.GetOptions{}); err == nil {
+		return roleBindingInterface.Update(context.TODO(), def, k8smeta.UpdateOptions{})
 	}
 
-	return roleBindingInterface.Create(def)
+	return roleBindingInterface.Create(context.TODO(), def, k8smeta.CreateOptions{})
 }
 
 func createRoleRef(kind, name string) v1.RoleRef {
@@ -40,7 +41,7 @@ func createRoleBindingDef(subject app.Spec, roleRef v1.RoleRef) *v1.RoleBinding
 func (c clientHolder) deleteRoleBinding(spec app.Spec) error {
 	rolebindingInterface := c.client.RbacV1().RoleBindings(spec.Namespace)
 
-	if e := rolebindingInterface.Delete(spec.ResourceName(), &k8smeta.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+	if e := rolebindingInterface.Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
 		return e
 	} else {
 		return nil
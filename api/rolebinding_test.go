@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/nais/naisd/api/app"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -46,11 +47,11 @@ func TestCreateRoleBinding(t *testing.T) {
 		err = client.deleteRoleBinding(newNonExistingSpec)
 		assert.NoError(t, err)
 
-		rolebinding, err := client.client.RbacV1().RoleBindings(newSpec.Namespace).Get(newSpec.ResourceName(), v1.GetOptions{})
+		rolebinding, err := client.client.RbacV1().RoleBindings(newSpec.Namespace).Get(context.TODO(), newSpec.ResourceName(), v1.GetOptions{})
 		assert.Nil(t, rolebinding)
 		assert.True(t, errors.IsNotFound(err))
 
-		rolebinding, err = client.client.RbacV1().RoleBindings(newNonExistingSpec.Namespace).Get(newNonExistingSpec.ResourceName(), v1.GetOptions{})
+		rolebinding, err = client.client.RbacV1().RoleBindings(newNonExistingSpec.Namespace).Get(context.TODO(), newNonExistingSpec.ResourceName(), v1.GetOptions{})
 		assert.Nil(t, rolebinding)
 		assert.True(t, errors.IsNotFound(err))
 	})
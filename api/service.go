@@ -1,9 +1,11 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"github.com/nais/naisd/api/app"
 	"k8s.io/api/core/v1"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func (c clientHolder) redirectOldServiceToNewApp(originalService *v1.Service, spec app.Spec) (*v1.Service, error) {
@@ -18,5 +20,5 @@ func (c clientHolder) redirectOldServiceToNewApp(originalService *v1.Service, sp
 		},
 	}
 
-	return serviceInterface.Update(externalNameService)
+	return serviceInterface.Update(context.TODO(), externalNameService, k8smeta.UpdateOptions{})
 }
@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/golang/glog"
 	"github.com/nais/naisd/api/app"
 	"k8s.io/api/core/v1"
@@ -23,7 +24,7 @@ func NewServiceAccountInterface(client kubernetes.Interface) ServiceAccountInter
 func (c clientHolder) DeleteServiceAccount(spec app.Spec) error {
 	serviceAccountInterface := c.client.CoreV1().ServiceAccounts(spec.Namespace)
 
-	if e := serviceAccountInterface.Delete(spec.ResourceName(), &k8smeta.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
+	if e := serviceAccountInterface.Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{}); e != nil && !errors.IsNotFound(e) {
 		return e
 	} else {
 		return nil
@@ -33,12 +34,12 @@ func (c clientHolder) DeleteServiceAccount(spec app.Spec) error {
 func (c clientHolder) CreateServiceAccountIfNotExist(spec app.Spec) (*v1.ServiceAccount, error) {
 	serviceAccountInterface := c.client.CoreV1().ServiceAccounts(spec.Namespace)
 
-	if account, err := serviceAccountInterface.Get(spec.ResourceName(), k8smeta.GetOptions{}); err == nil {
+	if account, err := serviceAccountInterface.Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{}); err == nil {
 		glog.Infof("Skipping service account creation. All ready exist for application: %s in namespace: %s", spec.ResourceName(), spec.Namespace)
 		return account, nil
 	}
 
-	return serviceAccountInterface.Create(createServiceAccountDef(spec))
+	return serviceAccountInterface.Create(context.TODO(), createServiceAccountDef(spec), k8smeta.CreateOptions{})
 }
 
 func createServiceAccountDef(spec app.Spec) *v1.ServiceAccount {
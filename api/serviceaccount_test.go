@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"github.com/nais/naisd/api/app"
 	"github.com/stretchr/testify/assert"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -21,7 +22,7 @@ func TestCreateOrUpdateServiceAccount(t *testing.T) {
 		assert.NoError(t, e)
 		assert.NotNil(t, serviceAccount)
 
-		sa, err := clientset.CoreV1().ServiceAccounts(spec.Namespace).Get(spec.ResourceName(), v1.GetOptions{})
+		sa, err := clientset.CoreV1().ServiceAccounts(spec.Namespace).Get(context.TODO(), spec.ResourceName(), v1.GetOptions{})
 		assert.NotNil(t, sa)
 		assert.NoError(t, err)
 		assert.Equal(t, spec.ResourceName(), sa.Name)
@@ -53,7 +54,7 @@ func TestDeleteServiceAccount(t *testing.T) {
 		e2 := serviceAccountInterface.DeleteServiceAccount(spec)
 		assert.NoError(t, e2)
 
-		sa, e3 := clientset.CoreV1().ServiceAccounts(team).Get(name, v1.GetOptions{})
+		sa, e3 := clientset.CoreV1().ServiceAccounts(team).Get(context.TODO(), name, v1.GetOptions{})
 		assert.Nil(t, sa)
 		assert.True(t, errors.IsNotFound(e3))
 	})
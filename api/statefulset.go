@@ -0,0 +1,255 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	k8sresource "k8s.io/apimachinery/pkg/api/resource"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+)
+
+// StatefulSet configures the workloads of kind StatefulSet
+type StatefulSet struct {
+	PodManagementPolicy string `yaml:"podManagementPolicy"`
+	Volumes             []PersistentVolume
+}
+
+// PersistentVolume is a volume claimed for each of the pods of a StatefulSet, which keeps it when it is restarted
+type PersistentVolume struct {
+	Name         string
+	MountPath    string `yaml:"mountPath"`
+	Size         string
+	StorageClass string `yaml:"storageClass"`
+}
+
+func isStatefulSet(manifest NaisManifest) bool {
+	return manifest.Kind == WorkloadStatefulSet
+}
+
+func createVolumeClaimTemplates(spec app.Spec, volumes []PersistentVolume) []k8score.PersistentVolumeClaim {
+	var claims []k8score.PersistentVolumeClaim
+
+	for _, volume := range volumes {
+		claim := k8score.PersistentVolumeClaim{
+			ObjectMeta: addAppLabelsToObjectMeta(k8smeta.ObjectMeta{Name: volume.Name}, spec),
+			Spec: k8score.PersistentVolumeClaimSpec{
+				AccessModes: []k8score.PersistentVolumeAccessMode{k8score.ReadWriteOnce},
+				Resources: k8score.ResourceRequirements{
+					Requests: k8score.ResourceList{
+						k8score.ResourceStorage: k8sresource.MustParse(volume.Size),
+					},
+				},
+			},
+		}
+
+		if len(volume.StorageClass) > 0 {
+			claim.Spec.StorageClassName = &volume.StorageClass
+		}
+
+		claims = append(claims, claim)
+	}
+
+	return claims
+}
+
+// Creates a Kubernetes StatefulSet object. The pods are wired like those of a deployment, and mount the volumes each
+// of them claims. If existingStatefulSet is provided, this is updated with modifiable fields.
+func createStatefulSetDef(spec app.Spec, naisResources []NaisResource, manifest NaisManifest, deploymentRequest naisrequest.Deploy, existingStatefulSet *k8sapps.StatefulSet, istioEnabled bool) (*k8sapps.StatefulSet, error) {
+	deploymentSpec, err := createDeploymentSpec(spec, deploymentRequest, manifest, naisResources, istioEnabled)
+	if err != nil {
+		return nil, err
+	}
+
+	template := deploymentSpec.Template
+	container := &template.Spec.Containers[0]
+	for _, volume := range manifest.StatefulSet.Volumes {
+		container.VolumeMounts = append(container.VolumeMounts, k8score.VolumeMount{Name: volume.Name, MountPath: volume.MountPath})
+	}
+
+	statefulSetSpec := k8sapps.StatefulSetSpec{
+		Replicas:            int32p(int32(manifest.Replicas.Min)),
+		Selector:            deploymentSpec.Selector,
+		ServiceName:         spec.ResourceName(),
+		PodManagementPolicy: k8sapps.PodManagementPolicyType(manifest.StatefulSet.PodManagementPolicy),
+		UpdateStrategy: k8sapps.StatefulSetUpdateStrategy{
+			Type: k8sapps.RollingUpdateStatefulSetStrategyType,
+		},
+		RevisionHistoryLimit: deploymentSpec.RevisionHistoryLimit,
+		Template:             template,
+		VolumeClaimTemplates: createVolumeClaimTemplates(spec, manifest.StatefulSet.Volumes),
+	}
+
+	statefulSet := existingStatefulSet
+	if statefulSet == nil {
+		statefulSet = &k8sapps.StatefulSet{
+			TypeMeta: k8smeta.TypeMeta{
+				Kind:       "StatefulSet",
+				APIVersion: "apps/v1",
+			},
+			ObjectMeta: createObjectMeta(spec.ResourceName(), spec.Namespace),
+		}
+	} else {
+		// The selector, service and volume claims of a StatefulSet can not be changed, and the autoscaler owns the
+		// replica count
+		if !sameVolumeClaimTemplates(statefulSet.Spec.VolumeClaimTemplates, statefulSetSpec.VolumeClaimTemplates) {
+			return nil, fmt.Errorf("StatefulSet volumes can't change after the statefulset has been created, delete the application to change StatefulSet.Volumes")
+		}
+		if isAutoscaled(manifest) || isPaused(statefulSet.ObjectMeta) {
+			statefulSetSpec.Replicas = statefulSet.Spec.Replicas
+		}
+		if isPaused(statefulSet.ObjectMeta) && !isAutoscaled(manifest) {
+			statefulSet.Annotations[PausedReplicasAnnotation] = strconv.Itoa(manifest.Replicas.Min)
+		}
+		statefulSetSpec.Selector = statefulSet.Spec.Selector
+		statefulSetSpec.ServiceName = statefulSet.Spec.ServiceName
+		statefulSetSpec.PodManagementPolicy = statefulSet.Spec.PodManagementPolicy
+		statefulSetSpec.VolumeClaimTemplates = statefulSet.Spec.VolumeClaimTemplates
+	}
+
+	statefulSet.ObjectMeta = addLabelsToObjectMeta(statefulSet.ObjectMeta, spec)
+	if statefulSet.Annotations == nil {
+		statefulSet.Annotations = make(map[string]string, 1)
+	}
+	statefulSet.Annotations[DeployedAtAnnotation] = time.Now().UTC().Format(time.RFC3339)
+	statefulSet.Spec = statefulSetSpec
+
+	return statefulSet, nil
+}
+
+// sameVolumeClaimTemplates is true when the manifest claims the volumes an existing statefulset already claims
+func sameVolumeClaimTemplates(existing, claims []k8score.PersistentVolumeClaim) bool {
+	if len(existing) != len(claims) {
+		return false
+	}
+
+	for i, claim := range claims {
+		existingSize := existing[i].Spec.Resources.Requests[k8score.ResourceStorage]
+		if existing[i].Name != claim.Name || existingSize.Cmp(claim.Spec.Resources.Requests[k8score.ResourceStorage]) != 0 {
+			return false
+		}
+		if claim.Spec.StorageClassName != nil && (existing[i].Spec.StorageClassName == nil || *existing[i].Spec.StorageClassName != *claim.Spec.StorageClassName) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func createOrUpdateStatefulSet(spec app.Spec, deploymentRequest naisrequest.Deploy, manifest NaisManifest, naisResources []NaisResource, istioEnabled bool, k8sClient kubernetes.Interface) (*k8sapps.StatefulSet, error) {
+	existingStatefulSet, err := getExistingStatefulSet(spec, k8sClient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get existing statefulset: %s", err)
+	}
+
+	statefulSet, err := createStatefulSetDef(spec, naisResources, manifest, deploymentRequest, existingStatefulSet, istioEnabled)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create statefulset: %s", err)
+	}
+
+	if statefulSet.ResourceVersion != "" {
+		return k8sClient.AppsV1().StatefulSets(spec.Namespace).Update(context.TODO(), statefulSet, k8smeta.UpdateOptions{})
+	}
+	return k8sClient.AppsV1().StatefulSets(spec.Namespace).Create(context.TODO(), statefulSet, k8smeta.CreateOptions{})
+}
+
+func getExistingStatefulSet(spec app.Spec, k8sClient kubernetes.Interface) (*k8sapps.StatefulSet, error) {
+	statefulSet, err := k8sClient.AppsV1().StatefulSets(spec.Namespace).Get(context.TODO(), spec.ResourceName(), k8smeta.GetOptions{})
+
+	switch {
+	case err == nil:
+		return statefulSet, err
+	case errors.IsNotFound(err):
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+// The claims of the pods' volumes are kept, so the data is still there if the application is deployed again
+func deleteStatefulSet(spec app.Spec, k8sClient kubernetes.Interface) error {
+	foregroundDeletion := k8smeta.DeletePropagationForeground
+	return k8sClient.AppsV1().StatefulSets(spec.Namespace).Delete(context.TODO(), spec.ResourceName(), k8smeta.DeleteOptions{PropagationPolicy: &foregroundDeletion})
+}
+
+// statefulSetStatusAndView follows a rolling update, which replaces the pods one at a time from the highest ordinal.
+// StatefulSets have no progress deadline, so a rollout that does not get its pods ready stays in progress.
+func statefulSetStatusAndView(statefulSet k8sapps.StatefulSet) (DeployStatus, DeploymentStatusView) {
+	desired := int32(1)
+	if statefulSet.Spec.Replicas != nil {
+		desired = *statefulSet.Spec.Replicas
+	}
+
+	status, reason := Success, ""
+	switch {
+	case statefulSet.Status.ObservedGeneration < statefulSet.Generation:
+		status, reason = InProgress, "Waiting for statefulset spec update to be observed"
+	case statefulSet.Status.UpdatedReplicas < desired:
+		status, reason = InProgress, fmt.Sprintf("Waiting for rollout to finish: %d out of %d new pods have been updated.", statefulSet.Status.UpdatedReplicas, desired)
+	case statefulSet.Status.ReadyReplicas < desired:
+		status, reason = InProgress, fmt.Sprintf("Waiting for %d pods to be ready, %d are ready.", desired, statefulSet.Status.ReadyReplicas)
+	case statefulSet.Status.CurrentRevision != statefulSet.Status.UpdateRevision:
+		status, reason = InProgress, fmt.Sprintf("Waiting for rollout to finish: revision %s is not yet current.", statefulSet.Status.UpdateRevision)
+	}
+
+	containers, images := findContainerImages(statefulSet.Spec.Template.Spec.Containers)
+
+	return status, DeploymentStatusView{
+		Name:       statefulSet.Name,
+		Desired:    desired,
+		Current:    statefulSet.Status.Replicas,
+		UpToDate:   statefulSet.Status.UpdatedReplicas,
+		Available:  statefulSet.Status.ReadyReplicas,
+		Containers: containers,
+		Images:     images,
+		Status:     status.String(),
+		Reason:     reason,
+	}
+}
+
+func validateStatefulSet(manifest NaisManifest) *ValidationError {
+	if !isStatefulSet(manifest) {
+		return nil
+	}
+
+	if manifest.DeploymentStrategy != DeploymentStrategyRollingUpdate {
+		return &ValidationError{
+			ErrorMessage: "StatefulSets replace their pods one at a time, use DeploymentStrategy RollingUpdate",
+			Fields:       map[string]string{"DeploymentStrategy": manifest.DeploymentStrategy},
+		}
+	}
+
+	switch k8sapps.PodManagementPolicyType(manifest.StatefulSet.PodManagementPolicy) {
+	case k8sapps.OrderedReadyPodManagement, k8sapps.ParallelPodManagement:
+	default:
+		return &ValidationError{
+			ErrorMessage: "StatefulSet.PodManagementPolicy must be OrderedReady or Parallel",
+			Fields:       map[string]string{"StatefulSet.PodManagementPolicy": manifest.StatefulSet.PodManagementPolicy},
+		}
+	}
+
+	for _, volume := range manifest.StatefulSet.Volumes {
+		fields := map[string]string{"Name": volume.Name, "MountPath": volume.MountPath, "Size": volume.Size}
+
+		if len(validation.IsDNS1123Label(volume.Name)) > 0 {
+			return &ValidationError{ErrorMessage: "StatefulSet.Volumes must have a name that is a DNS label", Fields: fields}
+		}
+		if !path.IsAbs(volume.MountPath) {
+			return &ValidationError{ErrorMessage: "StatefulSet.Volumes must have an absolute mountPath", Fields: fields}
+		}
+		if _, err := k8sresource.ParseQuantity(volume.Size); err != nil {
+			return &ValidationError{ErrorMessage: "StatefulSet.Volumes must have a size, e.g. 10Gi", Fields: fields}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/nais/naisd/api/app"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/stretchr/testify/assert"
+	k8sapps "k8s.io/api/apps/v1"
+	k8score "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newStatefulSetManifest() NaisManifest {
+	manifest := newDefaultManifest()
+	manifest.Kind = WorkloadStatefulSet
+	manifest.Replicas = Replicas{Min: 2, Max: 4, CpuThresholdPercentage: 50}
+	manifest.StatefulSet = StatefulSet{
+		PodManagementPolicy: "OrderedReady",
+		Volumes:             []PersistentVolume{{Name: "data", MountPath: "/var/lib/data", Size: "10Gi"}},
+	}
+	return manifest
+}
+
+func TestCreateStatefulSetDef(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+
+	manifest := newStatefulSetManifest()
+	manifest.LeaderElection = true
+
+	statefulSet, err := createStatefulSetDef(spec, []NaisResource{}, manifest, request, nil, false)
+	assert.NoError(t, err)
+	assert.Equal(t, appName, statefulSet.Spec.ServiceName)
+	assert.Equal(t, k8sapps.OrderedReadyPodManagement, statefulSet.Spec.PodManagementPolicy)
+	assert.Len(t, statefulSet.Spec.Template.Spec.Containers, 2, "the elector sidecar is kept")
+	assert.Equal(t, "data", statefulSet.Spec.VolumeClaimTemplates[0].Name)
+	assert.Equal(t, appName, statefulSet.Spec.VolumeClaimTemplates[0].Labels["app"])
+
+	container := statefulSet.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, image+":"+version, container.Image)
+	assert.Contains(t, container.VolumeMounts, k8score.VolumeMount{Name: "data", MountPath: "/var/lib/data"})
+
+	t.Run("an existing statefulset keeps its replicas and volume claims", func(t *testing.T) {
+		statefulSet.Spec.Replicas = int32p(5)
+		manifest := newStatefulSetManifest()
+		manifest.StatefulSet.Volumes[0].MountPath = "/data"
+
+		updated, err := createStatefulSetDef(spec, []NaisResource{}, manifest, request, statefulSet, false)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(5), *updated.Spec.Replicas)
+		assert.Len(t, updated.Spec.VolumeClaimTemplates, 1)
+		assert.Contains(t, updated.Spec.Template.Spec.Containers[0].VolumeMounts, k8score.VolumeMount{Name: "data", MountPath: "/data"})
+	})
+
+	t.Run("the volumes of an existing statefulset can not be changed", func(t *testing.T) {
+		for name, volumes := range map[string][]PersistentVolume{
+			"removed": nil,
+			"added":   {{Name: "data", MountPath: "/var/lib/data", Size: "10Gi"}, {Name: "logs", MountPath: "/var/log", Size: "1Gi"}},
+			"renamed": {{Name: "state", MountPath: "/var/lib/data", Size: "10Gi"}},
+			"resized": {{Name: "data", MountPath: "/var/lib/data", Size: "20Gi"}},
+			"storage": {{Name: "data", MountPath: "/var/lib/data", Size: "10Gi", StorageClass: "ssd"}},
+		} {
+			manifest := newStatefulSetManifest()
+			manifest.StatefulSet.Volumes = volumes
+
+			_, err := createStatefulSetDef(spec, []NaisResource{}, manifest, request, statefulSet, false)
+			assert.EqualError(t, err, "StatefulSet volumes can't change after the statefulset has been created, delete the application to change StatefulSet.Volumes", name)
+		}
+	})
+}
+
+func TestCreateOrUpdateK8sResourcesForStatefulSets(t *testing.T) {
+	spec := app.Spec{Application: appName, Namespace: namespace, Team: teamName}
+	request := naisrequest.Deploy{Application: appName, Namespace: namespace, Version: version}
+	clientset := fake.NewSimpleClientset()
+
+	_, err := createOrUpdateDeployment(spec, request, newDefaultManifest(), []NaisResource{}, false, clientset)
+	assert.NoError(t, err)
+	_, err = createOrUpdateService(spec, newDefaultManifest(), clientset)
+	assert.NoError(t, err)
+
+	result, err := createOrUpdateK8sResources(spec, request, newStatefulSetManifest(), []NaisResource{}, "nais.example.yo", false, clientset, newFakeDynamicClient())
+	assert.NoError(t, err)
+	assert.NotNil(t, result.StatefulSet)
+	assert.Equal(t, k8score.ClusterIPNone, result.Service.Spec.ClusterIP, "the service is replaced by a headless one")
+	assert.Equal(t, "StatefulSet", result.Autoscaler.Spec.ScaleTargetRef.Kind)
+
+	pruned, err := pruneK8sResources(spec, result, clientset, newFakeDynamicClient())
+	assert.NoError(t, err)
+	assert.Contains(t, pruned, "deployment "+appName)
+	assert.NotContains(t, pruned, "service "+appName)
+
+	status, view, err := NewDeploymentStatusViewer(clientset).DeploymentStatusView(namespace, appName)
+	assert.NoError(t, err)
+	assert.Equal(t, InProgress, status)
+	assert.Equal(t, appName, view.Name)
+
+	t.Run("an app that becomes a deployment gets a cluster IP again", func(t *testing.T) {
+		service, err := createOrUpdateService(spec, newDefaultManifest(), clientset)
+		assert.NoError(t, err)
+		assert.Empty(t, service.Spec.ClusterIP)
+	})
+
+	t.Run("the statefulset is deleted with the app", func(t *testing.T) {
+		results, err := deleteK8sResouces(spec, clientset, newFakeDynamicClient())
+		assert.NoError(t, err)
+		assert.Contains(t, results, DeleteResult{Resource: "statefulset", Name: appName, Status: DeleteStatusDeleted})
+	})
+}
+
+func TestStatefulSetStatusAndView(t *testing.T) {
+	statefulSet := k8sapps.StatefulSet{}
+	statefulSet.Name = appName
+	statefulSet.Generation = 2
+	statefulSet.Spec.Replicas = int32p(3)
+	statefulSet.Status = k8sapps.StatefulSetStatus{ObservedGeneration: 1}
+
+	status, view := statefulSetStatusAndView(statefulSet)
+	assert.Equal(t, InProgress, status)
+	assert.Equal(t, "Waiting for statefulset spec update to be observed", view.Reason)
+
+	statefulSet.Status = k8sapps.StatefulSetStatus{ObservedGeneration: 2, Replicas: 3, UpdatedReplicas: 1, ReadyReplicas: 3, CurrentRevision: "a", UpdateRevision: "b"}
+	status, view = statefulSetStatusAndView(statefulSet)
+	assert.Equal(t, InProgress, status)
+	assert.Equal(t, "Waiting for rollout to finish: 1 out of 3 new pods have been updated.", view.Reason)
+
+	statefulSet.Status.UpdatedReplicas = 3
+	status, _ = statefulSetStatusAndView(statefulSet)
+	assert.Equal(t, InProgress, status, "the rollout is not done until the update revision is current")
+
+	statefulSet.Status.CurrentRevision = "b"
+	status, view = statefulSetStatusAndView(statefulSet)
+	assert.Equal(t, Success, status)
+	assert.Equal(t, int32(3), view.Available)
+}
+
+func TestValidateStatefulSet(t *testing.T) {
+	assert.Nil(t, validateStatefulSet(newDefaultManifest()))
+	assert.Nil(t, validateStatefulSet(newStatefulSetManifest()))
+
+	manifest := newStatefulSetManifest()
+	manifest.DeploymentStrategy = DeploymentStrategyBlueGreen
+	assert.NotNil(t, validateStatefulSet(manifest))
+
+	manifest = newStatefulSetManifest()
+	manifest.StatefulSet.PodManagementPolicy = "Random"
+	assert.Equal(t, "StatefulSet.PodManagementPolicy must be OrderedReady or Parallel", validateStatefulSet(manifest).ErrorMessage)
+
+	manifest = newStatefulSetManifest()
+	manifest.StatefulSet.Volumes[0].MountPath = "data"
+	assert.Equal(t, "StatefulSet.Volumes must have an absolute mountPath", validateStatefulSet(manifest).ErrorMessage)
+
+	manifest = newStatefulSetManifest()
+	manifest.StatefulSet.Volumes[0].Size = "lots"
+	assert.NotNil(t, validateStatefulSet(manifest))
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/nais/naisd/api/naisrequest"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const AppEndpoint = "/app"
+
+func sendDeleteRequest(deleteUrl string, deleteRequest naisrequest.Delete) (*api.DeleteResponse, error) {
+	jsonStr, err := json.Marshal(deleteRequest)
+	if err != nil {
+		return nil, fmt.Errorf("error while marshalling JSON: %v", err)
+	}
+
+	req, err := http.NewRequest("DELETE", deleteUrl, bytes.NewBuffer(jsonStr))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error while sending DELETE to API: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 && resp.StatusCode != http.StatusInternalServerError {
+		return nil, fmt.Errorf("delete failed: %s %s", resp.Status, string(body))
+	}
+
+	var deleteResponse api.DeleteResponse
+	if err := json.Unmarshal(body, &deleteResponse); err != nil {
+		return nil, fmt.Errorf("unable to read response: %s %s", resp.Status, string(body))
+	}
+
+	if resp.StatusCode > 299 {
+		printDeleteResults(deleteResponse)
+		return nil, fmt.Errorf("delete failed: %s", resp.Status)
+	}
+
+	return &deleteResponse, nil
+}
+
+func printDeleteResults(deleteResponse api.DeleteResponse) {
+	for _, result := range deleteResponse.Resources {
+		line := fmt.Sprintf("  %-28s %-40s %s", result.Resource, result.Name, result.Status)
+		if len(result.Message) > 0 {
+			line += " (" + result.Message + ")"
+		}
+		fmt.Println(line)
+	}
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Deletes your application",
+	Long:  `Deletes your application and every resource naisd created for it, after showing what will be deleted`,
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteRequest := naisrequest.Delete{
+			FasitUsername: os.Getenv("FASIT_USERNAME"),
+			FasitPassword: os.Getenv("FASIT_PASSWORD"),
+		}
+
+		var cluster, app, namespace string
+		flags := map[string]*string{
+			"app":               &app,
+			"namespace":         &namespace,
+			"cluster":           &cluster,
+			"fasit-environment": &deleteRequest.FasitEnvironment,
+			"fasit-username":    &deleteRequest.FasitUsername,
+			"fasit-password":    &deleteRequest.FasitPassword,
+		}
+
+		for key, pointer := range flags {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		if len(app) == 0 {
+			fmt.Println("Application cannot be empty")
+			os.Exit(1)
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		appUrl := fmt.Sprintf("%s%s/%s/%s", clusterUrl, AppEndpoint, namespace, app)
+
+		plan, err := sendDeleteRequest(appUrl+"?dryRun=true", deleteRequest)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("The following resources for %s in %s will be deleted:\n", app, namespace)
+		printDeleteResults(*plan)
+
+		if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+			return
+		}
+
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			fmt.Printf("Type the name of the application to confirm: ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if strings.TrimSpace(answer) != app {
+				fmt.Println("Confirmation did not match the application name, nothing was deleted")
+				os.Exit(1)
+			}
+		}
+
+		result, err := sendDeleteRequest(appUrl+"?confirmationToken="+url.QueryEscape(plan.ConfirmationToken), deleteRequest)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Deleted %s in %s:\n", app, namespace)
+		printDeleteResults(*result)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(deleteCmd)
+
+	deleteCmd.Flags().StringP("app", "a", "", "name of your app")
+	deleteCmd.Flags().StringP("cluster", "c", "", "the cluster you want to delete from")
+	deleteCmd.Flags().StringP("namespace", "n", "default", "the kubernetes namespace")
+	deleteCmd.Flags().StringP("fasit-username", "u", "", "the username")
+	deleteCmd.Flags().StringP("fasit-password", "p", "", "the password")
+	deleteCmd.Flags().StringP("fasit-environment", "e", "", "fasit environment to remove the application instance from")
+	deleteCmd.Flags().Bool("dry-run", false, "only show what would be deleted")
+	deleteCmd.Flags().BoolP("yes", "y", false, "delete without asking for confirmation")
+}
@@ -86,6 +86,8 @@ var deployCmd = &cobra.Command{
 			"fasit-username":    &deployRequest.FasitUsername,
 			"fasit-password":    &deployRequest.FasitPassword,
 			"manifest-url":      &deployRequest.ManifestUrl,
+			"preview":           &deployRequest.Preview,
+			"preview-ttl":       &deployRequest.PreviewTTL,
 			"cluster":           &cluster,
 		}
 
@@ -100,6 +102,7 @@ var deployCmd = &cobra.Command{
 
 		fmt.Printf("Deploying to namespace: %s", deployRequest.Namespace)
 		deployRequest.SkipFasit, _ = cmd.Flags().GetBool("skip-fasit")
+		deployRequest.Force, _ = cmd.Flags().GetBool("force")
 
 		if !deployRequest.SkipFasit {
 			if deployRequest.FasitUsername == "" {
@@ -164,7 +167,7 @@ var deployCmd = &cobra.Command{
 		} else if wait {
 			start := time.Now()
 
-			if err := waitForDeploy(fmt.Sprintf("%s%s/%s/%s", clusterUrl, StatusEndpoint, deployRequest.Application, deployRequest.Namespace)); err != nil {
+			if err := waitForDeploy(fmt.Sprintf("%s%s/%s/%s", clusterUrl, StatusEndpoint, deployRequest.DeployName(), deployRequest.Namespace)); err != nil {
 				fmt.Printf("%v\n", err)
 				os.Exit(1)
 			}
@@ -186,7 +189,10 @@ func init() {
 	deployCmd.Flags().StringP("fasit-password", "p", "", "the password")
 	deployCmd.Flags().StringP("fasit-environment", "e", "q0", "fasit environment you want to use")
 	deployCmd.Flags().StringP("manifest-url", "m", "", "alternative URL to the nais manifest")
+	deployCmd.Flags().String("preview", "", "deploy a preview of the app under <app>-pr-<preview>, e.g. the pull request number")
+	deployCmd.Flags().String("preview-ttl", "", "how long the preview lives after its last deploy, e.g. 48h (defaults to the cluster's TTL)")
 	deployCmd.Flags().Bool("wait", false, "whether to wait until the deploy has succeeded (or failed)")
 	deployCmd.Flags().Bool("skip-fasit", false, "whether to skip interaction with fasit")
+	deployCmd.Flags().Bool("force", false, "whether to deploy even if another deploy of the app is in progress")
 	deployCmd.Flags().Bool("application-namespaced", false, "whether to deploy application to it's own namespace")
 }
@@ -0,0 +1,128 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/nais/naisd/api"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const AppsEndpoint = "/apps"
+
+func fetchApplications(appsUrl string) ([]api.ApplicationSummary, error) {
+	resp, err := http.Get(appsUrl)
+	if err != nil {
+		return nil, fmt.Errorf("error while fetching applications: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode > 299 {
+		return nil, fmt.Errorf("listing applications failed: %s %s", resp.Status, string(body))
+	}
+
+	var applications []api.ApplicationSummary
+	if err := json.Unmarshal(body, &applications); err != nil {
+		return nil, fmt.Errorf("unable to read response: %v", err)
+	}
+
+	return applications, nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func printApplications(applications []api.ApplicationSummary) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tKIND\tTEAM\tVERSION\tREPLICAS\tHOSTS\tREDIS\tVAULT\tLAST DEPLOY")
+
+	for _, application := range applications {
+		lastDeploy := "-"
+		if application.LastDeploy != nil {
+			lastDeploy = application.LastDeploy.Local().Format(time.RFC3339)
+		}
+
+		replicas := fmt.Sprintf("%d/%d", application.AvailableReplicas, application.Replicas)
+		if application.Paused {
+			replicas += " (paused)"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			application.Namespace,
+			application.Name,
+			application.Kind,
+			application.Team,
+			application.Version,
+			replicas,
+			strings.Join(application.IngressHosts, ","),
+			yesNo(application.Redis),
+			yesNo(application.Vault),
+			lastDeploy)
+	}
+
+	w.Flush()
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists deployed applications",
+	Long:  `Lists the applications deployed to a cluster, optionally only those in a namespace or belonging to a team`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cluster, namespace, team string
+		flags := map[string]*string{
+			"namespace": &namespace,
+			"cluster":   &cluster,
+			"team":      &team,
+		}
+
+		for key, pointer := range flags {
+			if value, err := cmd.Flags().GetString(key); err != nil {
+				fmt.Printf("Error when getting flag: %s. %v\n", key, err)
+				os.Exit(1)
+			} else if len(value) > 0 {
+				*pointer = value
+			}
+		}
+
+		clusterUrl, err := getClusterUrl(cluster)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		appsUrl := clusterUrl + AppsEndpoint
+		if len(namespace) > 0 {
+			appsUrl += "/" + namespace
+		}
+		if len(team) > 0 {
+			appsUrl += "?team=" + url.QueryEscape(team)
+		}
+
+		applications, err := fetchApplications(appsUrl)
+		if err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+
+		printApplications(applications)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(listCmd)
+
+	listCmd.Flags().StringP("cluster", "c", "", "the cluster to list applications in")
+	listCmd.Flags().StringP("namespace", "n", "", "only list applications in this namespace")
+	listCmd.Flags().StringP("team", "t", "", "only list applications belonging to this team")
+}
@@ -10,7 +10,9 @@ import (
 )
 
 const (
-	mountPath = "/var/run/secrets/nais.io/vault"
+	mountPath            = "/var/run/secrets/nais.io/vault"
+	initContainerName    = "vks-init"
+	sidecarContainerName = "vks-sidecar"
 	//EnvVaultAddr is the environment name for looking up the address of the Vault server
 	EnvVaultAddr = "NAISD_VAULT_ADDR" //
 	//EnvInitContainerImage is the environment name for looking up the init container to use
@@ -155,10 +157,20 @@ func (c initializer) vaultRole() string {
 	return c.spec.Application
 }
 
+//Used reports whether the pod spec has Vault secrets injected by AddVaultContainers
+func Used(podSpec k8score.PodSpec) bool {
+	for _, container := range podSpec.InitContainers {
+		if container.Name == initContainerName {
+			return true
+		}
+	}
+	return false
+}
+
 func (c initializer) vaultContainer(mount k8score.VolumeMount, sidecar bool) k8score.Container {
-	var name = "vks-init"
+	var name = initContainerName
 	if sidecar {
-		name = "vks-sidecar"
+		name = sidecarContainerName
 	}
 
 	return k8score.Container{
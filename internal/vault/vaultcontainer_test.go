@@ -102,8 +102,10 @@ func TestInitializer_AddInitContainer(t *testing.T) {
 				},
 			},
 		}
+		assert.False(t, Used(*podSpec))
 		actualPodSpec := initializer.AddVaultContainers(podSpec)
 
+		assert.True(t, Used(actualPodSpec))
 		assert.Equal(t, 1, len(actualPodSpec.InitContainers))
 		assert.Equal(t, expectedInitContainer, actualPodSpec.InitContainers[0])
 		assert.Equal(t, 1, len(actualPodSpec.Volumes))
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"github.com/nais/naisd/pkg/event"
 	"github.com/nais/naisd/pkg/kafka"
+	"github.com/nais/naisd/pkg/leader"
+	"github.com/nais/naisd/pkg/notify"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -46,6 +50,8 @@ func main() {
 	clusterName := flag.String("clustername", "kubernetes", "Name of the kubernetes cluster")
 	istioEnabled := flag.Bool("istio-enabled", false, "If istio is enabled or not")
 	authenticationEnabled := flag.Bool("authentication-enabled", false, "If authentication is enabled or not")
+	leaderElectionEnabled := flag.Bool("leader-election-enabled", false, "If replicas elect a leader to run singleton background tasks")
+	leaderElectionNamespace := flag.String("leader-election-namespace", "nais", "Namespace of the leader election lease")
 
 	flag.Parse()
 
@@ -54,6 +60,11 @@ func main() {
 	glog.Infof("istio enabled = %t", *istioEnabled)
 	glog.Infof("authentication enabled = %t", *authenticationEnabled)
 	glog.Infof("kafka enabled = %t", kafkaConfig.Enabled)
+	glog.Infof("leader election enabled = %t", *leaderElectionEnabled)
+
+	if err := api.ValidateDeleteConfirmationConfig(); err != nil {
+		log.Fatalf("invalid delete confirmation config: %s", err)
+	}
 
 	deploymentEventHandler := func(event deployment.Event) {}
 
@@ -71,14 +82,48 @@ func main() {
 		if err != nil {
 			log.Fatalf("unable to setup kafka: %s", err)
 		}
+		// The producer loop drains the event queue of this replica's own deploys, so it runs in every replica
 		go kafkaClient.ProducerLoop()
 		deploymentEventHandler = kafkaClient.Send
 	}
 
-	clientSet := newClientSet(*kubeconfig)
+	notifier, err := notify.NewDispatcherFromConfig()
+	if err != nil {
+		log.Fatalf("unable to setup notifiers: %s", err)
+	}
+	// Notifications are sent from a queue, so the deploy response does not wait for Sensu, Slack and the like
+	go notifier.Loop()
+
+	config := newRestConfig(*kubeconfig)
+	clientSet := newClientSet(config)
+	dynamicClient := newDynamicClient(config)
 	deploymentStatusViewer := api.NewDeploymentStatusViewer(clientSet)
+
+	canaryController := api.NewCanaryController(clientSet, hostname())
+	blueGreenController := api.NewBlueGreenController(clientSet, hostname())
+	previewJanitor := api.NewPreviewJanitor(clientSet, dynamicClient, hostname())
+	alertRulesMigrator := api.NewAlertRulesMigrator(clientSet, dynamicClient, hostname())
+
+	var leaderStatus api.LeaderStatus
+	if *leaderElectionEnabled {
+		elector := leader.NewElector(clientSet, *leaderElectionNamespace, "naisd-leader", hostname())
+		elector.Register(canaryController.Run)
+		elector.Register(blueGreenController.Run)
+		elector.Register(previewJanitor.Run)
+		elector.Register(alertRulesMigrator.Run)
+		go elector.Run(context.Background())
+		leaderStatus = elector
+	} else {
+		// Without leader election naisd is expected to run as a single replica, which then runs the tasks itself
+		go canaryController.Run(context.Background())
+		go blueGreenController.Run(context.Background())
+		go previewJanitor.Run(context.Background())
+		go alertRulesMigrator.Run(context.Background())
+	}
+
 	naisd := api.NewAPI(
 		clientSet,
+		dynamicClient,
 		*fasitUrl,
 		*clusterSubdomain,
 		*clusterName,
@@ -86,15 +131,27 @@ func main() {
 		*authenticationEnabled,
 		deploymentStatusViewer,
 		deploymentEventHandler,
+		leaderStatus,
+		notifier.Send,
 	)
-	err := http.ListenAndServe(Port, naisd.Handler())
+	err = http.ListenAndServe(Port, naisd.Handler())
 	if err != nil {
 		panic(err)
 	}
 }
 
+// hostname is the pod name when running inside a cluster, and identifies the replica in leader election
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return name
+}
+
 // returns config using kubeconfig if provided, else from cluster context
-func newClientSet(kubeconfig string) kubernetes.Interface {
+func newRestConfig(kubeconfig string) *rest.Config {
 
 	var config *rest.Config
 	var err error
@@ -111,6 +168,10 @@ func newClientSet(kubeconfig string) kubernetes.Interface {
 		panic(err.Error())
 	}
 
+	return config
+}
+
+func newClientSet(config *rest.Config) kubernetes.Interface {
 	clientset, err := kubernetes.NewForConfig(config)
 
 	if err != nil {
@@ -119,3 +180,13 @@ func newClientSet(kubeconfig string) kubernetes.Interface {
 
 	return clientset
 }
+
+func newDynamicClient(config *rest.Config) dynamic.Interface {
+	dynamicClient, err := dynamic.NewForConfig(config)
+
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return dynamicClient
+}
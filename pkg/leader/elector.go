@@ -0,0 +1,125 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	k8smeta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// Task is background work that must only run in one naisd replica at a time.
+// It is started when the replica becomes leader and must return when ctx is done.
+type Task func(ctx context.Context)
+
+// Elector takes part in leader election through a Lease shared by all naisd replicas, and runs the registered
+// tasks while this replica is the leader. The HTTP API does not depend on it and is served by every replica.
+type Elector struct {
+	lock    *resourcelock.LeaseLock
+	leading int32
+
+	mutex  sync.Mutex
+	leader string
+	tasks  []Task
+}
+
+// NewElector creates an elector competing for the Lease name in namespace, identified by identity (typically the pod name)
+func NewElector(client kubernetes.Interface, namespace, name, identity string) *Elector {
+	return &Elector{
+		lock: &resourcelock.LeaseLock{
+			LeaseMeta:  k8smeta.ObjectMeta{Name: name, Namespace: namespace},
+			Client:     client.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+	}
+}
+
+// Register adds a task to run while this replica is leader. Tasks must be registered before Run is called.
+func (e *Elector) Register(task Task) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.tasks = append(e.tasks, task)
+}
+
+// IsLeader returns whether this replica currently runs the registered tasks
+func (e *Elector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leading) == 1
+}
+
+// Identity returns the identity this replica takes part in the election with
+func (e *Elector) Identity() string {
+	return e.lock.Identity()
+}
+
+// Leader returns the identity of the last observed leader, or an empty string if none has been observed yet
+func (e *Elector) Leader() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return e.leader
+}
+
+// Run takes part in the election until ctx is done. A replica that loses the leadership rejoins the election.
+func (e *Elector) Run(ctx context.Context) {
+	for {
+		leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+			Lock:            e.lock,
+			LeaseDuration:   leaseDuration,
+			RenewDeadline:   renewDeadline,
+			RetryPeriod:     retryPeriod,
+			ReleaseOnCancel: true,
+			Name:            e.lock.LeaseMeta.Name,
+			Callbacks: leaderelection.LeaderCallbacks{
+				OnStartedLeading: e.startLeading,
+				OnStoppedLeading: e.stopLeading,
+				OnNewLeader:      e.observeLeader,
+			},
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+func (e *Elector) startLeading(ctx context.Context) {
+	glog.Infof("%s became leader, starting background tasks", e.Identity())
+	atomic.StoreInt32(&e.leading, 1)
+
+	// OnNewLeader is called asynchronously, so the leader is recorded here as well before the tasks start
+	e.mutex.Lock()
+	e.leader = e.Identity()
+	tasks := e.tasks
+	e.mutex.Unlock()
+
+	for _, task := range tasks {
+		go task(ctx)
+	}
+}
+
+func (e *Elector) stopLeading() {
+	if atomic.CompareAndSwapInt32(&e.leading, 1, 0) {
+		glog.Infof("%s stopped leading, background tasks are stopping", e.Identity())
+	}
+}
+
+func (e *Elector) observeLeader(identity string) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.leader = identity
+}
@@ -0,0 +1,53 @@
+package leader
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestElector(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+
+	t.Run("the first replica becomes leader and runs the registered tasks until it stops", func(t *testing.T) {
+		elector := NewElector(clientset, "nais", "naisd", "naisd-1")
+
+		started := make(chan struct{})
+		stopped := make(chan struct{})
+		elector.Register(func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+		})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			elector.Run(ctx)
+			close(done)
+		}()
+
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("task was not started")
+		}
+		assert.True(t, elector.IsLeader())
+		assert.Equal(t, "naisd-1", elector.Leader())
+
+		other := NewElector(clientset, "nais", "naisd", "naisd-2")
+		otherCtx, otherCancel := context.WithCancel(context.Background())
+		go other.Run(otherCtx)
+		time.Sleep(100 * time.Millisecond)
+		assert.False(t, other.IsLeader())
+		otherCancel()
+
+		cancel()
+		<-done
+		<-stopped
+		assert.False(t, elector.IsLeader())
+	})
+}
@@ -0,0 +1,108 @@
+package notify
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	EnvNotifiers            = "NAISD_NOTIFIERS"
+	EnvNotifyTimeout        = "NAISD_NOTIFY_TIMEOUT"
+	EnvSensuHost            = "NAISD_SENSU_HOST"
+	EnvSensuDialTimeout     = "NAISD_SENSU_DIAL_TIMEOUT"
+	EnvSensuTimeout         = "NAISD_SENSU_TIMEOUT"
+	EnvWebhookURL           = "NAISD_NOTIFY_WEBHOOK_URL"
+	EnvSlackWebhookURL      = "NAISD_NOTIFY_SLACK_WEBHOOK_URL"
+	EnvSlackChannel         = "NAISD_NOTIFY_SLACK_CHANNEL"
+	EnvInfluxDBWriteURL     = "NAISD_NOTIFY_INFLUXDB_URL"
+	NotifierSensu           = "sensu"
+	NotifierWebhook         = "webhook"
+	NotifierSlack           = "slack"
+	NotifierInfluxDB        = "influxdb"
+	defaultSensuHost        = "sensu.nais:3030"
+	defaultNotifiers        = NotifierSensu
+	defaultNotifyTimeout    = "10s"
+	defaultSensuDialTimeout = "2s"
+	defaultSensuTimeout     = "5s"
+)
+
+func init() {
+	viper.BindEnv(EnvNotifiers, EnvNotifiers)
+	viper.SetDefault(EnvNotifiers, defaultNotifiers)
+	viper.BindEnv(EnvNotifyTimeout, EnvNotifyTimeout)
+	viper.SetDefault(EnvNotifyTimeout, defaultNotifyTimeout)
+	viper.BindEnv(EnvSensuHost, EnvSensuHost)
+	viper.SetDefault(EnvSensuHost, defaultSensuHost)
+	viper.BindEnv(EnvSensuDialTimeout, EnvSensuDialTimeout)
+	viper.SetDefault(EnvSensuDialTimeout, defaultSensuDialTimeout)
+	viper.BindEnv(EnvSensuTimeout, EnvSensuTimeout)
+	viper.SetDefault(EnvSensuTimeout, defaultSensuTimeout)
+	viper.BindEnv(EnvWebhookURL, EnvWebhookURL)
+	viper.BindEnv(EnvSlackWebhookURL, EnvSlackWebhookURL)
+	viper.BindEnv(EnvSlackChannel, EnvSlackChannel)
+	viper.BindEnv(EnvInfluxDBWriteURL, EnvInfluxDBWriteURL)
+}
+
+// NewDispatcherFromConfig creates a dispatcher for the comma separated notifiers in NAISD_NOTIFIERS
+func NewDispatcherFromConfig() (*Dispatcher, error) {
+	timeout, err := time.ParseDuration(viper.GetString(EnvNotifyTimeout))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %s", EnvNotifyTimeout, err)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	notifiers := make(map[string]Notifier)
+
+	for _, name := range strings.Split(viper.GetString(EnvNotifiers), ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case NotifierSensu:
+			dialTimeout, err := time.ParseDuration(viper.GetString(EnvSensuDialTimeout))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse %s: %s", EnvSensuDialTimeout, err)
+			}
+			sensuTimeout, err := time.ParseDuration(viper.GetString(EnvSensuTimeout))
+			if err != nil {
+				return nil, fmt.Errorf("unable to parse %s: %s", EnvSensuTimeout, err)
+			}
+			notifiers[name] = SensuNotifier{Host: viper.GetString(EnvSensuHost), DialTimeout: dialTimeout, Timeout: sensuTimeout}
+		case NotifierWebhook:
+			url, err := requiredURL(EnvWebhookURL, name)
+			if err != nil {
+				return nil, err
+			}
+			notifiers[name] = WebhookNotifier{URL: url, Client: client}
+		case NotifierSlack:
+			url, err := requiredURL(EnvSlackWebhookURL, name)
+			if err != nil {
+				return nil, err
+			}
+			notifiers[name] = SlackNotifier{WebhookURL: url, Channel: viper.GetString(EnvSlackChannel), Client: client}
+		case NotifierInfluxDB:
+			url, err := requiredURL(EnvInfluxDBWriteURL, name)
+			if err != nil {
+				return nil, err
+			}
+			notifiers[name] = InfluxDBNotifier{WriteURL: url, Client: client}
+		default:
+			return nil, fmt.Errorf("unknown notifier %s in %s, must be one of %s, %s, %s or %s", name, EnvNotifiers, NotifierSensu, NotifierWebhook, NotifierSlack, NotifierInfluxDB)
+		}
+	}
+
+	return NewDispatcher(notifiers, timeout), nil
+}
+
+func requiredURL(env, notifier string) (string, error) {
+	url := viper.GetString(env)
+	if len(url) == 0 {
+		return "", fmt.Errorf("%s must be set when the %s notifier is enabled", env, notifier)
+	}
+
+	return url, nil
+}
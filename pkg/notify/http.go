@@ -0,0 +1,100 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// WebhookNotifier posts events as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func (w WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("unable to marshal event: %s", err)
+	}
+
+	return post(ctx, w.Client, w.URL, "application/json", body)
+}
+
+// SlackNotifier posts events as messages to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string
+	// Channel overrides the channel of the webhook when set
+	Channel string
+	Client  *http.Client
+}
+
+type slackMessage struct {
+	Channel string `json:"channel,omitempty"`
+	Text    string `json:"text"`
+}
+
+func createSlackText(event Event) string {
+	application := fmt.Sprintf("*%s* (%s) in %s on %s", event.Application, event.Version, event.Namespace, event.ClusterName)
+
+	switch event.Type {
+	case DeployStarted:
+		return fmt.Sprintf(":rocket: Deploying %s", application)
+	case DeploySucceeded:
+		return fmt.Sprintf(":white_check_mark: Deployed %s", application)
+	case DeployFailed:
+		return fmt.Sprintf(":x: Failed to deploy %s: %s", application, event.Error)
+	case Deleted:
+		return fmt.Sprintf(":wastebasket: Deleted *%s* in %s on %s", event.Application, event.Namespace, event.ClusterName)
+	}
+
+	return fmt.Sprintf("%s %s", event.Type, application)
+}
+
+func (s SlackNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(slackMessage{Channel: s.Channel, Text: createSlackText(event)})
+	if err != nil {
+		return fmt.Errorf("unable to marshal slack message: %s", err)
+	}
+
+	return post(ctx, s.Client, s.WebhookURL, "application/json", body)
+}
+
+// InfluxDBNotifier writes events as points to an InfluxDB write endpoint, e.g. http://influxdb:8086/write?db=nais
+type InfluxDBNotifier struct {
+	WriteURL string
+	Client   *http.Client
+}
+
+func (i InfluxDBNotifier) Notify(ctx context.Context, event Event) error {
+	return post(ctx, i.Client, i.WriteURL, "text/plain; charset=utf-8", []byte(createLinePoint(event)))
+}
+
+func post(ctx context.Context, client *http.Client, url, contentType string, body []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create request: %s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to post to %s: %s", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		responseBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s responded with %d: %s", url, resp.StatusCode, responseBody)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package notify
+
+import (
+	"fmt"
+	"strings"
+)
+
+var (
+	tagEscaper   = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	fieldEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// measurements are the names of the events in InfluxDB. Successful deploys are measured as naisd.deployment, as they
+// were before naisd reported the other events.
+var measurements = map[EventType]string{
+	DeployStarted:   "naisd.deployment_started",
+	DeploySucceeded: "naisd.deployment",
+	DeployFailed:    "naisd.deployment_failed",
+	Deleted:         "naisd.deletion",
+}
+
+// createLinePoint formats the event as a point in the InfluxDB line protocol
+func createLinePoint(event Event) string {
+	point := fmt.Sprintf("%s,application=%s,clusterName=%s,namespace=%s version=\"%s\"",
+		measurements[event.Type],
+		tagEscaper.Replace(event.Application),
+		tagEscaper.Replace(event.ClusterName),
+		tagEscaper.Replace(event.Namespace),
+		fieldEscaper.Replace(event.Version))
+
+	if len(event.Error) > 0 {
+		point += fmt.Sprintf(",error=\"%s\"", fieldEscaper.Replace(event.Error))
+	}
+
+	return fmt.Sprintf("%s %d", point, event.Time.UnixNano())
+}
@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// EventType is what happened to the application
+type EventType string
+
+const (
+	DeployStarted   EventType = "deploy_started"
+	DeploySucceeded EventType = "deploy_succeeded"
+	DeployFailed    EventType = "deploy_failed"
+	Deleted         EventType = "deleted"
+)
+
+// Event is a deploy or delete of an application that notifiers are told about
+type Event struct {
+	Type          EventType `json:"type"`
+	Application   string    `json:"application"`
+	Namespace     string    `json:"namespace"`
+	Team          string    `json:"team,omitempty"`
+	Version       string    `json:"version,omitempty"`
+	ClusterName   string    `json:"clusterName"`
+	CorrelationID string    `json:"correlationId,omitempty"`
+	// Error is why a deploy failed
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// Notifier sends events to a system outside the cluster. Notify must return when ctx is done.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Dispatcher sends events to the notifiers from a queue, so deploys are not held up by slow or unreachable notifiers.
+// Events are dropped when the queue is full.
+type Dispatcher struct {
+	notifiers map[string]Notifier
+	timeout   time.Duration
+	SendQueue chan Event
+}
+
+func NewDispatcher(notifiers map[string]Notifier, timeout time.Duration) *Dispatcher {
+	return &Dispatcher{
+		notifiers: notifiers,
+		timeout:   timeout,
+		SendQueue: make(chan Event, 1024),
+	}
+}
+
+// Send queues the event for the notifiers without waiting for them
+func (d *Dispatcher) Send(event Event) {
+	select {
+	case d.SendQueue <- event:
+	default:
+		glog.Errorf("Notification queue is full, dropped %s of %s in %s", event.Type, event.Application, event.Namespace)
+	}
+}
+
+// Loop sends events from the queue in perpetuity
+func (d *Dispatcher) Loop() {
+	for event := range d.SendQueue {
+		d.dispatch(event)
+	}
+}
+
+// dispatch sends the event to all notifiers at once, and gives each of them until the timeout
+func (d *Dispatcher) dispatch(event Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for name, notifier := range d.notifiers {
+		wg.Add(1)
+		go func(name string, notifier Notifier) {
+			defer wg.Done()
+			if err := notifier.Notify(ctx, event); err != nil {
+				glog.Errorf("Failed while notifying %s about %s of %s in %s: %s", name, event.Type, event.Application, event.Namespace, err)
+			}
+		}(name, notifier)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,179 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type notifierFunc func(ctx context.Context, event Event) error
+
+func (f notifierFunc) Notify(ctx context.Context, event Event) error {
+	return f(ctx, event)
+}
+
+func newEvent(eventType EventType) Event {
+	return Event{
+		Type:        eventType,
+		Application: "appname",
+		Namespace:   "default",
+		Team:        "aura",
+		Version:     "42.0.0",
+		ClusterName: "nais-dev",
+		Time:        time.Unix(0, 1565000000000000000),
+	}
+}
+
+func TestDispatcher(t *testing.T) {
+	t.Run("events are sent to every notifier, also when one of them fails or hangs", func(t *testing.T) {
+		received := make(chan Event, 2)
+		dispatcher := NewDispatcher(map[string]Notifier{
+			"failing": notifierFunc(func(ctx context.Context, event Event) error { return fmt.Errorf("unreachable") }),
+			"hanging": notifierFunc(func(ctx context.Context, event Event) error { <-ctx.Done(); return ctx.Err() }),
+			"working": notifierFunc(func(ctx context.Context, event Event) error { received <- event; return nil }),
+		}, 50*time.Millisecond)
+		go dispatcher.Loop()
+		defer close(dispatcher.SendQueue)
+
+		dispatcher.Send(newEvent(DeployStarted))
+		dispatcher.Send(newEvent(DeploySucceeded))
+
+		assert.Equal(t, DeployStarted, (<-received).Type)
+		assert.Equal(t, DeploySucceeded, (<-received).Type)
+	})
+
+	t.Run("sending does not block when the queue is full", func(t *testing.T) {
+		dispatcher := NewDispatcher(nil, time.Second)
+		for i := 0; i < cap(dispatcher.SendQueue)+1; i++ {
+			dispatcher.Send(newEvent(DeployStarted))
+		}
+		assert.Len(t, dispatcher.SendQueue, cap(dispatcher.SendQueue))
+	})
+}
+
+func TestCreateLinePoint(t *testing.T) {
+	assert.Equal(t, `naisd.deployment,application=appname,clusterName=nais-dev,namespace=default version="42.0.0" 1565000000000000000`, createLinePoint(newEvent(DeploySucceeded)))
+
+	event := newEvent(DeployFailed)
+	event.Application = "app name,with=specials"
+	event.Error = `unable to "deploy"`
+	assert.Equal(t, `naisd.deployment_failed,application=app\ name\,with\=specials,clusterName=nais-dev,namespace=default version="42.0.0",error="unable to \"deploy\"" 1565000000000000000`, createLinePoint(event))
+}
+
+func TestSensuNotifier(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		message, _ := bufio.NewReader(conn).ReadString('\n')
+		messages <- message
+		conn.Write([]byte("ok"))
+	}()
+
+	sensu := SensuNotifier{Host: listener.Addr().String(), DialTimeout: time.Second, Timeout: time.Second}
+	assert.NoError(t, sensu.Notify(context.Background(), newEvent(DeploySucceeded)))
+
+	expectedMessagePrefix := "{\"name\":\"naisd.deployment\",\"type\":\"metric\",\"handlers\":[\"events_nano\"],\"output\":\"naisd.deployment,application=appname,clusterName=nais-dev,namespace=default version=\\\"42.0.0\\\""
+	assert.True(t, strings.HasPrefix(<-messages, expectedMessagePrefix))
+
+	t.Run("a Sensu that does not answer times out", func(t *testing.T) {
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			time.Sleep(time.Second)
+			conn.Close()
+		}()
+
+		sensu := SensuNotifier{Host: listener.Addr().String(), DialTimeout: time.Second, Timeout: 50 * time.Millisecond}
+		err := sensu.Notify(context.Background(), newEvent(DeploySucceeded))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "problem reading response from sensu")
+	})
+}
+
+func TestHTTPNotifiers(t *testing.T) {
+	var contentType, body string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		contentType, body = r.Header.Get("Content-Type"), string(b)
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	t.Run("webhook receives the event as JSON", func(t *testing.T) {
+		assert.NoError(t, WebhookNotifier{URL: server.URL}.Notify(context.Background(), newEvent(Deleted)))
+		assert.Equal(t, "application/json", contentType)
+
+		var event Event
+		assert.NoError(t, json.Unmarshal([]byte(body), &event))
+		assert.Equal(t, Deleted, event.Type)
+		assert.Equal(t, "appname", event.Application)
+	})
+
+	t.Run("slack receives a message", func(t *testing.T) {
+		event := newEvent(DeployFailed)
+		event.Error = "ingress host is already taken"
+		assert.NoError(t, SlackNotifier{WebhookURL: server.URL, Channel: "#aura-deploys"}.Notify(context.Background(), event))
+
+		var message slackMessage
+		assert.NoError(t, json.Unmarshal([]byte(body), &message))
+		assert.Equal(t, "#aura-deploys", message.Channel)
+		assert.Equal(t, ":x: Failed to deploy *appname* (42.0.0) in default on nais-dev: ingress host is already taken", message.Text)
+	})
+
+	t.Run("influxdb receives a point", func(t *testing.T) {
+		assert.NoError(t, InfluxDBNotifier{WriteURL: server.URL + "/write?db=nais"}.Notify(context.Background(), newEvent(DeployStarted)))
+		assert.True(t, strings.HasPrefix(body, "naisd.deployment_started,application=appname"))
+	})
+
+	t.Run("an unsuccessful response is an error", func(t *testing.T) {
+		status = http.StatusBadRequest
+		defer func() { status = http.StatusOK }()
+
+		err := WebhookNotifier{URL: server.URL}.Notify(context.Background(), newEvent(Deleted))
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "responded with 400")
+	})
+}
+
+func TestNewDispatcherFromConfig(t *testing.T) {
+	defer viper.Set(EnvNotifiers, defaultNotifiers)
+
+	dispatcher, err := NewDispatcherFromConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, SensuNotifier{Host: defaultSensuHost, DialTimeout: 2 * time.Second, Timeout: 5 * time.Second}, dispatcher.notifiers[NotifierSensu])
+
+	viper.Set(EnvNotifiers, "sensu, slack")
+	_, err = NewDispatcherFromConfig()
+	assert.EqualError(t, err, "NAISD_NOTIFY_SLACK_WEBHOOK_URL must be set when the slack notifier is enabled")
+
+	viper.Set(EnvNotifiers, "carrierpigeon")
+	_, err = NewDispatcherFromConfig()
+	assert.Error(t, err)
+
+	viper.Set(EnvNotifiers, "")
+	dispatcher, err = NewDispatcherFromConfig()
+	assert.NoError(t, err)
+	assert.Empty(t, dispatcher.notifiers)
+}
@@ -0,0 +1,75 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+const stopCharacter = "\n"
+
+type sensuMessage struct {
+	Name        string   `json:"name"`
+	MessageType string   `json:"type"`
+	Handlers    []string `json:"handlers"`
+	Output      string   `json:"output"`
+}
+
+// SensuNotifier sends events as metrics to the socket of a Sensu client, which hands them to the events_nano handler
+type SensuNotifier struct {
+	Host        string
+	DialTimeout time.Duration
+	// Timeout is how long Sensu has to receive the message and answer
+	Timeout time.Duration
+}
+
+func createSensuMessage(event Event) ([]byte, error) {
+	m := sensuMessage{"naisd.deployment", "metric", []string{"events_nano"}, createLinePoint(event)}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("can't marshal message for Sensu. Message was: %v\nError was: %s", m, err)
+	}
+
+	return b, nil
+}
+
+func (s SensuNotifier) Notify(ctx context.Context, event Event) error {
+	message, err := createSensuMessage(event)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: s.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Host)
+	if err != nil {
+		return fmt.Errorf("problem connecting to sensu on %s: %s", s.Host, err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(s.Timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetDeadline(deadline)
+
+	if _, err := conn.Write(append(message, stopCharacter...)); err != nil {
+		return fmt.Errorf("problem sending message to sensu: %s", err)
+	}
+
+	buff := make([]byte, 1024)
+	n, err := conn.Read(buff)
+	if err != nil {
+		return fmt.Errorf("problem reading response from sensu: %s", err)
+	}
+
+	response := bytes.TrimRight(buff[:n], "\x00\n")
+	if string(response) != "ok" {
+		return fmt.Errorf("sensu responded with something other than 'ok'. Response was: '%s'", response)
+	}
+
+	return nil
+}